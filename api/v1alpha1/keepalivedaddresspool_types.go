@@ -0,0 +1,91 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// KeepalivedAddressPoolSpec defines the desired state of KeepalivedAddressPool
+type KeepalivedAddressPoolSpec struct {
+	// CIDRs from which IPs are allocated. For IPv4 CIDRs larger than /31 the network and broadcast addresses are skipped
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	CIDRs []string `json:"cidrs,omitempty"`
+
+	// Addresses lists individual IPs that can be allocated
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	Addresses []string `json:"addresses,omitempty"`
+
+	// Reserved lists IPs, CIDRs or ranges in the form first-last that are never allocated
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	Reserved []string `json:"reserved,omitempty"`
+
+	// NamespaceQuotas limits the number of IPs that can be allocated to the services of a namespace
+	// +kubebuilder:validation:Optional
+	// +mapType=granular
+	NamespaceQuotas map[string]int `json:"namespaceQuotas,omitempty"`
+}
+
+// AddressAllocation records an IP allocated from a KeepalivedAddressPool
+type AddressAllocation struct {
+	// +kubebuilder:validation:Required
+	IP string `json:"ip"`
+
+	// Service is the namespace/name of the service the IP is allocated to
+	// +kubebuilder:validation:Required
+	Service string `json:"service"`
+
+	// KeepalivedGroup is the namespace/name of the KeepalivedGroup that allocated the IP
+	// +kubebuilder:validation:Required
+	KeepalivedGroup string `json:"keepalivedGroup"`
+}
+
+// KeepalivedAddressPoolStatus defines the observed state of KeepalivedAddressPool
+type KeepalivedAddressPoolStatus struct {
+	// +listType=map
+	// +listMapKey=ip
+	Allocations []AddressAllocation `json:"allocations,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+
+// KeepalivedAddressPool is the Schema for the keepalivedaddresspools API
+type KeepalivedAddressPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   KeepalivedAddressPoolSpec   `json:"spec,omitempty"`
+	Status KeepalivedAddressPoolStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// KeepalivedAddressPoolList contains a list of KeepalivedAddressPool
+type KeepalivedAddressPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []KeepalivedAddressPool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&KeepalivedAddressPool{}, &KeepalivedAddressPoolList{})
+}
@@ -21,6 +21,25 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// VRRPStateAnnotation is set on the keepalived pods to the JSON map of the VRRP instance names to their state on the node (MASTER, BACKUP, FAULT),
+// the states are UNKNOWN from the time keepalived exits until the new keepalived process notifies them
+const VRRPStateAnnotation = "keepalived-operator.redhat-cop.io/vrrp-state"
+
+// ConfigHashAnnotation is set on the keepalived pods to the hex encoded sha256 of the keepalived.conf key of the ConfigMap, as last loaded by keepalived
+const ConfigHashAnnotation = "keepalived-operator.redhat-cop.io/config-hash"
+
+// ConfigErrorAnnotation is set on the keepalived pods when the latest configuration could not be loaded, to the reason why
+const ConfigErrorAnnotation = "keepalived-operator.redhat-cop.io/config-error"
+
+// ConfigRevisionLabel is set on the ConfigMaps holding the revisions of the keepalived configuration of a KeepalivedGroup, to the revision number
+const ConfigRevisionLabel = "keepalived-operator.redhat-cop.io/config-revision"
+
+// NextConfigKey is the key of the ConfigMap holding the configuration being rolled out, while a canary rollout is in progress
+const NextConfigKey = "keepalived-next.conf"
+
+// NextConfigPodsKey is the key of the ConfigMap listing the keepalived pods that load NextConfigKey instead of keepalived.conf, one pod name per line
+const NextConfigPodsKey = "keepalived-next.pods"
+
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
@@ -33,30 +52,52 @@ type KeepalivedGroupSpec struct {
 	// +mapType=granular
 	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
 
-	// //+kubebuilder:validation:Optional
-	// +kubebuilder:validation:Required
-	// +kubebuilder:default:=registry.redhat.io/openshift4/ose-keepalived-ipfailover
+	// Image is the keepalived image, it defaults to registry.redhat.io/openshift4/ose-keepalived-ipfailover
+	// +kubebuilder:validation:Optional
 	Image string `json:"image"`
 
-	// +kubebuilder:validation:Required
+	// SidecarImages overrides the images of the containers that run next to keepalived, which default to the images configured in the operator
+	// +kubebuilder:validation:Optional
+	SidecarImages *SidecarImages `json:"sidecarImages,omitempty"`
+
+	// RequireImageDigests rejects the keepalived and sidecar images that are not pinned by a sha256 digest
+	// +kubebuilder:validation:Optional
+	RequireImageDigests bool `json:"requireImageDigests,omitempty"`
+
+	// Interface on which the VIPs are exposed, it is required unless InterfaceFromIP is set
+	// +kubebuilder:validation:Optional
 	Interface string `json:"interface"`
 
+	// InterfaceFromIP is an IPv4 or IPv6 address, when set the VIPs are exposed on the interface each node would use to reach it
 	// +optional
-	// +kubebuilder:validation:Format=ipv4
 	InterfaceFromIP string `json:"interfaceFromIP"`
 
 	// +optional
 	PasswordAuth PasswordAuth `json:"passwordAuth,omitempty"`
 
+	// VerbatimConfig adds keywords to the global_defs section of the keepalived configuration, for the options that have no typed field.
+	// It is rendered after GlobalDefs
 	// +kubebuilder:validation:Optional
 	// +mapType=granular
 	VerbatimConfig map[string]string `json:"verbatimConfig,omitempty"`
 
+	// GlobalDefs are the typed options of the global_defs section of the keepalived configuration
+	// +kubebuilder:validation:Optional
+	GlobalDefs *GlobalDefs `json:"globalDefs,omitempty"`
+
+	// VRRPOptions are the typed options of the vrrp instances of the services, services can override them with the vrrp-options annotation
+	// +kubebuilder:validation:Optional
+	VRRPOptions *VRRPOptions `json:"vrrpOptions,omitempty"`
+
 	// +kubebuilder:validation:Optional
 	// // +kubebuilder:validation:UniqueItems=true
 	// +listType=set
 	BlacklistRouterIDs []int `json:"blacklistRouterIDs,omitempty"`
 
+	// RouterIDRange restricts the virtual router ids allocated to the services of this group, ids pinned by services must also be in this range
+	// +kubebuilder:validation:Optional
+	RouterIDRange *RouterIDRange `json:"routerIDRange,omitempty"`
+
 	// +optional
 	UnicastEnabled bool `json:"unicastEnabled,omitempty"`
 
@@ -66,6 +107,395 @@ type KeepalivedGroupSpec struct {
 	// +kubebuilder:validation:Optional
 	// +mapType=granular
 	DaemonsetPodAnnotations map[string]string `json:"daemonsetPodAnnotations,omitempty"`
+
+	// DaemonsetPodTolerations replaces the default toleration of the keepalived pods, which tolerates all taints
+	// +kubebuilder:validation:Optional
+	DaemonsetPodTolerations []corev1.Toleration `json:"daemonsetPodTolerations,omitempty"`
+
+	// DaemonsetPodAffinity restricts the nodes the keepalived pods run on, in addition to NodeSelector
+	// +kubebuilder:validation:Optional
+	DaemonsetPodAffinity *corev1.Affinity `json:"daemonsetPodAffinity,omitempty"`
+
+	// DaemonsetPodSecurityContext is the security context of the keepalived pods
+	// +kubebuilder:validation:Optional
+	DaemonsetPodSecurityContext *corev1.PodSecurityContext `json:"daemonsetPodSecurityContext,omitempty"`
+
+	// DaemonsetImagePullPolicy is the pull policy of the images of the keepalived pods, it defaults to Always
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=Always;Never;IfNotPresent
+	DaemonsetImagePullPolicy corev1.PullPolicy `json:"daemonsetImagePullPolicy,omitempty"`
+
+	// DaemonsetImagePullSecrets are the secrets used to pull the images of the keepalived pods
+	// +kubebuilder:validation:Optional
+	DaemonsetImagePullSecrets []corev1.LocalObjectReference `json:"daemonsetImagePullSecrets,omitempty"`
+
+	// DaemonsetContainers sets the resources and the security context of the containers of the keepalived pods
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=name
+	DaemonsetContainers []ContainerOverride `json:"daemonsetContainers,omitempty"`
+
+	// AddressPool enables the built-in IPAM: LoadBalancer services referencing this group that have no ingress IP get one allocated from this pool
+	// +kubebuilder:validation:Optional
+	AddressPool *AddressPool `json:"addressPool,omitempty"`
+
+	// AddressPoolRef is the name of a cluster-scoped KeepalivedAddressPool to allocate LoadBalancer IPs from, it cannot be combined with AddressPool
+	// +kubebuilder:validation:Optional
+	AddressPoolRef string `json:"addressPoolRef,omitempty"`
+
+	// NodePriorities are the VRRP priorities of the nodes for the services that do not set the node-priorities annotation,
+	// the node with the highest priority becomes MASTER. Nodes that are not selected get the keepalived default priority of 100
+	// +kubebuilder:validation:Optional
+	NodePriorities []NodePriority `json:"nodePriorities,omitempty"`
+
+	// Preemption controls whether and when a node takes the VIPs over from a MASTER with a lower priority, services can override it with annotations
+	// +kubebuilder:validation:Optional
+	Preemption *Preemption `json:"preemption,omitempty"`
+
+	// DrainNodes lists nodes that must hand over the VIPs they hold, for example before a maintenance.
+	// Their keepalived pods keep running with the lowest priority, so they only hold VIPs when no other node can
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	DrainNodes []string `json:"drainNodes,omitempty"`
+
+	// NodeMaintenance controls how the VIPs are moved off the nodes that are cordoned or tainted for a maintenance
+	// +kubebuilder:validation:Optional
+	NodeMaintenance *NodeMaintenance `json:"nodeMaintenance,omitempty"`
+
+	// ConfigRollout controls how the changes of the keepalived configuration reach the nodes, all the nodes load them at once by default
+	// +kubebuilder:validation:Optional
+	ConfigRollout *ConfigRollout `json:"configRollout,omitempty"`
+
+	// ConfigHistory controls the revisions of the keepalived configuration kept in ConfigMaps, and the automatic revert of the configurations that make keepalived crash loop
+	// +kubebuilder:validation:Optional
+	ConfigHistory *ConfigHistory `json:"configHistory,omitempty"`
+}
+
+// ConfigHistory controls the revisions of the keepalived configuration kept in ConfigMaps.
+// A configuration becomes the last known good configuration when all the nodes ran it for MinStableSeconds without keepalived crashing,
+// a configuration that makes keepalived crash loop is reverted to the last known good configuration
+type ConfigHistory struct {
+	// RevisionHistoryLimit is the number of revisions kept, the current and the last known good revisions are always kept
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +kubebuilder:default:=5
+	RevisionHistoryLimit int `json:"revisionHistoryLimit,omitempty"`
+
+	// MinStableSeconds is how long all the nodes must run a configuration without keepalived crashing before it becomes the last known good configuration
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=3600
+	// +kubebuilder:default:=60
+	MinStableSeconds int `json:"minStableSeconds,omitempty"`
+
+	// DisableCrashLoopRevert keeps the configurations that make keepalived crash loop
+	// +kubebuilder:validation:Optional
+	DisableCrashLoopRevert bool `json:"disableCrashLoopRevert,omitempty"`
+}
+
+// ConfigRolloutStrategy is how the changes of the keepalived configuration are rolled out
+// +kubebuilder:validation:Enum=AllAtOnce;Canary
+type ConfigRolloutStrategy string
+
+const (
+	// AllAtOnceConfigRollout makes all the nodes load a new configuration at once
+	AllAtOnceConfigRollout ConfigRolloutStrategy = "AllAtOnce"
+	// CanaryConfigRollout makes a few nodes load a new configuration first, and rolls it back when they fail to run it
+	CanaryConfigRollout ConfigRolloutStrategy = "Canary"
+)
+
+// ConfigRollout controls how the changes of the keepalived configuration are rolled out.
+// With the Canary strategy, CanaryNodes nodes load a new configuration first, then StepNodes more nodes at each step.
+// A step completes when its nodes loaded the configuration and ran it for StabilizationSeconds without VRRP fault or split brain.
+// The configuration is rolled back when a node rejects it, when VRRP breaks on the nodes running it, or when the nodes of a step do not load it within ProgressDeadlineSeconds
+// Only the configuration is canaried, the changes of the DaemonSet are rolled out by its rolling update, one node at a time
+type ConfigRollout struct {
+	// Strategy is AllAtOnce, to make all the nodes load a new configuration at once, or Canary
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:default:=AllAtOnce
+	Strategy ConfigRolloutStrategy `json:"strategy,omitempty"`
+
+	// CanaryNodes is the number of nodes that load a new configuration first
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default:=1
+	CanaryNodes int `json:"canaryNodes,omitempty"`
+
+	// StepNodes is the number of nodes that load the configuration at each step after the canary step, all the remaining nodes when 0
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	StepNodes int `json:"stepNodes,omitempty"`
+
+	// StabilizationSeconds is how long the nodes of a step must run the configuration with a stable VRRP state before the next step
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=3600
+	// +kubebuilder:default:=30
+	StabilizationSeconds int `json:"stabilizationSeconds,omitempty"`
+
+	// ProgressDeadlineSeconds is how long the nodes of a step can take to load the configuration before it is rolled back
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default:=600
+	ProgressDeadlineSeconds int `json:"progressDeadlineSeconds,omitempty"`
+}
+
+// NodeMaintenance controls which nodes are drained automatically. Cordoned nodes and nodes with the node.kubernetes.io/unschedulable
+// or node.kubernetes.io/out-of-service taints are drained unless Disabled is set
+type NodeMaintenance struct {
+	// Disabled stops draining the nodes under maintenance, only DrainNodes are drained
+	// +kubebuilder:validation:Optional
+	Disabled bool `json:"disabled,omitempty"`
+
+	// TaintKeys are the keys of additional taints that mark a node under maintenance, whatever their value and effect
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	TaintKeys []string `json:"taintKeys,omitempty"`
+}
+
+// Preemption controls when a node with a higher priority takes the VIPs over from the MASTER
+type Preemption struct {
+	// NoPreempt lets the MASTER keep the VIPs when a node with a higher priority comes back, instead of failing over a second time
+	// +kubebuilder:validation:Optional
+	NoPreempt bool `json:"noPreempt,omitempty"`
+
+	// PreemptDelay is how many seconds a node waits after it starts before taking the VIPs over from a MASTER with a lower priority
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=1000
+	PreemptDelay int `json:"preemptDelay,omitempty"`
+}
+
+// GlobalDefs are the typed options of the global_defs section of the keepalived configuration
+type GlobalDefs struct {
+	// VRRPVersion is the version of the VRRP protocol, keepalived uses version 2 by default
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Enum=2;3
+	VRRPVersion int `json:"vrrpVersion,omitempty"`
+
+	// VRRPStrict enforces the compliance with the VRRP protocol, it cannot be combined with unicastEnabled and passwordAuth
+	// +kubebuilder:validation:Optional
+	VRRPStrict bool `json:"vrrpStrict,omitempty"`
+
+	// VRRPSkipCheckAdvertAddresses skips checking the addresses of the advertisements received from the same MASTER
+	// +kubebuilder:validation:Optional
+	VRRPSkipCheckAdvertAddresses bool `json:"vrrpSkipCheckAdvertAddresses,omitempty"`
+
+	// EnableScriptSecurity prevents keepalived from running scripts that non-root users can modify
+	// +kubebuilder:validation:Optional
+	EnableScriptSecurity bool `json:"enableScriptSecurity,omitempty"`
+
+	// ScriptUser is the user the scripts are run as
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Pattern=`^[a-z_][a-z0-9_-]{0,31}$`
+	ScriptUser string `json:"scriptUser,omitempty"`
+
+	// SMTP configures the emails sent by keepalived on the state changes of the vrrp instances that enable smtpAlert
+	// +kubebuilder:validation:Optional
+	SMTP *SMTPSettings `json:"smtp,omitempty"`
+}
+
+// SMTPSettings configure the emails sent by keepalived
+type SMTPSettings struct {
+	// Server is the host name or the IP address of the SMTP server
+	// +kubebuilder:validation:Required
+	Server string `json:"server"`
+
+	// Port of the SMTP server, keepalived uses 25 by default
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int `json:"port,omitempty"`
+
+	// ConnectTimeoutSeconds is how long keepalived waits for the SMTP server, 30 seconds by default
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=3600
+	ConnectTimeoutSeconds int `json:"connectTimeoutSeconds,omitempty"`
+
+	// From is the sender address of the emails
+	// +kubebuilder:validation:Optional
+	From string `json:"from,omitempty"`
+
+	// NotificationEmails are the recipients of the emails
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	NotificationEmails []string `json:"notificationEmails,omitempty"`
+}
+
+// VRRPOptions are the typed options of a vrrp instance. In the vrrp-options annotation of a service,
+// each option that is set replaces the one of the KeepalivedGroup
+type VRRPOptions struct {
+	// AdvertIntervalSeconds is the interval between the VRRP advertisements of the MASTER, keepalived uses 1 second by default
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=255
+	AdvertIntervalSeconds *int `json:"advertIntervalSeconds,omitempty"`
+
+	// GarpMasterDelaySeconds is the delay before the second set of gratuitous ARPs sent after becoming MASTER
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=3600
+	GarpMasterDelaySeconds *int `json:"garpMasterDelaySeconds,omitempty"`
+
+	// GarpMasterRepeat is the number of gratuitous ARPs sent at once after becoming MASTER
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=255
+	GarpMasterRepeat *int `json:"garpMasterRepeat,omitempty"`
+
+	// GarpMasterRefreshSeconds is the interval between the gratuitous ARPs sent while MASTER, 0 disables them
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=3600
+	GarpMasterRefreshSeconds *int `json:"garpMasterRefreshSeconds,omitempty"`
+
+	// GarpMasterRefreshRepeat is the number of gratuitous ARPs sent at each refresh
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=255
+	GarpMasterRefreshRepeat *int `json:"garpMasterRefreshRepeat,omitempty"`
+
+	// DontTrackPrimary ignores the failures of the interface the VIPs are exposed on
+	// +kubebuilder:validation:Optional
+	DontTrackPrimary *bool `json:"dontTrackPrimary,omitempty"`
+
+	// SMTPAlert sends an email on the state changes of the instance, to the recipients of globalDefs.smtp
+	// +kubebuilder:validation:Optional
+	SMTPAlert *bool `json:"smtpAlert,omitempty"`
+
+	// TrackInterfaces are additional interfaces whose failure moves the instance to the FAULT state, or changes its priority when a weight is set
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=name
+	TrackInterfaces []TrackInterface `json:"trackInterfaces,omitempty"`
+
+	// VirtualRoutes are routes added on the MASTER with the VIPs, only the routes of the address family of the VIPs are added to an instance
+	// +kubebuilder:validation:Optional
+	VirtualRoutes []VirtualRoute `json:"virtualRoutes,omitempty"`
+}
+
+// TrackInterface is an interface tracked by a vrrp instance
+type TrackInterface struct {
+	// Name of the interface
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+
+	// Weight is added to the priority of the instance while the interface is up, when it is positive,
+	// or subtracted while the interface is down, when it is negative. Without weight the instance moves to the FAULT state when the interface is down
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=-254
+	// +kubebuilder:validation:Maximum=254
+	Weight *int `json:"weight,omitempty"`
+}
+
+// VirtualRoute is a route added on the MASTER of a vrrp instance
+type VirtualRoute struct {
+	// To is the destination of the route as a CIDR
+	// +kubebuilder:validation:Required
+	To string `json:"to"`
+
+	// Via is the gateway of the route
+	// +kubebuilder:validation:Optional
+	Via string `json:"via,omitempty"`
+
+	// Dev is the interface of the route
+	// +kubebuilder:validation:Optional
+	Dev string `json:"dev,omitempty"`
+
+	// Src is the preferred source address of the route
+	// +kubebuilder:validation:Optional
+	Src string `json:"src,omitempty"`
+
+	// Metric of the route
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	Metric *int `json:"metric,omitempty"`
+
+	// Table is the routing table of the route, the main table by default
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=4294967295
+	Table *int64 `json:"table,omitempty"`
+}
+
+// SidecarImages are the images of the containers that run next to keepalived, as tag or digest references
+type SidecarImages struct {
+	// ConfigReloader is the image of the config-setup and config-reloader containers
+	// +kubebuilder:validation:Optional
+	ConfigReloader string `json:"configReloader,omitempty"`
+
+	// VRRPStateReporter is the image of the vrrp-state-reporter container
+	// +kubebuilder:validation:Optional
+	VRRPStateReporter string `json:"vrrpStateReporter,omitempty"`
+
+	// PrometheusExporter is the image of the prometheus-exporter container
+	// +kubebuilder:validation:Optional
+	PrometheusExporter string `json:"prometheusExporter,omitempty"`
+}
+
+// ContainerOverride sets the resources and the security context of a container of the keepalived pods
+type ContainerOverride struct {
+	// Name of the container
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=keepalived;config-setup;config-reloader;vrrp-state-reporter;prometheus-exporter
+	Name string `json:"name"`
+
+	// Resources of the container, no resources are requested by default
+	// +kubebuilder:validation:Optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// SecurityContext is merged onto the default security context of the container, the capabilities added by default cannot be dropped.
+	// keepalived and prometheus-exporter are privileged to manage the network of the node, config-reloader needs SYS_CHROOT and SYS_PTRACE to validate the configuration
+	// +kubebuilder:validation:Optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+}
+
+// NodePriority sets the VRRP priority of the keepalived pods running on the nodes selected by name or by labels
+type NodePriority struct {
+	// NodeName selects a node by name, it cannot be combined with NodeSelector
+	// +kubebuilder:validation:Optional
+	NodeName string `json:"nodeName,omitempty"`
+
+	// NodeSelector selects the nodes that have all these labels
+	// +kubebuilder:validation:Optional
+	// +mapType=granular
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Priority of the selected nodes, when a node is selected by several entries the highest priority applies
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=254
+	Priority int `json:"priority"`
+}
+
+// AddressPool defines the IPs that can be allocated to LoadBalancer services
+type AddressPool struct {
+	// CIDRs from which IPs are allocated. For IPv4 CIDRs larger than /31 the network and broadcast addresses are skipped
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	CIDRs []string `json:"cidrs,omitempty"`
+
+	// Addresses lists individual IPs that can be allocated
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// RouterIDRange is an inclusive range of virtual router ids
+type RouterIDRange struct {
+	// Min defaults to 1
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=255
+	Min int `json:"min,omitempty"`
+
+	// Max defaults to 255
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=255
+	Max int `json:"max,omitempty"`
 }
 
 // PasswordAuth references a Kubernetes secret to extract the password for VRRP authentication
@@ -73,8 +503,9 @@ type PasswordAuth struct {
 	// +required
 	SecretRef corev1.LocalObjectReference `json:"secretRef"`
 
+	// SecretKey is the key of the secret holding the password, it defaults to password.
+	// The password can be at most 8 characters long
 	// +optional
-	// +kubebuilder:default:=password
 	SecretKey string `json:"secretKey"`
 }
 
@@ -87,8 +518,240 @@ type KeepalivedGroupStatus struct {
 	// +listMapKey=type
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 
+	// RouterIDs maps vrrp instances to their virtual router id. IPv4 and IPv6 instances have separate id spaces, IPv6 instances of services are named <namespace>/<name>/ipv6
 	// +mapType=granular
 	RouterIDs map[string]int `json:"routerIDs,omitempty"`
+
+	// VRRPInstances reports the router id and the VRRP state of each vrrp instance, as notified by the keepalived pods
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	VRRPInstances []VRRPInstanceStatus `json:"vrrpInstances,omitempty"`
+
+	// RouterIDSpaces reports the usage of the router ids of each interface and address family, keepalived scopes router ids per interface and family
+	// +optional
+	RouterIDSpaces []RouterIDSpace `json:"routerIDSpaces,omitempty"`
+
+	// IPAllocations maps the namespace/name of LoadBalancer services to the IP allocated to them from the address pool
+	// +mapType=granular
+	IPAllocations map[string]string `json:"ipAllocations,omitempty"`
+
+	// DesiredConfigHash is the hex encoded sha256 of the keepalived configuration rendered by the operator
+	// +optional
+	DesiredConfigHash string `json:"desiredConfigHash,omitempty"`
+
+	// AppliedConfigs reports the configuration loaded by keepalived on each node, as notified by the keepalived pods
+	// +optional
+	// +listType=map
+	// +listMapKey=node
+	AppliedConfigs []AppliedConfigStatus `json:"appliedConfigs,omitempty"`
+
+	// DrainedNodes reports the nodes the VIPs are moved off, and the VIPs they still hold
+	// +optional
+	// +listType=map
+	// +listMapKey=node
+	DrainedNodes []DrainedNodeStatus `json:"drainedNodes,omitempty"`
+
+	// Images reports the image of each container of the keepalived pods, and the image IDs the pods run
+	// +optional
+	// +listType=map
+	// +listMapKey=container
+	Images []ImageStatus `json:"images,omitempty"`
+
+	// ConfigRollout reports the progress of the canary rollout of the keepalived configuration
+	// +optional
+	ConfigRollout *ConfigRolloutStatus `json:"configRollout,omitempty"`
+
+	// ConfigHistory reports the revisions of the keepalived configuration
+	// +optional
+	ConfigHistory *ConfigHistoryStatus `json:"configHistory,omitempty"`
+}
+
+// ConfigHistoryStatus reports the revisions of the keepalived configuration
+type ConfigHistoryStatus struct {
+	// CurrentRevision is the revision of the configuration rendered from the current spec
+	// +optional
+	CurrentRevision int64 `json:"currentRevision,omitempty"`
+
+	// LastKnownGoodRevision is the revision of the last configuration all the nodes ran for MinStableSeconds without keepalived crashing
+	// +optional
+	LastKnownGoodRevision int64 `json:"lastKnownGoodRevision,omitempty"`
+
+	// LastKnownGoodConfigHash is the hash of the last known good configuration
+	// +optional
+	LastKnownGoodConfigHash string `json:"lastKnownGoodConfigHash,omitempty"`
+
+	// StableConfigHash is the hash of the configuration all the nodes run without keepalived crashing, since StableSince
+	// +optional
+	StableConfigHash string `json:"stableConfigHash,omitempty"`
+
+	// +optional
+	StableSince *metav1.Time `json:"stableSince,omitempty"`
+
+	// RevertedRevision is the revision of the last configuration reverted because keepalived crash looped with it
+	// +optional
+	RevertedRevision int64 `json:"revertedRevision,omitempty"`
+
+	// RevertedConfigHash is the hash of the last reverted configuration, it is reverted until the rendered configuration changes
+	// +optional
+	RevertedConfigHash string `json:"revertedConfigHash,omitempty"`
+
+	// RevertMessage is why the last reverted configuration was reverted
+	// +optional
+	RevertMessage string `json:"revertMessage,omitempty"`
+}
+
+// ConfigRolloutStatus reports the progress of the canary rollout of the keepalived configuration
+type ConfigRolloutStatus struct {
+	// StableConfigHash is the hash of the configuration of the nodes that are not part of the rollout
+	// +optional
+	StableConfigHash string `json:"stableConfigHash,omitempty"`
+
+	// TargetConfigHash is the hash of the configuration being rolled out, empty when no rollout is in progress
+	// +optional
+	TargetConfigHash string `json:"targetConfigHash,omitempty"`
+
+	// UpdatedPods are the keepalived pods that load the configuration being rolled out
+	// +optional
+	// +listType=set
+	UpdatedPods []string `json:"updatedPods,omitempty"`
+
+	// StepStartTime is when the current step of the rollout started
+	// +optional
+	StepStartTime *metav1.Time `json:"stepStartTime,omitempty"`
+
+	// StableSince is when the updated pods last all ran the configuration being rolled out with a stable VRRP state
+	// +optional
+	StableSince *metav1.Time `json:"stableSince,omitempty"`
+
+	// FailedConfigHash is the hash of the last configuration that was rolled back, it is not rolled out again
+	// +optional
+	FailedConfigHash string `json:"failedConfigHash,omitempty"`
+
+	// FailureMessage is why the last configuration was rolled back
+	// +optional
+	FailureMessage string `json:"failureMessage,omitempty"`
+}
+
+// ImageStatus reports the image of a container of the keepalived pods
+type ImageStatus struct {
+	// +kubebuilder:validation:Required
+	Container string `json:"container"`
+
+	// Image is the image reference the container is configured with
+	// +kubebuilder:validation:Required
+	Image string `json:"image"`
+
+	// ImageIDs are the image IDs reported by the keepalived pods for the container, they resolve tags to digests
+	// +optional
+	// +listType=set
+	ImageIDs []string `json:"imageIDs,omitempty"`
+}
+
+// DrainedNodeStatus reports the progress of the drain of a node
+type DrainedNodeStatus struct {
+	// +kubebuilder:validation:Required
+	Node string `json:"node"`
+
+	// Reason why the node is drained: DrainNodes, Unschedulable or Taint
+	// +kubebuilder:validation:Required
+	Reason string `json:"reason"`
+
+	// Message details the reason, like the key of the taint
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
+
+	// VIPs still held by the node, as notified by its keepalived pod
+	// +kubebuilder:validation:Optional
+	VIPs []string `json:"vips,omitempty"`
+
+	// Drained is true when the node holds no VIP anymore
+	// +kubebuilder:validation:Required
+	Drained bool `json:"drained"`
+}
+
+// AppliedConfigStatus reports the keepalived configuration loaded on a node
+type AppliedConfigStatus struct {
+	// +kubebuilder:validation:Required
+	Node string `json:"node"`
+
+	// Pod is the name of the keepalived pod running on the node
+	// +kubebuilder:validation:Required
+	Pod string `json:"pod"`
+
+	// ConfigHash is the hash of the configuration loaded by keepalived, empty until the pod reports it
+	// +kubebuilder:validation:Optional
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// Error is the reason why the latest configuration could not be loaded, empty when it was loaded
+	// +kubebuilder:validation:Optional
+	Error string `json:"error,omitempty"`
+}
+
+// VRRPInstanceStatus reports which nodes hold the VIPs of a vrrp instance
+type VRRPInstanceStatus struct {
+	// Name of the vrrp instance, as in RouterIDs
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+
+	// Service is the namespace/name of the service the instance belongs to
+	// +kubebuilder:validation:Required
+	Service string `json:"service"`
+
+	// +kubebuilder:validation:Required
+	RouterID int `json:"routerID"`
+
+	// VIPs of the instance
+	// +kubebuilder:validation:Optional
+	VIPs []string `json:"vips,omitempty"`
+
+	// Owner is the node the VIPs are assigned to when the service spreads its VIPs, it is given the highest priority.
+	// The assignment is kept as long as the node runs a keepalived pod, to avoid moving VIPs when nodes come and go
+	// +kubebuilder:validation:Optional
+	Owner string `json:"owner,omitempty"`
+
+	// OwnerZone is the topology.kubernetes.io/zone of the owner node, VIPs of a service are spread across zones first
+	// +kubebuilder:validation:Optional
+	OwnerZone string `json:"ownerZone,omitempty"`
+
+	// Master is the node holding the VIPs, empty when no node reports the MASTER state
+	// +kubebuilder:validation:Optional
+	Master string `json:"master,omitempty"`
+
+	// Backup lists the nodes in BACKUP state
+	// +kubebuilder:validation:Optional
+	Backup []string `json:"backup,omitempty"`
+
+	// Fault lists the nodes in FAULT state
+	// +kubebuilder:validation:Optional
+	Fault []string `json:"fault,omitempty"`
+
+	// SplitBrain is set when more than one node reports the MASTER state, Master is then the first of them
+	// +kubebuilder:validation:Optional
+	SplitBrain []string `json:"splitBrain,omitempty"`
+}
+
+// RouterIDSpace reports the usage of the virtual router ids of an interface and address family
+type RouterIDSpace struct {
+	// +kubebuilder:validation:Required
+	Interface string `json:"interface"`
+
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=IPv4;IPv6
+	Family string `json:"family"`
+
+	// Used is the number of vrrp instances using an id of this space
+	// +kubebuilder:validation:Required
+	Used int `json:"used"`
+
+	// Available is the number of ids of this space that are neither used nor blacklisted
+	// +kubebuilder:validation:Required
+	Available int `json:"available"`
+
+	// RouterIDs lists the ids used in this space, they are avoided by the keepalived groups sharing the same interface and nodes
+	// +kubebuilder:validation:Optional
+	// +listType=set
+	RouterIDs []int `json:"routerIDs,omitempty"`
 }
 
 func (m *KeepalivedGroup) GetConditions() []metav1.Condition {
@@ -0,0 +1,409 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultImage is the keepalived image used when the KeepalivedGroup does not set one
+	DefaultImage = "registry.redhat.io/openshift4/ose-keepalived-ipfailover"
+	// DefaultProgressDeadlineSeconds is how long a step of a canary rollout can take when the KeepalivedGroup does not set it
+	DefaultProgressDeadlineSeconds = 600
+	// DefaultSecretKey is the key of the passwordAuth secret used when the KeepalivedGroup does not set one
+	DefaultSecretKey = "password"
+	// MaxPasswordLength is the longest password accepted by keepalived for PASS authentication
+	MaxPasswordLength = 8
+	// MaxPreemptDelay is the longest preempt_delay accepted by keepalived, in seconds
+	MaxPreemptDelay = 1000
+	maxRouterID     = 255
+	// 255 is reserved by VRRP for the owner of the addresses
+	minPriority = 1
+	maxPriority = 254
+)
+
+// keepalived keywords are made of letters, digits and underscores
+var verbatimConfigKeyRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// image references are made of an optional registry, a repository, an optional tag and an optional digest
+var imageReferenceRegexp = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[\w][\w.-]{0,127})?(?:@[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,})?$`)
+
+var imageDigestRegexp = regexp.MustCompile(`@sha256:[0-9a-f]{64}$`)
+
+// linux interface names are at most 15 characters long and cannot contain slashes or white spaces
+var interfaceNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:@-]{1,15}$`)
+
+var scriptUserRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// email addresses are restricted to characters that do not need quoting in the keepalived configuration
+var emailRegexp = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+$`)
+
+var keepalivedgrouplog = logf.Log.WithName("keepalivedgroup-resource")
+
+// KeepalivedGroupWebhook defaults and validates KeepalivedGroups at admission time
+// +kubebuilder:object:generate=false
+type KeepalivedGroupWebhook struct {
+	// Client is used to read the passwordAuth secrets
+	Client client.Reader
+}
+
+// SetupWebhookWithManager registers the defaulting and validating webhooks for KeepalivedGroups
+func (w *KeepalivedGroupWebhook) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	if w.Client == nil {
+		w.Client = mgr.GetAPIReader()
+	}
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&KeepalivedGroup{}).
+		WithDefaulter(w).
+		WithValidator(w).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-redhatcop-redhat-io-v1alpha1-keepalivedgroup,mutating=true,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=keepalivedgroups,verbs=create;update,versions=v1alpha1,name=mkeepalivedgroup.kb.io,admissionReviewVersions=v1
+
+// Default implements admission.CustomDefaulter
+func (w *KeepalivedGroupWebhook) Default(ctx context.Context, obj runtime.Object) error {
+	instance, ok := obj.(*KeepalivedGroup)
+	if !ok {
+		return fmt.Errorf("expected a KeepalivedGroup, got %T", obj)
+	}
+	keepalivedgrouplog.V(1).Info("default", "name", instance.Name)
+	instance.Default()
+	return nil
+}
+
+// Default sets the defaults of the KeepalivedGroup and returns true if any field was changed
+func (m *KeepalivedGroup) Default() bool {
+	changed := false
+	if m.Spec.Image == "" {
+		m.Spec.Image = DefaultImage
+		changed = true
+	}
+	if m.Spec.PasswordAuth.SecretRef.Name != "" && m.Spec.PasswordAuth.SecretKey == "" {
+		m.Spec.PasswordAuth.SecretKey = DefaultSecretKey
+		changed = true
+	}
+	if m.Spec.ConfigRollout != nil {
+		if m.Spec.ConfigRollout.Strategy == "" {
+			m.Spec.ConfigRollout.Strategy = AllAtOnceConfigRollout
+			changed = true
+		}
+		if m.Spec.ConfigRollout.CanaryNodes == 0 {
+			m.Spec.ConfigRollout.CanaryNodes = 1
+			changed = true
+		}
+		if m.Spec.ConfigRollout.ProgressDeadlineSeconds == 0 {
+			m.Spec.ConfigRollout.ProgressDeadlineSeconds = DefaultProgressDeadlineSeconds
+			changed = true
+		}
+	}
+	if m.Spec.RouterIDRange != nil {
+		if m.Spec.RouterIDRange.Min == 0 {
+			m.Spec.RouterIDRange.Min = 1
+			changed = true
+		}
+		if m.Spec.RouterIDRange.Max == 0 {
+			m.Spec.RouterIDRange.Max = maxRouterID
+			changed = true
+		}
+	}
+	return changed
+}
+
+//+kubebuilder:webhook:path=/validate-redhatcop-redhat-io-v1alpha1-keepalivedgroup,mutating=false,failurePolicy=fail,sideEffects=None,groups=redhatcop.redhat.io,resources=keepalivedgroups,verbs=create;update,versions=v1alpha1,name=vkeepalivedgroup.kb.io,admissionReviewVersions=v1
+
+// ValidateCreate implements admission.CustomValidator
+func (w *KeepalivedGroupWebhook) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	return w.validate(ctx, obj)
+}
+
+// ValidateUpdate implements admission.CustomValidator
+func (w *KeepalivedGroupWebhook) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	return w.validate(ctx, newObj)
+}
+
+// ValidateDelete implements admission.CustomValidator
+func (w *KeepalivedGroupWebhook) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+func (w *KeepalivedGroupWebhook) validate(ctx context.Context, obj runtime.Object) error {
+	instance, ok := obj.(*KeepalivedGroup)
+	if !ok {
+		return fmt.Errorf("expected a KeepalivedGroup, got %T", obj)
+	}
+	keepalivedgrouplog.V(1).Info("validate", "name", instance.Name)
+	errs := instance.ValidateSpec()
+	errs = append(errs, w.validatePassword(ctx, instance)...)
+	if len(errs) > 0 {
+		return apierrors.NewInvalid(schema.GroupKind{Group: GroupVersion.Group, Kind: "KeepalivedGroup"}, instance.Name, errs)
+	}
+	return nil
+}
+
+// validatePassword checks the password of the passwordAuth secret, if the secret already exists
+func (w *KeepalivedGroupWebhook) validatePassword(ctx context.Context, instance *KeepalivedGroup) field.ErrorList {
+	errs := field.ErrorList{}
+	if instance.Spec.PasswordAuth.SecretRef.Name == "" || w.Client == nil {
+		return errs
+	}
+	secret := &corev1.Secret{}
+	err := w.Client.Get(ctx, types.NamespacedName{Namespace: instance.Namespace, Name: instance.Spec.PasswordAuth.SecretRef.Name}, secret)
+	if err != nil {
+		// the secret may be created after the KeepalivedGroup, the controller reports it as missing
+		keepalivedgrouplog.V(1).Info("unable to read passwordAuth secret", "name", instance.Name, "error", err.Error())
+		return errs
+	}
+	key := instance.Spec.PasswordAuth.SecretKey
+	if key == "" {
+		key = DefaultSecretKey
+	}
+	if password, ok := secret.Data[key]; ok && len(password) > MaxPasswordLength {
+		errs = append(errs, field.Invalid(field.NewPath("spec", "passwordAuth", "secretKey"), key, fmt.Sprintf("the password in key %s of secret %s is %d characters long, keepalived supports at most %d", key, secret.Name, len(password), MaxPasswordLength)))
+	}
+	return errs
+}
+
+// ValidateSpec checks the fields of the KeepalivedGroup that would otherwise break the keepalived configuration
+func (m *KeepalivedGroup) ValidateSpec() field.ErrorList {
+	errs := field.ErrorList{}
+	spec := field.NewPath("spec")
+	if m.Spec.Interface == "" && m.Spec.InterfaceFromIP == "" {
+		errs = append(errs, field.Required(spec.Child("interface"), "either interface or interfaceFromIP must be set"))
+	}
+	if m.Spec.InterfaceFromIP != "" {
+		if _, err := netip.ParseAddr(m.Spec.InterfaceFromIP); err != nil {
+			errs = append(errs, field.Invalid(spec.Child("interfaceFromIP"), m.Spec.InterfaceFromIP, "must be a valid IPv4 or IPv6 address"))
+		}
+	}
+	for i, id := range m.Spec.BlacklistRouterIDs {
+		if id < 1 || id > maxRouterID {
+			errs = append(errs, field.Invalid(spec.Child("blacklistRouterIDs").Index(i), id, fmt.Sprintf("router ids must be between 1 and %d", maxRouterID)))
+		}
+	}
+	if m.Spec.RouterIDRange != nil && m.Spec.RouterIDRange.Max != 0 && m.Spec.RouterIDRange.Min > m.Spec.RouterIDRange.Max {
+		errs = append(errs, field.Invalid(spec.Child("routerIDRange", "min"), m.Spec.RouterIDRange.Min, fmt.Sprintf("must not be greater than max %d", m.Spec.RouterIDRange.Max)))
+	}
+	keys := []string{}
+	for key := range m.Spec.VerbatimConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := m.Spec.VerbatimConfig[key]
+		path := spec.Child("verbatimConfig").Key(key)
+		if !verbatimConfigKeyRegexp.MatchString(key) {
+			errs = append(errs, field.Invalid(path, key, "keys must be single keepalived keywords made of letters, digits and underscores"))
+		} else if key == "router_id" {
+			errs = append(errs, field.Forbidden(path, "router_id is set by the operator to the name of the KeepalivedGroup"))
+		}
+		if strings.ContainsAny(value, "{}\n\r") {
+			errs = append(errs, field.Invalid(path, value, "values must not contain braces or line breaks, they would end the global_defs block"))
+		}
+	}
+	if m.Spec.AddressPool != nil && m.Spec.AddressPoolRef != "" {
+		errs = append(errs, field.Forbidden(spec.Child("addressPoolRef"), "addressPool and addressPoolRef cannot be set at the same time"))
+	}
+	errs = append(errs, ValidateNodePriorities(m.Spec.NodePriorities, spec.Child("nodePriorities"))...)
+	if m.Spec.Preemption != nil && (m.Spec.Preemption.PreemptDelay < 0 || m.Spec.Preemption.PreemptDelay > MaxPreemptDelay) {
+		errs = append(errs, field.Invalid(spec.Child("preemption", "preemptDelay"), m.Spec.Preemption.PreemptDelay, fmt.Sprintf("must be between 0 and %d seconds", MaxPreemptDelay)))
+	}
+	for i, node := range m.Spec.DrainNodes {
+		for _, msg := range validation.IsDNS1123Subdomain(node) {
+			errs = append(errs, field.Invalid(spec.Child("drainNodes").Index(i), node, msg))
+		}
+	}
+	errs = append(errs, ValidateImage(m.Spec.Image, m.Spec.RequireImageDigests, spec.Child("image"))...)
+	if m.Spec.SidecarImages != nil {
+		images := spec.Child("sidecarImages")
+		errs = append(errs, ValidateImage(m.Spec.SidecarImages.ConfigReloader, m.Spec.RequireImageDigests, images.Child("configReloader"))...)
+		errs = append(errs, ValidateImage(m.Spec.SidecarImages.VRRPStateReporter, m.Spec.RequireImageDigests, images.Child("vrrpStateReporter"))...)
+		errs = append(errs, ValidateImage(m.Spec.SidecarImages.PrometheusExporter, m.Spec.RequireImageDigests, images.Child("prometheusExporter"))...)
+	}
+	errs = append(errs, m.validateGlobalDefs(spec.Child("globalDefs"))...)
+	errs = append(errs, ValidateVRRPOptions(m.Spec.VRRPOptions, spec.Child("vrrpOptions"))...)
+	if m.Spec.NodeMaintenance != nil {
+		for i, key := range m.Spec.NodeMaintenance.TaintKeys {
+			for _, msg := range validation.IsQualifiedName(key) {
+				errs = append(errs, field.Invalid(spec.Child("nodeMaintenance", "taintKeys").Index(i), key, msg))
+			}
+		}
+	}
+	return errs
+}
+
+func (m *KeepalivedGroup) validateGlobalDefs(path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	globalDefs := m.Spec.GlobalDefs
+	if globalDefs == nil {
+		return errs
+	}
+	if globalDefs.VRRPVersion != 0 && globalDefs.VRRPVersion != 2 && globalDefs.VRRPVersion != 3 {
+		errs = append(errs, field.NotSupported(path.Child("vrrpVersion"), globalDefs.VRRPVersion, []string{"2", "3"}))
+	}
+	if globalDefs.VRRPStrict {
+		if m.Spec.UnicastEnabled {
+			errs = append(errs, field.Forbidden(path.Child("vrrpStrict"), "vrrpStrict cannot be combined with unicastEnabled"))
+		}
+		if m.Spec.PasswordAuth.SecretRef.Name != "" {
+			errs = append(errs, field.Forbidden(path.Child("vrrpStrict"), "vrrpStrict cannot be combined with passwordAuth"))
+		}
+	}
+	if globalDefs.ScriptUser != "" && !scriptUserRegexp.MatchString(globalDefs.ScriptUser) {
+		errs = append(errs, field.Invalid(path.Child("scriptUser"), globalDefs.ScriptUser, "must be a valid user name"))
+	}
+	if smtp := globalDefs.SMTP; smtp != nil {
+		smtpPath := path.Child("smtp")
+		if smtp.Server == "" {
+			errs = append(errs, field.Required(smtpPath.Child("server"), "the SMTP server must be set"))
+		} else if _, err := netip.ParseAddr(smtp.Server); err != nil && len(validation.IsDNS1123Subdomain(smtp.Server)) > 0 {
+			errs = append(errs, field.Invalid(smtpPath.Child("server"), smtp.Server, "must be a host name or an IP address"))
+		}
+		if smtp.Port < 0 || smtp.Port > 65535 {
+			errs = append(errs, field.Invalid(smtpPath.Child("port"), smtp.Port, "must be between 1 and 65535"))
+		}
+		if smtp.ConnectTimeoutSeconds < 0 || smtp.ConnectTimeoutSeconds > 3600 {
+			errs = append(errs, field.Invalid(smtpPath.Child("connectTimeoutSeconds"), smtp.ConnectTimeoutSeconds, "must be between 1 and 3600 seconds"))
+		}
+		if smtp.From != "" && !emailRegexp.MatchString(smtp.From) {
+			errs = append(errs, field.Invalid(smtpPath.Child("from"), smtp.From, "must be an email address"))
+		}
+		for i, email := range smtp.NotificationEmails {
+			if !emailRegexp.MatchString(email) {
+				errs = append(errs, field.Invalid(smtpPath.Child("notificationEmails").Index(i), email, "must be an email address"))
+			}
+		}
+	}
+	return errs
+}
+
+// ValidateVRRPOptions checks the vrrp options, of a KeepalivedGroup or of the vrrp-options annotation of a service.
+// The values end up in the keepalived configuration, so they are checked even where the CRD schema already checks them
+func ValidateVRRPOptions(options *VRRPOptions, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if options == nil {
+		return errs
+	}
+	validateRange := func(value *int, name string, min, max int) {
+		if value != nil && (*value < min || *value > max) {
+			errs = append(errs, field.Invalid(path.Child(name), *value, fmt.Sprintf("must be between %d and %d", min, max)))
+		}
+	}
+	validateRange(options.AdvertIntervalSeconds, "advertIntervalSeconds", 1, 255)
+	validateRange(options.GarpMasterDelaySeconds, "garpMasterDelaySeconds", 0, 3600)
+	validateRange(options.GarpMasterRepeat, "garpMasterRepeat", 1, 255)
+	validateRange(options.GarpMasterRefreshSeconds, "garpMasterRefreshSeconds", 0, 3600)
+	validateRange(options.GarpMasterRefreshRepeat, "garpMasterRefreshRepeat", 1, 255)
+	names := map[string]bool{}
+	for i, track := range options.TrackInterfaces {
+		trackPath := path.Child("trackInterfaces").Index(i)
+		if !interfaceNameRegexp.MatchString(track.Name) {
+			errs = append(errs, field.Invalid(trackPath.Child("name"), track.Name, "must be a valid interface name"))
+		} else if names[track.Name] {
+			errs = append(errs, field.Duplicate(trackPath.Child("name"), track.Name))
+		}
+		names[track.Name] = true
+		if track.Weight != nil && (*track.Weight < -maxPriority || *track.Weight > maxPriority) {
+			errs = append(errs, field.Invalid(trackPath.Child("weight"), *track.Weight, fmt.Sprintf("must be between %d and %d", -maxPriority, maxPriority)))
+		}
+	}
+	for i, route := range options.VirtualRoutes {
+		routePath := path.Child("virtualRoutes").Index(i)
+		prefix, err := netip.ParsePrefix(route.To)
+		if err != nil {
+			errs = append(errs, field.Invalid(routePath.Child("to"), route.To, "must be an IPv4 or IPv6 CIDR"))
+		}
+		for _, address := range []struct{ name, value string }{{"via", route.Via}, {"src", route.Src}} {
+			name, value := address.name, address.value
+			if value == "" {
+				continue
+			}
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				errs = append(errs, field.Invalid(routePath.Child(name), value, "must be an IPv4 or IPv6 address"))
+			} else if prefix.IsValid() && addr.Is4() != prefix.Addr().Is4() {
+				errs = append(errs, field.Invalid(routePath.Child(name), value, "must be of the address family of the destination"))
+			}
+		}
+		if route.Dev != "" && !interfaceNameRegexp.MatchString(route.Dev) {
+			errs = append(errs, field.Invalid(routePath.Child("dev"), route.Dev, "must be a valid interface name"))
+		}
+		if route.Metric != nil && *route.Metric < 0 {
+			errs = append(errs, field.Invalid(routePath.Child("metric"), *route.Metric, "must not be negative"))
+		}
+		if route.Table != nil && (*route.Table < 1 || *route.Table > 4294967295) {
+			errs = append(errs, field.Invalid(routePath.Child("table"), *route.Table, "must be between 1 and 4294967295"))
+		}
+	}
+	return errs
+}
+
+// ValidateImage checks an image reference, empty references are left to the defaults.
+// The operator defaults of the sidecar images are checked by the controller, as they are not part of the KeepalivedGroup
+func ValidateImage(image string, requireDigest bool, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	if image == "" {
+		return errs
+	}
+	if !imageReferenceRegexp.MatchString(image) {
+		errs = append(errs, field.Invalid(path, image, "must be a valid image reference, like registry.example.com/repository:tag or registry.example.com/repository@sha256:<digest>"))
+	} else if requireDigest && !IsImageDigestPinned(image) {
+		errs = append(errs, field.Invalid(path, image, "must be pinned by a sha256 digest, like registry.example.com/repository@sha256:<digest>, as requireImageDigests is set"))
+	}
+	return errs
+}
+
+// IsImageDigestPinned returns true if the image reference is pinned by a sha256 digest
+func IsImageDigestPinned(image string) bool {
+	return imageDigestRegexp.MatchString(image)
+}
+
+// ValidateNodePriorities checks node priorities, of a KeepalivedGroup or of the node-priorities annotation of a service
+func ValidateNodePriorities(priorities []NodePriority, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	for i, priority := range priorities {
+		switch {
+		case priority.NodeName == "" && len(priority.NodeSelector) == 0:
+			errs = append(errs, field.Required(path.Index(i), "either nodeName or nodeSelector must be set"))
+		case priority.NodeName != "" && len(priority.NodeSelector) > 0:
+			errs = append(errs, field.Forbidden(path.Index(i).Child("nodeSelector"), "nodeName and nodeSelector cannot be set at the same time"))
+		}
+		if priority.Priority < minPriority || priority.Priority > maxPriority {
+			errs = append(errs, field.Invalid(path.Index(i).Child("priority"), priority.Priority, fmt.Sprintf("priorities must be between %d and %d", minPriority, maxPriority)))
+		}
+	}
+	return errs
+}
@@ -22,10 +22,344 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AddressAllocation) DeepCopyInto(out *AddressAllocation) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AddressAllocation.
+func (in *AddressAllocation) DeepCopy() *AddressAllocation {
+	if in == nil {
+		return nil
+	}
+	out := new(AddressAllocation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AddressPool) DeepCopyInto(out *AddressPool) {
+	*out = *in
+	if in.CIDRs != nil {
+		in, out := &in.CIDRs, &out.CIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AddressPool.
+func (in *AddressPool) DeepCopy() *AddressPool {
+	if in == nil {
+		return nil
+	}
+	out := new(AddressPool)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AppliedConfigStatus) DeepCopyInto(out *AppliedConfigStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AppliedConfigStatus.
+func (in *AppliedConfigStatus) DeepCopy() *AppliedConfigStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AppliedConfigStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigHistory) DeepCopyInto(out *ConfigHistory) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigHistory.
+func (in *ConfigHistory) DeepCopy() *ConfigHistory {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigHistory)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigHistoryStatus) DeepCopyInto(out *ConfigHistoryStatus) {
+	*out = *in
+	if in.StableSince != nil {
+		in, out := &in.StableSince, &out.StableSince
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigHistoryStatus.
+func (in *ConfigHistoryStatus) DeepCopy() *ConfigHistoryStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigHistoryStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigRollout) DeepCopyInto(out *ConfigRollout) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigRollout.
+func (in *ConfigRollout) DeepCopy() *ConfigRollout {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigRollout)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigRolloutStatus) DeepCopyInto(out *ConfigRolloutStatus) {
+	*out = *in
+	if in.UpdatedPods != nil {
+		in, out := &in.UpdatedPods, &out.UpdatedPods
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.StepStartTime != nil {
+		in, out := &in.StepStartTime, &out.StepStartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.StableSince != nil {
+		in, out := &in.StableSince, &out.StableSince
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigRolloutStatus.
+func (in *ConfigRolloutStatus) DeepCopy() *ConfigRolloutStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigRolloutStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ContainerOverride) DeepCopyInto(out *ContainerOverride) {
+	*out = *in
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(corev1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(corev1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ContainerOverride.
+func (in *ContainerOverride) DeepCopy() *ContainerOverride {
+	if in == nil {
+		return nil
+	}
+	out := new(ContainerOverride)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DrainedNodeStatus) DeepCopyInto(out *DrainedNodeStatus) {
+	*out = *in
+	if in.VIPs != nil {
+		in, out := &in.VIPs, &out.VIPs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DrainedNodeStatus.
+func (in *DrainedNodeStatus) DeepCopy() *DrainedNodeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(DrainedNodeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GlobalDefs) DeepCopyInto(out *GlobalDefs) {
+	*out = *in
+	if in.SMTP != nil {
+		in, out := &in.SMTP, &out.SMTP
+		*out = new(SMTPSettings)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GlobalDefs.
+func (in *GlobalDefs) DeepCopy() *GlobalDefs {
+	if in == nil {
+		return nil
+	}
+	out := new(GlobalDefs)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageStatus) DeepCopyInto(out *ImageStatus) {
+	*out = *in
+	if in.ImageIDs != nil {
+		in, out := &in.ImageIDs, &out.ImageIDs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageStatus.
+func (in *ImageStatus) DeepCopy() *ImageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeepalivedAddressPool) DeepCopyInto(out *KeepalivedAddressPool) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeepalivedAddressPool.
+func (in *KeepalivedAddressPool) DeepCopy() *KeepalivedAddressPool {
+	if in == nil {
+		return nil
+	}
+	out := new(KeepalivedAddressPool)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *KeepalivedAddressPool) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeepalivedAddressPoolList) DeepCopyInto(out *KeepalivedAddressPoolList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]KeepalivedAddressPool, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeepalivedAddressPoolList.
+func (in *KeepalivedAddressPoolList) DeepCopy() *KeepalivedAddressPoolList {
+	if in == nil {
+		return nil
+	}
+	out := new(KeepalivedAddressPoolList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *KeepalivedAddressPoolList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeepalivedAddressPoolSpec) DeepCopyInto(out *KeepalivedAddressPoolSpec) {
+	*out = *in
+	if in.CIDRs != nil {
+		in, out := &in.CIDRs, &out.CIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Addresses != nil {
+		in, out := &in.Addresses, &out.Addresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Reserved != nil {
+		in, out := &in.Reserved, &out.Reserved
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NamespaceQuotas != nil {
+		in, out := &in.NamespaceQuotas, &out.NamespaceQuotas
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeepalivedAddressPoolSpec.
+func (in *KeepalivedAddressPoolSpec) DeepCopy() *KeepalivedAddressPoolSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(KeepalivedAddressPoolSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeepalivedAddressPoolStatus) DeepCopyInto(out *KeepalivedAddressPoolStatus) {
+	*out = *in
+	if in.Allocations != nil {
+		in, out := &in.Allocations, &out.Allocations
+		*out = make([]AddressAllocation, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeepalivedAddressPoolStatus.
+func (in *KeepalivedAddressPoolStatus) DeepCopy() *KeepalivedAddressPoolStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(KeepalivedAddressPoolStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *KeepalivedGroup) DeepCopyInto(out *KeepalivedGroup) {
 	*out = *in
@@ -95,6 +429,11 @@ func (in *KeepalivedGroupSpec) DeepCopyInto(out *KeepalivedGroupSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.SidecarImages != nil {
+		in, out := &in.SidecarImages, &out.SidecarImages
+		*out = new(SidecarImages)
+		**out = **in
+	}
 	out.PasswordAuth = in.PasswordAuth
 	if in.VerbatimConfig != nil {
 		in, out := &in.VerbatimConfig, &out.VerbatimConfig
@@ -103,11 +442,26 @@ func (in *KeepalivedGroupSpec) DeepCopyInto(out *KeepalivedGroupSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.GlobalDefs != nil {
+		in, out := &in.GlobalDefs, &out.GlobalDefs
+		*out = new(GlobalDefs)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.VRRPOptions != nil {
+		in, out := &in.VRRPOptions, &out.VRRPOptions
+		*out = new(VRRPOptions)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.BlacklistRouterIDs != nil {
 		in, out := &in.BlacklistRouterIDs, &out.BlacklistRouterIDs
 		*out = make([]int, len(*in))
 		copy(*out, *in)
 	}
+	if in.RouterIDRange != nil {
+		in, out := &in.RouterIDRange, &out.RouterIDRange
+		*out = new(RouterIDRange)
+		**out = **in
+	}
 	if in.DaemonsetPodAnnotations != nil {
 		in, out := &in.DaemonsetPodAnnotations, &out.DaemonsetPodAnnotations
 		*out = make(map[string]string, len(*in))
@@ -115,6 +469,72 @@ func (in *KeepalivedGroupSpec) DeepCopyInto(out *KeepalivedGroupSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.DaemonsetPodTolerations != nil {
+		in, out := &in.DaemonsetPodTolerations, &out.DaemonsetPodTolerations
+		*out = make([]corev1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.DaemonsetPodAffinity != nil {
+		in, out := &in.DaemonsetPodAffinity, &out.DaemonsetPodAffinity
+		*out = new(corev1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DaemonsetPodSecurityContext != nil {
+		in, out := &in.DaemonsetPodSecurityContext, &out.DaemonsetPodSecurityContext
+		*out = new(corev1.PodSecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DaemonsetImagePullSecrets != nil {
+		in, out := &in.DaemonsetImagePullSecrets, &out.DaemonsetImagePullSecrets
+		*out = make([]corev1.LocalObjectReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.DaemonsetContainers != nil {
+		in, out := &in.DaemonsetContainers, &out.DaemonsetContainers
+		*out = make([]ContainerOverride, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.AddressPool != nil {
+		in, out := &in.AddressPool, &out.AddressPool
+		*out = new(AddressPool)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NodePriorities != nil {
+		in, out := &in.NodePriorities, &out.NodePriorities
+		*out = make([]NodePriority, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Preemption != nil {
+		in, out := &in.Preemption, &out.Preemption
+		*out = new(Preemption)
+		**out = **in
+	}
+	if in.DrainNodes != nil {
+		in, out := &in.DrainNodes, &out.DrainNodes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NodeMaintenance != nil {
+		in, out := &in.NodeMaintenance, &out.NodeMaintenance
+		*out = new(NodeMaintenance)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ConfigRollout != nil {
+		in, out := &in.ConfigRollout, &out.ConfigRollout
+		*out = new(ConfigRollout)
+		**out = **in
+	}
+	if in.ConfigHistory != nil {
+		in, out := &in.ConfigHistory, &out.ConfigHistory
+		*out = new(ConfigHistory)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeepalivedGroupSpec.
@@ -144,6 +564,56 @@ func (in *KeepalivedGroupStatus) DeepCopyInto(out *KeepalivedGroupStatus) {
 			(*out)[key] = val
 		}
 	}
+	if in.VRRPInstances != nil {
+		in, out := &in.VRRPInstances, &out.VRRPInstances
+		*out = make([]VRRPInstanceStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RouterIDSpaces != nil {
+		in, out := &in.RouterIDSpaces, &out.RouterIDSpaces
+		*out = make([]RouterIDSpace, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.IPAllocations != nil {
+		in, out := &in.IPAllocations, &out.IPAllocations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.AppliedConfigs != nil {
+		in, out := &in.AppliedConfigs, &out.AppliedConfigs
+		*out = make([]AppliedConfigStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.DrainedNodes != nil {
+		in, out := &in.DrainedNodes, &out.DrainedNodes
+		*out = make([]DrainedNodeStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Images != nil {
+		in, out := &in.Images, &out.Images
+		*out = make([]ImageStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ConfigRollout != nil {
+		in, out := &in.ConfigRollout, &out.ConfigRollout
+		*out = new(ConfigRolloutStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ConfigHistory != nil {
+		in, out := &in.ConfigHistory, &out.ConfigHistory
+		*out = new(ConfigHistoryStatus)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeepalivedGroupStatus.
@@ -156,6 +626,48 @@ func (in *KeepalivedGroupStatus) DeepCopy() *KeepalivedGroupStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeMaintenance) DeepCopyInto(out *NodeMaintenance) {
+	*out = *in
+	if in.TaintKeys != nil {
+		in, out := &in.TaintKeys, &out.TaintKeys
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeMaintenance.
+func (in *NodeMaintenance) DeepCopy() *NodeMaintenance {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeMaintenance)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodePriority) DeepCopyInto(out *NodePriority) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodePriority.
+func (in *NodePriority) DeepCopy() *NodePriority {
+	if in == nil {
+		return nil
+	}
+	out := new(NodePriority)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PasswordAuth) DeepCopyInto(out *PasswordAuth) {
 	*out = *in
@@ -171,3 +683,232 @@ func (in *PasswordAuth) DeepCopy() *PasswordAuth {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Preemption) DeepCopyInto(out *Preemption) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Preemption.
+func (in *Preemption) DeepCopy() *Preemption {
+	if in == nil {
+		return nil
+	}
+	out := new(Preemption)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RouterIDRange) DeepCopyInto(out *RouterIDRange) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RouterIDRange.
+func (in *RouterIDRange) DeepCopy() *RouterIDRange {
+	if in == nil {
+		return nil
+	}
+	out := new(RouterIDRange)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RouterIDSpace) DeepCopyInto(out *RouterIDSpace) {
+	*out = *in
+	if in.RouterIDs != nil {
+		in, out := &in.RouterIDs, &out.RouterIDs
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RouterIDSpace.
+func (in *RouterIDSpace) DeepCopy() *RouterIDSpace {
+	if in == nil {
+		return nil
+	}
+	out := new(RouterIDSpace)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SMTPSettings) DeepCopyInto(out *SMTPSettings) {
+	*out = *in
+	if in.NotificationEmails != nil {
+		in, out := &in.NotificationEmails, &out.NotificationEmails
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SMTPSettings.
+func (in *SMTPSettings) DeepCopy() *SMTPSettings {
+	if in == nil {
+		return nil
+	}
+	out := new(SMTPSettings)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SidecarImages) DeepCopyInto(out *SidecarImages) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SidecarImages.
+func (in *SidecarImages) DeepCopy() *SidecarImages {
+	if in == nil {
+		return nil
+	}
+	out := new(SidecarImages)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TrackInterface) DeepCopyInto(out *TrackInterface) {
+	*out = *in
+	if in.Weight != nil {
+		in, out := &in.Weight, &out.Weight
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrackInterface.
+func (in *TrackInterface) DeepCopy() *TrackInterface {
+	if in == nil {
+		return nil
+	}
+	out := new(TrackInterface)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VRRPInstanceStatus) DeepCopyInto(out *VRRPInstanceStatus) {
+	*out = *in
+	if in.VIPs != nil {
+		in, out := &in.VIPs, &out.VIPs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Backup != nil {
+		in, out := &in.Backup, &out.Backup
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Fault != nil {
+		in, out := &in.Fault, &out.Fault
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SplitBrain != nil {
+		in, out := &in.SplitBrain, &out.SplitBrain
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VRRPInstanceStatus.
+func (in *VRRPInstanceStatus) DeepCopy() *VRRPInstanceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VRRPInstanceStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VRRPOptions) DeepCopyInto(out *VRRPOptions) {
+	*out = *in
+	if in.AdvertIntervalSeconds != nil {
+		in, out := &in.AdvertIntervalSeconds, &out.AdvertIntervalSeconds
+		*out = new(int)
+		**out = **in
+	}
+	if in.GarpMasterDelaySeconds != nil {
+		in, out := &in.GarpMasterDelaySeconds, &out.GarpMasterDelaySeconds
+		*out = new(int)
+		**out = **in
+	}
+	if in.GarpMasterRepeat != nil {
+		in, out := &in.GarpMasterRepeat, &out.GarpMasterRepeat
+		*out = new(int)
+		**out = **in
+	}
+	if in.GarpMasterRefreshSeconds != nil {
+		in, out := &in.GarpMasterRefreshSeconds, &out.GarpMasterRefreshSeconds
+		*out = new(int)
+		**out = **in
+	}
+	if in.GarpMasterRefreshRepeat != nil {
+		in, out := &in.GarpMasterRefreshRepeat, &out.GarpMasterRefreshRepeat
+		*out = new(int)
+		**out = **in
+	}
+	if in.DontTrackPrimary != nil {
+		in, out := &in.DontTrackPrimary, &out.DontTrackPrimary
+		*out = new(bool)
+		**out = **in
+	}
+	if in.SMTPAlert != nil {
+		in, out := &in.SMTPAlert, &out.SMTPAlert
+		*out = new(bool)
+		**out = **in
+	}
+	if in.TrackInterfaces != nil {
+		in, out := &in.TrackInterfaces, &out.TrackInterfaces
+		*out = make([]TrackInterface, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.VirtualRoutes != nil {
+		in, out := &in.VirtualRoutes, &out.VirtualRoutes
+		*out = make([]VirtualRoute, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VRRPOptions.
+func (in *VRRPOptions) DeepCopy() *VRRPOptions {
+	if in == nil {
+		return nil
+	}
+	out := new(VRRPOptions)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualRoute) DeepCopyInto(out *VirtualRoute) {
+	*out = *in
+	if in.Metric != nil {
+		in, out := &in.Metric, &out.Metric
+		*out = new(int)
+		**out = **in
+	}
+	if in.Table != nil {
+		in, out := &in.Table, &out.Table
+		*out = new(int64)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualRoute.
+func (in *VirtualRoute) DeepCopy() *VirtualRoute {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualRoute)
+	in.DeepCopyInto(out)
+	return out
+}
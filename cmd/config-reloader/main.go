@@ -0,0 +1,124 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// config-reloader runs as a sidecar of keepalived. It watches the keepalived configuration rendered by the operator in a ConfigMap,
+// sets the interface discovered on the node, validates the result with keepalived and makes keepalived reload it.
+// During a canary rollout, the pods listed in the ConfigMap load the configuration being rolled out instead of the stable one.
+// The hash of the configuration keepalived loaded is published in an annotation of its own pod, where the operator picks it up.
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var log = ctrl.Log.WithName("config-reloader")
+
+func main() {
+	r := &reloader{}
+	var reachIP string
+	var listenAddress string
+	var once bool
+	var retryInterval time.Duration
+	flag.StringVar(&r.srcFile, "src-file", "/etc/keepalived.d/src/keepalived.conf", "The keepalived configuration rendered by the operator.")
+	flag.StringVar(&r.nextSrcFile, "next-src-file", "/etc/keepalived.d/src/keepalived-next.conf", "The keepalived configuration being rolled out by the operator.")
+	flag.StringVar(&r.nextPodsFile, "next-pods-file", "/etc/keepalived.d/src/keepalived-next.pods", "The pods that load next-src-file instead of src-file, one per line.")
+	flag.StringVar(&r.dstFile, "dst-file", "/etc/keepalived.d/dst/keepalived.conf", "The keepalived configuration loaded by keepalived.")
+	flag.StringVar(&r.keepalivedDstFile, "keepalived-dst-file", "/etc/keepalived.d/keepalived.conf", "The path of dst-file in the keepalived container.")
+	flag.StringVar(&r.pidFile, "pid-file", "/etc/keepalived.pid/keepalived.pid", "The file keepalived writes its pid to.")
+	flag.StringVar(&r.keepalivedBinary, "keepalived-binary", "/usr/sbin/keepalived", "The path of the keepalived binary in the keepalived container.")
+	flag.StringVar(&r.defaultInterface, "default-interface", "", "The interface of the keepalived group, replaced by the discovered interface when reach-ip is set.")
+	flag.StringVar(&reachIP, "reach-ip", "", "When set, the interface used to reach this IP replaces the default interface.")
+	flag.DurationVar(&r.debounce, "debounce", 2*time.Second, "How long to wait for the configuration to settle before reloading.")
+	flag.DurationVar(&r.resync, "resync", time.Minute, "How often the configuration is checked, in case a change notification was missed.")
+	flag.StringVar(&listenAddress, "listen-address", ":9651", "The address the metrics and readiness endpoints bind to.")
+	flag.BoolVar(&once, "once", false, "Write the configuration once and exit, without waiting for keepalived.")
+	flag.DurationVar(&retryInterval, "retry-interval", 5*time.Second, "How long to wait before retrying to publish the configuration status after an error.")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	r.configID = os.Getenv("POD_NAME")
+	if reachIP != "" {
+		ip, err := netip.ParseAddr(reachIP)
+		if err != nil {
+			log.Error(err, "invalid reach-ip", "reach-ip", reachIP)
+			os.Exit(1)
+		}
+		r.reachIP = ip
+	}
+
+	if once {
+		if err := r.writeConfig(r.dstFile); err != nil {
+			log.Error(err, "unable to write the keepalived configuration")
+			os.Exit(1)
+		}
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if !r.isReady() {
+			http.Error(w, "the last keepalived configuration could not be applied", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	go func() {
+		if err := http.ListenAndServe(listenAddress, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error(err, "unable to serve metrics and readiness endpoints", "address", listenAddress)
+			os.Exit(1)
+		}
+	}()
+
+	ctx := ctrl.SetupSignalHandler()
+	podName, podNamespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE")
+	if podName != "" && podNamespace != "" {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			log.Error(err, "unable to load the in cluster configuration")
+			os.Exit(1)
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			log.Error(err, "unable to create the kubernetes client")
+			os.Exit(1)
+		}
+		r.status = newStatusPublisher(clientset, types.NamespacedName{Namespace: podNamespace, Name: podName}, retryInterval)
+		r.status.load(ctx)
+		go r.status.publish(ctx)
+	} else {
+		log.Info("POD_NAME or POD_NAMESPACE is not set, the configuration status is not published")
+	}
+
+	if err := r.run(ctx); err != nil {
+		log.Error(err, "unable to watch the keepalived configuration")
+		os.Exit(1)
+	}
+}
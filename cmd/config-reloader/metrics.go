@@ -0,0 +1,49 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var (
+	reloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keepalived_config_reloads_total",
+		Help: "Number of attempts to apply a new keepalived configuration, by result.",
+	}, []string{"result"})
+	configTestFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keepalived_config_test_failures_total",
+		Help: "Number of configurations rejected by keepalived --config-test.",
+	})
+	lastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "keepalived_config_last_reload_successful",
+		Help: "Whether the last attempt to apply a keepalived configuration succeeded.",
+	})
+	lastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "keepalived_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful keepalived configuration reload.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reloadsTotal, configTestFailuresTotal, lastReloadSuccessful, lastReloadSuccessTimestamp)
+}
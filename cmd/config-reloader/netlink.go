@@ -0,0 +1,119 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// interfaceToReach asks the kernel, with a netlink RTM_GETROUTE request, which interface the node uses to reach the IP
+func interfaceToReach(ip netip.Addr) (string, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(fd)
+	kernel := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return "", err
+	}
+	if err := syscall.Sendto(fd, newRouteRequest(ip), 0, kernel); err != nil {
+		return "", err
+	}
+
+	response := make([]byte, syscall.Getpagesize())
+	n, _, err := syscall.Recvfrom(fd, response, 0)
+	if err != nil {
+		return "", err
+	}
+	index, err := parseRouteResponse(response[:n])
+	if err != nil {
+		return "", fmt.Errorf("no route to %s: %w", ip, err)
+	}
+	iface, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return "", err
+	}
+	return iface.Name, nil
+}
+
+// newRouteRequest returns the RTM_GETROUTE message asking for the route to the IP
+func newRouteRequest(ip netip.Addr) []byte {
+	family := syscall.AF_INET
+	if ip.Is6() {
+		family = syscall.AF_INET6
+	}
+	addr := ip.AsSlice()
+	attrLen := syscall.SizeofRtAttr + len(addr)
+	request := make([]byte, syscall.SizeofNlMsghdr+syscall.SizeofRtMsg+rtaAlign(attrLen))
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&request[0])) = syscall.NlMsghdr{
+		Len:   uint32(len(request)),
+		Type:  syscall.RTM_GETROUTE,
+		Flags: syscall.NLM_F_REQUEST,
+		Seq:   1,
+	}
+	*(*syscall.RtMsg)(unsafe.Pointer(&request[syscall.SizeofNlMsghdr])) = syscall.RtMsg{
+		Family:  uint8(family),
+		Dst_len: uint8(len(addr) * 8),
+	}
+	offset := syscall.SizeofNlMsghdr + syscall.SizeofRtMsg
+	*(*syscall.RtAttr)(unsafe.Pointer(&request[offset])) = syscall.RtAttr{
+		Len:  uint16(attrLen),
+		Type: syscall.RTA_DST,
+	}
+	copy(request[offset+syscall.SizeofRtAttr:], addr)
+	return request
+}
+
+// parseRouteResponse returns the index of the output interface of the route the kernel answered with
+func parseRouteResponse(response []byte) (int, error) {
+	messages, err := syscall.ParseNetlinkMessage(response)
+	if err != nil {
+		return 0, err
+	}
+	for i := range messages {
+		message := &messages[i]
+		switch message.Header.Type {
+		case syscall.NLMSG_ERROR:
+			if len(message.Data) >= 4 {
+				if errno := *(*int32)(unsafe.Pointer(&message.Data[0])); errno != 0 {
+					return 0, syscall.Errno(-errno)
+				}
+			}
+		case syscall.RTM_NEWROUTE:
+			attrs, err := syscall.ParseNetlinkRouteAttr(message)
+			if err != nil {
+				return 0, err
+			}
+			for _, attr := range attrs {
+				if attr.Attr.Type == syscall.RTA_OIF && len(attr.Value) >= 4 {
+					return int(*(*uint32)(unsafe.Pointer(&attr.Value[0]))), nil
+				}
+			}
+		}
+	}
+	return 0, errors.New("the kernel returned no output interface")
+}
+
+func rtaAlign(length int) int {
+	return (length + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+}
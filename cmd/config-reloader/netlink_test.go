@@ -0,0 +1,168 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// netlinkMessage returns a netlink message with the payload
+func netlinkMessage(messageType uint16, payload []byte) []byte {
+	message := make([]byte, syscall.SizeofNlMsghdr+rtaAlign(len(payload)))
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&message[0])) = syscall.NlMsghdr{
+		Len:  uint32(syscall.SizeofNlMsghdr + len(payload)),
+		Type: messageType,
+		Seq:  1,
+	}
+	copy(message[syscall.SizeofNlMsghdr:], payload)
+	return message
+}
+
+// routeAttr returns a route attribute with the value
+func routeAttr(attrType uint16, value []byte) []byte {
+	attr := make([]byte, rtaAlign(syscall.SizeofRtAttr+len(value)))
+	*(*syscall.RtAttr)(unsafe.Pointer(&attr[0])) = syscall.RtAttr{Len: uint16(syscall.SizeofRtAttr + len(value)), Type: attrType}
+	copy(attr[syscall.SizeofRtAttr:], value)
+	return attr
+}
+
+func uint32Value(value uint32) []byte {
+	bytes := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&bytes[0])) = value
+	return bytes
+}
+
+// newRouteMessage returns a RTM_NEWROUTE message with the attributes
+func newRouteMessage(attrs ...[]byte) []byte {
+	payload := make([]byte, syscall.SizeofRtMsg)
+	*(*syscall.RtMsg)(unsafe.Pointer(&payload[0])) = syscall.RtMsg{Family: syscall.AF_INET, Dst_len: 32}
+	for _, attr := range attrs {
+		payload = append(payload, attr...)
+	}
+	return netlinkMessage(syscall.RTM_NEWROUTE, payload)
+}
+
+// errorMessage returns a NLMSG_ERROR message for the errno, followed by the header of the request as the kernel does
+func errorMessage(errno syscall.Errno) []byte {
+	payload := append(uint32Value(uint32(-int32(errno))), make([]byte, syscall.SizeofNlMsghdr)...)
+	return netlinkMessage(syscall.NLMSG_ERROR, payload)
+}
+
+func TestNewRouteRequest(t *testing.T) {
+	tests := []struct {
+		ip     string
+		family uint8
+	}{
+		{"192.168.1.10", syscall.AF_INET},
+		{"fd00::10", syscall.AF_INET6},
+	}
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			ip := netip.MustParseAddr(test.ip)
+			messages, err := syscall.ParseNetlinkMessage(newRouteRequest(ip))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 || messages[0].Header.Type != syscall.RTM_GETROUTE || messages[0].Header.Flags != syscall.NLM_F_REQUEST {
+				t.Fatalf("expected a single RTM_GETROUTE request, got %+v", messages)
+			}
+			rtmsg := (*syscall.RtMsg)(unsafe.Pointer(&messages[0].Data[0]))
+			if rtmsg.Family != test.family || int(rtmsg.Dst_len) != ip.BitLen() {
+				t.Errorf("unexpected route message %+v", rtmsg)
+			}
+			// a request has the same layout as a route message, the destination is its only attribute
+			messages[0].Header.Type = syscall.RTM_NEWROUTE
+			attrs, err := syscall.ParseNetlinkRouteAttr(&messages[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(attrs) != 1 || attrs[0].Attr.Type != syscall.RTA_DST {
+				t.Fatalf("expected the destination as only attribute, got %+v", attrs)
+			}
+			if dst, ok := netip.AddrFromSlice(attrs[0].Value); !ok || dst != ip {
+				t.Errorf("expected the destination %s, got %v", ip, attrs[0].Value)
+			}
+		})
+	}
+}
+
+func TestParseRouteResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		index    int
+		err      error
+	}{
+		{
+			name:     "output interface",
+			response: newRouteMessage(routeAttr(syscall.RTA_TABLE, uint32Value(254)), routeAttr(syscall.RTA_DST, []byte{192, 168, 1, 10}), routeAttr(syscall.RTA_OIF, uint32Value(3))),
+			index:    3,
+		},
+		{
+			name:     "output interface after an acknowledgment",
+			response: append(errorMessage(0), newRouteMessage(routeAttr(syscall.RTA_OIF, uint32Value(7)))...),
+			index:    7,
+		},
+		{
+			name:     "unreachable network",
+			response: errorMessage(syscall.ENETUNREACH),
+			err:      syscall.ENETUNREACH,
+		},
+		{
+			name:     "route without output interface",
+			response: newRouteMessage(routeAttr(syscall.RTA_DST, []byte{192, 168, 1, 10})),
+		},
+		{
+			name:     "truncated response",
+			response: newRouteMessage(routeAttr(syscall.RTA_OIF, uint32Value(3)))[:10],
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index, err := parseRouteResponse(test.response)
+			if test.index != 0 {
+				if err != nil || index != test.index {
+					t.Errorf("got index %d and error %v, want index %d", index, err, test.index)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error, got index %d", index)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestInterfaceToReachLoopback(t *testing.T) {
+	iface, err := interfaceToReach(netip.MustParseAddr("127.0.0.1"))
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EAFNOSUPPORT) {
+		t.Skipf("netlink is not available: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface != "lo" {
+		t.Errorf("expected the loopback interface to reach 127.0.0.1, got %s", iface)
+	}
+}
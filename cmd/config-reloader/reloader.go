@@ -0,0 +1,296 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var errConfigRejected = errors.New("keepalived rejected the configuration")
+
+type reloader struct {
+	srcFile           string
+	nextSrcFile       string
+	nextPodsFile      string
+	dstFile           string
+	keepalivedDstFile string
+	pidFile           string
+	keepalivedBinary  string
+	defaultInterface  string
+	reachIP           netip.Addr
+	configID          string
+	debounce          time.Duration
+	resync            time.Duration
+	// status publishes the outcome of the reloads, when not nil
+	status *statusPublisher
+
+	// applied is the configuration keepalived was last asked to load
+	applied []byte
+	// rejected is the last configuration keepalived refused, it is not tested again
+	rejected []byte
+	ready    bool
+	mutex    sync.Mutex
+}
+
+func (r *reloader) isReady() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.ready
+}
+
+func (r *reloader) setReady(ready bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.ready = ready
+	if ready {
+		lastReloadSuccessful.Set(1)
+	} else {
+		lastReloadSuccessful.Set(0)
+	}
+}
+
+// run reloads keepalived every time the source configuration changes, until the context is done
+func (r *reloader) run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// ConfigMap volumes are updated by swapping a symlink, so the directory is watched rather than the file
+	err = watcher.Add(filepath.Dir(r.srcFile))
+	if err != nil {
+		return err
+	}
+	r.reload()
+	resync := time.NewTicker(r.resync)
+	defer resync.Stop()
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			log.V(1).Info("configuration changed", "event", event.String())
+			debounce = time.After(r.debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			log.Error(err, "error watching the configuration", "file", r.srcFile)
+		case <-resync.C:
+			r.reload()
+		case <-debounce:
+			debounce = nil
+			r.reload()
+		}
+	}
+}
+
+// reload applies the source configuration, if it differs from the one last applied
+func (r *reloader) reload() {
+	source, err := r.readSource()
+	if err != nil {
+		r.failed(err)
+		return
+	}
+	config, err := r.renderConfig(source)
+	if err != nil {
+		r.failed(err)
+		return
+	}
+	if bytes.Equal(config, r.applied) {
+		if !r.isReady() {
+			// the source went back to the configuration keepalived runs, after a rollback
+			r.succeeded(source)
+		}
+		return
+	}
+	if bytes.Equal(config, r.rejected) {
+		return
+	}
+	err = r.apply(config)
+	if err != nil {
+		if errors.Is(err, errConfigRejected) {
+			r.rejected = config
+		}
+		r.failed(err)
+		return
+	}
+	r.applied = config
+	r.rejected = nil
+	reloadsTotal.WithLabelValues(resultSuccess).Inc()
+	lastReloadSuccessTimestamp.SetToCurrentTime()
+	r.succeeded(source)
+	log.Info("keepalived configuration reloaded")
+}
+
+func (r *reloader) succeeded(source []byte) {
+	r.setReady(true)
+	if r.status != nil {
+		// the operator compares this hash with the hash of the ConfigMap it rendered, before the interface is replaced
+		r.status.applied(fmt.Sprintf("%x", sha256.Sum256(source)))
+	}
+}
+
+// readSource reads the configuration this pod must load: the configuration being rolled out when the pod is listed in the next pods file,
+// the stable configuration otherwise
+func (r *reloader) readSource() ([]byte, error) {
+	if r.configID != "" && r.nextPodsFile != "" {
+		pods, err := os.ReadFile(r.nextPodsFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, pod := range strings.Split(string(pods), "\n") {
+			if strings.TrimSpace(pod) == r.configID {
+				return os.ReadFile(r.nextSrcFile)
+			}
+		}
+	}
+	return os.ReadFile(r.srcFile)
+}
+
+func (r *reloader) failed(err error) {
+	log.Error(err, "unable to apply the keepalived configuration")
+	reloadsTotal.WithLabelValues(resultFailure).Inc()
+	r.setReady(false)
+	if r.status != nil {
+		r.status.failed(err)
+	}
+}
+
+// renderConfig moves the instances of the default interface of the source configuration to the discovered interface
+func (r *reloader) renderConfig(config []byte) ([]byte, error) {
+	if !r.reachIP.IsValid() {
+		return config, nil
+	}
+	iface, err := interfaceToReach(r.reachIP)
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover the interface that reaches %s: %w", r.reachIP, err)
+	}
+	log.V(1).Info("discovered interface", "reach-ip", r.reachIP.String(), "interface", iface)
+	return replaceInterface(config, r.defaultInterface, iface), nil
+}
+
+// replaceInterface replaces the interface of the lines using the default interface, the lines using another interface are kept
+func replaceInterface(config []byte, defaultInterface string, iface string) []byte {
+	pattern := regexp.MustCompile(`(?m)^(\s*)interface\s+` + regexp.QuoteMeta(defaultInterface) + `\s*$`)
+	return pattern.ReplaceAll(config, []byte("${1}interface "+iface))
+}
+
+// writeConfig atomically replaces the file with the rendered configuration
+func (r *reloader) writeConfig(file string) error {
+	source, err := r.readSource()
+	if err != nil {
+		return err
+	}
+	config, err := r.renderConfig(source)
+	if err != nil {
+		return err
+	}
+	return writeFile(file, config)
+}
+
+func writeFile(file string, content []byte) error {
+	tmp := file + ".tmp"
+	err := os.WriteFile(tmp, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// apply validates the configuration with the keepalived binary of the running keepalived and makes keepalived reload it
+func (r *reloader) apply(config []byte) error {
+	pid, err := r.keepalivedPid()
+	if err != nil {
+		// keepalived loads the configuration when it starts
+		log.Info("keepalived is not running, writing the configuration without reloading", "reason", err.Error())
+		return writeFile(r.dstFile, config)
+	}
+	candidate := r.dstFile + ".candidate"
+	err = os.WriteFile(candidate, config, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(candidate)
+	err = r.configTest(pid, r.keepalivedDstFile+".candidate")
+	if err != nil {
+		configTestFailuresTotal.Inc()
+		return err
+	}
+	err = os.Rename(candidate, r.dstFile)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
+
+// keepalivedPid returns the pid of the keepalived process, the pod shares its process namespace
+func (r *reloader) keepalivedPid() (int, error) {
+	content, err := os.ReadFile(r.pidFile)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s: %w", r.pidFile, err)
+	}
+	err = syscall.Kill(pid, 0)
+	if err != nil {
+		return 0, fmt.Errorf("keepalived process %d is not running: %w", pid, err)
+	}
+	return pid, nil
+}
+
+// configTest runs keepalived --config-test in the root filesystem of the keepalived container
+func (r *reloader) configTest(pid int, file string) error {
+	args := []string{"--config-test", "--use-file=" + file}
+	if r.configID != "" {
+		args = append(args, "--config-id="+r.configID)
+	}
+	cmd := exec.Command(r.keepalivedBinary, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: fmt.Sprintf("/proc/%d/root", pid)}
+	cmd.Dir = "/"
+	output, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("%w: %v: %s", errConfigRejected, err, strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to run %s: %w", r.keepalivedBinary, err)
+	}
+	return nil
+}
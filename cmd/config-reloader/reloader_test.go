@@ -0,0 +1,264 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeKeepalived rejects the configurations containing the word invalid, and records the configurations it tests
+const fakeKeepalived = `#!/bin/sh
+for arg in "$@"; do
+  case "$arg" in
+    --use-file=*) file="${arg#--use-file=}" ;;
+  esac
+done
+cat "$file" >> "$(dirname "$0")/tested"
+if grep -q invalid "$file"; then
+  echo "Unknown keyword 'invalid'" >&2
+  exit 1
+fi
+`
+
+// newTestReloader returns a reloader whose keepalived is the test process, its configuration is tested by fakeKeepalived in the same root filesystem
+func newTestReloader(t *testing.T) *reloader {
+	t.Helper()
+	// the configuration is tested in the root filesystem of keepalived, entering it requires CAP_SYS_CHROOT
+	if os.Geteuid() != 0 {
+		t.Skip("testing configurations requires root")
+	}
+	dir := t.TempDir()
+	for _, sub := range []string{"src", "dst"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &reloader{
+		srcFile:          filepath.Join(dir, "src", "keepalived.conf"),
+		nextSrcFile:      filepath.Join(dir, "src", "keepalived-next.conf"),
+		nextPodsFile:     filepath.Join(dir, "src", "keepalived-next.pods"),
+		dstFile:          filepath.Join(dir, "dst", "keepalived.conf"),
+		pidFile:          filepath.Join(dir, "keepalived.pid"),
+		keepalivedBinary: filepath.Join(dir, "keepalived"),
+		configID:         "keepalived-abcde",
+	}
+	r.keepalivedDstFile = r.dstFile
+	if err := os.WriteFile(r.keepalivedBinary, []byte(fakeKeepalived), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(r.pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func writeTestFile(t *testing.T, file string, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, file string) string {
+	t.Helper()
+	content, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// expectReload checks whether keepalived was signaled to reload its configuration
+func expectReload(t *testing.T, hangups chan os.Signal, expected bool) {
+	t.Helper()
+	select {
+	case <-hangups:
+		if !expected {
+			t.Error("keepalived was asked to reload")
+		}
+	case <-time.After(100 * time.Millisecond):
+		if expected {
+			t.Error("keepalived was not asked to reload")
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	r := newTestReloader(t)
+	// the test process stands for keepalived, it receives the SIGHUP asking for a reload
+	hangups := make(chan os.Signal, 10)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	tested := filepath.Join(filepath.Dir(r.keepalivedBinary), "tested")
+
+	writeTestFile(t, r.srcFile, "vrrp_instance a {}\n")
+	r.reload()
+	if got := readTestFile(t, r.dstFile); got != "vrrp_instance a {}\n" || !r.isReady() {
+		t.Fatalf("expected the valid configuration to be applied, got %q, ready %t", got, r.isReady())
+	}
+	expectReload(t, hangups, true)
+	if _, err := os.Stat(r.dstFile + ".candidate"); !os.IsNotExist(err) {
+		t.Error("expected the candidate configuration to be removed")
+	}
+
+	// an unchanged configuration is neither tested nor reloaded
+	writeTestFile(t, tested, "")
+	r.reload()
+	expectReload(t, hangups, false)
+	if got := readTestFile(t, tested); got != "" {
+		t.Errorf("expected the applied configuration not to be tested again, got %q", got)
+	}
+
+	// a configuration keepalived rejects is not loaded, keepalived keeps running the previous one
+	writeTestFile(t, r.srcFile, "vrrp_instance a { invalid }\n")
+	r.reload()
+	if got := readTestFile(t, r.dstFile); got != "vrrp_instance a {}\n" {
+		t.Errorf("expected the previous configuration to be kept, got %q", got)
+	}
+	if r.isReady() {
+		t.Error("expected the reloader not to be ready after a rejected configuration")
+	}
+	expectReload(t, hangups, false)
+	if got := readTestFile(t, tested); got != "vrrp_instance a { invalid }\n" {
+		t.Errorf("expected the rejected configuration to be tested, got %q", got)
+	}
+
+	// the rejected configuration is not tested again
+	writeTestFile(t, tested, "")
+	r.reload()
+	if got := readTestFile(t, tested); got != "" {
+		t.Errorf("expected the rejected configuration not to be tested again, got %q", got)
+	}
+
+	// rolling back to the running configuration makes the reloader ready without a reload
+	writeTestFile(t, r.srcFile, "vrrp_instance a {}\n")
+	r.reload()
+	if !r.isReady() {
+		t.Error("expected the reloader to be ready once the source is the running configuration again")
+	}
+	expectReload(t, hangups, false)
+	if got := readTestFile(t, tested); got != "" {
+		t.Errorf("expected the running configuration not to be tested again, got %q", got)
+	}
+
+	// a new valid configuration is applied
+	writeTestFile(t, r.srcFile, "vrrp_instance b {}\n")
+	r.reload()
+	if got := readTestFile(t, r.dstFile); got != "vrrp_instance b {}\n" || !r.isReady() {
+		t.Errorf("expected the new configuration to be applied, got %q, ready %t", got, r.isReady())
+	}
+	expectReload(t, hangups, true)
+}
+
+func TestReloadWithoutKeepalived(t *testing.T) {
+	r := newTestReloader(t)
+	if err := os.Remove(r.pidFile); err != nil {
+		t.Fatal(err)
+	}
+	// keepalived loads the configuration when it starts, it cannot be tested before
+	writeTestFile(t, r.srcFile, "vrrp_instance a { invalid }\n")
+	r.reload()
+	if got := readTestFile(t, r.dstFile); got != "vrrp_instance a { invalid }\n" || !r.isReady() {
+		t.Errorf("expected the configuration to be written, got %q, ready %t", got, r.isReady())
+	}
+}
+
+func TestReloadTestFailure(t *testing.T) {
+	r := newTestReloader(t)
+	r.keepalivedBinary = filepath.Join(filepath.Dir(r.keepalivedBinary), "missing")
+	writeTestFile(t, r.srcFile, "vrrp_instance a {}\n")
+	r.reload()
+	if r.isReady() || r.rejected != nil {
+		t.Errorf("expected a failure that is not a rejection, ready %t, rejected %q", r.isReady(), r.rejected)
+	}
+	if got := readTestFile(t, r.dstFile); got != "" {
+		t.Errorf("expected no configuration to be written, got %q", got)
+	}
+}
+
+func TestReadSource(t *testing.T) {
+	dir := t.TempDir()
+	r := &reloader{
+		srcFile:      filepath.Join(dir, "keepalived.conf"),
+		nextSrcFile:  filepath.Join(dir, "keepalived-next.conf"),
+		nextPodsFile: filepath.Join(dir, "keepalived-next.pods"),
+		configID:     "keepalived-abcde",
+	}
+	writeTestFile(t, r.srcFile, "stable")
+	writeTestFile(t, r.nextSrcFile, "next")
+	tests := []struct {
+		name     string
+		pods     string
+		expected string
+	}{
+		{name: "no canary", expected: "stable"},
+		{name: "other canaries", pods: "keepalived-fghij\nkeepalived-klmno\n", expected: "stable"},
+		{name: "canary", pods: "keepalived-fghij\nkeepalived-abcde\n", expected: "next"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(r.nextPodsFile)
+			if test.pods != "" {
+				writeTestFile(t, r.nextPodsFile, test.pods)
+			}
+			source, err := r.readSource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(source) != test.expected {
+				t.Errorf("got %q, want %q", source, test.expected)
+			}
+		})
+	}
+}
+
+func TestReplaceInterface(t *testing.T) {
+	config := strings.Join([]string{
+		"vrrp_instance a {",
+		"    interface eth0",
+		"}",
+		"vrrp_instance b {",
+		"    interface eth1",
+		"}",
+		"vrrp_instance c {",
+		"    interface eth0 ",
+		"}",
+		"# interface eth0",
+	}, "\n")
+	expected := strings.Join([]string{
+		"vrrp_instance a {",
+		"    interface ens3",
+		"}",
+		"vrrp_instance b {",
+		"    interface eth1",
+		"}",
+		"vrrp_instance c {",
+		"    interface ens3",
+		"}",
+		"# interface eth0",
+	}, "\n")
+	if got := string(replaceInterface([]byte(config), "eth0", "ens3")); got != expected {
+		t.Errorf("got:\n%s\nwant:\n%s", got, expected)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const maxErrorLength = 1024
+
+// statusPublisher notifies the operator of the configuration loaded by keepalived through annotations of the keepalived pod
+type statusPublisher struct {
+	clientset     kubernetes.Interface
+	pod           types.NamespacedName
+	retryInterval time.Duration
+	// hash and error are the state to publish
+	hash    string
+	error   string
+	mutex   sync.Mutex
+	changes chan struct{}
+}
+
+func newStatusPublisher(clientset kubernetes.Interface, pod types.NamespacedName, retryInterval time.Duration) *statusPublisher {
+	return &statusPublisher{
+		clientset:     clientset,
+		pod:           pod,
+		retryInterval: retryInterval,
+		changes:       make(chan struct{}, 1),
+	}
+}
+
+// load restores the hash already published, so that a restart of the reloader does not lose the configuration keepalived runs
+func (p *statusPublisher) load(ctx context.Context) {
+	pod, err := p.clientset.CoreV1().Pods(p.pod.Namespace).Get(ctx, p.pod.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Error(err, "unable to read the published configuration status", "pod", p.pod)
+		return
+	}
+	p.mutex.Lock()
+	p.hash = pod.GetAnnotations()[redhatcopv1alpha1.ConfigHashAnnotation]
+	p.mutex.Unlock()
+}
+
+// applied notifies that keepalived loaded the configuration with the hash
+func (p *statusPublisher) applied(hash string) {
+	p.mutex.Lock()
+	p.hash = hash
+	p.error = ""
+	p.mutex.Unlock()
+	p.notify()
+}
+
+// failed notifies that the latest configuration could not be loaded, keepalived keeps the configuration last notified as applied
+func (p *statusPublisher) failed(err error) {
+	p.mutex.Lock()
+	p.error = err.Error()
+	// keepalived can be verbose, annotations are meant to stay small
+	if len(p.error) > maxErrorLength {
+		p.error = p.error[:maxErrorLength] + "..."
+	}
+	p.mutex.Unlock()
+	p.notify()
+}
+
+// notify wakes publish up, publish always sends the latest state
+func (p *statusPublisher) notify() {
+	select {
+	case p.changes <- struct{}{}:
+	default:
+	}
+}
+
+// publish patches the annotations of the pod, retrying until it succeeds
+func (p *statusPublisher) publish(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.changes:
+		}
+		for {
+			// a nil value removes the annotation
+			annotations := map[string]interface{}{
+				redhatcopv1alpha1.ConfigHashAnnotation:  nil,
+				redhatcopv1alpha1.ConfigErrorAnnotation: nil,
+			}
+			p.mutex.Lock()
+			if p.hash != "" {
+				annotations[redhatcopv1alpha1.ConfigHashAnnotation] = p.hash
+			}
+			if p.error != "" {
+				annotations[redhatcopv1alpha1.ConfigErrorAnnotation] = p.error
+			}
+			p.mutex.Unlock()
+			patch, err := json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": annotations,
+				},
+			})
+			if err == nil {
+				_, err = p.clientset.CoreV1().Pods(p.pod.Namespace).Patch(ctx, p.pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+			}
+			if err == nil {
+				break
+			}
+			log.Error(err, "unable to publish the configuration status", "pod", p.pod)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.retryInterval):
+			}
+		}
+	}
+}
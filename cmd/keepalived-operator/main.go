@@ -0,0 +1,58 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// keepalived-operator gathers the offline tools of the operator, which work on manifests instead of a cluster.
+// The render subcommand prints the objects and the keepalived configuration the operator produces for a KeepalivedGroup.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// subcommands are run with the arguments that follow their name
+var subcommands = map[string]func(args []string) error{
+	"render": runRender,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s <command> [flags]
+
+Commands:
+  render    render the objects and the keepalived configuration of a KeepalivedGroup from manifests
+
+Run %s <command> -h for the flags of a command.
+`, os.Args[0], os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	run, ok := subcommands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "-h" && os.Args[1] != "--help" && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		}
+		usage()
+		os.Exit(2)
+	}
+	if err := run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
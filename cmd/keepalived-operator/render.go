@@ -0,0 +1,267 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/keepalived-operator/controllers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	outputAll     = "all"
+	outputObjects = "objects"
+	outputConfig  = "config"
+)
+
+// blankInterfaceRegexp matches the interface lines the config-reloader completes with the interface it discovers on the node
+var blankInterfaceRegexp = regexp.MustCompile(`(?m)^(\s*)interface $`)
+
+// fileNames collects the values of a repeated flag
+type fileNames []string
+
+func (f *fileNames) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileNames) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runRender renders the objects of a KeepalivedGroup from manifests, with the same code as the operator
+func runRender(args []string) error {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	var files fileNames
+	var group, namespace, output, templateFileName, keepalivedBinary, testInterface string
+	var podMonitors, configTest bool
+	flags.Var(&files, "f", "A file with the manifests of the KeepalivedGroups, Services, keepalived Pods, Nodes, Secrets and KeepalivedAddressPools, - for the standard input. Can be repeated.")
+	flags.StringVar(&group, "group", "", "The <namespace>/<name> of the KeepalivedGroup to render, it can be omitted when the manifests contain a single KeepalivedGroup.")
+	flags.StringVar(&namespace, "namespace", "default", "The namespace of the namespaced manifests that do not set one.")
+	flags.StringVar(&output, "o", outputAll, "What to print: all, objects for the rendered objects as YAML, config for the keepalived configuration.")
+	flags.StringVar(&templateFileName, "template", "", "A custom template of the keepalived objects, as set with the KEEPALIVEDGROUP_TEMPLATE_FILE_NAME environment variable of the operator.")
+	flags.BoolVar(&podMonitors, "pod-monitors", false, "Render the PodMonitor, as on clusters with the prometheus operator.")
+	flags.BoolVar(&configTest, "config-test", false, "Check the keepalived configuration with keepalived --config-test.")
+	flags.StringVar(&keepalivedBinary, "keepalived-binary", "keepalived", "The keepalived binary used by -config-test.")
+	flags.StringVar(&testInterface, "test-interface", "lo", "The interface -config-test sets in place of the one the config-reloader discovers on the nodes, when the KeepalivedGroup sets interfaceFromIP.")
+	opts := zap.Options{}
+	opts.BindFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s render -f <file> [-f <file>...] [flags]\n\nFlags:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts), zap.WriteTo(os.Stderr)))
+	if len(files) == 0 {
+		return errors.New("at least one manifest file must be passed with -f")
+	}
+	if output != outputAll && output != outputObjects && output != outputConfig {
+		return fmt.Errorf("invalid output %q, it must be one of %s, %s or %s", output, outputAll, outputObjects, outputConfig)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return err
+	}
+	if err := redhatcopv1alpha1.AddToScheme(scheme); err != nil {
+		return err
+	}
+	objs := []client.Object{}
+	for _, fileName := range files {
+		fileObjs, err := readManifests(scheme, fileName, namespace)
+		if err != nil {
+			return err
+		}
+		objs = append(objs, fileObjs...)
+	}
+	groupName, err := getGroupName(objs, group)
+	if err != nil {
+		return err
+	}
+
+	// the manifests stand for the content of the cluster, in an in memory client
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	result, err := controllers.RenderKeepalivedGroup(context.TODO(), c, groupName, controllers.RenderOptions{
+		TemplateFileName:    templateFileName,
+		SupportsPodMonitors: podMonitors,
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range result.Events {
+		fmt.Fprintf(os.Stderr, "event: %s\n", event)
+	}
+	if output != outputConfig {
+		for _, obj := range result.Objects {
+			content, err := yaml.Marshal(obj.Object)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("---\n%s", content)
+		}
+	}
+	if output == outputAll {
+		fmt.Printf("# keepalived.conf\n")
+	}
+	if output != outputObjects {
+		fmt.Print(result.KeepalivedConfig)
+	}
+	if configTest {
+		return runConfigTest(keepalivedBinary, blankInterfaceRegexp.ReplaceAllString(result.KeepalivedConfig, "${1}interface "+testInterface))
+	}
+	return nil
+}
+
+// readManifests decodes the objects of a multi-document YAML or JSON file, the items of the lists are decoded as well
+func readManifests(scheme *runtime.Scheme, fileName string, namespace string) ([]client.Object, error) {
+	var reader io.Reader = os.Stdin
+	if fileName != "-" {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+	decoder := serializer.NewCodecFactory(scheme).UniversalDeserializer()
+	documents := utilyaml.NewYAMLReader(bufio.NewReader(reader))
+	objs := []client.Object{}
+	for {
+		document, err := documents.Read()
+		if errors.Is(err, io.EOF) {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", fileName, err)
+		}
+		if len(bytes.TrimSpace(document)) == 0 {
+			continue
+		}
+		decoded, err := decodeManifest(decoder, document, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode %s: %w", fileName, err)
+		}
+		objs = append(objs, decoded...)
+	}
+}
+
+func decodeManifest(decoder runtime.Decoder, document []byte, namespace string) ([]client.Object, error) {
+	decoded, _, err := decoder.Decode(document, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if list, ok := decoded.(*corev1.List); ok {
+		objs := []client.Object{}
+		for _, item := range list.Items {
+			itemObjs, err := decodeManifest(decoder, item.Raw, namespace)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, itemObjs...)
+		}
+		return objs, nil
+	}
+	obj, ok := decoded.(client.Object)
+	if !ok {
+		return nil, fmt.Errorf("unsupported object %s", decoded.GetObjectKind().GroupVersionKind())
+	}
+	switch obj.(type) {
+	case *redhatcopv1alpha1.KeepalivedGroup, *corev1.Service, *corev1.Pod, *corev1.Secret:
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(namespace)
+		}
+	}
+	// the manifests exported from a cluster carry a resource version, which the in memory client of the rendering must assign itself
+	obj.SetResourceVersion("")
+	return []client.Object{obj}, nil
+}
+
+// getGroupName returns the KeepalivedGroup to render, the passed one or the only one of the manifests
+func getGroupName(objs []client.Object, group string) (types.NamespacedName, error) {
+	if group != "" {
+		elements := strings.Split(group, "/")
+		if len(elements) != 2 {
+			return types.NamespacedName{}, fmt.Errorf("group %q must be <namespace>/<name>", group)
+		}
+		return types.NamespacedName{Namespace: elements[0], Name: elements[1]}, nil
+	}
+	groups := []types.NamespacedName{}
+	for _, obj := range objs {
+		if _, ok := obj.(*redhatcopv1alpha1.KeepalivedGroup); ok {
+			groups = append(groups, client.ObjectKeyFromObject(obj))
+		}
+	}
+	if len(groups) != 1 {
+		return types.NamespacedName{}, fmt.Errorf("the manifests contain %d KeepalivedGroups, the one to render must be passed with -group", len(groups))
+	}
+	return groups[0], nil
+}
+
+// runConfigTest checks the keepalived configuration with keepalived --config-test, the output of keepalived goes to the standard error
+func runConfigTest(keepalivedBinary string, config string) error {
+	file, err := os.CreateTemp("", "keepalived-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(config); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	cmd := exec.Command(keepalivedBinary, "--config-test", "--use-file="+file.Name())
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("keepalived --config-test rejected the configuration: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to run keepalived --config-test: %w", err)
+	}
+	return nil
+}
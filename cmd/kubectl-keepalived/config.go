@@ -0,0 +1,145 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/redhat-cop/keepalived-operator/pkg/keepalived"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	keepalivedGroupAnnotation = "keepalived-operator.redhat-cop.io/keepalivedgroup"
+	keepalivedConfigKey       = "keepalived.conf"
+	// keepalivedNextConfigKey holds the configuration being rolled out during a canary rollout
+	keepalivedNextConfigKey = "keepalived-next.conf"
+)
+
+// runConfig prints the sections of the keepalived configuration rendered for a service:
+// its vrrp instances, the vrrp scripts they track and the virtual servers of their VIPs
+func runConfig(args []string) error {
+	flags, options := newFlagSet("config", "<service> [flags]", false)
+	var next, full bool
+	flags.BoolVar(&next, "next", false, "Print the configuration being rolled out to the canary pods instead of the stable one.")
+	flags.BoolVar(&full, "full", false, "Print the whole configuration of the KeepalivedGroup of the service.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a service, found %d arguments", flags.NArg())
+	}
+	c, namespace, err := options.newClient()
+	if err != nil {
+		return err
+	}
+	serviceKey, err := parseKey(flags.Arg(0), namespace)
+	if err != nil {
+		return err
+	}
+	service := &corev1.Service{}
+	if err := c.Get(context.TODO(), serviceKey, service); err != nil {
+		return err
+	}
+	groupKey, err := getServiceGroup(service)
+	if err != nil {
+		return err
+	}
+	// the ConfigMap holding the configuration is named after the KeepalivedGroup
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(context.TODO(), groupKey, configMap); err != nil {
+		return fmt.Errorf("unable to get the configuration of KeepalivedGroup %s: %w", groupKey, err)
+	}
+	key := keepalivedConfigKey
+	if next {
+		key = keepalivedNextConfigKey
+	}
+	config, ok := configMap.Data[key]
+	if !ok {
+		if next {
+			return fmt.Errorf("no configuration is being rolled out for KeepalivedGroup %s", groupKey)
+		}
+		return fmt.Errorf("ConfigMap %s has no %s key", groupKey, key)
+	}
+	if full {
+		fmt.Print(config)
+		return nil
+	}
+	sections := getServiceSections(keepalived.Sections(config), serviceKey.String())
+	if len(sections) == 0 {
+		return fmt.Errorf("the configuration of KeepalivedGroup %s has no vrrp_instance for service %s", groupKey, serviceKey)
+	}
+	for i, section := range sections {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Print(section.Text)
+	}
+	return nil
+}
+
+// getServiceGroup returns the KeepalivedGroup referenced by the annotation of the service
+func getServiceGroup(service *corev1.Service) (types.NamespacedName, error) {
+	value, ok := service.GetAnnotations()[keepalivedGroupAnnotation]
+	if !ok {
+		return types.NamespacedName{}, fmt.Errorf("service %s has no %s annotation", client.ObjectKeyFromObject(service), keepalivedGroupAnnotation)
+	}
+	elements := strings.Split(value, "/")
+	if len(elements) != 2 {
+		return types.NamespacedName{}, fmt.Errorf("annotation %s of service %s must be <namespace>/<name>, found %q", keepalivedGroupAnnotation, client.ObjectKeyFromObject(service), value)
+	}
+	return types.NamespacedName{Namespace: elements[0], Name: elements[1]}, nil
+}
+
+// getServiceSections returns the vrrp instances of the service, followed by the vrrp scripts they track and the virtual servers of their VIPs
+func getServiceSections(sections []keepalived.Section, service string) []keepalived.Section {
+	instances := []keepalived.Section{}
+	scripts := map[string]bool{}
+	vips := map[string]bool{}
+	for _, section := range sections {
+		if section.Keyword != "vrrp_instance" || (section.Name() != service && !strings.HasPrefix(section.Name(), service+"/")) {
+			continue
+		}
+		instances = append(instances, section)
+		for _, script := range section.Values("track_script") {
+			scripts[script] = true
+		}
+		for _, vip := range section.Values("virtual_ipaddress") {
+			vips[strings.SplitN(vip, "/", 2)[0]] = true
+		}
+	}
+	if len(instances) == 0 {
+		return nil
+	}
+	result := []keepalived.Section{}
+	for _, section := range sections {
+		if section.Keyword == "vrrp_script" && scripts[section.Name()] {
+			result = append(result, section)
+		}
+	}
+	result = append(result, instances...)
+	for _, section := range sections {
+		if section.Keyword == "virtual_server" && vips[section.Name()] {
+			result = append(result, section)
+		}
+	}
+	return result
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/redhat-cop/keepalived-operator/pkg/keepalived"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const testConfig = `global_defs {
+    router_id group
+}
+
+vrrp_script chk_a {
+    script "/usr/bin/true"
+}
+
+vrrp_script chk_b {
+    script "/usr/bin/true"
+}
+
+vrrp_instance ns/svc {
+    interface eth0
+    virtual_router_id 1
+    track_script {
+        chk_a
+    }
+    virtual_ipaddress {
+        10.0.0.1/32
+    }
+}
+
+vrrp_instance ns/svc/ipv6 {
+    interface eth0
+    virtual_router_id 1
+    virtual_ipaddress {
+        fd00::1
+    }
+}
+
+vrrp_instance ns/svc2 {
+    interface eth0
+    virtual_router_id 2
+    track_script {
+        chk_b
+    }
+    virtual_ipaddress {
+        10.0.0.2
+    }
+}
+
+virtual_server 10.0.0.1 80 {
+    real_server 192.168.1.1 80 {
+    }
+}
+
+virtual_server 10.0.0.2 80 {
+    real_server 192.168.1.2 80 {
+    }
+}
+`
+
+// sectionNames returns the keyword and the name of each section
+func sectionNames(sections []keepalived.Section) []string {
+	names := []string{}
+	for _, section := range sections {
+		names = append(names, section.Keyword+" "+section.Name())
+	}
+	return names
+}
+
+func TestGetServiceSections(t *testing.T) {
+	tests := []struct {
+		service  string
+		expected []string
+	}{
+		{
+			service:  "ns/svc",
+			expected: []string{"vrrp_script chk_a", "vrrp_instance ns/svc", "vrrp_instance ns/svc/ipv6", "virtual_server 10.0.0.1"},
+		},
+		{
+			service:  "ns/svc2",
+			expected: []string{"vrrp_script chk_b", "vrrp_instance ns/svc2", "virtual_server 10.0.0.2"},
+		},
+		{
+			service:  "ns/other",
+			expected: []string{},
+		},
+	}
+	sections := keepalived.Sections(testConfig)
+	for _, test := range tests {
+		t.Run(test.service, func(t *testing.T) {
+			if got := sectionNames(getServiceSections(sections, test.service)); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("got %v, want %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetServiceGroup(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		group       types.NamespacedName
+		ok          bool
+	}{
+		{name: "reference", annotations: map[string]string{keepalivedGroupAnnotation: "keepalived-operator/group"}, group: types.NamespacedName{Namespace: "keepalived-operator", Name: "group"}, ok: true},
+		{name: "no annotation"},
+		{name: "no namespace", annotations: map[string]string{keepalivedGroupAnnotation: "group"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "svc", Annotations: test.annotations}}
+			group, err := getServiceGroup(service)
+			if (err == nil) != test.ok || group != test.group {
+				t.Errorf("got %v and error %v, want %v", group, err, test.group)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	keepalivedNodePrioritiesAnnotation = "keepalived-operator.redhat-cop.io/node-priorities"
+	keepalivedNoPreemptAnnotation      = "keepalived-operator.redhat-cop.io/nopreempt"
+	// failoverPriority is the highest VRRP priority a node can be given, the node takes over the VIPs from any other
+	failoverPriority = 254
+)
+
+// pollInterval is how often the state of the vrrp instances is checked while waiting for a failover
+var pollInterval = 2 * time.Second
+
+// failoverOptions are the flags of the failover command
+type failoverOptions struct {
+	node    string
+	reset   bool
+	preempt bool
+	timeout time.Duration
+}
+
+// runFailover moves the VIPs of a service to a node by giving the node the highest priority in the node-priorities annotation of the service.
+// The priorities replace the ones of the KeepalivedGroup and the spreading of the VIPs for the service, until they are reset
+func runFailover(args []string) error {
+	flags, options := newFlagSet("failover", "<service> (--to <node> | --reset) [flags]", false)
+	settings := failoverOptions{}
+	flags.StringVar(&settings.node, "to", "", "The node to move the VIPs of the service to, it must run a keepalived pod of the KeepalivedGroup of the service.")
+	flags.BoolVar(&settings.reset, "reset", false, "Remove the node-priorities annotation of the service, it gets the priorities of its KeepalivedGroup again.")
+	flags.BoolVar(&settings.preempt, "preempt", false, "Also set the nopreempt annotation of the service to false when the service does not preempt, the VIPs would not move otherwise.")
+	flags.DurationVar(&settings.timeout, "wait", 0, "How long to wait for the node to report the MASTER state for all the vrrp instances of the service, 0 to return right away.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a service, found %d arguments", flags.NArg())
+	}
+	if (settings.node == "") == !settings.reset {
+		return errors.New("either --to or --reset must be passed")
+	}
+	c, namespace, err := options.newClient()
+	if err != nil {
+		return err
+	}
+	serviceKey, err := parseKey(flags.Arg(0), namespace)
+	if err != nil {
+		return err
+	}
+	return failover(context.TODO(), c, serviceKey, settings)
+}
+
+// failover sets or removes the node-priorities annotation of the service, as selected by the options
+func failover(ctx context.Context, c client.Client, serviceKey types.NamespacedName, options failoverOptions) error {
+	node := options.node
+	service := &corev1.Service{}
+	if err := c.Get(ctx, serviceKey, service); err != nil {
+		return err
+	}
+	groupKey, err := getServiceGroup(service)
+	if err != nil {
+		return err
+	}
+	group := &redhatcopv1alpha1.KeepalivedGroup{}
+	if err := c.Get(ctx, groupKey, group); err != nil {
+		return err
+	}
+	previous, hadPriorities := service.GetAnnotations()[keepalivedNodePrioritiesAnnotation]
+	if hadPriorities {
+		fmt.Fprintf(os.Stderr, "previous %s annotation of service %s: %s\n", keepalivedNodePrioritiesAnnotation, serviceKey, previous)
+	}
+
+	patch := client.MergeFromWithOptions(service.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	if options.reset {
+		if !hadPriorities {
+			fmt.Printf("service %s has no %s annotation, nothing to reset\n", serviceKey, keepalivedNodePrioritiesAnnotation)
+			return nil
+		}
+		delete(service.Annotations, keepalivedNodePrioritiesAnnotation)
+		if err := c.Patch(ctx, service, patch); err != nil {
+			return err
+		}
+		fmt.Printf("service %s gets the node priorities of KeepalivedGroup %s again\n", serviceKey, groupKey)
+		if _, ok := service.GetAnnotations()[keepalivedNoPreemptAnnotation]; ok {
+			fmt.Fprintf(os.Stderr, "the %s annotation of service %s is left as is\n", keepalivedNoPreemptAnnotation, serviceKey)
+		}
+		return nil
+	}
+
+	if err := checkFailoverNode(ctx, c, group, node); err != nil {
+		return err
+	}
+	if noPreempt(group, service) {
+		if !options.preempt {
+			return fmt.Errorf("service %s does not preempt, the current MASTER would keep the VIPs: pass --preempt to also set its %s annotation to false", serviceKey, keepalivedNoPreemptAnnotation)
+		}
+		service.Annotations[keepalivedNoPreemptAnnotation] = "false"
+	}
+	priorities, err := json.Marshal([]redhatcopv1alpha1.NodePriority{{NodeName: node, Priority: failoverPriority}})
+	if err != nil {
+		return err
+	}
+	service.Annotations[keepalivedNodePrioritiesAnnotation] = string(priorities)
+	if err := c.Patch(ctx, service, patch); err != nil {
+		return err
+	}
+	fmt.Printf("service %s fails over to node %s once its keepalived pod loads the new configuration, run kubectl keepalived failover %s --reset to undo\n", serviceKey, node, serviceKey)
+	if options.timeout == 0 {
+		return nil
+	}
+	return waitForMaster(ctx, c, groupKey, serviceKey.String(), node, options.timeout)
+}
+
+// runDrain adds a node to the DrainNodes of a KeepalivedGroup, the operator moves all the VIPs away from it
+func runDrain(args []string) error {
+	return setDrained(args, "drain", true)
+}
+
+// runUndrain removes a node from the DrainNodes of a KeepalivedGroup
+func runUndrain(args []string) error {
+	return setDrained(args, "undrain", false)
+}
+
+func setDrained(args []string, name string, drain bool) error {
+	flags, options := newFlagSet(name, "<group> <node> [flags]", false)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("expected a KeepalivedGroup and a node, found %d arguments", flags.NArg())
+	}
+	c, namespace, err := options.newClient()
+	if err != nil {
+		return err
+	}
+	groupKey, err := parseKey(flags.Arg(0), namespace)
+	if err != nil {
+		return err
+	}
+	return setNodeDrained(context.TODO(), c, groupKey, flags.Arg(1), drain)
+}
+
+// setNodeDrained adds the node to the DrainNodes of the KeepalivedGroup, or removes it, nothing is patched when it is already the case
+func setNodeDrained(ctx context.Context, c client.Client, groupKey types.NamespacedName, node string, drain bool) error {
+	name := "undrain"
+	if drain {
+		name = "drain"
+	}
+	group := &redhatcopv1alpha1.KeepalivedGroup{}
+	if err := c.Get(ctx, groupKey, group); err != nil {
+		return err
+	}
+	patch := client.MergeFromWithOptions(group.DeepCopy(), client.MergeFromWithOptimisticLock{})
+	drainNodes := []string{}
+	for _, drainNode := range group.Spec.DrainNodes {
+		if drainNode != node {
+			drainNodes = append(drainNodes, drainNode)
+		}
+	}
+	if drain {
+		drainNodes = append(drainNodes, node)
+	}
+	if len(drainNodes) == len(group.Spec.DrainNodes) {
+		fmt.Printf("node %s is already %sed in KeepalivedGroup %s\n", node, name, groupKey)
+		if !drain {
+			for _, drained := range group.Status.DrainedNodes {
+				if drained.Node == node {
+					fmt.Fprintf(os.Stderr, "node %s is still drained by the operator: %s %s\n", node, drained.Reason, drained.Message)
+				}
+			}
+		}
+		return nil
+	}
+	group.Spec.DrainNodes = drainNodes
+	if err := c.Patch(ctx, group, patch); err != nil {
+		return err
+	}
+	if drain {
+		fmt.Printf("node %s is drained in KeepalivedGroup %s, check that it holds no VIP anymore with kubectl keepalived groups -n %s\n", node, groupKey, groupKey.Namespace)
+		return nil
+	}
+	fmt.Printf("node %s is undrained in KeepalivedGroup %s\n", node, groupKey)
+	return nil
+}
+
+// checkFailoverNode checks that the node runs a keepalived pod of the KeepalivedGroup and is not drained, the VIPs could not move to it otherwise
+func checkFailoverNode(ctx context.Context, c client.Client, group *redhatcopv1alpha1.KeepalivedGroup, node string) error {
+	for _, drained := range group.Status.DrainedNodes {
+		if drained.Node == node {
+			return fmt.Errorf("node %s is drained in KeepalivedGroup %s: %s", node, client.ObjectKeyFromObject(group), drained.Reason)
+		}
+	}
+	pods, err := listKeepalivedPods(ctx, c, group)
+	if err != nil {
+		return err
+	}
+	nodes := []string{}
+	for i := range pods {
+		if pods[i].Spec.NodeName == node {
+			return nil
+		}
+		nodes = append(nodes, pods[i].Spec.NodeName)
+	}
+	return fmt.Errorf("node %s runs no keepalived pod of KeepalivedGroup %s, the nodes are: %s", node, client.ObjectKeyFromObject(group), orNone(strings.Join(nodes, ",")))
+}
+
+// noPreempt returns whether the MASTER of the service keeps the VIPs when a node with a higher priority is available,
+// the annotation of the service overrides the KeepalivedGroup
+func noPreempt(group *redhatcopv1alpha1.KeepalivedGroup, service *corev1.Service) bool {
+	if value, ok := service.GetAnnotations()[keepalivedNoPreemptAnnotation]; ok {
+		return value == "true"
+	}
+	return group.Spec.Preemption != nil && group.Spec.Preemption.NoPreempt
+}
+
+// waitForMaster waits until the node reports the MASTER state for all the vrrp instances of the service in the status of the KeepalivedGroup
+func waitForMaster(ctx context.Context, c client.Client, groupKey types.NamespacedName, service string, node string, timeout time.Duration) error {
+	err := wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		group := &redhatcopv1alpha1.KeepalivedGroup{}
+		if err := c.Get(ctx, groupKey, group); err != nil {
+			return false, err
+		}
+		found := false
+		for _, status := range group.Status.VRRPInstances {
+			if status.Service != service {
+				continue
+			}
+			found = true
+			if status.Master != node || len(status.SplitBrain) > 0 {
+				return false, nil
+			}
+		}
+		return found, nil
+	})
+	if errors.Is(err, wait.ErrWaitTimeout) {
+		return fmt.Errorf("node %s is not the MASTER of all the vrrp instances of service %s after %s, check kubectl keepalived services %s", node, service, timeout, service)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("node %s is the MASTER of all the vrrp instances of service %s\n", node, service)
+	return nil
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var (
+	testGroupKey   = types.NamespacedName{Namespace: "keepalived-operator", Name: "group"}
+	testServiceKey = types.NamespacedName{Namespace: "ns", Name: "svc"}
+)
+
+func newTestClient(t *testing.T, objs ...client.Object) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := redhatcopv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+func newTestGroup() *redhatcopv1alpha1.KeepalivedGroup {
+	return &redhatcopv1alpha1.KeepalivedGroup{ObjectMeta: metav1.ObjectMeta{Namespace: testGroupKey.Namespace, Name: testGroupKey.Name}}
+}
+
+func newTestService(annotations map[string]string) *corev1.Service {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   testServiceKey.Namespace,
+		Name:        testServiceKey.Name,
+		Annotations: map[string]string{keepalivedGroupAnnotation: testGroupKey.String()},
+	}}
+	for key, value := range annotations {
+		service.Annotations[key] = value
+	}
+	return service
+}
+
+// newTestPods returns the keepalived pods of the test group on the nodes
+func newTestPods(nodes ...string) []client.Object {
+	pods := []client.Object{}
+	for _, node := range nodes {
+		pods = append(pods, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: testGroupKey.Namespace, Name: "group-" + node, Labels: map[string]string{keepalivedGroupLabel: testGroupKey.Name}},
+			Spec:       corev1.PodSpec{NodeName: node},
+		})
+	}
+	return pods
+}
+
+func getTestService(t *testing.T, c client.Client) *corev1.Service {
+	t.Helper()
+	service := &corev1.Service{}
+	if err := c.Get(context.TODO(), testServiceKey, service); err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func getTestGroup(t *testing.T, c client.Client) *redhatcopv1alpha1.KeepalivedGroup {
+	t.Helper()
+	group := &redhatcopv1alpha1.KeepalivedGroup{}
+	if err := c.Get(context.TODO(), testGroupKey, group); err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+func TestFailover(t *testing.T) {
+	drained := newTestGroup()
+	drained.Status.DrainedNodes = []redhatcopv1alpha1.DrainedNodeStatus{{Node: "node-b", Reason: "Drained"}}
+	noPreemptGroup := newTestGroup()
+	noPreemptGroup.Spec.Preemption = &redhatcopv1alpha1.Preemption{NoPreempt: true}
+	tests := []struct {
+		name        string
+		group       *redhatcopv1alpha1.KeepalivedGroup
+		service     *corev1.Service
+		options     failoverOptions
+		annotations map[string]string
+		problem     string
+	}{
+		{
+			name:    "gives the node the highest priority",
+			group:   newTestGroup(),
+			service: newTestService(nil),
+			options: failoverOptions{node: "node-b"},
+			annotations: map[string]string{
+				keepalivedGroupAnnotation:          testGroupKey.String(),
+				keepalivedNodePrioritiesAnnotation: `[{"nodeName":"node-b","priority":254}]`,
+			},
+		},
+		{
+			name:    "replaces the previous priorities",
+			group:   newTestGroup(),
+			service: newTestService(map[string]string{keepalivedNodePrioritiesAnnotation: `[{"nodeName":"node-a","priority":254}]`}),
+			options: failoverOptions{node: "node-b"},
+			annotations: map[string]string{
+				keepalivedGroupAnnotation:          testGroupKey.String(),
+				keepalivedNodePrioritiesAnnotation: `[{"nodeName":"node-b","priority":254}]`,
+			},
+		},
+		{
+			name:    "rejects a node without keepalived pod",
+			group:   newTestGroup(),
+			service: newTestService(nil),
+			options: failoverOptions{node: "node-c"},
+			problem: "node node-c runs no keepalived pod of KeepalivedGroup keepalived-operator/group, the nodes are: node-a,node-b",
+		},
+		{
+			name:    "rejects a drained node",
+			group:   drained,
+			service: newTestService(nil),
+			options: failoverOptions{node: "node-b"},
+			problem: "node node-b is drained in KeepalivedGroup keepalived-operator/group",
+		},
+		{
+			name:    "rejects a service that does not preempt",
+			group:   newTestGroup(),
+			service: newTestService(map[string]string{keepalivedNoPreemptAnnotation: "true"}),
+			options: failoverOptions{node: "node-b"},
+			problem: "does not preempt",
+		},
+		{
+			name:    "rejects a service of a group that does not preempt",
+			group:   noPreemptGroup,
+			service: newTestService(nil),
+			options: failoverOptions{node: "node-b"},
+			problem: "does not preempt",
+		},
+		{
+			name:    "makes a service that does not preempt preempt",
+			group:   noPreemptGroup,
+			service: newTestService(nil),
+			options: failoverOptions{node: "node-b", preempt: true},
+			annotations: map[string]string{
+				keepalivedGroupAnnotation:          testGroupKey.String(),
+				keepalivedNodePrioritiesAnnotation: `[{"nodeName":"node-b","priority":254}]`,
+				keepalivedNoPreemptAnnotation:      "false",
+			},
+		},
+		{
+			name:    "removes the priorities",
+			group:   newTestGroup(),
+			service: newTestService(map[string]string{keepalivedNodePrioritiesAnnotation: `[{"nodeName":"node-b","priority":254}]`, keepalivedNoPreemptAnnotation: "false"}),
+			options: failoverOptions{reset: true},
+			annotations: map[string]string{
+				keepalivedGroupAnnotation:     testGroupKey.String(),
+				keepalivedNoPreemptAnnotation: "false",
+			},
+		},
+		{
+			name:        "resets a service without priorities",
+			group:       newTestGroup(),
+			service:     newTestService(nil),
+			options:     failoverOptions{reset: true},
+			annotations: map[string]string{keepalivedGroupAnnotation: testGroupKey.String()},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestClient(t, append(newTestPods("node-a", "node-b"), test.group, test.service)...)
+			resourceVersion := getTestService(t, c).ResourceVersion
+			err := failover(context.TODO(), c, testServiceKey, test.options)
+			service := getTestService(t, c)
+			if test.problem != "" {
+				if err == nil || !strings.Contains(err.Error(), test.problem) {
+					t.Errorf("expected an error containing %q, got %v", test.problem, err)
+				}
+				if service.ResourceVersion != resourceVersion {
+					t.Error("expected the service not to be updated")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(service.Annotations, test.annotations) {
+				t.Errorf("got annotations %v, want %v", service.Annotations, test.annotations)
+			}
+			if reflect.DeepEqual(test.service.Annotations, test.annotations) && service.ResourceVersion != resourceVersion {
+				t.Error("expected an unchanged service not to be updated")
+			}
+		})
+	}
+}
+
+func TestSetNodeDrained(t *testing.T) {
+	group := newTestGroup()
+	group.Spec.DrainNodes = []string{"node-a"}
+	c := newTestClient(t, group)
+	steps := []struct {
+		node     string
+		drain    bool
+		expected []string
+		patched  bool
+	}{
+		{node: "node-b", drain: true, expected: []string{"node-a", "node-b"}, patched: true},
+		{node: "node-b", drain: true, expected: []string{"node-a", "node-b"}},
+		{node: "node-a", drain: false, expected: []string{"node-b"}, patched: true},
+		{node: "node-a", drain: false, expected: []string{"node-b"}},
+		{node: "node-b", drain: false, expected: []string{}, patched: true},
+	}
+	for _, step := range steps {
+		resourceVersion := getTestGroup(t, c).ResourceVersion
+		if err := setNodeDrained(context.TODO(), c, testGroupKey, step.node, step.drain); err != nil {
+			t.Fatal(err)
+		}
+		group := getTestGroup(t, c)
+		drainNodes := group.Spec.DrainNodes
+		if drainNodes == nil {
+			drainNodes = []string{}
+		}
+		if !reflect.DeepEqual(drainNodes, step.expected) {
+			t.Errorf("drain %t of %s: got drain nodes %v, want %v", step.drain, step.node, drainNodes, step.expected)
+		}
+		if patched := group.ResourceVersion != resourceVersion; patched != step.patched {
+			t.Errorf("drain %t of %s: got patched %t, want %t", step.drain, step.node, patched, step.patched)
+		}
+	}
+	if err := setNodeDrained(context.TODO(), c, types.NamespacedName{Namespace: "keepalived-operator", Name: "missing"}, "node-a", true); err == nil {
+		t.Error("expected an error for a missing KeepalivedGroup")
+	}
+}
+
+func TestWaitForMaster(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+	tests := []struct {
+		name      string
+		instances []redhatcopv1alpha1.VRRPInstanceStatus
+		ok        bool
+	}{
+		{
+			name: "master of all the instances",
+			instances: []redhatcopv1alpha1.VRRPInstanceStatus{
+				{Name: "ns/svc", Service: "ns/svc", Master: "node-b"},
+				{Name: "ns/svc/ipv6", Service: "ns/svc", Master: "node-b"},
+				{Name: "ns/other", Service: "ns/other", Master: "node-a"},
+			},
+			ok: true,
+		},
+		{
+			name: "backup of an instance",
+			instances: []redhatcopv1alpha1.VRRPInstanceStatus{
+				{Name: "ns/svc", Service: "ns/svc", Master: "node-b"},
+				{Name: "ns/svc/ipv6", Service: "ns/svc", Master: "node-a"},
+			},
+		},
+		{
+			name:      "split brain",
+			instances: []redhatcopv1alpha1.VRRPInstanceStatus{{Name: "ns/svc", Service: "ns/svc", Master: "node-b", SplitBrain: []string{"node-b", "node-a"}}},
+		},
+		{
+			name:      "no instance",
+			instances: []redhatcopv1alpha1.VRRPInstanceStatus{{Name: "ns/other", Service: "ns/other", Master: "node-b"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			group := newTestGroup()
+			group.Status.VRRPInstances = test.instances
+			c := newTestClient(t, group)
+			err := waitForMaster(context.TODO(), c, testGroupKey, testServiceKey.String(), "node-b", 50*time.Millisecond)
+			if test.ok && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if !test.ok && (err == nil || !strings.Contains(err.Error(), "is not the MASTER")) {
+				t.Errorf("expected a timeout, got %v", err)
+			}
+		})
+	}
+
+	t.Run("failover in progress", func(t *testing.T) {
+		group := newTestGroup()
+		group.Status.VRRPInstances = []redhatcopv1alpha1.VRRPInstanceStatus{{Name: "ns/svc", Service: "ns/svc", Master: "node-a"}}
+		c := newTestClient(t, group)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			group := &redhatcopv1alpha1.KeepalivedGroup{}
+			if err := c.Get(context.TODO(), testGroupKey, group); err != nil {
+				return
+			}
+			group.Status.VRRPInstances[0].Master = "node-b"
+			_ = c.Update(context.TODO(), group)
+		}()
+		if err := waitForMaster(context.TODO(), c, testGroupKey, testServiceKey.String(), "node-b", 5*time.Second); err != nil {
+			t.Errorf("expected the failover to be noticed, got %v", err)
+		}
+	})
+}
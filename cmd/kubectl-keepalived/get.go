@@ -0,0 +1,363 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// keepalivedGroupLabel selects the keepalived pods of a KeepalivedGroup
+	keepalivedGroupLabel = "keepalivedGroup"
+	none                 = "<none>"
+)
+
+// problemConditions are the conditions of a KeepalivedGroup reported by the groups command, with the status that needs attention
+var problemConditions = []metav1.Condition{
+	{Type: "Degraded", Status: metav1.ConditionTrue},
+	{Type: "RouterIDConflict", Status: metav1.ConditionTrue},
+	{Type: "RouterIDsNearExhaustion", Status: metav1.ConditionTrue},
+	{Type: "ConfigApplied", Status: metav1.ConditionFalse},
+	{Type: "ConfigReverted", Status: metav1.ConditionTrue},
+	{Type: "KeepalivedVIPAssigned", Status: metav1.ConditionFalse},
+	{Type: "Progressing", Status: metav1.ConditionTrue},
+}
+
+// newTabWriter returns a writer aligning the columns like kubectl get
+func newTabWriter(output io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(output, 6, 4, 3, ' ', 0)
+}
+
+// runGroups lists the KeepalivedGroups with their services, the configuration loaded by their nodes and their drained nodes
+func runGroups(args []string) error {
+	flags, options := newFlagSet("groups", "[flags]", true)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c, namespace, err := options.newClient()
+	if err != nil {
+		return err
+	}
+	listOptions := []client.ListOption{}
+	if !options.allNamespaces {
+		listOptions = append(listOptions, client.InNamespace(namespace))
+	}
+	groups, err := listGroups(context.TODO(), c, listOptions...)
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		fmt.Fprintln(os.Stderr, "No KeepalivedGroups found.")
+		return nil
+	}
+	w := newTabWriter(os.Stdout)
+	if options.allNamespaces {
+		fmt.Fprint(w, "NAMESPACE\t")
+	}
+	fmt.Fprintln(w, "NAME\tINTERFACE\tSERVICES\tINSTANCES\tCONFIG\tDRAINED\tSTATUS")
+	for i := range groups {
+		group := &groups[i]
+		if options.allNamespaces {
+			fmt.Fprintf(w, "%s\t", group.Namespace)
+		}
+		services := map[string]bool{}
+		for name := range group.Status.RouterIDs {
+			services[instanceService(group, name)] = true
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n", group.Name, groupInterface(group), len(services), len(group.Status.RouterIDs),
+			appliedConfigs(group), drainedNodes(group), groupStatus(group))
+	}
+	return w.Flush()
+}
+
+// runServices lists the vrrp instances of the services, with their VRID, their VIPs and the nodes holding them
+func runServices(args []string) error {
+	flags, options := newFlagSet("services", "[<service>] [flags]", true)
+	var groupName string
+	flags.StringVar(&groupName, "group", "", "Only list the services of this KeepalivedGroup, <name> or <namespace>/<name>.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("expected at most one service, found %d arguments", flags.NArg())
+	}
+	c, namespace, err := options.newClient()
+	if err != nil {
+		return err
+	}
+	// services can reference the KeepalivedGroups of any namespace
+	groups, err := listGroups(context.TODO(), c)
+	if err != nil {
+		return err
+	}
+	var groupKey, serviceKey types.NamespacedName
+	if groupName != "" {
+		if groupKey, err = parseKey(groupName, namespace); err != nil {
+			return err
+		}
+	}
+	if flags.NArg() == 1 {
+		if serviceKey, err = parseKey(flags.Arg(0), namespace); err != nil {
+			return err
+		}
+	}
+
+	w := newTabWriter(os.Stdout)
+	fmt.Fprintln(w, "INSTANCE\tGROUP\tVRID\tVIPS\tMASTER\tBACKUP\tFAULT")
+	found := false
+	for i := range groups {
+		group := &groups[i]
+		if groupName != "" && client.ObjectKeyFromObject(group) != groupKey {
+			continue
+		}
+		statuses := map[string]redhatcopv1alpha1.VRRPInstanceStatus{}
+		for _, status := range group.Status.VRRPInstances {
+			statuses[status.Name] = status
+		}
+		for _, name := range sortedKeys(group.Status.RouterIDs) {
+			service := instanceService(group, name)
+			switch {
+			case serviceKey.Name != "" && service != serviceKey.String():
+				continue
+			case serviceKey.Name == "" && !options.allNamespaces && !strings.HasPrefix(service, namespace+"/"):
+				continue
+			}
+			found = true
+			status := statuses[name]
+			master := orNone(status.Master)
+			if len(status.SplitBrain) > 0 {
+				master = strings.Join(status.SplitBrain, ",") + " (split brain)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", name, client.ObjectKeyFromObject(group), group.Status.RouterIDs[name],
+				orNone(strings.Join(status.VIPs, ",")), master, orNone(strings.Join(status.Backup, ",")), orNone(strings.Join(status.Fault, ",")))
+		}
+	}
+	if !found {
+		if serviceKey.Name != "" {
+			return fmt.Errorf("no KeepalivedGroup has allocated a router id to service %s", serviceKey)
+		}
+		fmt.Fprintln(os.Stderr, "No services found.")
+		return nil
+	}
+	return w.Flush()
+}
+
+// runNodes lists the keepalived pods of a KeepalivedGroup with the configuration they loaded and the state of their vrrp instances
+func runNodes(args []string) error {
+	flags, options := newFlagSet("nodes", "<group> [flags]", false)
+	var instances bool
+	flags.BoolVar(&instances, "instances", false, "List the VRRP state of each vrrp instance on each node.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected a KeepalivedGroup, found %d arguments", flags.NArg())
+	}
+	c, namespace, err := options.newClient()
+	if err != nil {
+		return err
+	}
+	groupKey, err := parseKey(flags.Arg(0), namespace)
+	if err != nil {
+		return err
+	}
+	group := &redhatcopv1alpha1.KeepalivedGroup{}
+	if err := c.Get(context.TODO(), groupKey, group); err != nil {
+		return err
+	}
+	pods, err := listKeepalivedPods(context.TODO(), c, group)
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		fmt.Fprintf(os.Stderr, "No keepalived pods found for KeepalivedGroup %s.\n", groupKey)
+		return nil
+	}
+	drained := map[string]bool{}
+	for _, node := range group.Status.DrainedNodes {
+		drained[node.Node] = true
+	}
+
+	w := newTabWriter(os.Stdout)
+	if instances {
+		fmt.Fprintln(w, "NODE\tPOD\tINSTANCE\tVRID\tSTATE")
+		for i := range pods {
+			states := getPodVRRPStates(&pods[i])
+			for _, name := range sortedKeys(group.Status.RouterIDs) {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", pods[i].Spec.NodeName, pods[i].Name, name, group.Status.RouterIDs[name], orNone(states[name]))
+			}
+		}
+		return w.Flush()
+	}
+	fmt.Fprintln(w, "NODE\tPOD\tPHASE\tCONFIG\tUP-TO-DATE\tMASTER\tBACKUP\tFAULT\tDRAINED\tERROR")
+	for i := range pods {
+		pod := &pods[i]
+		hash := pod.GetAnnotations()[redhatcopv1alpha1.ConfigHashAnnotation]
+		counts := map[string]int{}
+		for _, state := range getPodVRRPStates(pod) {
+			counts[state]++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%d\t%d\t%d\t%t\t%s\n", pod.Spec.NodeName, pod.Name, pod.Status.Phase, orNone(shortHash(hash)),
+			hash != "" && hash == group.Status.DesiredConfigHash, counts["MASTER"], counts["BACKUP"], counts["FAULT"], drained[pod.Spec.NodeName],
+			orNone(pod.GetAnnotations()[redhatcopv1alpha1.ConfigErrorAnnotation]))
+	}
+	return w.Flush()
+}
+
+// listGroups returns the KeepalivedGroups sorted by namespace and name
+func listGroups(ctx context.Context, c client.Client, listOptions ...client.ListOption) ([]redhatcopv1alpha1.KeepalivedGroup, error) {
+	groupList := &redhatcopv1alpha1.KeepalivedGroupList{}
+	if err := c.List(ctx, groupList, listOptions...); err != nil {
+		return nil, err
+	}
+	groups := groupList.Items
+	sort.Slice(groups, func(i, j int) bool {
+		return client.ObjectKeyFromObject(&groups[i]).String() < client.ObjectKeyFromObject(&groups[j]).String()
+	})
+	return groups, nil
+}
+
+// listKeepalivedPods returns the keepalived pods of a KeepalivedGroup sorted by node
+func listKeepalivedPods(ctx context.Context, c client.Client, group *redhatcopv1alpha1.KeepalivedGroup) ([]corev1.Pod, error) {
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList, client.InNamespace(group.Namespace), client.MatchingLabels{keepalivedGroupLabel: group.Name}); err != nil {
+		return nil, err
+	}
+	pods := podList.Items
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Spec.NodeName < pods[j].Spec.NodeName
+	})
+	return pods, nil
+}
+
+// instanceService returns the namespace/name of the service of a vrrp instance, the instances of a service
+// are named after it, with a suffix for its IPv6 VIPs and its spread VIPs
+func instanceService(group *redhatcopv1alpha1.KeepalivedGroup, name string) string {
+	for _, status := range group.Status.VRRPInstances {
+		if status.Name == name {
+			return status.Service
+		}
+	}
+	elements := strings.SplitN(name, "/", 3)
+	if len(elements) < 2 {
+		return name
+	}
+	return elements[0] + "/" + elements[1]
+}
+
+// getPodVRRPStates returns the VRRP state of each instance published by the keepalived pod
+func getPodVRRPStates(pod *corev1.Pod) map[string]string {
+	states := map[string]string{}
+	if value, ok := pod.GetAnnotations()[redhatcopv1alpha1.VRRPStateAnnotation]; ok {
+		// a malformed annotation is reported as no state, as the operator does
+		_ = json.Unmarshal([]byte(value), &states)
+	}
+	return states
+}
+
+func groupInterface(group *redhatcopv1alpha1.KeepalivedGroup) string {
+	if group.Spec.InterfaceFromIP != "" {
+		return "from " + group.Spec.InterfaceFromIP
+	}
+	return group.Spec.Interface
+}
+
+// appliedConfigs returns how many nodes loaded the desired configuration out of the nodes of the KeepalivedGroup
+func appliedConfigs(group *redhatcopv1alpha1.KeepalivedGroup) string {
+	applied := 0
+	for _, config := range group.Status.AppliedConfigs {
+		if config.ConfigHash != "" && config.ConfigHash == group.Status.DesiredConfigHash {
+			applied++
+		}
+	}
+	return strconv.Itoa(applied) + "/" + strconv.Itoa(len(group.Status.AppliedConfigs))
+}
+
+func drainedNodes(group *redhatcopv1alpha1.KeepalivedGroup) string {
+	nodes := []string{}
+	for _, node := range group.Status.DrainedNodes {
+		if !node.Drained {
+			nodes = append(nodes, node.Node+" (draining)")
+			continue
+		}
+		nodes = append(nodes, node.Node)
+	}
+	return orNone(strings.Join(nodes, ","))
+}
+
+// groupStatus returns the conditions of the KeepalivedGroup that need attention, OK when there are none
+func groupStatus(group *redhatcopv1alpha1.KeepalivedGroup) string {
+	problems := []string{}
+	// the operator keeps both conditions and refreshes the one of the last reconcile cycle
+	failure, failed := apis.GetCondition(apis.ReconcileError, group.Status.Conditions)
+	success, succeeded := apis.GetCondition(apis.ReconcileSuccess, group.Status.Conditions)
+	if failed && (!succeeded || success.LastTransitionTime.Before(&failure.LastTransitionTime)) {
+		problems = append(problems, apis.ReconcileError)
+	}
+	for _, problem := range problemConditions {
+		if condition, ok := apis.GetCondition(problem.Type, group.Status.Conditions); ok && condition.Status == problem.Status {
+			if problem.Status == metav1.ConditionFalse {
+				problems = append(problems, "Not"+problem.Type)
+				continue
+			}
+			problems = append(problems, problem.Type)
+		}
+	}
+	if len(problems) == 0 {
+		return "OK"
+	}
+	return strings.Join(problems, ",")
+}
+
+// shortHash abbreviates a configuration hash, like git abbreviates commits
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return none
+	}
+	return value
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-keepalived is a kubectl plugin to inspect and operate the KeepalivedGroups of a cluster.
+// It reports which node holds the VIPs of each service and the health of the keepalived pods from the status the operator
+// and the keepalived pods publish, and moves VIPs by changing the same annotations and fields as a user would.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// subcommands are run with the arguments that follow their name
+var subcommands = map[string]func(args []string) error{
+	"groups":   runGroups,
+	"services": runServices,
+	"nodes":    runNodes,
+	"config":   runConfig,
+	"failover": runFailover,
+	"drain":    runDrain,
+	"undrain":  runUndrain,
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: kubectl keepalived <command> [flags]
+
+Commands:
+  groups                        list the KeepalivedGroups with the state of their configuration and drained nodes
+  services                      list the services of the KeepalivedGroups with their VRIDs, VIPs and the node holding them
+  nodes <group>                 list the keepalived pods of a KeepalivedGroup with their configuration hash and VRRP states
+  config <service>              print the keepalived configuration rendered for a service
+  failover <service> --to <node>
+                                move the VIPs of a service to a node, --reset gives the service back its default priorities
+  drain <group> <node>          move all the VIPs of a KeepalivedGroup away from a node
+  undrain <group> <node>        let a drained node take VIPs again
+
+Groups and services are <name> in the namespace of the current context or of -n, or <namespace>/<name>.
+Run kubectl keepalived <command> -h for the flags of a command.
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	run, ok := subcommands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "-h" && os.Args[1] != "--help" && os.Args[1] != "help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		}
+		usage()
+		os.Exit(2)
+	}
+	// the usage of the command was printed when it is asked for with -h
+	if err := run(os.Args[2:]); err != nil && !errors.Is(err, pflag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// clientOptions are the flags selecting the cluster and the namespace, as the ones of kubectl
+type clientOptions struct {
+	kubeconfig    string
+	context       string
+	namespace     string
+	allNamespaces bool
+}
+
+// newFlagSet returns the flags of a command with the flags of the client, allNamespaces adds -A
+func newFlagSet(name string, arguments string, allNamespaces bool) (*pflag.FlagSet, *clientOptions) {
+	options := &clientOptions{}
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags.StringVar(&options.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file, KUBECONFIG and ~/.kube/config are used when empty.")
+	flags.StringVar(&options.context, "context", "", "The kubeconfig context to use.")
+	flags.StringVarP(&options.namespace, "namespace", "n", "", "The namespace of the objects, the one of the current context when empty.")
+	if allNamespaces {
+		flags.BoolVarP(&options.allNamespaces, "all-namespaces", "A", false, "List the objects of all the namespaces.")
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: kubectl keepalived %s %s\n\nFlags:\n%s", name, arguments, flags.FlagUsages())
+	}
+	return flags, options
+}
+
+// newClient returns a client for the operator API types and the namespace selected by the flags or the kubeconfig context
+func (o *clientOptions) newClient() (client.Client, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: o.context}
+	overrides.Context.Namespace = o.namespace
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, "", err
+	}
+	if err := redhatcopv1alpha1.AddToScheme(scheme); err != nil {
+		return nil, "", err
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, "", err
+	}
+	return c, namespace, nil
+}
+
+// parseKey parses a <name> or a <namespace>/<name> reference, the namespace defaults to the passed one
+func parseKey(value string, namespace string) (types.NamespacedName, error) {
+	elements := strings.Split(value, "/")
+	switch {
+	case len(elements) == 1 && elements[0] != "":
+		return types.NamespacedName{Namespace: namespace, Name: elements[0]}, nil
+	case len(elements) == 2 && elements[0] != "" && elements[1] != "":
+		return types.NamespacedName{Namespace: elements[0], Name: elements[1]}, nil
+	}
+	return types.NamespacedName{}, fmt.Errorf("%q must be <name> or <namespace>/<name>", value)
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		value string
+		key   types.NamespacedName
+		ok    bool
+	}{
+		{value: "svc", key: types.NamespacedName{Namespace: "default", Name: "svc"}, ok: true},
+		{value: "ns/svc", key: types.NamespacedName{Namespace: "ns", Name: "svc"}, ok: true},
+		{value: ""},
+		{value: "/svc"},
+		{value: "ns/"},
+		{value: "ns/svc/ipv6"},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			key, err := parseKey(test.value, "default")
+			if (err == nil) != test.ok || key != test.key {
+				t.Errorf("got %v and error %v, want %v", key, err, test.key)
+			}
+		})
+	}
+}
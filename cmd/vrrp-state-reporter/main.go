@@ -0,0 +1,348 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// vrrp-state-reporter runs as a sidecar of keepalived. It reads the state notifications keepalived writes to its notify_fifo
+// and publishes the state of each vrrp instance in an annotation of its own pod, where the operator picks them up.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var log = ctrl.Log.WithName("vrrp-state-reporter")
+
+// stateUnknown is published for the instances of a keepalived process that exited, until the new process notifies their state
+const stateUnknown = "UNKNOWN"
+
+func main() {
+	var fifo, pidFile string
+	var retryInterval, checkInterval, unknownRetention time.Duration
+	flag.StringVar(&fifo, "fifo", "/var/run/keepalived-state/notify.fifo", "The notify_fifo keepalived writes the state changes to.")
+	flag.StringVar(&pidFile, "pid-file", "/etc/keepalived.pid/keepalived.pid", "The file keepalived writes its pid to.")
+	flag.DurationVar(&retryInterval, "retry-interval", 5*time.Second, "How long to wait before retrying to publish the state after an error.")
+	flag.DurationVar(&checkInterval, "check-interval", 2*time.Second, "How often to check whether keepalived exited or restarted.")
+	flag.DurationVar(&unknownRetention, "unknown-state-retention", 5*time.Minute, "How long the unknown state of an instance is published before it is dropped, keepalived does not notify the instances removed from its configuration.")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	podName, podNamespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE")
+	if podName == "" || podNamespace == "" {
+		log.Error(errors.New("POD_NAME and POD_NAMESPACE must be set"), "unable to identify the keepalived pod")
+		os.Exit(1)
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		log.Error(err, "unable to load the in cluster configuration")
+		os.Exit(1)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Error(err, "unable to create the kubernetes client")
+		os.Exit(1)
+	}
+	reporter := newReporter(clientset, types.NamespacedName{Namespace: podNamespace, Name: podName}, pidFile, retryInterval, unknownRetention)
+	ctx := ctrl.SetupSignalHandler()
+	reporter.loadStates(ctx)
+	go reporter.publish(ctx)
+	go reporter.watchKeepalived(ctx, checkInterval)
+	err = reporter.readNotifications(ctx, fifo)
+	if err != nil {
+		log.Error(err, "unable to read keepalived notifications", "fifo", fifo)
+		os.Exit(1)
+	}
+}
+
+type reporter struct {
+	clientset     kubernetes.Interface
+	pod           types.NamespacedName
+	pidFile       string
+	retryInterval time.Duration
+	// unknownRetention is how long an instance can stay in the unknown state before it is dropped
+	unknownRetention time.Duration
+	// mutex guards states, updated, unknownSince and latest, which are changed by readNotifications and watchKeepalived
+	mutex sync.Mutex
+	// states maps the vrrp instance names to their state
+	states map[string]string
+	// updated maps the vrrp instance names to the time of their last notification, the restored states have none
+	updated map[string]time.Time
+	// unknownSince maps the vrrp instance names in the unknown state to the time their state was reset
+	unknownSince map[string]time.Time
+	// latest is the serialized states waiting to be published
+	latest  []byte
+	changes chan struct{}
+}
+
+func newReporter(clientset kubernetes.Interface, pod types.NamespacedName, pidFile string, retryInterval time.Duration, unknownRetention time.Duration) *reporter {
+	return &reporter{
+		clientset:        clientset,
+		pod:              pod,
+		pidFile:          pidFile,
+		retryInterval:    retryInterval,
+		unknownRetention: unknownRetention,
+		states:           map[string]string{},
+		updated:          map[string]time.Time{},
+		unknownSince:     map[string]time.Time{},
+		changes:          make(chan struct{}, 1),
+	}
+}
+
+// loadStates restores the states already published, so that a restart of the reporter does not lose the instances that did not change since
+func (r *reporter) loadStates(ctx context.Context) {
+	pod, err := r.clientset.CoreV1().Pods(r.pod.Namespace).Get(ctx, r.pod.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Error(err, "unable to read the published states", "pod", r.pod)
+		return
+	}
+	if value, ok := pod.GetAnnotations()[redhatcopv1alpha1.VRRPStateAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &r.states); err != nil {
+			log.Error(err, "unable to parse the published states", "pod", r.pod)
+			r.states = map[string]string{}
+		}
+	}
+	// the restored unknown states are dropped if the running keepalived does not notify them
+	for name, state := range r.states {
+		if state == stateUnknown {
+			r.unknownSince[name] = time.Now()
+		}
+	}
+}
+
+// readNotifications parses the lines keepalived writes to the fifo, like: INSTANCE "namespace/name" MASTER 200
+func (r *reporter) readNotifications(ctx context.Context, fifo string) error {
+	if _, err := os.Stat(fifo); errors.Is(err, fs.ErrNotExist) {
+		if err := syscall.Mkfifo(fifo, 0600); err != nil {
+			return err
+		}
+	}
+	// opening the fifo for writing as well keeps it open when keepalived restarts
+	file, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, state, ok := parseNotification(scanner.Text())
+		if ok {
+			r.setState(name, state)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	// the fifo is also open for writing, it only ends on errors: the states cannot be followed anymore
+	r.resetStates(time.Now())
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// setState records the state notified for an instance
+func (r *reporter) setState(name string, state string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.updated[name] = time.Now()
+	delete(r.unknownSince, name)
+	if r.states[name] == state {
+		return
+	}
+	log.Info("vrrp instance changed state", "instance", name, "state", state)
+	r.states[name] = state
+	r.notify()
+}
+
+// resetStates sets the state of the instances that were not notified since the passed time to unknown,
+// they were notified by a keepalived process that is gone
+func (r *reporter) resetStates(since time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	changed := false
+	for name, state := range r.states {
+		if state == stateUnknown || r.updated[name].After(since) {
+			continue
+		}
+		r.states[name] = stateUnknown
+		r.unknownSince[name] = time.Now()
+		changed = true
+	}
+	if changed {
+		log.Info("keepalived exited, the states of its vrrp instances are unknown until they are notified again")
+		r.notify()
+	}
+}
+
+// pruneStates drops the instances that stayed in the unknown state longer than the retention, keepalived never notifies
+// the instances removed from its configuration while it was restarting
+func (r *reporter) pruneStates(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	changed := false
+	for name, since := range r.unknownSince {
+		if now.Sub(since) < r.unknownRetention {
+			continue
+		}
+		log.Info("dropping the unknown state of a vrrp instance that was not notified again", "instance", name)
+		delete(r.states, name)
+		delete(r.updated, name)
+		delete(r.unknownSince, name)
+		changed = true
+	}
+	if changed {
+		r.notify()
+	}
+}
+
+// watchKeepalived resets the states when the keepalived process exits or is replaced by a new one. The new process notifies the states
+// of its instances, those notified before the check are kept by resetting the states that were not notified since the pid file was written
+func (r *reporter) watchKeepalived(ctx context.Context, interval time.Duration) {
+	pid, _ := r.keepalivedPid()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pid = r.checkKeepalived(pid)
+	}
+}
+
+// checkKeepalived resets the states if keepalived is not the process with the passed pid anymore, it returns the current pid.
+// The states still unknown after the retention are dropped
+func (r *reporter) checkKeepalived(previous int) int {
+	r.pruneStates(time.Now())
+	pid, started := r.keepalivedPid()
+	if pid == previous {
+		return pid
+	}
+	if pid == 0 {
+		started = time.Now()
+	}
+	r.resetStates(started)
+	return pid
+}
+
+// keepalivedPid returns the pid of the running keepalived process and the time it wrote its pid file, the pod shares its process namespace.
+// The pid is 0 when keepalived is not running
+func (r *reporter) keepalivedPid() (int, time.Time) {
+	info, err := os.Stat(r.pidFile)
+	if err != nil {
+		return 0, time.Time{}
+	}
+	content, err := os.ReadFile(r.pidFile)
+	if err != nil {
+		return 0, time.Time{}
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return 0, time.Time{}
+	}
+	return pid, info.ModTime()
+}
+
+func parseNotification(line string) (string, string, bool) {
+	if !strings.HasPrefix(line, "INSTANCE ") {
+		return "", "", false
+	}
+	line = strings.TrimPrefix(line, "INSTANCE ")
+	// the instance name is quoted
+	end := strings.LastIndex(line, "\"")
+	if !strings.HasPrefix(line, "\"") || end <= 0 {
+		return "", "", false
+	}
+	name := line[1:end]
+	fields := strings.Fields(line[end+1:])
+	if len(fields) == 0 {
+		return "", "", false
+	}
+	return name, fields[0], true
+}
+
+// notify hands the current states over to publish, only the latest states are kept if publish is busy. The mutex must be held
+func (r *reporter) notify() {
+	latest, err := json.Marshal(r.states)
+	if err != nil {
+		log.Error(err, "unable to serialize the states")
+		return
+	}
+	r.latest = latest
+	select {
+	case r.changes <- struct{}{}:
+	default:
+	}
+}
+
+// publish patches the annotation of the pod with the latest states, retrying until it succeeds
+func (r *reporter) publish(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.changes:
+		}
+		for {
+			r.mutex.Lock()
+			latest := r.latest
+			r.mutex.Unlock()
+			patch, err := json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						redhatcopv1alpha1.VRRPStateAnnotation: string(latest),
+					},
+				},
+			})
+			if err == nil {
+				_, err = r.clientset.CoreV1().Pods(r.pod.Namespace).Patch(ctx, r.pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+			}
+			if err == nil {
+				break
+			}
+			log.Error(err, "unable to publish the states", "pod", r.pod)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.retryInterval):
+			}
+		}
+	}
+}
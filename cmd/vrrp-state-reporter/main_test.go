@@ -0,0 +1,271 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var testPod = types.NamespacedName{Namespace: "keepalived-operator", Name: "keepalived-abcde"}
+
+func newTestReporter(t *testing.T, annotations map[string]string) (*reporter, *fake.Clientset) {
+	t.Helper()
+	clientset := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: testPod.Namespace, Name: testPod.Name, Annotations: annotations}})
+	return newReporter(clientset, testPod, filepath.Join(t.TempDir(), "keepalived.pid"), 10*time.Millisecond, time.Hour), clientset
+}
+
+// getStates returns a copy of the states of the reporter
+func (r *reporter) getStates() map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	states := map[string]string{}
+	for name, state := range r.states {
+		states[name] = state
+	}
+	return states
+}
+
+// waitForPublishedStates waits until the annotation of the pod holds the expected states
+func waitForPublishedStates(t *testing.T, clientset *fake.Clientset, expected map[string]string) {
+	t.Helper()
+	var published map[string]string
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		pod, err := clientset.CoreV1().Pods(testPod.Namespace).Get(context.TODO(), testPod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		published = map[string]string{}
+		if err := json.Unmarshal([]byte(pod.GetAnnotations()[redhatcopv1alpha1.VRRPStateAnnotation]), &published); err != nil {
+			return false, nil
+		}
+		return reflect.DeepEqual(published, expected), nil
+	})
+	if err != nil {
+		t.Fatalf("published states %v, expected %v: %v", published, expected, err)
+	}
+}
+
+func TestParseNotification(t *testing.T) {
+	tests := []struct {
+		line  string
+		name  string
+		state string
+		ok    bool
+	}{
+		{line: `INSTANCE "default/svc" MASTER 200`, name: "default/svc", state: "MASTER", ok: true},
+		{line: `INSTANCE "default/svc/ipv6" BACKUP 100`, name: "default/svc/ipv6", state: "BACKUP", ok: true},
+		{line: `INSTANCE "default/svc with space" FAULT 0`, name: "default/svc with space", state: "FAULT", ok: true},
+		{line: `INSTANCE "default/svc" STOP`, name: "default/svc", state: "STOP", ok: true},
+		{line: `GROUP "group" MASTER 0`},
+		{line: `INSTANCE default/svc MASTER 200`},
+		{line: `INSTANCE "default/svc"`},
+		{line: ``},
+	}
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			name, state, ok := parseNotification(test.line)
+			if name != test.name || state != test.state || ok != test.ok {
+				t.Errorf("got %q %q %t, want %q %q %t", name, state, ok, test.name, test.state, test.ok)
+			}
+		})
+	}
+}
+
+func TestReadNotifications(t *testing.T) {
+	r, clientset := newTestReporter(t, nil)
+	fifo := filepath.Join(t.TempDir(), "notify.fifo")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.publish(ctx)
+	done := make(chan error)
+	go func() {
+		done <- r.readNotifications(ctx, fifo)
+	}()
+	// the reporter creates the fifo before opening it
+	var writer *os.File
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		var err error
+		writer, err = os.OpenFile(fifo, os.O_WRONLY, 0)
+		return err == nil, nil
+	})
+	if err != nil {
+		t.Fatal("the fifo was not created")
+	}
+	defer writer.Close()
+	for _, line := range []string{
+		`INSTANCE "default/a" BACKUP 100`,
+		`GROUP "group" MASTER 0`,
+		`INSTANCE "default/a" MASTER 200`,
+		`INSTANCE "default/b" BACKUP 100`,
+	} {
+		if _, err := writer.WriteString(line + "\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForPublishedStates(t, clientset, map[string]string{"default/a": "MASTER", "default/b": "BACKUP"})
+
+	// keepalived closing the fifo does not end the reporter, a new keepalived process reuses the fifo
+	writer.Close()
+	writer, err = os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteString(`INSTANCE "default/b" FAULT 0` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPublishedStates(t, clientset, map[string]string{"default/a": "MASTER", "default/b": "FAULT"})
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected no error when the context is done, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the reporter did not stop with its context")
+	}
+}
+
+func TestLoadStates(t *testing.T) {
+	r, _ := newTestReporter(t, map[string]string{redhatcopv1alpha1.VRRPStateAnnotation: `{"default/a":"MASTER"}`})
+	r.loadStates(context.TODO())
+	if states := r.getStates(); !reflect.DeepEqual(states, map[string]string{"default/a": "MASTER"}) {
+		t.Errorf("unexpected restored states %v", states)
+	}
+
+	r, _ = newTestReporter(t, map[string]string{redhatcopv1alpha1.VRRPStateAnnotation: `MASTER`})
+	r.loadStates(context.TODO())
+	if states := r.getStates(); len(states) != 0 {
+		t.Errorf("expected invalid states to be ignored, got %v", states)
+	}
+}
+
+func TestResetStates(t *testing.T) {
+	r, _ := newTestReporter(t, nil)
+	r.states = map[string]string{"default/restored": "MASTER"}
+	r.setState("default/old", "BACKUP")
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+	r.setState("default/new", "MASTER")
+	r.resetStates(since)
+	expected := map[string]string{"default/restored": stateUnknown, "default/old": stateUnknown, "default/new": "MASTER"}
+	if states := r.getStates(); !reflect.DeepEqual(states, expected) {
+		t.Errorf("got %v, want %v", states, expected)
+	}
+	r.setState("default/old", "BACKUP")
+	expected["default/old"] = "BACKUP"
+	if states := r.getStates(); !reflect.DeepEqual(states, expected) {
+		t.Errorf("expected a notification to replace the unknown state, got %v, want %v", states, expected)
+	}
+}
+
+func TestCheckKeepalived(t *testing.T) {
+	r, clientset := newTestReporter(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.publish(ctx)
+	writePid := func(pid int) {
+		if err := os.WriteFile(r.pidFile, []byte(strconv.Itoa(pid)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the pid of the test process stands for keepalived, the one of its parent for the new keepalived process
+	writePid(os.Getpid())
+	pid, _ := r.keepalivedPid()
+	if pid != os.Getpid() {
+		t.Fatalf("expected pid %d, got %d", os.Getpid(), pid)
+	}
+	r.setState("default/a", "MASTER")
+	r.setState("default/b", "BACKUP")
+	if pid = r.checkKeepalived(pid); pid != os.Getpid() {
+		t.Fatalf("expected pid %d, got %d", os.Getpid(), pid)
+	}
+	waitForPublishedStates(t, clientset, map[string]string{"default/a": "MASTER", "default/b": "BACKUP"})
+
+	// keepalived exited
+	if err := os.Remove(r.pidFile); err != nil {
+		t.Fatal(err)
+	}
+	if pid = r.checkKeepalived(pid); pid != 0 {
+		t.Fatalf("expected no pid, got %d", pid)
+	}
+	waitForPublishedStates(t, clientset, map[string]string{"default/a": stateUnknown, "default/b": stateUnknown})
+
+	// keepalived restarted and notified a state before the check
+	time.Sleep(10 * time.Millisecond)
+	writePid(os.Getppid())
+	r.setState("default/a", "BACKUP")
+	if pid = r.checkKeepalived(pid); pid != os.Getppid() {
+		t.Fatalf("expected pid %d, got %d", os.Getppid(), pid)
+	}
+	waitForPublishedStates(t, clientset, map[string]string{"default/a": "BACKUP", "default/b": stateUnknown})
+
+	// keepalived was replaced between two checks
+	r.setState("default/b", "MASTER")
+	time.Sleep(10 * time.Millisecond)
+	writePid(os.Getpid())
+	if pid = r.checkKeepalived(pid); pid != os.Getpid() {
+		t.Fatalf("expected pid %d, got %d", os.Getpid(), pid)
+	}
+	waitForPublishedStates(t, clientset, map[string]string{"default/a": stateUnknown, "default/b": stateUnknown})
+
+	// a stale pid file is not a running keepalived
+	writePid(1 << 22)
+	if pid = r.checkKeepalived(pid); pid != 0 {
+		t.Fatalf("expected no pid for a stale pid file, got %d", pid)
+	}
+
+	// the instances that are not notified again are dropped after the retention
+	r.unknownRetention = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	r.checkKeepalived(pid)
+	waitForPublishedStates(t, clientset, map[string]string{})
+}
+
+func TestPruneStates(t *testing.T) {
+	r, _ := newTestReporter(t, map[string]string{redhatcopv1alpha1.VRRPStateAnnotation: `{"default/restored":"UNKNOWN"}`})
+	r.loadStates(context.TODO())
+	r.setState("default/removed", "MASTER")
+	r.setState("default/kept", "BACKUP")
+	r.resetStates(time.Now())
+	r.setState("default/kept", "MASTER")
+
+	r.pruneStates(time.Now())
+	expected := map[string]string{"default/restored": stateUnknown, "default/removed": stateUnknown, "default/kept": "MASTER"}
+	if states := r.getStates(); !reflect.DeepEqual(states, expected) {
+		t.Errorf("expected the unknown states to be kept during the retention, got %v, want %v", states, expected)
+	}
+	r.pruneStates(time.Now().Add(r.unknownRetention))
+	expected = map[string]string{"default/kept": "MASTER"}
+	if states := r.getStates(); !reflect.DeepEqual(states, expected) {
+		t.Errorf("expected the unknown states to be dropped after the retention, got %v, want %v", states, expected)
+	}
+}
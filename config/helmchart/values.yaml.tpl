@@ -16,8 +16,14 @@ fullnameOverride: ""
 env:
 - name: KEEPALIVED_OPERATOR_IMAGE_NAME
   value: quay.io/redhat-cop/keepalived-operator:latest
-- name: KEEPALIVEDGROUP_TEMPLATE_FILE_NAME
-  value: /templates/keepalived-template.yaml
+# the sidecar images of the keepalived pods default to KEEPALIVED_OPERATOR_IMAGE_NAME
+# - name: KEEPALIVED_OPERATOR_CONFIG_RELOADER_IMAGE_NAME
+#   value: quay.io/redhat-cop/keepalived-operator:latest
+# - name: KEEPALIVED_OPERATOR_VRRP_STATE_REPORTER_IMAGE_NAME
+#   value: quay.io/redhat-cop/keepalived-operator:latest
+# - name: KEEPALIVED_OPERATOR_PROMETHEUS_EXPORTER_IMAGE_NAME
+#   value: quay.io/redhat-cop/keepalived-operator:latest
+# the keepalived objects are rendered from this template instead of being generated by the operator, when set
 keepalivedTemplateFromConfigMap: "" #i.e. "keepalived-template" of an existing ConfigMap
 
 podAnnotations: {}
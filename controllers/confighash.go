@@ -0,0 +1,152 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// ConfigApplied is True when keepalived loaded the latest configuration on every node
+	configAppliedCondition = "ConfigApplied"
+	keepalivedConfigKey    = "keepalived.conf"
+)
+
+// getConfigMap returns the ConfigMap rendered from the template that holds the keepalived configuration, nil if there is none
+func getConfigMap(objs []unstructured.Unstructured) *unstructured.Unstructured {
+	for i := range objs {
+		if objs[i].GetAPIVersion() != "v1" || objs[i].GetKind() != "ConfigMap" {
+			continue
+		}
+		if _, found, err := unstructured.NestedString(objs[i].Object, "data", keepalivedConfigKey); err == nil && found {
+			return &objs[i]
+		}
+	}
+	return nil
+}
+
+// getDesiredConfigHash returns the hash of the keepalived configuration in the ConfigMap rendered from the template, empty if there is none
+func getDesiredConfigHash(objs []unstructured.Unstructured) string {
+	configMap := getConfigMap(objs)
+	if configMap == nil {
+		return ""
+	}
+	config, _, _ := unstructured.NestedString(configMap.Object, "data", keepalivedConfigKey)
+	return getConfigHash(config)
+}
+
+// getConfigHash must match the hash the config-reloader computes on the mounted file
+func getConfigHash(config string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(config)))
+}
+
+// getAppliedConfigs returns the configuration notified by each scheduled keepalived pod, sorted by node
+func getAppliedConfigs(pods []corev1.Pod) []redhatcopv1alpha1.AppliedConfigStatus {
+	applied := []redhatcopv1alpha1.AppliedConfigStatus{}
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Spec.NodeName == "" || pod.GetDeletionTimestamp() != nil {
+			continue
+		}
+		applied = append(applied, redhatcopv1alpha1.AppliedConfigStatus{
+			Node:       pod.Spec.NodeName,
+			Pod:        pod.GetName(),
+			ConfigHash: pod.GetAnnotations()[redhatcopv1alpha1.ConfigHashAnnotation],
+			Error:      pod.GetAnnotations()[redhatcopv1alpha1.ConfigErrorAnnotation],
+		})
+	}
+	sort.Slice(applied, func(i, j int) bool {
+		return applied[i].Node < applied[j].Node
+	})
+	return applied
+}
+
+// updateAppliedConfigStatus records the desired and the applied configurations and sets the ConfigApplied condition.
+// The desired configuration is the one rendered from the template, before a canary rollout holds it back
+func updateAppliedConfigStatus(instance *redhatcopv1alpha1.KeepalivedGroup, desiredConfigHash string, pods []corev1.Pod) {
+	instance.Status.DesiredConfigHash = desiredConfigHash
+	instance.Status.AppliedConfigs = getAppliedConfigs(pods)
+	condition := getConfigAppliedCondition(instance.Status.DesiredConfigHash, instance.Status.AppliedConfigs)
+	if rollout := instance.Status.ConfigRollout; rollout != nil && desiredConfigHash != "" && rollout.FailedConfigHash == desiredConfigHash {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ConfigRolledBack"
+		condition.Message = "the latest configuration was rolled back: " + rollout.FailureMessage
+	}
+	if history := instance.Status.ConfigHistory; history != nil && desiredConfigHash != "" && history.RevertedConfigHash == desiredConfigHash {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ConfigRolledBack"
+		condition.Message = "the latest configuration was reverted: " + history.RevertMessage
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+}
+
+func getConfigAppliedCondition(desired string, applied []redhatcopv1alpha1.AppliedConfigStatus) metav1.Condition {
+	failed := []string{}
+	pending := []string{}
+	for _, node := range applied {
+		switch {
+		case node.Error != "":
+			failed = append(failed, fmt.Sprintf("%s: %s", node.Node, node.Error))
+		case node.ConfigHash != desired:
+			pending = append(pending, node.Node)
+		}
+	}
+	condition := metav1.Condition{
+		Type:    configAppliedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Converged",
+		Message: fmt.Sprintf("keepalived loaded the latest configuration on all %d nodes", len(applied)),
+	}
+	switch {
+	case desired == "":
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "NoConfigMap"
+		condition.Message = "the keepalived template did not render a ConfigMap with a " + keepalivedConfigKey + " key"
+	case len(applied) == 0:
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "NoKeepalivedPods"
+		condition.Message = "no keepalived pod is scheduled"
+	case len(failed) > 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ConfigRejected"
+		condition.Message = "keepalived could not load the latest configuration on nodes " + strings.Join(failed, "; ")
+	case len(pending) > 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ConfigPending"
+		condition.Message = fmt.Sprintf("%d of %d nodes did not load the latest configuration yet: %s", len(pending), len(applied), strings.Join(pending, ","))
+	}
+	return condition
+}
+
+// appliedConfigChanged returns true if the configuration notified by a keepalived pod changed
+func appliedConfigChanged(oldPod *corev1.Pod, newPod *corev1.Pod) bool {
+	for _, annotation := range []string{redhatcopv1alpha1.ConfigHashAnnotation, redhatcopv1alpha1.ConfigErrorAnnotation} {
+		if oldPod.GetAnnotations()[annotation] != newPod.GetAnnotations()[annotation] {
+			return true
+		}
+	}
+	return oldPod.Spec.NodeName != newPod.Spec.NodeName
+}
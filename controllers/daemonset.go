@@ -0,0 +1,441 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	keepalivedContainerName         = "keepalived"
+	configSetupContainerName        = "config-setup"
+	configReloaderContainerName     = "config-reloader"
+	vrrpStateReporterContainerName  = "vrrp-state-reporter"
+	prometheusExporterContainerName = "prometheus-exporter"
+	metricsPort                     = 9650
+	reloadMetricsPort               = 9651
+	notifyFifo                      = "/var/run/keepalived-state/notify.fifo"
+	kubeAPIAccessVolume             = "kube-api-access"
+)
+
+// keepalivedCommand starts keepalived in the foreground, with the conditional settings of the pod enabled by --config-id
+const keepalivedCommand = "exec /usr/sbin/keepalived --log-console --log-detail --dont-fork --config-id=${POD_NAME} " +
+	"--use-file=/etc/keepalived.d/keepalived.conf --pid=/etc/keepalived.pid/keepalived.pid\n"
+
+// newDaemonSet returns the DaemonSet of the keepalived pods of the KeepalivedGroup
+func newDaemonSet(instance *redhatcopv1alpha1.KeepalivedGroup, images keepalivedImages) *appsv1.DaemonSet {
+	labels := map[string]string{keepalivedGroupLabel: instance.Name}
+	tolerations := instance.Spec.DaemonsetPodTolerations
+	if len(tolerations) == 0 {
+		tolerations = []corev1.Toleration{{Operator: corev1.TolerationOpExists}}
+	}
+	return &appsv1.DaemonSet{
+		TypeMeta: metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "DaemonSet"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name,
+			Namespace: instance.Namespace,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			// only the keepalived configuration is canaried by rolloutConfig, the changes of the pod template are rolled out one node at a time
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateDaemonSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDaemonSet{MaxUnavailable: intOrStringPtr(intstr.FromInt(1))},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: instance.Spec.DaemonsetPodAnnotations,
+					Labels:      labels,
+				},
+				Spec: corev1.PodSpec{
+					PriorityClassName:            instance.Spec.DaemonsetPodPriorityClassName,
+					Tolerations:                  tolerations,
+					Affinity:                     instance.Spec.DaemonsetPodAffinity,
+					SecurityContext:              instance.Spec.DaemonsetPodSecurityContext,
+					ImagePullSecrets:             instance.Spec.DaemonsetImagePullSecrets,
+					NodeSelector:                 instance.Spec.NodeSelector,
+					ServiceAccountName:           getServiceAccountName(instance),
+					HostNetwork:                  true,
+					AutomountServiceAccountToken: boolPtr(false),
+					EnableServiceLinks:           boolPtr(false),
+					ShareProcessNamespace:        boolPtr(true),
+					InitContainers:               []corev1.Container{newConfigSetupContainer(instance, images)},
+					Containers: []corev1.Container{
+						newKeepalivedContainer(instance, images),
+						newVRRPStateReporterContainer(instance, images),
+						newConfigReloaderContainer(instance, images),
+						newPrometheusExporterContainer(instance, images),
+					},
+					Volumes: newKeepalivedVolumes(instance),
+				},
+			},
+		},
+	}
+}
+
+func newConfigSetupContainer(instance *redhatcopv1alpha1.KeepalivedGroup, images keepalivedImages) corev1.Container {
+	container := corev1.Container{
+		Name:            configSetupContainerName,
+		Image:           images.ConfigReloader,
+		ImagePullPolicy: getImagePullPolicy(instance),
+		Command:         []string{"/usr/local/bin/config-reloader"},
+		Args: append([]string{
+			"--once",
+			"--src-file=/etc/keepalived.d/src/keepalived.conf",
+			"--dst-file=/etc/keepalived.d/dst/keepalived.conf",
+		}, getInterfaceArgs(instance)...),
+		// picks the configuration being rolled out, when the pod is part of the rollout
+		Env: []corev1.EnvVar{fieldRefEnv("POD_NAME", "metadata.name")},
+		VolumeMounts: []corev1.VolumeMount{
+			{MountPath: "/etc/keepalived.d/src", Name: "config", ReadOnly: true},
+			{MountPath: "/etc/keepalived.d/dst", Name: "config-dst"},
+		},
+	}
+	return overrideContainer(instance, container, &corev1.SecurityContext{RunAsUser: int64Ptr(0)})
+}
+
+func newKeepalivedContainer(instance *redhatcopv1alpha1.KeepalivedGroup, images keepalivedImages) corev1.Container {
+	container := corev1.Container{
+		Name:            keepalivedContainerName,
+		Image:           images.Keepalived,
+		ImagePullPolicy: getImagePullPolicy(instance),
+		Command:         []string{"/bin/bash"},
+		Args:            []string{"-c", keepalivedCommand},
+		Env:             []corev1.EnvVar{fieldRefEnv("POD_NAME", "metadata.name")},
+		VolumeMounts: []corev1.VolumeMount{
+			{MountPath: "/lib/modules", Name: "lib-modules", ReadOnly: true},
+			{MountPath: "/etc/keepalived.d", Name: "config-dst", ReadOnly: true},
+			{MountPath: "/etc/keepalived.pid", Name: "pid"},
+			{MountPath: "/tmp", Name: "stats"},
+			{MountPath: "/var/run/keepalived-state", Name: "state"},
+		},
+	}
+	return overrideContainer(instance, container, &corev1.SecurityContext{Privileged: boolPtr(true)})
+}
+
+func newVRRPStateReporterContainer(instance *redhatcopv1alpha1.KeepalivedGroup, images keepalivedImages) corev1.Container {
+	container := corev1.Container{
+		Name:            vrrpStateReporterContainerName,
+		Image:           images.VRRPStateReporter,
+		ImagePullPolicy: getImagePullPolicy(instance),
+		Command:         []string{"/usr/local/bin/vrrp-state-reporter"},
+		Args:            []string{"--fifo=" + notifyFifo},
+		Env: []corev1.EnvVar{
+			fieldRefEnv("POD_NAME", "metadata.name"),
+			fieldRefEnv("POD_NAMESPACE", "metadata.namespace"),
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{MountPath: "/var/run/keepalived-state", Name: "state"},
+			{MountPath: "/etc/keepalived.pid", Name: "pid", ReadOnly: true},
+			{MountPath: "/var/run/secrets/kubernetes.io/serviceaccount", Name: kubeAPIAccessVolume, ReadOnly: true},
+		},
+	}
+	return overrideContainer(instance, container, &corev1.SecurityContext{RunAsUser: int64Ptr(0)})
+}
+
+func newConfigReloaderContainer(instance *redhatcopv1alpha1.KeepalivedGroup, images keepalivedImages) corev1.Container {
+	args := []string{
+		"--src-file=/etc/keepalived.d/src/keepalived.conf",
+		"--dst-file=/etc/keepalived.d/dst/keepalived.conf",
+		"--keepalived-dst-file=/etc/keepalived.d/keepalived.conf",
+		"--pid-file=/etc/keepalived.pid/keepalived.pid",
+	}
+	args = append(args, getInterfaceArgs(instance)...)
+	container := corev1.Container{
+		Name:            configReloaderContainerName,
+		Image:           images.ConfigReloader,
+		ImagePullPolicy: getImagePullPolicy(instance),
+		Command:         []string{"/usr/local/bin/config-reloader"},
+		Args:            append(args, "--listen-address=:9651"),
+		Env: []corev1.EnvVar{
+			fieldRefEnv("POD_NAME", "metadata.name"),
+			fieldRefEnv("POD_NAMESPACE", "metadata.namespace"),
+		},
+		Ports: []corev1.ContainerPort{{Name: "reload-metrics", ContainerPort: reloadMetricsPort, Protocol: corev1.ProtocolTCP}},
+		ReadinessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{Path: "/readyz", Port: intstr.FromInt(reloadMetricsPort)},
+			},
+			PeriodSeconds: 10,
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{MountPath: "/etc/keepalived.d/src", Name: "config", ReadOnly: true},
+			{MountPath: "/etc/keepalived.d/dst", Name: "config-dst"},
+			{MountPath: "/etc/keepalived.pid", Name: "pid"},
+			{MountPath: "/var/run/secrets/kubernetes.io/serviceaccount", Name: kubeAPIAccessVolume, ReadOnly: true},
+		},
+	}
+	// the configuration is validated with the keepalived binary, in the root filesystem of the keepalived container
+	return overrideContainer(instance, container, &corev1.SecurityContext{
+		RunAsUser:    int64Ptr(0),
+		Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_CHROOT", "SYS_PTRACE"}},
+	})
+}
+
+func newPrometheusExporterContainer(instance *redhatcopv1alpha1.KeepalivedGroup, images keepalivedImages) corev1.Container {
+	container := corev1.Container{
+		Name:            prometheusExporterContainerName,
+		Image:           images.PrometheusExporter,
+		ImagePullPolicy: getImagePullPolicy(instance),
+		Command:         []string{"/usr/local/bin/keepalived_exporter"},
+		Args:            []string{"-web.listen-address", ":9650", "-web.telemetry-path", "/metrics"},
+		Ports:           []corev1.ContainerPort{{Name: "metrics", ContainerPort: metricsPort, Protocol: corev1.ProtocolTCP}},
+		VolumeMounts: []corev1.VolumeMount{
+			{MountPath: "/lib/modules", Name: "lib-modules", ReadOnly: true},
+			{MountPath: "/tmp", Name: "stats"},
+		},
+	}
+	return overrideContainer(instance, container, &corev1.SecurityContext{Privileged: boolPtr(true)})
+}
+
+func newKeepalivedVolumes(instance *redhatcopv1alpha1.KeepalivedGroup) []corev1.Volume {
+	return []corev1.Volume{
+		{Name: "lib-modules", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/lib/modules"}}},
+		{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: instance.Name}}}},
+		{Name: "config-dst", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		{Name: "pid", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}}},
+		{Name: "stats", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		{Name: "state", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}}},
+		// the service account token is only mounted in the vrrp-state-reporter and config-reloader containers
+		{Name: kubeAPIAccessVolume, VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+			Sources: []corev1.VolumeProjection{
+				{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{Path: "token"}},
+				{ConfigMap: &corev1.ConfigMapProjection{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "kube-root-ca.crt"},
+					Items:                []corev1.KeyToPath{{Key: "ca.crt", Path: "ca.crt"}},
+				}},
+				{DownwardAPI: &corev1.DownwardAPIProjection{
+					Items: []corev1.DownwardAPIVolumeFile{{Path: "namespace", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+				}},
+			},
+		}}},
+	}
+}
+
+// newKeepalivedConfigMap returns the ConfigMap holding the keepalived configuration of the KeepalivedGroup
+func newKeepalivedConfigMap(instance *redhatcopv1alpha1.KeepalivedGroup, config string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instance.Name,
+			Namespace: instance.Namespace,
+			Labels:    map[string]string{keepalivedGroupLabel: instance.Name},
+		},
+		Data: map[string]string{keepalivedConfigKey: config},
+	}
+}
+
+// newRoleAndBinding returns a Role with the rules and a RoleBinding granting it to a service account
+func newRoleAndBinding(instance *redhatcopv1alpha1.KeepalivedGroup, name string, rules []rbacv1.PolicyRule, subject rbacv1.Subject) (*rbacv1.Role, *rbacv1.RoleBinding) {
+	role := &rbacv1.Role{
+		TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: instance.Namespace},
+		Rules:      rules,
+	}
+	binding := &rbacv1.RoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: instance.Namespace},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: name},
+		Subjects:   []rbacv1.Subject{subject},
+	}
+	return role, binding
+}
+
+// getServiceAccountName returns the name of the service account of the keepalived pods
+func getServiceAccountName(instance *redhatcopv1alpha1.KeepalivedGroup) string {
+	return instance.Name + "-keepalived"
+}
+
+// newServiceAccount returns the service account of the keepalived pods, so that the permissions of their sidecars are not granted to the other pods of the namespace
+func newServiceAccount(instance *redhatcopv1alpha1.KeepalivedGroup) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		TypeMeta:   metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{Name: getServiceAccountName(instance), Namespace: instance.Namespace},
+	}
+}
+
+// newVRRPStateReporterRBAC lets the vrrp-state-reporter sidecar, which runs as the service account of the keepalived pods, patch its own pod
+func newVRRPStateReporterRBAC(instance *redhatcopv1alpha1.KeepalivedGroup) (*rbacv1.Role, *rbacv1.RoleBinding) {
+	return newRoleAndBinding(instance, instance.Name+"-vrrp-state-reporter",
+		[]rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "patch"}}},
+		rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: getServiceAccountName(instance), Namespace: instance.Namespace})
+}
+
+// newPrometheusRBAC lets the OpenShift cluster monitoring discover the keepalived pods
+func newPrometheusRBAC(instance *redhatcopv1alpha1.KeepalivedGroup) (*rbacv1.Role, *rbacv1.RoleBinding) {
+	return newRoleAndBinding(instance, instance.Name+"-prometheus-k8s",
+		[]rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"endpoints", "pods", "services"}, Verbs: []string{"get", "list", "watch"}}},
+		rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "prometheus-k8s", Namespace: "openshift-monitoring"})
+}
+
+// newPodMonitor returns the PodMonitor scraping the metrics of the keepalived pods, the prometheus operator types are not a dependency of the operator
+func newPodMonitor(instance *redhatcopv1alpha1.KeepalivedGroup) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": podMonitorAPIVersion,
+		"kind":       podMonitorKind,
+		"metadata": map[string]interface{}{
+			"name":      instance.Name,
+			"namespace": instance.Namespace,
+			"labels": map[string]interface{}{
+				keepalivedGroupLabel: instance.Name,
+				"metrics":            "keepalived",
+			},
+		},
+		"spec": map[string]interface{}{
+			"selector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{keepalivedGroupLabel: instance.Name},
+			},
+			"podMetricsEndpoints": []interface{}{
+				map[string]interface{}{"port": "metrics"},
+				map[string]interface{}{"port": "reload-metrics"},
+			},
+		},
+	}}
+}
+
+// getInterfaceArgs returns the config-reloader arguments that select the interface of the VIPs
+func getInterfaceArgs(instance *redhatcopv1alpha1.KeepalivedGroup) []string {
+	args := []string{"--default-interface=" + instance.Spec.Interface}
+	if instance.Spec.InterfaceFromIP != "" {
+		args = append(args, "--reach-ip="+instance.Spec.InterfaceFromIP)
+	}
+	return args
+}
+
+// getImagePullPolicy returns the pull policy of the containers of the keepalived pods, their images are pulled at every start by default
+func getImagePullPolicy(instance *redhatcopv1alpha1.KeepalivedGroup) corev1.PullPolicy {
+	if instance.Spec.DaemonsetImagePullPolicy != "" {
+		return instance.Spec.DaemonsetImagePullPolicy
+	}
+	return corev1.PullAlways
+}
+
+// getContainerOverride returns the settings of a container of the keepalived pods, empty if the KeepalivedGroup does not set any
+func getContainerOverride(instance *redhatcopv1alpha1.KeepalivedGroup, name string) redhatcopv1alpha1.ContainerOverride {
+	for _, container := range instance.Spec.DaemonsetContainers {
+		if container.Name == name {
+			return container
+		}
+	}
+	return redhatcopv1alpha1.ContainerOverride{Name: name}
+}
+
+// overrideContainer sets the resources of the KeepalivedGroup on the container, and its security context merged onto the default one
+func overrideContainer(instance *redhatcopv1alpha1.KeepalivedGroup, container corev1.Container, securityContext *corev1.SecurityContext) corev1.Container {
+	override := getContainerOverride(instance, container.Name)
+	if override.Resources != nil {
+		container.Resources = *override.Resources
+	}
+	container.SecurityContext = mergeSecurityContext(securityContext, override.SecurityContext)
+	return container
+}
+
+// mergeSecurityContext returns the default security context with the fields set by the override.
+// The capabilities the container needs are kept: they are added to the ones of the override and cannot be dropped
+func mergeSecurityContext(defaults *corev1.SecurityContext, override *corev1.SecurityContext) *corev1.SecurityContext {
+	merged := defaults.DeepCopy()
+	if override == nil {
+		return merged
+	}
+	override = override.DeepCopy()
+	if override.Capabilities != nil {
+		if merged.Capabilities != nil {
+			override.Capabilities.Add = mergeCapabilities(merged.Capabilities.Add, override.Capabilities.Add)
+			override.Capabilities.Drop = removeCapabilities(override.Capabilities.Drop, merged.Capabilities.Add)
+		}
+		merged.Capabilities = override.Capabilities
+	}
+	if override.Privileged != nil {
+		merged.Privileged = override.Privileged
+	}
+	if override.SELinuxOptions != nil {
+		merged.SELinuxOptions = override.SELinuxOptions
+	}
+	if override.WindowsOptions != nil {
+		merged.WindowsOptions = override.WindowsOptions
+	}
+	if override.RunAsUser != nil {
+		merged.RunAsUser = override.RunAsUser
+	}
+	if override.RunAsGroup != nil {
+		merged.RunAsGroup = override.RunAsGroup
+	}
+	if override.RunAsNonRoot != nil {
+		merged.RunAsNonRoot = override.RunAsNonRoot
+	}
+	if override.ReadOnlyRootFilesystem != nil {
+		merged.ReadOnlyRootFilesystem = override.ReadOnlyRootFilesystem
+	}
+	if override.AllowPrivilegeEscalation != nil {
+		merged.AllowPrivilegeEscalation = override.AllowPrivilegeEscalation
+	}
+	if override.ProcMount != nil {
+		merged.ProcMount = override.ProcMount
+	}
+	if override.SeccompProfile != nil {
+		merged.SeccompProfile = override.SeccompProfile
+	}
+	return merged
+}
+
+// mergeCapabilities returns the needed capabilities followed by the other capabilities
+func mergeCapabilities(needed []corev1.Capability, capabilities []corev1.Capability) []corev1.Capability {
+	merged := append([]corev1.Capability{}, needed...)
+	return append(merged, removeCapabilities(capabilities, needed)...)
+}
+
+// removeCapabilities returns the capabilities that are not removed
+func removeCapabilities(capabilities []corev1.Capability, removed []corev1.Capability) []corev1.Capability {
+	var kept []corev1.Capability
+	for _, capability := range capabilities {
+		found := false
+		for _, r := range removed {
+			if strings.EqualFold(strings.TrimPrefix(string(capability), "CAP_"), strings.TrimPrefix(string(r), "CAP_")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, capability)
+		}
+	}
+	return kept
+}
+
+func fieldRefEnv(name, fieldPath string) corev1.EnvVar {
+	return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: fieldPath}}}
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
+
+func intOrStringPtr(value intstr.IntOrString) *intstr.IntOrString {
+	return &value
+}
+
+func int64Ptr(value int64) *int64 {
+	return &value
+}
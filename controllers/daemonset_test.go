@@ -0,0 +1,103 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestMergeSecurityContext(t *testing.T) {
+	reloaderDefaults := &corev1.SecurityContext{
+		RunAsUser:    int64Ptr(0),
+		Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_CHROOT", "SYS_PTRACE"}},
+	}
+	cases := []struct {
+		name     string
+		defaults *corev1.SecurityContext
+		override *corev1.SecurityContext
+		want     *corev1.SecurityContext
+	}{
+		{
+			name:     "keeps the defaults without override",
+			defaults: &corev1.SecurityContext{Privileged: boolPtr(true)},
+			want:     &corev1.SecurityContext{Privileged: boolPtr(true)},
+		},
+		{
+			name:     "keeps privileged when the override does not set it",
+			defaults: &corev1.SecurityContext{Privileged: boolPtr(true)},
+			override: &corev1.SecurityContext{ReadOnlyRootFilesystem: boolPtr(true), SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}},
+			want:     &corev1.SecurityContext{Privileged: boolPtr(true), ReadOnlyRootFilesystem: boolPtr(true), SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}},
+		},
+		{
+			name:     "lets the override replace privileged with capabilities",
+			defaults: &corev1.SecurityContext{Privileged: boolPtr(true)},
+			override: &corev1.SecurityContext{Privileged: boolPtr(false), Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}}},
+			want:     &corev1.SecurityContext{Privileged: boolPtr(false), Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}}},
+		},
+		{
+			name:     "overrides the user",
+			defaults: reloaderDefaults,
+			override: &corev1.SecurityContext{RunAsUser: int64Ptr(1000)},
+			want:     &corev1.SecurityContext{RunAsUser: int64Ptr(1000), Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_CHROOT", "SYS_PTRACE"}}},
+		},
+		{
+			name:     "adds the needed capabilities to the ones of the override",
+			defaults: reloaderDefaults,
+			override: &corev1.SecurityContext{Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_RAW", "CAP_SYS_CHROOT"}}},
+			want:     &corev1.SecurityContext{RunAsUser: int64Ptr(0), Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_CHROOT", "SYS_PTRACE", "NET_RAW"}}},
+		},
+		{
+			name:     "does not drop the needed capabilities",
+			defaults: reloaderDefaults,
+			override: &corev1.SecurityContext{Capabilities: &corev1.Capabilities{Drop: []corev1.Capability{"ALL", "sys_ptrace"}}},
+			want:     &corev1.SecurityContext{RunAsUser: int64Ptr(0), Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_CHROOT", "SYS_PTRACE"}, Drop: []corev1.Capability{"ALL"}}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var override *corev1.SecurityContext
+			if c.override != nil {
+				override = c.override.DeepCopy()
+			}
+			got := mergeSecurityContext(c.defaults, c.override)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+			if !reflect.DeepEqual(c.override, override) {
+				t.Error("expected the override not to be modified")
+			}
+		})
+	}
+}
+
+func TestGetImagePullPolicy(t *testing.T) {
+	images := keepalivedImages{Keepalived: "keepalived", ConfigReloader: "operator", VRRPStateReporter: "operator", PrometheusExporter: "operator"}
+	instance := &redhatcopv1alpha1.KeepalivedGroup{}
+	for _, container := range []corev1.Container{newKeepalivedContainer(instance, images), newConfigReloaderContainer(instance, images), newPrometheusExporterContainer(instance, images)} {
+		if container.ImagePullPolicy != corev1.PullAlways {
+			t.Errorf("%s: expected the image to be pulled at every start by default, got %q", container.Name, container.ImagePullPolicy)
+		}
+	}
+	instance.Spec.DaemonsetImagePullPolicy = corev1.PullIfNotPresent
+	if container := newKeepalivedContainer(instance, images); container.ImagePullPolicy != corev1.PullIfNotPresent {
+		t.Errorf("expected the pull policy of the KeepalivedGroup, got %q", container.ImagePullPolicy)
+	}
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// ConfigReverted is True while the rendered configuration is replaced by the last known good configuration, because keepalived crash loops with it
+	configRevertedCondition = "ConfigReverted"
+	crashLoopBackOff        = "CrashLoopBackOff"
+)
+
+// getConfigHistory returns the history settings of the KeepalivedGroup, the history is kept by default
+func getConfigHistory(instance *redhatcopv1alpha1.KeepalivedGroup) redhatcopv1alpha1.ConfigHistory {
+	history := redhatcopv1alpha1.ConfigHistory{RevisionHistoryLimit: 5, MinStableSeconds: 60}
+	if instance.Spec.ConfigHistory != nil {
+		history = *instance.Spec.ConfigHistory
+		if history.RevisionHistoryLimit == 0 {
+			history.RevisionHistoryLimit = 5
+		}
+	}
+	return history
+}
+
+// manageConfigHistory records the rendered configuration as a revision and reverts it to the last known good configuration
+// when keepalived crash loops with it, by rewriting the keepalived.conf key of the rendered ConfigMap.
+// It runs before rolloutConfig, which owns the keepalived-next keys
+func (r *KeepalivedGroupReconciler) manageConfigHistory(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, objs []unstructured.Unstructured, pods []corev1.Pod) error {
+	configMap := getConfigMap(objs)
+	if configMap == nil {
+		return nil
+	}
+	history := getConfigHistory(instance)
+	status := instance.Status.ConfigHistory
+	if status == nil {
+		status = &redhatcopv1alpha1.ConfigHistoryStatus{}
+		instance.Status.ConfigHistory = status
+	}
+	rendered, _, _ := unstructured.NestedString(configMap.Object, "data", keepalivedConfigKey)
+	renderedHash := getConfigHash(rendered)
+	revision, err := r.recordConfigRevision(ctx, instance, rendered, history.RevisionHistoryLimit)
+	if err != nil {
+		return err
+	}
+	status.CurrentRevision = revision
+
+	if renderedHash != status.RevertedConfigHash && !history.DisableCrashLoopRevert {
+		if nodes := getCrashLoopingNodes(pods, renderedHash); len(nodes) > 0 {
+			message := fmt.Sprintf("keepalived crash loops with configuration revision %d on nodes %s", revision, strings.Join(nodes, ","))
+			if status.LastKnownGoodConfigHash == "" || status.LastKnownGoodConfigHash == renderedHash {
+				meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+					Type:    configRevertedCondition,
+					Status:  metav1.ConditionFalse,
+					Reason:  "NoLastKnownGoodConfig",
+					Message: message + ", no previous configuration is known to be good",
+				})
+				return nil
+			}
+			r.GetRecorder().Event(instance, corev1.EventTypeWarning, "ConfigReverted", fmt.Sprintf("%s, reverting to revision %d", message, status.LastKnownGoodRevision))
+			status.RevertedRevision = revision
+			status.RevertedConfigHash = renderedHash
+			status.RevertMessage = message
+		}
+	}
+	if renderedHash != status.RevertedConfigHash {
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type:    configRevertedCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  "CurrentConfig",
+			Message: fmt.Sprintf("the nodes are given configuration revision %d, rendered from the current spec", revision),
+		})
+		return nil
+	}
+	lastKnownGood, err := r.getConfigRevision(ctx, instance, status.LastKnownGoodConfigHash)
+	if err != nil {
+		return err
+	}
+	if lastKnownGood == nil {
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type:    configRevertedCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  "NoLastKnownGoodConfig",
+			Message: fmt.Sprintf("%s, the ConfigMap of last known good revision %d is missing", status.RevertMessage, status.LastKnownGoodRevision),
+		})
+		return nil
+	}
+	// the last known good configuration replaces the rendered one, rolloutConfig then rolls it out like any other configuration
+	_ = unstructured.SetNestedField(configMap.Object, lastKnownGood.Data[keepalivedConfigKey], "data", keepalivedConfigKey)
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:    configRevertedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  "CrashLoop",
+		Message: fmt.Sprintf("%s, the nodes are given last known good revision %d until the rendered configuration changes", status.RevertMessage, status.LastKnownGoodRevision),
+	})
+	return nil
+}
+
+// getCrashLoopingNodes returns the nodes where the keepalived container crash loops after loading the configuration with the hash
+func getCrashLoopingNodes(pods []corev1.Pod, hash string) []string {
+	nodes := []string{}
+	for i := range pods {
+		if pods[i].GetAnnotations()[redhatcopv1alpha1.ConfigHashAnnotation] != hash {
+			continue
+		}
+		for _, status := range pods[i].Status.ContainerStatuses {
+			if status.Name == keepalivedContainerName && status.State.Waiting != nil && status.State.Waiting.Reason == crashLoopBackOff {
+				nodes = append(nodes, pods[i].Spec.NodeName)
+			}
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// updateLastKnownGoodConfig makes the configuration of the rendered ConfigMap the last known good configuration,
+// once all the keepalived pods ran it for MinStableSeconds without keepalived crashing.
+// It returns when to check again, 0 when there is nothing to wait for
+func (r *KeepalivedGroupReconciler) updateLastKnownGoodConfig(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, objs []unstructured.Unstructured, pods []corev1.Pod) (time.Duration, error) {
+	configMap := getConfigMap(objs)
+	status := instance.Status.ConfigHistory
+	if configMap == nil || status == nil {
+		return 0, nil
+	}
+	config, _, _ := unstructured.NestedString(configMap.Object, "data", keepalivedConfigKey)
+	hash := getConfigHash(config)
+	if _, rollout, _ := unstructured.NestedString(configMap.Object, "data", redhatcopv1alpha1.NextConfigPodsKey); rollout || !runStably(pods, hash) {
+		status.StableConfigHash = ""
+		status.StableSince = nil
+		return 0, nil
+	}
+	if status.LastKnownGoodConfigHash == hash {
+		return 0, nil
+	}
+	now := metav1.Now()
+	// a keepalived container that restarted since the configuration was found stable restarts the wait
+	if status.StableConfigHash != hash || status.StableSince == nil || getLastKeepalivedStart(pods).After(status.StableSince.Time) {
+		status.StableConfigHash = hash
+		status.StableSince = &now
+	}
+	wait := status.StableSince.Add(time.Duration(getConfigHistory(instance).MinStableSeconds) * time.Second).Sub(now.Time)
+	if wait > 0 {
+		return maxDuration(wait, minRolloutRequeue), nil
+	}
+	revision, err := r.getConfigRevision(ctx, instance, hash)
+	if err != nil {
+		return 0, err
+	}
+	if revision == nil {
+		// the configuration was reverted to a revision that has been pruned since
+		return 0, nil
+	}
+	number, _ := strconv.ParseInt(revision.GetLabels()[redhatcopv1alpha1.ConfigRevisionLabel], 10, 64)
+	status.LastKnownGoodRevision = number
+	status.LastKnownGoodConfigHash = hash
+	return 0, nil
+}
+
+// runStably returns true if all the keepalived pods loaded the configuration with the hash and their keepalived container runs
+func runStably(pods []corev1.Pod, hash string) bool {
+	candidates := 0
+	for i := range pods {
+		if pods[i].Spec.NodeName == "" || pods[i].GetDeletionTimestamp() != nil {
+			continue
+		}
+		candidates++
+		if pods[i].GetAnnotations()[redhatcopv1alpha1.ConfigHashAnnotation] != hash {
+			return false
+		}
+		for _, status := range pods[i].Status.ContainerStatuses {
+			if status.Name == keepalivedContainerName && status.State.Running == nil {
+				return false
+			}
+		}
+	}
+	return candidates > 0
+}
+
+// getLastKeepalivedStart returns when the keepalived container that started last started
+func getLastKeepalivedStart(pods []corev1.Pod) time.Time {
+	last := time.Time{}
+	for i := range pods {
+		if status := getKeepalivedContainerStatus(&pods[i]); status != nil && status.State.Running != nil && status.State.Running.StartedAt.After(last) {
+			last = status.State.Running.StartedAt.Time
+		}
+	}
+	return last
+}
+
+// recordConfigRevision makes sure a ConfigMap holds the configuration as the latest revision, and prunes the oldest revisions
+func (r *KeepalivedGroupReconciler) recordConfigRevision(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, config string, limit int) (int64, error) {
+	revisions, err := r.listConfigRevisions(ctx, instance)
+	if err != nil {
+		return 0, err
+	}
+	hash := getConfigHash(config)
+	latest := int64(0)
+	var current *corev1.ConfigMap
+	for i := range revisions {
+		revision := getRevisionNumber(&revisions[i])
+		if revision > latest {
+			latest = revision
+		}
+		if revisions[i].GetName() == getConfigRevisionName(instance, hash) {
+			current = &revisions[i]
+		}
+	}
+	switch {
+	case current == nil:
+		current = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      getConfigRevisionName(instance, hash),
+				Namespace: instance.GetNamespace(),
+				Labels: map[string]string{
+					keepalivedGroupLabel:                  instance.GetName(),
+					redhatcopv1alpha1.ConfigRevisionLabel: strconv.FormatInt(latest+1, 10),
+				},
+				Annotations: map[string]string{
+					redhatcopv1alpha1.ConfigHashAnnotation: hash,
+				},
+			},
+			Data: map[string]string{keepalivedConfigKey: config},
+		}
+		if err := controllerutil.SetControllerReference(instance, current, r.GetScheme()); err != nil {
+			return 0, err
+		}
+		if err := r.GetClient().Create(ctx, current); err != nil {
+			r.Log.Error(err, "unable to create configuration revision", "configmap", current.GetName())
+			return 0, err
+		}
+		revisions = append(revisions, *current)
+	case getRevisionNumber(current) < latest:
+		// a configuration rendered again becomes the latest revision, like the revisions of deployments
+		current.Labels[redhatcopv1alpha1.ConfigRevisionLabel] = strconv.FormatInt(latest+1, 10)
+		if err := r.GetClient().Update(ctx, current); err != nil {
+			r.Log.Error(err, "unable to update configuration revision", "configmap", current.GetName())
+			return 0, err
+		}
+	}
+	return getRevisionNumber(current), r.pruneConfigRevisions(ctx, instance, revisions, limit)
+}
+
+// pruneConfigRevisions deletes the oldest revisions beyond the limit, except the last known good revision
+func (r *KeepalivedGroupReconciler) pruneConfigRevisions(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, revisions []corev1.ConfigMap, limit int) error {
+	sort.Slice(revisions, func(i, j int) bool {
+		return getRevisionNumber(&revisions[i]) > getRevisionNumber(&revisions[j])
+	})
+	lastKnownGood := ""
+	if instance.Status.ConfigHistory != nil && instance.Status.ConfigHistory.LastKnownGoodConfigHash != "" {
+		lastKnownGood = getConfigRevisionName(instance, instance.Status.ConfigHistory.LastKnownGoodConfigHash)
+	}
+	for i := range revisions {
+		if i < limit || revisions[i].GetName() == lastKnownGood {
+			continue
+		}
+		err := r.GetClient().Delete(ctx, &revisions[i])
+		if err != nil && !apierrors.IsNotFound(err) {
+			r.Log.Error(err, "unable to delete configuration revision", "configmap", revisions[i].GetName())
+			return err
+		}
+	}
+	return nil
+}
+
+// listConfigRevisions returns the ConfigMaps holding the revisions of the configuration of the KeepalivedGroup
+func (r *KeepalivedGroupReconciler) listConfigRevisions(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup) ([]corev1.ConfigMap, error) {
+	requirement, err := labels.NewRequirement(redhatcopv1alpha1.ConfigRevisionLabel, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	selector := labels.SelectorFromSet(map[string]string{keepalivedGroupLabel: instance.GetName()}).Add(*requirement)
+	configMapList := &corev1.ConfigMapList{}
+	err = r.GetAPIReader().List(ctx, configMapList, &client.ListOptions{Namespace: instance.GetNamespace(), LabelSelector: selector})
+	if err != nil {
+		r.Log.Error(err, "unable to list configuration revisions")
+		return nil, err
+	}
+	return configMapList.Items, nil
+}
+
+// getConfigRevision returns the ConfigMap holding the revision of the configuration with the hash, nil if there is none
+func (r *KeepalivedGroupReconciler) getConfigRevision(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, hash string) (*corev1.ConfigMap, error) {
+	configMap := &corev1.ConfigMap{}
+	err := r.GetAPIReader().Get(ctx, types.NamespacedName{Namespace: instance.GetNamespace(), Name: getConfigRevisionName(instance, hash)}, configMap)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		r.Log.Error(err, "unable to get configuration revision", "hash", hash)
+		return nil, err
+	}
+	return configMap, nil
+}
+
+// getConfigRevisionName names the revisions after the hash of their configuration, so that the revision of a configuration is found without listing them
+func getConfigRevisionName(instance *redhatcopv1alpha1.KeepalivedGroup, hash string) string {
+	return fmt.Sprintf("%s-config-%s", instance.GetName(), shortHash(hash))
+}
+
+func getRevisionNumber(configMap *corev1.ConfigMap) int64 {
+	revision, _ := strconv.ParseInt(configMap.GetLabels()[redhatcopv1alpha1.ConfigRevisionLabel], 10, 64)
+	return revision
+}
+
+// keepalivedRestarted returns true if the keepalived container of the pod restarted or changed state, to catch crash loops
+func keepalivedRestarted(oldPod *corev1.Pod, newPod *corev1.Pod) bool {
+	oldStatus, newStatus := getKeepalivedContainerStatus(oldPod), getKeepalivedContainerStatus(newPod)
+	if oldStatus == nil || newStatus == nil {
+		return oldStatus != newStatus
+	}
+	return oldStatus.RestartCount != newStatus.RestartCount || getWaitingReason(oldStatus) != getWaitingReason(newStatus)
+}
+
+func getKeepalivedContainerStatus(pod *corev1.Pod) *corev1.ContainerStatus {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == keepalivedContainerName {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+func getWaitingReason(status *corev1.ContainerStatus) string {
+	if status.State.Waiting == nil {
+		return ""
+	}
+	return status.State.Waiting.Reason
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"sort"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/scylladb/go-set/strset"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const (
+	defaultOperatorImage = "quay.io/redhat-cop/keepalived-operator:latest"
+	// the operator defaults of the sidecar images fall back to the operator image
+	configReloaderImageEnv     = "KEEPALIVED_OPERATOR_CONFIG_RELOADER_IMAGE_NAME"
+	vrrpStateReporterImageEnv  = "KEEPALIVED_OPERATOR_VRRP_STATE_REPORTER_IMAGE_NAME"
+	prometheusExporterImageEnv = "KEEPALIVED_OPERATOR_PROMETHEUS_EXPORTER_IMAGE_NAME"
+)
+
+// keepalivedImages are the images of the containers of the keepalived pods
+type keepalivedImages struct {
+	Keepalived         string
+	ConfigReloader     string
+	VRRPStateReporter  string
+	PrometheusExporter string
+}
+
+// containers returns the image of each container of the keepalived pods, by container name
+func (i keepalivedImages) containers() map[string]string {
+	return map[string]string{
+		keepalivedContainerName:         i.Keepalived,
+		configSetupContainerName:        i.ConfigReloader,
+		configReloaderContainerName:     i.ConfigReloader,
+		vrrpStateReporterContainerName:  i.VRRPStateReporter,
+		prometheusExporterContainerName: i.PrometheusExporter,
+	}
+}
+
+// getImages resolves the images of the keepalived pods, the images of the KeepalivedGroup override the operator defaults.
+// The operator defaults are checked here, as the webhook only checks the KeepalivedGroup
+func getImages(instance *redhatcopv1alpha1.KeepalivedGroup) (keepalivedImages, error) {
+	operatorImage := lookupImageEnv(imageNameEnv, defaultOperatorImage)
+	images := keepalivedImages{
+		Keepalived:         instance.Spec.Image,
+		ConfigReloader:     lookupImageEnv(configReloaderImageEnv, operatorImage),
+		VRRPStateReporter:  lookupImageEnv(vrrpStateReporterImageEnv, operatorImage),
+		PrometheusExporter: lookupImageEnv(prometheusExporterImageEnv, operatorImage),
+	}
+	if images.Keepalived == "" {
+		images.Keepalived = redhatcopv1alpha1.DefaultImage
+	}
+	if sidecars := instance.Spec.SidecarImages; sidecars != nil {
+		if sidecars.ConfigReloader != "" {
+			images.ConfigReloader = sidecars.ConfigReloader
+		}
+		if sidecars.VRRPStateReporter != "" {
+			images.VRRPStateReporter = sidecars.VRRPStateReporter
+		}
+		if sidecars.PrometheusExporter != "" {
+			images.PrometheusExporter = sidecars.PrometheusExporter
+		}
+	}
+	path := field.NewPath("spec", "sidecarImages")
+	errs := redhatcopv1alpha1.ValidateImage(images.Keepalived, instance.Spec.RequireImageDigests, field.NewPath("spec", "image"))
+	errs = append(errs, redhatcopv1alpha1.ValidateImage(images.ConfigReloader, instance.Spec.RequireImageDigests, path.Child("configReloader"))...)
+	errs = append(errs, redhatcopv1alpha1.ValidateImage(images.VRRPStateReporter, instance.Spec.RequireImageDigests, path.Child("vrrpStateReporter"))...)
+	errs = append(errs, redhatcopv1alpha1.ValidateImage(images.PrometheusExporter, instance.Spec.RequireImageDigests, path.Child("prometheusExporter"))...)
+	return images, errs.ToAggregate()
+}
+
+func lookupImageEnv(name string, defaultImage string) string {
+	if image, ok := os.LookupEnv(name); ok && image != "" {
+		return image
+	}
+	return defaultImage
+}
+
+// getImagesStatus reports the image of each container, and the image IDs the keepalived pods run for it
+func getImagesStatus(images keepalivedImages, pods []corev1.Pod) []redhatcopv1alpha1.ImageStatus {
+	imageIDs := map[string]*strset.Set{}
+	for i := range pods {
+		statuses := append(append([]corev1.ContainerStatus{}, pods[i].Status.InitContainerStatuses...), pods[i].Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if status.ImageID == "" {
+				continue
+			}
+			if _, ok := imageIDs[status.Name]; !ok {
+				imageIDs[status.Name] = strset.New()
+			}
+			imageIDs[status.Name].Add(status.ImageID)
+		}
+	}
+	result := []redhatcopv1alpha1.ImageStatus{}
+	for container, image := range images.containers() {
+		status := redhatcopv1alpha1.ImageStatus{Container: container, Image: image}
+		if ids, ok := imageIDs[container]; ok {
+			status.ImageIDs = ids.List()
+			sort.Strings(status.ImageIDs)
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Container < result[j].Container
+	})
+	return result
+}
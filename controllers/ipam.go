@@ -0,0 +1,563 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"sort"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// LoadBalancerIPsAllocated is False when LoadBalancer services wait for an ip from the address pool of the KeepalivedGroup
+	loadBalancerIPsAllocatedCondition = "LoadBalancerIPsAllocated"
+	// addressPoolFinalizer releases the ips allocated by a KeepalivedGroup when it is deleted
+	addressPoolFinalizer = "keepalived-operator.redhat-cop.io/address-pool"
+)
+
+// ipRange is an inclusive range of IPs of the same family
+type ipRange struct {
+	first netip.Addr
+	last  netip.Addr
+}
+
+func (r ipRange) contains(ip netip.Addr) bool {
+	return r.first.Compare(ip) <= 0 && ip.Compare(r.last) <= 0
+}
+
+// lastAddr returns the highest address of the passed prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 1 << (7 - i%8)
+	}
+	ip, _ := netip.AddrFromSlice(bytes)
+	return ip
+}
+
+// parseIPRange parses a single IP, a CIDR or a range in the form first-last
+func parseIPRange(value string) (ipRange, error) {
+	switch {
+	case strings.Contains(value, "/"):
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return ipRange{}, err
+		}
+		return ipRange{first: prefix.Masked().Addr(), last: lastAddr(prefix)}, nil
+	case strings.Contains(value, "-"):
+		bounds := strings.SplitN(value, "-", 2)
+		first, err := netip.ParseAddr(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return ipRange{}, err
+		}
+		last, err := netip.ParseAddr(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return ipRange{}, err
+		}
+		if first.BitLen() != last.BitLen() || last.Less(first) {
+			return ipRange{}, fmt.Errorf("%s is not a valid ip range", value)
+		}
+		return ipRange{first: first, last: last}, nil
+	default:
+		ip, err := netip.ParseAddr(value)
+		if err != nil {
+			return ipRange{}, err
+		}
+		return ipRange{first: ip, last: ip}, nil
+	}
+}
+
+// addressPool is the parsed form of the address pool of a KeepalivedGroup or of a KeepalivedAddressPool
+type addressPool struct {
+	prefixes  []netip.Prefix
+	addresses []netip.Addr
+	reserved  []ipRange
+}
+
+func parseAddressPool(cidrs []string, addresses []string, reserved []string) (*addressPool, error) {
+	result := &addressPool{}
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address pool cidr %s: %w", cidr, err)
+		}
+		result.prefixes = append(result.prefixes, prefix.Masked())
+	}
+	for _, address := range addresses {
+		ip, err := netip.ParseAddr(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address pool address %s: %w", address, err)
+		}
+		result.addresses = append(result.addresses, ip)
+	}
+	for _, value := range reserved {
+		reservedRange, err := parseIPRange(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address pool reserved range %s: %w", value, err)
+		}
+		result.reserved = append(result.reserved, reservedRange)
+	}
+	return result, nil
+}
+
+// usableInPrefix excludes the network and broadcast addresses of IPv4 prefixes that have them
+func usableInPrefix(prefix netip.Prefix, ip netip.Addr) bool {
+	if !prefix.Contains(ip) {
+		return false
+	}
+	if !ip.Is4() || prefix.Bits() >= 31 {
+		return true
+	}
+	if ip == prefix.Addr() {
+		return false
+	}
+	return prefix.Contains(ip.Next())
+}
+
+// reservedRange returns the reserved range containing the passed ip, if any
+func (p *addressPool) reservedRange(ip netip.Addr) (ipRange, bool) {
+	for _, reserved := range p.reserved {
+		if reserved.contains(ip) {
+			return reserved, true
+		}
+	}
+	return ipRange{}, false
+}
+
+func (p *addressPool) contains(ip netip.Addr) bool {
+	if _, ok := p.reservedRange(ip); ok {
+		return false
+	}
+	for _, address := range p.addresses {
+		if address == ip {
+			return true
+		}
+	}
+	for _, prefix := range p.prefixes {
+		if usableInPrefix(prefix, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *addressPool) containsString(value string) bool {
+	ip, err := netip.ParseAddr(value)
+	return err == nil && p.contains(ip)
+}
+
+// nextFree returns the first address of the pool that is neither in use nor reserved, explicit addresses first and then CIDRs in the order they are declared
+func (p *addressPool) nextFree(used map[netip.Addr]string) (netip.Addr, bool) {
+	for _, address := range p.addresses {
+		if _, ok := used[address]; !ok && p.contains(address) {
+			return address, true
+		}
+	}
+	for _, prefix := range p.prefixes {
+		for ip := prefix.Addr(); ip.IsValid() && prefix.Contains(ip); ip = ip.Next() {
+			if reserved, ok := p.reservedRange(ip); ok {
+				// skip the whole reserved range
+				ip = reserved.last
+				continue
+			}
+			if _, ok := used[ip]; !ok && usableInPrefix(prefix, ip) {
+				return ip, true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+func getIngressIPs(service *corev1.Service) []string {
+	ips := []string{}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			ips = append(ips, ingress.IP)
+		}
+	}
+	return ips
+}
+
+// getUsedIPs returns the IPs that are in use, mapped to their user: IPs allocated by other KeepalivedGroups map to the group, IPs found on services map to the service.
+// It also returns the set of existing KeepalivedGroups.
+func (r *KeepalivedGroupReconciler) getUsedIPs(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup) (map[netip.Addr]string, map[string]bool, error) {
+	used := map[netip.Addr]string{}
+	keepalivedGroups := map[string]bool{}
+	markUsed := func(user string, ips ...string) {
+		for _, value := range ips {
+			if ip, err := netip.ParseAddr(value); err == nil {
+				if _, ok := used[ip]; !ok {
+					used[ip] = user
+				}
+			}
+		}
+	}
+	// read the groups without cache to make sure allocations of recent reconcile cycles are visible
+	keepalivedGroupList := &redhatcopv1alpha1.KeepalivedGroupList{}
+	err := r.GetAPIReader().List(ctx, keepalivedGroupList, &client.ListOptions{})
+	if err != nil {
+		r.Log.Error(err, "unable to list keepalived groups")
+		return used, keepalivedGroups, err
+	}
+	for i := range keepalivedGroupList.Items {
+		keepalivedGroup := &keepalivedGroupList.Items[i]
+		keepalivedGroups[apis.GetKeyShort(keepalivedGroup)] = true
+		if apis.GetKeyShort(keepalivedGroup) == apis.GetKeyShort(instance) {
+			continue
+		}
+		for _, ip := range keepalivedGroup.Status.IPAllocations {
+			markUsed("KeepalivedGroup "+apis.GetKeyShort(keepalivedGroup), ip)
+		}
+	}
+	serviceList := &corev1.ServiceList{}
+	err = r.GetClient().List(ctx, serviceList, &client.ListOptions{})
+	if err != nil {
+		r.Log.Error(err, "unable to list services")
+		return used, keepalivedGroups, err
+	}
+	for i := range serviceList.Items {
+		service := &serviceList.Items[i]
+		markUsed(apis.GetKeyShort(service), append(getIngressIPs(service), service.Spec.ExternalIPs...)...)
+	}
+	return used, keepalivedGroups, nil
+}
+
+// allocateLoadBalancerIPs releases the IPs of services that no longer reference the instance and assigns an IP from the address pool to the LoadBalancer services that do not have one.
+// When the instance references a KeepalivedAddressPool the allocations are recorded in the status of the pool before being written to the services.
+// It returns the services with their updated status.
+func (r *KeepalivedGroupReconciler) allocateLoadBalancerIPs(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service) ([]corev1.Service, error) {
+	if instance.Spec.AddressPool != nil && instance.Spec.AddressPoolRef != "" {
+		return services, errors.New("addressPool and addressPoolRef cannot be both set")
+	}
+	var sharedPool *redhatcopv1alpha1.KeepalivedAddressPool
+	var pool *addressPool
+	var err error
+	switch {
+	case instance.Spec.AddressPoolRef != "":
+		sharedPool = &redhatcopv1alpha1.KeepalivedAddressPool{}
+		// read the pool without cache, its status is updated by all the groups referencing it
+		err = r.GetAPIReader().Get(ctx, types.NamespacedName{Name: instance.Spec.AddressPoolRef}, sharedPool)
+		if apierrors.IsNotFound(err) {
+			// the pool may be created later, the ips already allocated are kept and no new ip is allocated meanwhile
+			meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+				Type:    loadBalancerIPsAllocatedCondition,
+				Status:  metav1.ConditionFalse,
+				Reason:  "AddressPoolNotFound",
+				Message: fmt.Sprintf("keepalived address pool %s does not exist, no ip is allocated until it is created", instance.Spec.AddressPoolRef),
+			})
+			return services, nil
+		}
+		if err != nil {
+			r.Log.Error(err, "unable to get keepalived address pool", "name", instance.Spec.AddressPoolRef)
+			return services, err
+		}
+		pool, err = parseAddressPool(sharedPool.Spec.CIDRs, sharedPool.Spec.Addresses, sharedPool.Spec.Reserved)
+	case instance.Spec.AddressPool != nil:
+		pool, err = parseAddressPool(instance.Spec.AddressPool.CIDRs, instance.Spec.AddressPool.Addresses, nil)
+	}
+	if err != nil {
+		return services, err
+	}
+	// the allocations recorded in the pools the instance referenced before are released
+	err = r.releaseAddressPoolAllocations(ctx, instance, instance.Spec.AddressPoolRef)
+	if err != nil {
+		return services, err
+	}
+	referencing := map[string]bool{}
+	for i := range services {
+		if services[i].Spec.Type == corev1.ServiceTypeLoadBalancer {
+			referencing[apis.GetKeyShort(&services[i])] = true
+		}
+	}
+	// release the IPs of services that no longer reference the instance and the IPs that are no longer part of the pool
+	for key, ip := range instance.Status.IPAllocations {
+		if referencing[key] && pool != nil && pool.containsString(ip) {
+			continue
+		}
+		released, err := r.releaseLoadBalancerIP(ctx, key, ip)
+		if err != nil {
+			r.Log.Error(err, "unable to release load balancer ip", "service", key, "ip", ip)
+			return services, err
+		}
+		delete(instance.Status.IPAllocations, key)
+		// a service still referencing the instance gets an ip from the pool in this cycle
+		if service := getServiceByKey(services, key); service != nil && released != nil {
+			*service = *released
+		}
+	}
+	if pool == nil {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, loadBalancerIPsAllocatedCondition)
+		return services, nil
+	}
+	used, keepalivedGroups, err := r.getUsedIPs(ctx, instance)
+	if err != nil {
+		return services, err
+	}
+	if instance.Status.IPAllocations == nil {
+		instance.Status.IPAllocations = map[string]string{}
+	}
+	otherAllocations := []redhatcopv1alpha1.AddressAllocation{}
+	namespaceAllocations := map[string]int{}
+	if sharedPool != nil {
+		for _, allocation := range sharedPool.Status.Allocations {
+			// allocations of this instance are rebuilt below, allocations of deleted groups are dropped
+			if allocation.KeepalivedGroup == apis.GetKeyShort(instance) || !keepalivedGroups[allocation.KeepalivedGroup] {
+				continue
+			}
+			otherAllocations = append(otherAllocations, allocation)
+			if ip, err := netip.ParseAddr(allocation.IP); err == nil {
+				used[ip] = "KeepalivedGroup " + allocation.KeepalivedGroup
+			}
+			if namespacedName, err := getNamespacedName(allocation.Service); err == nil {
+				namespaceAllocations[namespacedName.Namespace]++
+			}
+		}
+		for key := range instance.Status.IPAllocations {
+			if namespacedName, err := getNamespacedName(key); err == nil {
+				namespaceAllocations[namespacedName.Namespace]++
+			}
+		}
+	}
+	// allocate in a deterministic order
+	sort.SliceStable(services, func(i, j int) bool {
+		return apis.GetKeyShort(&services[i]) < apis.GetKeyShort(&services[j])
+	})
+	toBeUpdated := []int{}
+	exhausted := []string{}
+	overQuota := []string{}
+	for i := range services {
+		service := &services[i]
+		if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		key := apis.GetKeyShort(service)
+		ingressIPs := getIngressIPs(service)
+		allocated, ok := instance.Status.IPAllocations[key]
+		if !ok {
+			if len(ingressIPs) > 0 {
+				// adopt IPs from our pool that were written to the service before the allocation could be recorded, leave the others alone
+				if ip, err := netip.ParseAddr(ingressIPs[0]); err == nil && pool.contains(ip) && used[ip] == key {
+					instance.Status.IPAllocations[key] = ip.String()
+				}
+				continue
+			}
+			if sharedPool != nil {
+				if quota, ok := sharedPool.Spec.NamespaceQuotas[service.GetNamespace()]; ok && namespaceAllocations[service.GetNamespace()] >= quota {
+					message := fmt.Sprintf("namespace %s reached its quota of %d ips in keepalived address pool %s", service.GetNamespace(), quota, sharedPool.GetName())
+					r.Log.Info(message, "service", key)
+					r.GetRecorder().Event(service, "Warning", "AddressPoolQuotaExceeded", message)
+					overQuota = append(overQuota, key)
+					continue
+				}
+			}
+			ip, found := netip.Addr{}, false
+			if requested, err := netip.ParseAddr(service.Spec.LoadBalancerIP); err == nil && pool.contains(requested) && used[requested] == "" {
+				ip, found = requested, true
+			} else {
+				ip, found = pool.nextFree(used)
+			}
+			if !found {
+				// the service stays pending until an ip is released, the other services of the group are not held back
+				message := fmt.Sprintf("address pool of keepalived group %s is exhausted, unable to allocate an ip for service %s", apis.GetKeyShort(instance), key)
+				r.Log.Info(message, "service", key)
+				r.GetRecorder().Event(service, "Warning", "AddressPoolExhausted", message)
+				exhausted = append(exhausted, key)
+				continue
+			}
+			allocated = ip.String()
+			instance.Status.IPAllocations[key] = allocated
+			used[ip] = key
+			namespaceAllocations[service.GetNamespace()]++
+		}
+		if len(ingressIPs) == 0 {
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: allocated}}
+			toBeUpdated = append(toBeUpdated, i)
+		}
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, getLoadBalancerIPsAllocatedCondition(exhausted, overQuota))
+	if sharedPool != nil {
+		allocations := otherAllocations
+		for key, ip := range instance.Status.IPAllocations {
+			allocations = append(allocations, redhatcopv1alpha1.AddressAllocation{
+				IP:              ip,
+				Service:         key,
+				KeepalivedGroup: apis.GetKeyShort(instance),
+			})
+		}
+		sort.Slice(allocations, func(i, j int) bool {
+			return allocations[i].IP < allocations[j].IP
+		})
+		if !reflect.DeepEqual(allocations, sharedPool.Status.Allocations) {
+			sharedPool.Status.Allocations = allocations
+			// this fails on conflicting updates, in which case the allocation is retried with the new content of the pool
+			err := r.GetClient().Status().Update(ctx, sharedPool)
+			if err != nil {
+				r.Log.Error(err, "unable to update keepalived address pool allocations", "name", sharedPool.GetName())
+				return services, err
+			}
+		}
+	}
+	for _, i := range toBeUpdated {
+		err := r.GetClient().Status().Update(ctx, &services[i])
+		if err != nil {
+			r.Log.Error(err, "unable to update load balancer ingress", "service", apis.GetKeyShort(&services[i]))
+			return services, err
+		}
+	}
+	return services, nil
+}
+
+// getLoadBalancerIPsAllocatedCondition reports the LoadBalancer services left pending without an ip
+func getLoadBalancerIPsAllocatedCondition(exhausted []string, overQuota []string) metav1.Condition {
+	condition := metav1.Condition{
+		Type:    loadBalancerIPsAllocatedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Allocated",
+		Message: "all the LoadBalancer services have an ip",
+	}
+	switch {
+	case len(exhausted) > 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "AddressPoolExhausted"
+		condition.Message = "the address pool is exhausted, services pending: " + strings.Join(exhausted, ", ")
+		if len(overQuota) > 0 {
+			condition.Message += "; namespace quota exceeded, services pending: " + strings.Join(overQuota, ", ")
+		}
+	case len(overQuota) > 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "AddressPoolQuotaExceeded"
+		condition.Message = "namespace quota exceeded, services pending: " + strings.Join(overQuota, ", ")
+	}
+	return condition
+}
+
+// releaseAddressPoolAllocations removes the allocations of the instance from the status of the KeepalivedAddressPools, except the one named keep
+func (r *KeepalivedGroupReconciler) releaseAddressPoolAllocations(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, keep string) error {
+	poolList := &redhatcopv1alpha1.KeepalivedAddressPoolList{}
+	err := r.GetClient().List(ctx, poolList, &client.ListOptions{})
+	if err != nil {
+		r.Log.Error(err, "unable to list keepalived address pools")
+		return err
+	}
+	for i := range poolList.Items {
+		pool := &poolList.Items[i]
+		if pool.GetName() == keep {
+			continue
+		}
+		allocations := []redhatcopv1alpha1.AddressAllocation{}
+		for _, allocation := range pool.Status.Allocations {
+			if allocation.KeepalivedGroup != apis.GetKeyShort(instance) {
+				allocations = append(allocations, allocation)
+			}
+		}
+		if len(allocations) == len(pool.Status.Allocations) {
+			continue
+		}
+		pool.Status.Allocations = allocations
+		err := r.GetClient().Status().Update(ctx, pool)
+		if err != nil {
+			r.Log.Error(err, "unable to release keepalived address pool allocations", "name", pool.GetName())
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseAllLoadBalancerIPs releases the ips allocated by the instance when it is deleted, from the services and from the KeepalivedAddressPools
+func (r *KeepalivedGroupReconciler) releaseAllLoadBalancerIPs(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup) error {
+	for key, ip := range instance.Status.IPAllocations {
+		_, err := r.releaseLoadBalancerIP(ctx, key, ip)
+		if err != nil {
+			r.Log.Error(err, "unable to release load balancer ip", "service", key, "ip", ip)
+			return err
+		}
+	}
+	return r.releaseAddressPoolAllocations(ctx, instance, "")
+}
+
+// usesAddressPool returns whether the instance allocates ips, its allocations must then be released when it is deleted
+func usesAddressPool(instance *redhatcopv1alpha1.KeepalivedGroup) bool {
+	return instance.Spec.AddressPool != nil || instance.Spec.AddressPoolRef != "" || len(instance.Status.IPAllocations) > 0
+}
+
+// releaseLoadBalancerIP removes the passed IP from the ingress of the service, if the service still exists.
+// It returns the updated service, nil if it was not changed
+func (r *KeepalivedGroupReconciler) releaseLoadBalancerIP(ctx context.Context, key string, ip string) (*corev1.Service, error) {
+	namespacedName, err := getNamespacedName(key)
+	if err != nil {
+		return nil, err
+	}
+	service := &corev1.Service{}
+	err = r.GetClient().Get(ctx, namespacedName, service)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ingress := removeIngressIP(service.Status.LoadBalancer.Ingress, ip)
+	if len(ingress) == len(service.Status.LoadBalancer.Ingress) {
+		return nil, nil
+	}
+	service.Status.LoadBalancer.Ingress = ingress
+	err = r.GetClient().Status().Update(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+func removeIngressIP(ingress []corev1.LoadBalancerIngress, ip string) []corev1.LoadBalancerIngress {
+	result := []corev1.LoadBalancerIngress{}
+	for _, lbi := range ingress {
+		if lbi.IP != ip {
+			result = append(result, lbi)
+		}
+	}
+	return result
+}
+
+// Handler to issue reconciles for the KeepalivedGroups that reference a changed KeepalivedAddressPool
+func (r *KeepalivedGroupReconciler) requestsForKeepalivedAddressPoolChange(obj client.Object) []reconcile.Request {
+	keepalivedGroupList := &redhatcopv1alpha1.KeepalivedGroupList{}
+	err := r.GetClient().List(context.TODO(), keepalivedGroupList, &client.ListOptions{})
+	if err != nil {
+		r.Log.Error(err, "unable to list keepalived groups", "keepalivedaddresspool", obj.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, keepalivedGroup := range keepalivedGroupList.Items {
+		if keepalivedGroup.Spec.AddressPoolRef == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: keepalivedGroup.GetNamespace(), Name: keepalivedGroup.GetName()}})
+		}
+	}
+	return requests
+}
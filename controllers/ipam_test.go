@@ -0,0 +1,451 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestReconciler returns a reconciler working on an in memory client holding the passed objects
+func newTestReconciler(t *testing.T, objs ...client.Object) (*KeepalivedGroupReconciler, *record.FakeRecorder) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := redhatcopv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	recorder := record.NewFakeRecorder(100)
+	return &KeepalivedGroupReconciler{
+		ReconcilerBase: util.NewReconcilerBase(c, scheme, nil, recorder, c),
+		Log:            ctrl.Log.WithName("test"),
+	}, recorder
+}
+
+func newTestService(namespace, name string, serviceType corev1.ServiceType, ingressIPs ...string) *corev1.Service {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       corev1.ServiceSpec{Type: serviceType},
+	}
+	for _, ip := range ingressIPs {
+		service.Status.LoadBalancer.Ingress = append(service.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+	}
+	return service
+}
+
+func TestParseAddressPool(t *testing.T) {
+	cases := []struct {
+		name      string
+		cidrs     []string
+		addresses []string
+		reserved  []string
+		invalid   bool
+		contains  []string
+		excludes  []string
+		next      string
+	}{
+		{
+			name:     "cidr skips network and broadcast",
+			cidrs:    []string{"10.0.0.0/30"},
+			contains: []string{"10.0.0.1", "10.0.0.2"},
+			excludes: []string{"10.0.0.0", "10.0.0.3", "10.0.1.1"},
+			next:     "10.0.0.1",
+		},
+		{
+			name:     "point to point cidr uses both addresses",
+			cidrs:    []string{"10.0.0.0/31"},
+			contains: []string{"10.0.0.0", "10.0.0.1"},
+			next:     "10.0.0.0",
+		},
+		{
+			name:      "addresses come before cidrs",
+			cidrs:     []string{"10.0.0.0/29"},
+			addresses: []string{"192.168.0.10"},
+			contains:  []string{"192.168.0.10", "10.0.0.6"},
+			next:      "192.168.0.10",
+		},
+		{
+			name:     "reserved ranges are skipped",
+			cidrs:    []string{"10.0.0.0/28"},
+			reserved: []string{"10.0.0.1-10.0.0.4", "10.0.0.5", "10.0.0.8/30"},
+			contains: []string{"10.0.0.6", "10.0.0.14"},
+			excludes: []string{"10.0.0.1", "10.0.0.5", "10.0.0.9"},
+			next:     "10.0.0.6",
+		},
+		{
+			name:     "ipv6 cidr",
+			cidrs:    []string{"fd00::/126"},
+			contains: []string{"fd00::", "fd00::3"},
+			next:     "fd00::",
+		},
+		{
+			name:     "everything reserved",
+			cidrs:    []string{"10.0.0.0/30"},
+			reserved: []string{"10.0.0.0/30"},
+			excludes: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{name: "invalid cidr", cidrs: []string{"10.0.0.0/33"}, invalid: true},
+		{name: "invalid address", addresses: []string{"10.0.0"}, invalid: true},
+		{name: "reversed range", reserved: []string{"10.0.0.5-10.0.0.1"}, invalid: true},
+		{name: "range mixing families", reserved: []string{"10.0.0.1-fd00::1"}, invalid: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pool, err := parseAddressPool(tc.cidrs, tc.addresses, tc.reserved)
+			if tc.invalid {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range tc.contains {
+				if !pool.containsString(ip) {
+					t.Errorf("expected the pool to contain %s", ip)
+				}
+			}
+			for _, ip := range tc.excludes {
+				if pool.containsString(ip) {
+					t.Errorf("expected the pool not to contain %s", ip)
+				}
+			}
+			next, found := pool.nextFree(map[netip.Addr]string{})
+			if tc.next == "" {
+				if found {
+					t.Errorf("expected no free ip, found %s", next)
+				}
+				return
+			}
+			if !found || next.String() != tc.next {
+				t.Errorf("expected the first free ip to be %s, found %s", tc.next, next)
+			}
+		})
+	}
+}
+
+func TestAllocateLoadBalancerIPs(t *testing.T) {
+	cases := []struct {
+		name string
+		// services reference the group, others are the other objects of the cluster
+		services    []*corev1.Service
+		others      []client.Object
+		pool        *redhatcopv1alpha1.AddressPool
+		poolRef     string
+		allocations map[string]string
+		// expected results
+		ingress          map[string]string
+		wantAllocations  map[string]string
+		conditionReason  string
+		poolAllocations  []redhatcopv1alpha1.AddressAllocation
+		released         map[string][]string
+		expectEventCount int
+	}{
+		{
+			name: "allocates the first free ip",
+			services: []*corev1.Service{
+				newTestService("ns", "a", corev1.ServiceTypeLoadBalancer),
+				newTestService("ns", "b", corev1.ServiceTypeClusterIP),
+			},
+			others:          []client.Object{newTestService("other", "used", corev1.ServiceTypeLoadBalancer, "10.0.0.1")},
+			pool:            &redhatcopv1alpha1.AddressPool{CIDRs: []string{"10.0.0.0/29"}},
+			ingress:         map[string]string{"ns/a": "10.0.0.2"},
+			wantAllocations: map[string]string{"ns/a": "10.0.0.2"},
+			conditionReason: "Allocated",
+		},
+		{
+			name: "honors the requested ip",
+			services: []*corev1.Service{
+				func() *corev1.Service {
+					service := newTestService("ns", "a", corev1.ServiceTypeLoadBalancer)
+					service.Spec.LoadBalancerIP = "10.0.0.5"
+					return service
+				}(),
+			},
+			pool:            &redhatcopv1alpha1.AddressPool{CIDRs: []string{"10.0.0.0/29"}},
+			ingress:         map[string]string{"ns/a": "10.0.0.5"},
+			wantAllocations: map[string]string{"ns/a": "10.0.0.5"},
+			conditionReason: "Allocated",
+		},
+		{
+			name:            "releases the ips of services that no longer reference the group",
+			services:        []*corev1.Service{newTestService("ns", "a", corev1.ServiceTypeLoadBalancer, "10.0.0.1")},
+			others:          []client.Object{newTestService("ns", "gone", corev1.ServiceTypeLoadBalancer, "10.0.0.2")},
+			pool:            &redhatcopv1alpha1.AddressPool{CIDRs: []string{"10.0.0.0/29"}},
+			allocations:     map[string]string{"ns/a": "10.0.0.1", "ns/gone": "10.0.0.2"},
+			ingress:         map[string]string{"ns/a": "10.0.0.1"},
+			wantAllocations: map[string]string{"ns/a": "10.0.0.1"},
+			released:        map[string][]string{"ns/gone": {}},
+			conditionReason: "Allocated",
+		},
+		{
+			name:            "replaces the ips that left the pool",
+			services:        []*corev1.Service{newTestService("ns", "a", corev1.ServiceTypeLoadBalancer, "10.0.1.1")},
+			pool:            &redhatcopv1alpha1.AddressPool{CIDRs: []string{"10.0.0.0/29"}},
+			allocations:     map[string]string{"ns/a": "10.0.1.1"},
+			ingress:         map[string]string{"ns/a": "10.0.0.1"},
+			wantAllocations: map[string]string{"ns/a": "10.0.0.1"},
+			conditionReason: "Allocated",
+		},
+		{
+			name: "leaves the services pending when the pool is exhausted",
+			services: []*corev1.Service{
+				newTestService("ns", "a", corev1.ServiceTypeLoadBalancer),
+				newTestService("ns", "b", corev1.ServiceTypeLoadBalancer),
+				newTestService("ns", "c", corev1.ServiceTypeLoadBalancer),
+			},
+			pool:             &redhatcopv1alpha1.AddressPool{Addresses: []string{"10.0.0.1"}},
+			ingress:          map[string]string{"ns/a": "10.0.0.1"},
+			wantAllocations:  map[string]string{"ns/a": "10.0.0.1"},
+			conditionReason:  "AddressPoolExhausted",
+			expectEventCount: 2,
+		},
+		{
+			name: "records the allocations in the shared pool and enforces the namespace quotas",
+			services: []*corev1.Service{
+				newTestService("ns", "a", corev1.ServiceTypeLoadBalancer),
+				newTestService("ns", "b", corev1.ServiceTypeLoadBalancer),
+				newTestService("other", "c", corev1.ServiceTypeLoadBalancer),
+			},
+			others: []client.Object{&redhatcopv1alpha1.KeepalivedAddressPool{
+				ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+				Spec: redhatcopv1alpha1.KeepalivedAddressPoolSpec{
+					CIDRs:           []string{"10.0.0.0/29"},
+					Reserved:        []string{"10.0.0.1"},
+					NamespaceQuotas: map[string]int{"ns": 1},
+				},
+			}},
+			poolRef:         "shared",
+			ingress:         map[string]string{"ns/a": "10.0.0.2", "other/c": "10.0.0.3"},
+			wantAllocations: map[string]string{"ns/a": "10.0.0.2", "other/c": "10.0.0.3"},
+			poolAllocations: []redhatcopv1alpha1.AddressAllocation{
+				{IP: "10.0.0.2", Service: "ns/a", KeepalivedGroup: "ns/group"},
+				{IP: "10.0.0.3", Service: "other/c", KeepalivedGroup: "ns/group"},
+			},
+			conditionReason:  "AddressPoolQuotaExceeded",
+			expectEventCount: 1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			instance := &redhatcopv1alpha1.KeepalivedGroup{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "group"},
+				Spec:       redhatcopv1alpha1.KeepalivedGroupSpec{AddressPool: tc.pool, AddressPoolRef: tc.poolRef},
+				Status:     redhatcopv1alpha1.KeepalivedGroupStatus{IPAllocations: tc.allocations},
+			}
+			objs := append([]client.Object{instance}, tc.others...)
+			services := []corev1.Service{}
+			for _, service := range tc.services {
+				objs = append(objs, service)
+				services = append(services, *service)
+			}
+			r, recorder := newTestReconciler(t, objs...)
+
+			services, err := r.allocateLoadBalancerIPs(context.TODO(), instance, services)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(instance.Status.IPAllocations, tc.wantAllocations) {
+				t.Errorf("expected allocations %v, found %v", tc.wantAllocations, instance.Status.IPAllocations)
+			}
+			for i := range services {
+				key := services[i].GetNamespace() + "/" + services[i].GetName()
+				stored := &corev1.Service{}
+				if err := r.GetClient().Get(context.TODO(), types.NamespacedName{Namespace: services[i].GetNamespace(), Name: services[i].GetName()}, stored); err != nil {
+					t.Fatal(err)
+				}
+				ips := getIngressIPs(stored)
+				expected, ok := tc.ingress[key]
+				switch {
+				case ok && (len(ips) != 1 || ips[0] != expected):
+					t.Errorf("expected service %s to get ip %s, found %v", key, expected, ips)
+				case !ok && tc.released[key] == nil && len(ips) > 0:
+					t.Errorf("expected service %s to stay pending, found %v", key, ips)
+				}
+			}
+			for key, expected := range tc.released {
+				namespacedName, _ := getNamespacedName(key)
+				stored := &corev1.Service{}
+				if err := r.GetClient().Get(context.TODO(), namespacedName, stored); err != nil {
+					t.Fatal(err)
+				}
+				if ips := getIngressIPs(stored); len(ips) != len(expected) {
+					t.Errorf("expected the ip of service %s to be released, found %v", key, ips)
+				}
+			}
+			condition := meta.FindStatusCondition(instance.Status.Conditions, loadBalancerIPsAllocatedCondition)
+			if condition == nil || condition.Reason != tc.conditionReason {
+				t.Errorf("expected condition %s with reason %s, found %v", loadBalancerIPsAllocatedCondition, tc.conditionReason, condition)
+			}
+			if tc.poolRef != "" {
+				pool := &redhatcopv1alpha1.KeepalivedAddressPool{}
+				if err := r.GetClient().Get(context.TODO(), types.NamespacedName{Name: tc.poolRef}, pool); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(pool.Status.Allocations, tc.poolAllocations) {
+					t.Errorf("expected pool allocations %v, found %v", tc.poolAllocations, pool.Status.Allocations)
+				}
+			}
+			if len(recorder.Events) != tc.expectEventCount {
+				t.Errorf("expected %d warning events, found %d", tc.expectEventCount, len(recorder.Events))
+			}
+		})
+	}
+}
+
+func TestAllocateLoadBalancerIPsWithoutPool(t *testing.T) {
+	instance := &redhatcopv1alpha1.KeepalivedGroup{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "group"}}
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{Type: loadBalancerIPsAllocatedCondition, Status: metav1.ConditionFalse, Reason: "AddressPoolExhausted"})
+	service := newTestService("ns", "a", corev1.ServiceTypeLoadBalancer)
+	r, _ := newTestReconciler(t, instance, service)
+	services, err := r.allocateLoadBalancerIPs(context.TODO(), instance, []corev1.Service{*service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(getIngressIPs(&services[0])) > 0 {
+		t.Errorf("expected no ip without an address pool, found %v", getIngressIPs(&services[0]))
+	}
+	if condition := meta.FindStatusCondition(instance.Status.Conditions, loadBalancerIPsAllocatedCondition); condition != nil {
+		t.Errorf("expected no %s condition without an address pool, found %v", loadBalancerIPsAllocatedCondition, condition)
+	}
+}
+
+func TestAllocateLoadBalancerIPsMissingPool(t *testing.T) {
+	instance := &redhatcopv1alpha1.KeepalivedGroup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "group"},
+		Spec:       redhatcopv1alpha1.KeepalivedGroupSpec{AddressPoolRef: "missing"},
+		Status:     redhatcopv1alpha1.KeepalivedGroupStatus{IPAllocations: map[string]string{"ns/a": "10.0.0.1"}},
+	}
+	allocated := newTestService("ns", "a", corev1.ServiceTypeLoadBalancer, "10.0.0.1")
+	pending := newTestService("ns", "b", corev1.ServiceTypeLoadBalancer)
+	r, _ := newTestReconciler(t, instance, allocated, pending)
+	services, err := r.allocateLoadBalancerIPs(context.TODO(), instance, []corev1.Service{*allocated, *pending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(instance.Status.IPAllocations, map[string]string{"ns/a": "10.0.0.1"}) {
+		t.Errorf("expected the allocations to be kept, found %v", instance.Status.IPAllocations)
+	}
+	if ips := getIngressIPs(&services[0]); len(ips) != 1 {
+		t.Errorf("expected service ns/a to keep its ip, found %v", ips)
+	}
+	if ips := getIngressIPs(&services[1]); len(ips) != 0 {
+		t.Errorf("expected service ns/b to stay pending, found %v", ips)
+	}
+	condition := meta.FindStatusCondition(instance.Status.Conditions, loadBalancerIPsAllocatedCondition)
+	if condition == nil || condition.Reason != "AddressPoolNotFound" {
+		t.Errorf("expected condition %s with reason AddressPoolNotFound, found %v", loadBalancerIPsAllocatedCondition, condition)
+	}
+}
+
+func newTestAddressPool(name string, cidr string, allocations ...redhatcopv1alpha1.AddressAllocation) *redhatcopv1alpha1.KeepalivedAddressPool {
+	return &redhatcopv1alpha1.KeepalivedAddressPool{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       redhatcopv1alpha1.KeepalivedAddressPoolSpec{CIDRs: []string{cidr}},
+		Status:     redhatcopv1alpha1.KeepalivedAddressPoolStatus{Allocations: allocations},
+	}
+}
+
+func TestAllocateLoadBalancerIPsPoolChange(t *testing.T) {
+	instance := &redhatcopv1alpha1.KeepalivedGroup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "group"},
+		Spec:       redhatcopv1alpha1.KeepalivedGroupSpec{AddressPoolRef: "new"},
+		Status:     redhatcopv1alpha1.KeepalivedGroupStatus{IPAllocations: map[string]string{"ns/a": "10.0.0.2"}},
+	}
+	service := newTestService("ns", "a", corev1.ServiceTypeLoadBalancer, "10.0.0.2")
+	other := redhatcopv1alpha1.AddressAllocation{IP: "10.0.0.3", Service: "ns/b", KeepalivedGroup: "ns/other"}
+	oldPool := newTestAddressPool("old", "10.0.0.0/29", redhatcopv1alpha1.AddressAllocation{IP: "10.0.0.2", Service: "ns/a", KeepalivedGroup: "ns/group"}, other)
+	newPool := newTestAddressPool("new", "10.0.1.0/29")
+	r, _ := newTestReconciler(t, instance, service, oldPool, newPool, &redhatcopv1alpha1.KeepalivedGroup{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "other"}})
+
+	_, err := r.allocateLoadBalancerIPs(context.TODO(), instance, []corev1.Service{*service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.GetClient().Get(context.TODO(), types.NamespacedName{Name: "old"}, oldPool); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(oldPool.Status.Allocations, []redhatcopv1alpha1.AddressAllocation{other}) {
+		t.Errorf("expected the allocation of the group to be released from the old pool, found %v", oldPool.Status.Allocations)
+	}
+	if err := r.GetClient().Get(context.TODO(), types.NamespacedName{Name: "new"}, newPool); err != nil {
+		t.Fatal(err)
+	}
+	expected := []redhatcopv1alpha1.AddressAllocation{{IP: "10.0.1.1", Service: "ns/a", KeepalivedGroup: "ns/group"}}
+	if !reflect.DeepEqual(newPool.Status.Allocations, expected) {
+		t.Errorf("expected the service to get an ip from the new pool %v, found %v", expected, newPool.Status.Allocations)
+	}
+}
+
+func TestReleaseAllLoadBalancerIPs(t *testing.T) {
+	instance := &redhatcopv1alpha1.KeepalivedGroup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "group"},
+		Spec:       redhatcopv1alpha1.KeepalivedGroupSpec{AddressPoolRef: "pool"},
+		Status:     redhatcopv1alpha1.KeepalivedGroupStatus{IPAllocations: map[string]string{"ns/a": "10.0.0.2"}},
+	}
+	r, _ := newTestReconciler(t)
+	if r.IsInitialized(instance) || !util.HasFinalizer(instance, addressPoolFinalizer) {
+		t.Fatalf("expected the finalizer to be added to a group with an address pool, found %v", instance.GetFinalizers())
+	}
+	if !r.IsInitialized(instance) {
+		t.Fatal("expected the group to be initialized once the finalizer is added")
+	}
+
+	service := newTestService("ns", "a", corev1.ServiceTypeLoadBalancer, "10.0.0.2")
+	pool := newTestAddressPool("pool", "10.0.0.0/29", redhatcopv1alpha1.AddressAllocation{IP: "10.0.0.2", Service: "ns/a", KeepalivedGroup: "ns/group"})
+	r, _ = newTestReconciler(t, instance, service, pool)
+	if err := r.releaseAllLoadBalancerIPs(context.TODO(), instance); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.GetClient().Get(context.TODO(), types.NamespacedName{Namespace: "ns", Name: "a"}, service); err != nil {
+		t.Fatal(err)
+	}
+	if ips := getIngressIPs(service); len(ips) != 0 {
+		t.Errorf("expected the ip of the service to be released, found %v", ips)
+	}
+	if err := r.GetClient().Get(context.TODO(), types.NamespacedName{Name: "pool"}, pool); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Status.Allocations) != 0 {
+		t.Errorf("expected the allocations of the group to be released from the pool, found %v", pool.Status.Allocations)
+	}
+
+	instance.Spec.AddressPoolRef = ""
+	instance.Status.IPAllocations = nil
+	if r.IsInitialized(instance) || util.HasFinalizer(instance, addressPoolFinalizer) {
+		t.Errorf("expected the finalizer to be removed from a group without address pool, found %v", instance.GetFinalizers())
+	}
+}
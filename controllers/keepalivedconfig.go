@@ -0,0 +1,188 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/keepalived-operator/pkg/keepalived"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// getKeepalivedConfig returns the keepalived configuration of the KeepalivedGroup.
+// The invalid interface and verbatimconfig annotations of a service are left out, with a warning event on the service
+func (r *KeepalivedGroupReconciler) getKeepalivedConfig(instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service, vrrpInstances []vrrpInstance, pods []corev1.Pod, authPass string) keepalived.Config {
+	config := keepalived.Config{
+		GlobalDefs: getGlobalDefs(instance),
+	}
+	for _, service := range services {
+		if service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal {
+			config.VRRPScripts = append(config.VRRPScripts, keepalived.VRRPScript{
+				Name:    apis.GetKeyShort(&service),
+				Script:  fmt.Sprintf("/usr/bin/curl --fail --max-time 1 http://127.0.0.1:%d/health", service.Spec.HealthCheckNodePort),
+				Timeout: 10,
+				Rise:    3,
+				Fall:    3,
+			})
+		}
+	}
+	verbatimConfigs := map[string][]keepalived.Option{}
+	for _, vrrp := range vrrpInstances {
+		key := apis.GetKeyShort(vrrp.Service)
+		if _, ok := verbatimConfigs[key]; !ok {
+			verbatimConfigs[key] = r.getServiceVerbatimConfig(vrrp.Service)
+			if vrrp.Interface != "" {
+				if err := keepalived.ValidateWord(vrrp.Interface); err != nil {
+					r.GetRecorder().Event(vrrp.Service, corev1.EventTypeWarning, "InvalidInterface", fmt.Sprintf("ignoring annotation %s: %s", keepalivedInterfaceAnnotation, err))
+				}
+			}
+		}
+		if keepalived.ValidateWord(vrrp.Interface) != nil {
+			vrrp.Interface = ""
+		}
+		config.VRRPInstances = append(config.VRRPInstances, getVRRPInstanceConfig(instance, vrrp, pods, authPass, verbatimConfigs[key]))
+	}
+	return config
+}
+
+func getGlobalDefs(instance *redhatcopv1alpha1.KeepalivedGroup) keepalived.GlobalDefs {
+	globalDefs := keepalived.GlobalDefs{
+		RouterID:   instance.Name,
+		NotifyFifo: notifyFifo,
+		Options:    getOptions(instance.Spec.VerbatimConfig),
+	}
+	if defs := instance.Spec.GlobalDefs; defs != nil {
+		globalDefs.VRRPVersion = defs.VRRPVersion
+		globalDefs.VRRPStrict = defs.VRRPStrict
+		globalDefs.VRRPSkipCheckAdvertAddress = defs.VRRPSkipCheckAdvertAddresses
+		globalDefs.EnableScriptSecurity = defs.EnableScriptSecurity
+		globalDefs.ScriptUser = defs.ScriptUser
+		if smtp := defs.SMTP; smtp != nil {
+			globalDefs.SMTPServer = smtp.Server
+			globalDefs.SMTPPort = smtp.Port
+			globalDefs.SMTPConnectTimeout = smtp.ConnectTimeoutSeconds
+			globalDefs.NotificationEmailFrom = smtp.From
+			globalDefs.NotificationEmails = smtp.NotificationEmails
+		}
+	}
+	return globalDefs
+}
+
+func getVRRPInstanceConfig(instance *redhatcopv1alpha1.KeepalivedGroup, vrrp vrrpInstance, pods []corev1.Pod, authPass string, verbatimConfig []keepalived.Option) keepalived.VRRPInstance {
+	config := keepalived.VRRPInstance{
+		Name:                    vrrp.Name,
+		Interface:               instance.Spec.Interface,
+		VirtualRouterID:         instance.Status.RouterIDs[vrrp.Name],
+		NoPreempt:               vrrp.NoPreempt,
+		PreemptDelay:            vrrp.PreemptDelay,
+		AdvertInt:               vrrp.Options.AdvertIntervalSeconds,
+		GarpMasterDelay:         vrrp.Options.GarpMasterDelaySeconds,
+		GarpMasterRepeat:        vrrp.Options.GarpMasterRepeat,
+		GarpMasterRefresh:       vrrp.Options.GarpMasterRefreshSeconds,
+		GarpMasterRefreshRepeat: vrrp.Options.GarpMasterRefreshRepeat,
+		DontTrackPrimary:        vrrp.Options.DontTrackPrimary != nil && *vrrp.Options.DontTrackPrimary,
+		SMTPAlert:               vrrp.Options.SMTPAlert != nil && *vrrp.Options.SMTPAlert,
+		VirtualIPAddresses:      vrrp.IPs,
+		Unicast:                 instance.Spec.UnicastEnabled,
+		AuthPass:                authPass,
+		Options:                 verbatimConfig,
+	}
+	if vrrp.Interface != "" {
+		config.Interface = vrrp.Interface
+	}
+	for _, priority := range vrrp.Priorities {
+		config.Priorities = append(config.Priorities, keepalived.ConditionalPriority{ConfigID: priority.Pod, Priority: priority.Priority})
+	}
+	// the owner of spread VIPs starts as MASTER, unless preemption is disabled
+	if vrrp.OwnerPod != "" && !vrrp.NoPreempt {
+		config.MasterConfigID = vrrp.OwnerPod
+	}
+	for _, track := range vrrp.Options.TrackInterfaces {
+		config.TrackInterfaces = append(config.TrackInterfaces, keepalived.TrackInterface{Name: track.Name, Weight: track.Weight})
+	}
+	for _, route := range vrrp.Options.VirtualRoutes {
+		config.VirtualRoutes = append(config.VirtualRoutes, keepalived.VirtualRoute{
+			Src:    route.Src,
+			To:     route.To,
+			Via:    route.Via,
+			Dev:    route.Dev,
+			Metric: route.Metric,
+			Table:  route.Table,
+		})
+	}
+	if instance.Spec.UnicastEnabled {
+		for _, pod := range pods {
+			config.UnicastPeers = append(config.UnicastPeers, getPodIPs(pod, vrrp.IPv6)...)
+		}
+	}
+	if vrrp.Service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal {
+		config.TrackScripts = []string{apis.GetKeyShort(vrrp.Service)}
+	}
+	return config
+}
+
+// getServiceVerbatimConfig returns the valid entries of the verbatimconfig annotation of the service
+func (r *KeepalivedGroupReconciler) getServiceVerbatimConfig(service *corev1.Service) []keepalived.Option {
+	value := service.GetAnnotations()[keepalivedGroupVerbatimConfigAnnotation]
+	if value == "" {
+		return nil
+	}
+	verbatimConfig := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &verbatimConfig); err != nil {
+		r.GetRecorder().Event(service, corev1.EventTypeWarning, "InvalidVerbatimConfig", fmt.Sprintf("ignoring annotation %s: %s", keepalivedGroupVerbatimConfigAnnotation, err))
+		return nil
+	}
+	options := []keepalived.Option{}
+	for _, option := range getOptions(verbatimConfig) {
+		if err := keepalived.ValidateInstanceOption(option.Keyword, option.Value); err != nil {
+			r.GetRecorder().Event(service, corev1.EventTypeWarning, "InvalidVerbatimConfig", fmt.Sprintf("ignoring %s of annotation %s: %s", option.Keyword, keepalivedGroupVerbatimConfigAnnotation, err))
+			continue
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
+// getOptions returns the verbatim configuration as options sorted by keyword
+func getOptions(verbatimConfig map[string]string) []keepalived.Option {
+	options := []keepalived.Option{}
+	for keyword, value := range verbatimConfig {
+		options = append(options, keepalived.Option{Keyword: keyword, Value: value})
+	}
+	sort.Slice(options, func(i, j int) bool {
+		return options[i].Keyword < options[j].Keyword
+	})
+	return options
+}
+
+// getPodIPs returns the IPs of the passed address family of a keepalived pod, which runs on the host network and therefore has the IPs of its node
+func getPodIPs(pod corev1.Pod, ipv6 bool) []string {
+	ips := []string{}
+	for _, podIP := range pod.Status.PodIPs {
+		if podIP.IP != "" && isIPv6(podIP.IP) == ipv6 {
+			ips = append(ips, podIP.IP)
+		}
+	}
+	if len(ips) == 0 && pod.Status.HostIP != "" && isIPv6(pod.Status.HostIP) == ipv6 {
+		ips = append(ips, pod.Status.HostIP)
+	}
+	return ips
+}
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/netip"
 	"os"
 	"sort"
 	"strings"
@@ -29,16 +30,17 @@ import (
 
 	"github.com/go-logr/logr"
 	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/keepalived-operator/pkg/keepalived"
 	"github.com/redhat-cop/operator-utils/pkg/util"
 	"github.com/redhat-cop/operator-utils/pkg/util/apis"
 	"github.com/redhat-cop/operator-utils/pkg/util/templates"
-	"github.com/scylladb/go-set/iset"
 	"github.com/scylladb/go-set/strset"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -58,7 +60,10 @@ const (
 	keepalivedGroupAnnotation               = "keepalived-operator.redhat-cop.io/keepalivedgroup"
 	keepalivedGroupVerbatimConfigAnnotation = "keepalived-operator.redhat-cop.io/verbatimconfig"
 	keepalivedSpreadVIPsAnnotation          = "keepalived-operator.redhat-cop.io/spreadvips"
+	keepalivedInterfaceAnnotation           = "keepalived-operator.redhat-cop.io/interface"
+	keepalivedRouterIDAnnotation            = "keepalived-operator.redhat-cop.io/routerid"
 	keepalivedGroupLabel                    = "keepalivedGroup"
+	ipv6InstanceSuffix                      = "/ipv6"
 	podMonitorAPIVersion                    = "monitoring.coreos.com/v1"
 	podMonitorKind                          = "PodMonitor"
 )
@@ -98,9 +103,15 @@ func (r *KeepalivedGroupReconciler) setSupportForPodMonitorAvailable() {
 // +kubebuilder:rbac:groups=redhatcop.redhat.io,resources=keepalivedgroups,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=redhatcop.redhat.io,resources=keepalivedgroups/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=redhatcop.redhat.io,resources=keepalivedgroups/finalizers,verbs=update
+// +kubebuilder:rbac:groups=redhatcop.redhat.io,resources=keepalivedaddresspools,verbs=get;list;watch
+// +kubebuilder:rbac:groups=redhatcop.redhat.io,resources=keepalivedaddresspools/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=configmaps/finalizers,verbs=update
 // +kubebuilder:rbac:groups="",resources=services;endpoints;pods;secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=patch
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="apps",resources=daemonsets;daemonsets/finalizers,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="monitoring.coreos.com",resources=podmonitors,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="monitoring.coreos.com",resources=podmonitors/finalizers,verbs=update
@@ -133,6 +144,24 @@ func (r *KeepalivedGroupReconciler) Reconcile(context context.Context, req ctrl.
 		return reconcile.Result{}, err
 	}
 
+	if util.IsBeingDeleted(instance) {
+		if !util.HasFinalizer(instance, addressPoolFinalizer) {
+			return reconcile.Result{}, nil
+		}
+		err := r.releaseAllLoadBalancerIPs(context, instance)
+		if err != nil {
+			log.Error(err, "unable to release the load balancer ips of", "instance", instance)
+			return r.ManageError(context, instance, err)
+		}
+		util.RemoveFinalizer(instance, addressPoolFinalizer)
+		err = r.GetClient().Update(context, instance)
+		if err != nil {
+			log.Error(err, "unable to remove the finalizer of", "instance", instance)
+			return r.ManageError(context, instance, err)
+		}
+		return reconcile.Result{}, nil
+	}
+
 	if ok, err := r.IsValid(instance); !ok {
 		return r.ManageError(context, instance, err)
 	}
@@ -146,24 +175,10 @@ func (r *KeepalivedGroupReconciler) Reconcile(context context.Context, req ctrl.
 		return reconcile.Result{}, nil
 	}
 
-	// Check if VRRP authentication is needed and if so extract credentials
-	authPass := ""
-	if instance.Spec.PasswordAuth.SecretRef.Name != "" {
-		secret := &corev1.Secret{}
-		err := r.GetClient().Get(context, types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.Spec.PasswordAuth.SecretRef.Name}, secret)
-		if err != nil {
-			// Requeue and log error
-			log.Error(err, "could not find passwordAuth secret", "instance", instance)
-			return r.ManageError(context, instance, err)
-		}
-		pass, ok := secret.Data[instance.Spec.PasswordAuth.SecretKey]
-		if !ok {
-			// Requeue and log error
-			err = fmt.Errorf("could not find key %s in secret %s in namespace %s", instance.Spec.PasswordAuth.SecretKey, instance.Spec.PasswordAuth.SecretRef.Name, instance.GetNamespace())
-			log.Error(err, "could not find referenced key in passwordAuth secret", "instance", instance)
-			return r.ManageError(context, instance, err)
-		}
-		authPass = string(pass)
+	authPass, err := r.getAuthPass(context, instance)
+	if err != nil {
+		log.Error(err, "invalid passwordAuth secret", "instance", instance)
+		return r.ManageError(context, instance, err)
 	}
 
 	pods, err := r.getKeepalivedPods(instance)
@@ -172,14 +187,24 @@ func (r *KeepalivedGroupReconciler) Reconcile(context context.Context, req ctrl.
 		log.Error(err, "unable to get referencing services from", "instance", instance)
 		return r.ManageError(context, instance, err)
 	}
-	_, err = r.assignRouterIDs(instance, services)
+	services, err = r.allocateLoadBalancerIPs(context, instance, services)
 	if err != nil {
-		log.Error(err, "unable assign router ids to", "instance", instance, "from services", services)
+		log.Error(err, "unable to allocate load balancer ips to", "instance", instance, "from services", services)
 		return r.ManageError(context, instance, err)
 	}
-	objs, err := r.processTemplate(context, instance, services, pods, authPass)
+	objs, vrrpInstances, err := r.render(context, instance, services, pods, authPass)
 	if err != nil {
-		log.Error(err, "unable process keepalived template from", "instance", instance, "and from services", services)
+		return r.ManageError(context, instance, err)
+	}
+	desiredConfigHash := getDesiredConfigHash(*objs)
+	err = r.manageConfigHistory(context, instance, *objs, pods)
+	if err != nil {
+		log.Error(err, "unable to manage the configuration history of", "instance", instance)
+		return r.ManageError(context, instance, err)
+	}
+	requeueAfter, err := r.rolloutConfig(context, instance, *objs, pods)
+	if err != nil {
+		log.Error(err, "unable to roll out the keepalived configuration of", "instance", instance)
 		return r.ManageError(context, instance, err)
 	}
 
@@ -206,94 +231,224 @@ func (r *KeepalivedGroupReconciler) Reconcile(context context.Context, req ctrl.
 			return r.ManageError(context, instance, err)
 		}
 	}
-	return r.ManageSuccess(context, instance)
+	err = r.updateVRRPInstanceStatuses(context, instance, services, vrrpInstances, pods)
+	if err != nil {
+		log.Error(err, "unable to update the vrrp state of the services of", "instance", instance)
+		return r.ManageError(context, instance, err)
+	}
+	updateDrainedNodesStatus(instance)
+	updateAppliedConfigStatus(instance, desiredConfigHash, pods)
+	stableAfter, err := r.updateLastKnownGoodConfig(context, instance, *objs, pods)
+	if err != nil {
+		log.Error(err, "unable to update the last known good configuration of", "instance", instance)
+		return r.ManageError(context, instance, err)
+	}
+	if requeueAfter == 0 || (stableAfter > 0 && stableAfter < requeueAfter) {
+		requeueAfter = stableAfter
+	}
+	result, err := r.ManageSuccess(context, instance)
+	if err == nil && requeueAfter > 0 {
+		// the rollout and the history progress with time as well as with the pod changes
+		result.RequeueAfter = requeueAfter
+	}
+	return result, err
 }
 
-func (r *KeepalivedGroupReconciler) assignRouterIDs(instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service) (bool, error) {
-	assignedInstances := []string{}
-	assignedIDs := []int{}
-	if len(instance.Spec.BlacklistRouterIDs) > 0 {
-		assignedIDs = append(assignedIDs, instance.Spec.BlacklistRouterIDs...)
-		for key, val := range instance.Status.RouterIDs {
-			for _, id := range instance.Spec.BlacklistRouterIDs {
-				if val == id {
-					delete(instance.Status.RouterIDs, key)
-					break
-				}
-			}
-		}
+// getAuthPass returns the VRRP password of the KeepalivedGroup, empty if it does not use authentication
+func (r *KeepalivedGroupReconciler) getAuthPass(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup) (string, error) {
+	if instance.Spec.PasswordAuth.SecretRef.Name == "" {
+		return "", nil
 	}
-	for key := range instance.Status.RouterIDs {
-		assignedInstances = append(assignedInstances, key)
+	secret := &corev1.Secret{}
+	err := r.GetClient().Get(ctx, types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.Spec.PasswordAuth.SecretRef.Name}, secret)
+	if err != nil {
+		return "", fmt.Errorf("could not find passwordAuth secret %s in namespace %s: %w", instance.Spec.PasswordAuth.SecretRef.Name, instance.GetNamespace(), err)
 	}
-	vrrpInstances := servicesToVRRPInstances(services)
-
-	assignedInstancesSet := strset.New(assignedInstances...)
-	vrrpInstancesSet := strset.New(vrrpInstances...)
-	toBeRemovedSet := strset.Difference(assignedInstancesSet, vrrpInstancesSet)
-	toBeAddedSet := strset.Difference(vrrpInstancesSet, assignedInstancesSet)
+	pass, ok := secret.Data[instance.Spec.PasswordAuth.SecretKey]
+	if !ok {
+		return "", fmt.Errorf("could not find key %s in secret %s in namespace %s", instance.Spec.PasswordAuth.SecretKey, instance.Spec.PasswordAuth.SecretRef.Name, instance.GetNamespace())
+	}
+	if len(pass) > redhatcopv1alpha1.MaxPasswordLength {
+		return "", fmt.Errorf("the password in key %s of secret %s in namespace %s is longer than %d characters", instance.Spec.PasswordAuth.SecretKey, instance.Spec.PasswordAuth.SecretRef.Name, instance.GetNamespace(), redhatcopv1alpha1.MaxPasswordLength)
+	}
+	return string(pass), nil
+}
 
-	for _, value := range toBeRemovedSet.List() {
-		delete(instance.Status.RouterIDs, value)
+// render assigns the router ids of the services, places their vrrp instances on the nodes and renders the objects of the KeepalivedGroup.
+// It updates the status of the instance but does not change the cluster
+func (r *KeepalivedGroupReconciler) render(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service, pods []corev1.Pod, authPass string) (*[]unstructured.Unstructured, []vrrpInstance, error) {
+	log := r.Log.WithValues("keepalivedgroup", apis.GetKeyShort(instance))
+	peers, err := r.getPeerRouterIDs(ctx, instance)
+	if err != nil {
+		log.Error(err, "unable to get router ids of keepalived groups overlapping with", "instance", instance)
+		return nil, nil, err
+	}
+	_, conflicts, exhaustions := r.assignRouterIDs(instance, services, peers)
+	r.reportRouterIDConflicts(instance, conflicts)
+	r.reportRouterIDCollisions(instance, getRouterIDCollisions(instance, peers))
+	r.reportRouterIDExhaustion(instance, exhaustions)
+	// sort services and pods to ensure deterministic template output
+	sortServicesAndPods(services, pods)
+	vrrpInstances := getVRRPInstances(instance, services)
+	err = r.placeVRRPInstances(ctx, instance, vrrpInstances, pods)
+	if err != nil {
+		log.Error(err, "unable to place the vrrp instances of", "instance", instance)
+		return nil, nil, err
 	}
-	for _, value := range instance.Status.RouterIDs {
-		assignedIDs = append(assignedIDs, value)
+	images, err := getImages(instance)
+	if err != nil {
+		log.Error(err, "invalid images for", "instance", instance)
+		return nil, nil, err
 	}
-	// remove potential duplicates and sort
-	assignedIDs = iset.New(assignedIDs...).List()
-	if instance.Status.RouterIDs == nil {
-		instance.Status.RouterIDs = map[string]int{}
+	instance.Status.Images = getImagesStatus(images, pods)
+	objs, err := r.processTemplate(ctx, instance, services, vrrpInstances, pods, images, authPass)
+	if err != nil {
+		log.Error(err, "unable process keepalived template from", "instance", instance, "and from services", services)
+		return nil, nil, err
 	}
-	for _, value := range toBeAddedSet.List() {
-		id, err := findNextAvailableID(assignedIDs)
-		if err != nil {
-			r.Log.Error(err, "unable assign a router id to", "service", value)
-			return false, err
-		}
-		instance.Status.RouterIDs[value] = id
-		assignedIDs = append(assignedIDs, instance.Status.RouterIDs[value])
+	return objs, vrrpInstances, nil
+}
+
+// vrrpInstance describes a vrrp_instance section of the keepalived configuration
+type vrrpInstance struct {
+	// Name identifies the instance in the keepalived configuration and in Status.RouterIDs
+	Name string
+	// Service is the service the VIPs of the instance belong to
+	Service *corev1.Service
+	// IPv6 is true when the VIPs are IPv6 addresses, keepalived cannot mix address families in one instance
+	IPv6 bool
+	// IPs are the VIPs of the instance
+	IPs []string
+	// SpreadIndex is the position of the VIP among the VIPs of a service with spreadvips enabled, -1 otherwise
+	SpreadIndex int
+	// Interface overrides the interface of the KeepalivedGroup for this instance, when not empty
+	Interface string
+	// Priorities are the priorities of the keepalived pods on the nodes selected by the node priorities of the service,
+	// the other pods keep the default priority
+	Priorities []podPriority
+	// Owner is the node the VIPs of an instance of a service with spreadvips enabled are assigned to, in zone OwnerZone.
+	// OwnerPod is the keepalived pod of the node
+	Owner     string
+	OwnerZone string
+	OwnerPod  string
+	// NoPreempt and PreemptDelay are the preemption settings of the service
+	NoPreempt    bool
+	PreemptDelay int
+	// Options are the vrrp options of the service
+	Options redhatcopv1alpha1.VRRPOptions
+}
+
+// IsValid checks the fields of the KeepalivedGroup that the CRD schema cannot validate, in case the validating webhook is not deployed
+func (r *KeepalivedGroupReconciler) IsValid(obj metav1.Object) (bool, error) {
+	instance, ok := obj.(*redhatcopv1alpha1.KeepalivedGroup)
+	if !ok {
+		return false, fmt.Errorf("expected a KeepalivedGroup, got %T", obj)
+	}
+	if errs := instance.ValidateSpec(); len(errs) > 0 {
+		return false, errs.ToAggregate()
 	}
-	return (toBeAddedSet.Size() > 0 || toBeRemovedSet.Size() > 0), nil
+	return true, nil
 }
 
-func findNextAvailableID(ids []int) (int, error) {
-	if len(ids) == 0 {
-		return 1, nil
+// IsInitialized applies the defaults of the KeepalivedGroup, in case the defaulting webhook is not deployed,
+// and sets the finalizer releasing the ips of the KeepalivedGroups that allocate ips
+func (r *KeepalivedGroupReconciler) IsInitialized(obj metav1.Object) bool {
+	instance, ok := obj.(*redhatcopv1alpha1.KeepalivedGroup)
+	if !ok {
+		return false
 	}
-	usedSet := iset.New(ids...)
-	for i := 1; i <= 255; i++ {
-		used := false
-		if usedSet.Has(i) {
-			used = true
+	initialized := !instance.Default()
+	if usesAddressPool(instance) != util.HasFinalizer(instance, addressPoolFinalizer) {
+		if usesAddressPool(instance) {
+			util.AddFinalizer(instance, addressPoolFinalizer)
+		} else {
+			util.RemoveFinalizer(instance, addressPoolFinalizer)
 		}
-		if !used {
-			return i, nil
+		initialized = false
+	}
+	return initialized
+}
+
+// getVRRPInstances returns the vrrp instances of the services that have a router id.
+// Instances whose pinned router id was rejected and that have no router id yet, or whose router id space is full, are left out of the configuration
+func getVRRPInstances(instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service) []vrrpInstance {
+	vrrpInstances := []vrrpInstance{}
+	for _, vrrp := range servicesToVRRPInstances(services) {
+		if _, ok := instance.Status.RouterIDs[vrrp.Name]; ok {
+			vrrpInstances = append(vrrpInstances, vrrp)
 		}
 	}
-	return 0, errors.New("cannot allocate more than 255 ids in one keepalived group")
+	return vrrpInstances
 }
 
-func servicesToVRRPInstances(services []corev1.Service) []string {
-	vrrpInstances := []string{}
-	for _, service := range services {
-		svcName := apis.GetKeyShort(&service)
+// getServiceIPs returns the sorted union of the load balancer ingress IPs and of the external IPs of the service
+func getServiceIPs(service *corev1.Service) []string {
+	ips := strset.Union(strset.New(getIngressIPs(service)...), strset.New(service.Spec.ExternalIPs...)).List()
+	sort.Strings(ips)
+	return ips
+}
+
+func isIPv6(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && addr.Is6() && !addr.Is4In6()
+}
+
+// servicesToVRRPInstances maps the services to the vrrp instances that expose their VIPs.
+// A service with spreadvips enabled gets one instance per VIP, otherwise it gets one instance per address family.
+// For backward compatibility the IPv4 instance (or the only instance of a service without VIPs) is named after the service.
+func servicesToVRRPInstances(services []corev1.Service) []vrrpInstance {
+	vrrpInstances := []vrrpInstance{}
+	for i := range services {
+		service := &services[i]
+		svcName := apis.GetKeyShort(service)
+		ips := getServiceIPs(service)
+		iface := service.GetAnnotations()[keepalivedInterfaceAnnotation]
 		if ann, ok := service.GetAnnotations()[keepalivedSpreadVIPsAnnotation]; ok && ann == "true" {
-			for _, ingress := range service.Status.LoadBalancer.Ingress {
-				vrrpInstances = append(vrrpInstances, svcName+"/"+ingress.IP)
+			for j, ip := range ips {
+				vrrpInstances = append(vrrpInstances, vrrpInstance{
+					Name:        svcName + "/" + ip,
+					Service:     service,
+					IPv6:        isIPv6(ip),
+					IPs:         []string{ip},
+					SpreadIndex: j,
+					Interface:   iface,
+				})
 			}
-			for _, ip := range service.Spec.ExternalIPs {
-				vrrpInstances = append(vrrpInstances, svcName+"/"+ip)
+			continue
+		}
+		ipv4s, ipv6s := []string{}, []string{}
+		for _, ip := range ips {
+			if isIPv6(ip) {
+				ipv6s = append(ipv6s, ip)
+			} else {
+				ipv4s = append(ipv4s, ip)
 			}
-		} else {
-			vrrpInstances = append(vrrpInstances, svcName)
+		}
+		if len(ipv4s) > 0 || len(ipv6s) == 0 {
+			vrrpInstances = append(vrrpInstances, vrrpInstance{
+				Name:        svcName,
+				Service:     service,
+				IPs:         ipv4s,
+				SpreadIndex: -1,
+				Interface:   iface,
+			})
+		}
+		if len(ipv6s) > 0 {
+			vrrpInstances = append(vrrpInstances, vrrpInstance{
+				Name:        svcName + ipv6InstanceSuffix,
+				Service:     service,
+				IPv6:        true,
+				IPs:         ipv6s,
+				SpreadIndex: -1,
+				Interface:   iface,
+			})
 		}
 	}
 
 	return vrrpInstances
 }
 
-func (r *KeepalivedGroupReconciler) processTemplate(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service, pods []corev1.Pod, authPass string) (*[]unstructured.Unstructured, error) {
-	// sort services and pods to ensure deterministic template output
+func sortServicesAndPods(services []corev1.Service, pods []corev1.Pod) {
 	sort.SliceStable(services, func(i, j int) bool {
 		if services[i].GetNamespace() == services[j].GetNamespace() {
 			return services[i].GetName() < services[j].GetName()
@@ -303,24 +458,38 @@ func (r *KeepalivedGroupReconciler) processTemplate(ctx context.Context, instanc
 	sort.SliceStable(pods, func(i, j int) bool {
 		return pods[i].GetName() < pods[j].GetName()
 	})
+}
 
-	imagename, ok := os.LookupEnv(imageNameEnv)
-	if !ok {
-		imagename = "quay.io/redhat-cop/keepalived-operator:latest"
+// processTemplate returns the objects of the KeepalivedGroup, generated by the operator or rendered from the custom template when one is configured
+func (r *KeepalivedGroupReconciler) processTemplate(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service, vrrpInstances []vrrpInstance, pods []corev1.Pod, images keepalivedImages, authPass string) (*[]unstructured.Unstructured, error) {
+	if r.keepalivedTemplate == nil {
+		objs, err := r.generateObjects(instance, services, vrrpInstances, pods, images, authPass)
+		if err != nil {
+			r.Log.Error(err, "unable to generate the keepalived objects")
+			return &[]unstructured.Unstructured{}, err
+		}
+		return &objs, nil
 	}
 	objs, err := templates.ProcessTemplateArray(ctx, struct {
 		KeepalivedGroup *redhatcopv1alpha1.KeepalivedGroup
 		Services        []corev1.Service
+		VRRPInstances   []vrrpInstance
 		KeepalivedPods  []corev1.Pod
 		Misc            map[string]string
 	}{
 		instance,
 		services,
+		vrrpInstances,
 		pods,
 		map[string]string{
-			"image":              imagename,
-			"supportsPodMonitor": r.supportsPodMonitors,
-			"authPass":           authPass,
+			// image is the operator image, kept for the templates that predate the sidecar images
+			"image":                   lookupImageEnv(imageNameEnv, defaultOperatorImage),
+			"keepalivedImage":         images.Keepalived,
+			"configReloaderImage":     images.ConfigReloader,
+			"vrrpStateReporterImage":  images.VRRPStateReporter,
+			"prometheusExporterImage": images.PrometheusExporter,
+			"supportsPodMonitor":      r.supportsPodMonitors,
+			"authPass":                authPass,
 		},
 	}, r.keepalivedTemplate)
 	if err != nil {
@@ -330,6 +499,36 @@ func (r *KeepalivedGroupReconciler) processTemplate(ctx context.Context, instanc
 	return &objs, nil
 }
 
+// generateObjects returns the DaemonSet, the ConfigMap and the RBAC objects of the KeepalivedGroup, and the PodMonitor when it is supported
+func (r *KeepalivedGroupReconciler) generateObjects(instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service, vrrpInstances []vrrpInstance, pods []corev1.Pod, images keepalivedImages, authPass string) ([]unstructured.Unstructured, error) {
+	config, err := keepalived.Marshal(r.getKeepalivedConfig(instance, services, vrrpInstances, pods, authPass))
+	if err != nil {
+		return nil, err
+	}
+	role, roleBinding := newVRRPStateReporterRBAC(instance)
+	typed := []runtime.Object{newDaemonSet(instance, images), newKeepalivedConfigMap(instance, string(config)), newServiceAccount(instance), role, roleBinding}
+	if r.supportsPodMonitors == "true" {
+		role, roleBinding := newPrometheusRBAC(instance)
+		typed = append(typed, role, roleBinding)
+	}
+	objs := []unstructured.Unstructured{}
+	for _, obj := range typed {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
+		// the zero creation timestamps and statuses of the typed objects are not part of the desired state
+		unstructured.RemoveNestedField(content, "metadata", "creationTimestamp")
+		unstructured.RemoveNestedField(content, "spec", "template", "metadata", "creationTimestamp")
+		unstructured.RemoveNestedField(content, "status")
+		objs = append(objs, unstructured.Unstructured{Object: content})
+	}
+	if r.supportsPodMonitors == "true" {
+		objs = append(objs, *newPodMonitor(instance))
+	}
+	return objs, nil
+}
+
 func (r *KeepalivedGroupReconciler) getKeepalivedPods(instance *redhatcopv1alpha1.KeepalivedGroup) ([]corev1.Pod, error) {
 	podList := &corev1.PodList{}
 	err := r.GetClient().List(context.TODO(), podList, &client.ListOptions{Namespace: instance.GetNamespace(), LabelSelector: labels.SelectorFromSet(map[string]string{keepalivedGroupLabel: instance.GetName()})})
@@ -365,20 +564,17 @@ func (r *KeepalivedGroupReconciler) getReferencingServices(instance *redhatcopv1
 	return result, nil
 }
 
-// func (r *KeepalivedGroupReconciler) IsInitialized(instance *redhatcopv1alpha1.KeepalivedGroup) bool {
-// 	initialized := true
-// 	if instance.Spec.Image == "" {
-// 		instance.Spec.Image = "registry.redhat.io/openshift4/ose-keepalived-ipfailover"
-// 		initialized = false
-// 	}
-// 	return initialized
-// }
-
+// initializeTemplate parses the custom template of the keepalived objects, it returns nil when no custom template is configured
 func (r *KeepalivedGroupReconciler) initializeTemplate() (*template.Template, error) {
 	templateFileName, ok := os.LookupEnv(templateFileNameEnv)
-	if !ok {
-		templateFileName = "/etc/templates/job.template.yaml"
+	if !ok || templateFileName == "" {
+		return nil, nil
 	}
+	return r.parseTemplate(templateFileName)
+}
+
+// parseTemplate parses a template of the keepalived objects
+func (r *KeepalivedGroupReconciler) parseTemplate(templateFileName string) (*template.Template, error) {
 	text, err := ioutil.ReadFile(templateFileName)
 	if err != nil {
 		r.Log.Error(err, "Error reading job template file", "filename", templateFileName)
@@ -407,6 +603,17 @@ func (r *KeepalivedGroupReconciler) initializeTemplate() (*template.Template, er
 			return strset.Union(strset.New(s1...), strset.New(s2...)).List()
 		},
 		"modulus": func(a, b int) int { return a % b },
+		// isTrue dereferences the optional booleans, which are truthy in templates as soon as they are set
+		"isTrue": func(value *bool) bool { return value != nil && *value },
+		// toJson renders a value as JSON, which is valid inline YAML
+		"toJson": func(value interface{}) (string, error) {
+			b, err := json.Marshal(value)
+			return string(b), err
+		},
+		// containerOverride returns the settings of a container of the keepalived pods, empty if the KeepalivedGroup does not set any
+		"containerOverride": getContainerOverride,
+		// podIPs returns the IPs of the passed address family of a keepalived pod, which runs on the host network and therefore has the IPs of its node
+		"podIPs": getPodIPs,
 	}).Parse(string(text))
 	if err != nil {
 		r.Log.Error(err, "Error parsing template", "template", string(text))
@@ -499,13 +706,25 @@ func (r *KeepalivedGroupReconciler) requestsForKeepalivedPodChange(obj client.Ob
 }
 
 // PodChange is a predicate that filters Pod changes to issue KeepalivedGroup reconciles for creation and deletion of keepalived pods
+// and for changes of the VRRP state and of the configuration they notify, and for restarts of keepalived
 type PodChange struct {
 	predicate.Funcs
 }
 
-// Update filters out pod updates
+// Update filters out pod updates that do not change the notified VRRP state or configuration
 func (PodChange) Update(e event.UpdateEvent) bool {
-	return false
+	oldPod, ok := e.ObjectOld.(*corev1.Pod)
+	if !ok {
+		return false
+	}
+	newPod, ok := e.ObjectNew.(*corev1.Pod)
+	if !ok {
+		return false
+	}
+	if _, ok := newPod.GetLabels()[keepalivedGroupLabel]; !ok {
+		return false
+	}
+	return vrrpStatesChanged(oldPod, newPod) || appliedConfigChanged(oldPod, newPod) || keepalivedRestarted(oldPod, newPod)
 }
 
 // Create filters out pod creations if they are not keepalived pods
@@ -594,5 +813,16 @@ func (r *KeepalivedGroupReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			handler.EnqueueRequestsFromMapFunc(r.requestsForKeepalivedPodChange),
 			builder.WithPredicates(PodChange{}),
 		).
+		Watches(&source.Kind{Type: &redhatcopv1alpha1.KeepalivedAddressPool{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForKeepalivedAddressPoolChange),
+		).
+		Watches(&source.Kind{Type: &redhatcopv1alpha1.KeepalivedGroup{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForOverlappingKeepalivedGroups),
+			builder.WithPredicates(RouterIDSpacesChange{}),
+		).
+		Watches(&source.Kind{Type: &corev1.Node{}},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForNodeChange),
+			builder.WithPredicates(NodeChange{}),
+		).
 		Complete(r)
 }
@@ -0,0 +1,224 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	timeout  = 30 * time.Second
+	interval = 250 * time.Millisecond
+)
+
+var _ = Describe("KeepalivedGroup controller", func() {
+
+	// each spec runs in its own namespace, with groups selecting their own nodes so that they do not share router ids with the groups of other specs
+	var namespace string
+
+	BeforeEach(func() {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "keepalived-test-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.GetName()
+	})
+
+	newKeepalivedGroup := func(name string) *redhatcopv1alpha1.KeepalivedGroup {
+		return &redhatcopv1alpha1.KeepalivedGroup{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec: redhatcopv1alpha1.KeepalivedGroupSpec{
+				Interface:    "ens3",
+				NodeSelector: map[string]string{"keepalived-test": namespace + "-" + name},
+			},
+		}
+	}
+
+	newService := func(name string, group string, ips ...string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Annotations: map[string]string{keepalivedGroupAnnotation: namespace + "/" + group},
+			},
+			Spec: corev1.ServiceSpec{
+				Type:        corev1.ServiceTypeClusterIP,
+				ExternalIPs: ips,
+				Ports:       []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+			},
+		}
+	}
+
+	// routerIDs returns the router ids recorded in the status of the group
+	routerIDs := func(name string) func() (map[string]int, error) {
+		return func() (map[string]int, error) {
+			instance := &redhatcopv1alpha1.KeepalivedGroup{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, instance)
+			return instance.Status.RouterIDs, err
+		}
+	}
+
+	// keepalivedConfig returns the keepalived configuration rendered for the group
+	keepalivedConfig := func(name string) func() (string, error) {
+		return func() (string, error) {
+			configMap := &corev1.ConfigMap{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, configMap)
+			return configMap.Data[keepalivedConfigKey], err
+		}
+	}
+
+	key := func(name string) string {
+		return namespace + "/" + name
+	}
+
+	It("renders the DaemonSet and the ConfigMap of a group", func() {
+		instance := newKeepalivedGroup("render")
+		Expect(k8sClient.Create(ctx, instance)).To(Succeed())
+		Expect(k8sClient.Create(ctx, newService("svc1", "render", "192.168.131.129"))).To(Succeed())
+
+		Eventually(keepalivedConfig("render"), timeout, interval).Should(And(
+			ContainSubstring("router_id render"),
+			ContainSubstring(fmt.Sprintf("vrrp_instance %s {", key("svc1"))),
+			ContainSubstring("interface ens3"),
+			ContainSubstring("virtual_router_id 1"),
+			ContainSubstring("192.168.131.129"),
+		))
+
+		daemonSet := &appsv1.DaemonSet{}
+		Eventually(func() error {
+			return k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "render"}, daemonSet)
+		}, timeout, interval).Should(Succeed())
+		Expect(daemonSet.Spec.Template.Spec.NodeSelector).To(Equal(instance.Spec.NodeSelector))
+		Expect(daemonSet.Spec.Template.Spec.HostNetwork).To(BeTrue())
+		Expect(daemonSet.Spec.Selector.MatchLabels).To(HaveKeyWithValue(keepalivedGroupLabel, "render"))
+		containerNames := []string{}
+		for _, container := range daemonSet.Spec.Template.Spec.Containers {
+			containerNames = append(containerNames, container.Name)
+		}
+		Expect(containerNames).To(ContainElements(keepalivedContainerName, configReloaderContainerName))
+		Expect(daemonSet.GetOwnerReferences()).To(ContainElement(And(
+			HaveField("Kind", "KeepalivedGroup"),
+			HaveField("Name", "render"),
+		)))
+	})
+
+	It("allocates router ids to the services and releases them when the services are deleted", func() {
+		Expect(k8sClient.Create(ctx, newKeepalivedGroup("allocation"))).To(Succeed())
+		svc1 := newService("svc1", "allocation", "192.168.131.130")
+		Expect(k8sClient.Create(ctx, svc1)).To(Succeed())
+		Eventually(routerIDs("allocation"), timeout, interval).Should(Equal(map[string]int{key("svc1"): 1}))
+		Expect(k8sClient.Create(ctx, newService("svc2", "allocation", "192.168.131.131"))).To(Succeed())
+		Eventually(routerIDs("allocation"), timeout, interval).Should(Equal(map[string]int{key("svc1"): 1, key("svc2"): 2}))
+
+		By("deleting a service")
+		Expect(k8sClient.Delete(ctx, svc1)).To(Succeed())
+		Eventually(routerIDs("allocation"), timeout, interval).Should(Equal(map[string]int{key("svc2"): 2}))
+		Eventually(keepalivedConfig("allocation"), timeout, interval).ShouldNot(ContainSubstring(key("svc1")))
+
+		By("reusing the released router id for a new service")
+		Expect(k8sClient.Create(ctx, newService("svc3", "allocation", "192.168.131.132"))).To(Succeed())
+		Eventually(routerIDs("allocation"), timeout, interval).Should(Equal(map[string]int{key("svc2"): 2, key("svc3"): 1}))
+	})
+
+	It("never assigns blacklisted router ids", func() {
+		instance := newKeepalivedGroup("blacklist")
+		instance.Spec.BlacklistRouterIDs = []int{1, 2}
+		Expect(k8sClient.Create(ctx, instance)).To(Succeed())
+		Expect(k8sClient.Create(ctx, newService("svc1", "blacklist", "192.168.131.133"))).To(Succeed())
+		Eventually(routerIDs("blacklist"), timeout, interval).Should(Equal(map[string]int{key("svc1"): 3}))
+
+		By("blacklisting the router id in use")
+		Eventually(func() error {
+			instance := &redhatcopv1alpha1.KeepalivedGroup{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "blacklist"}, instance)
+			if err != nil {
+				return err
+			}
+			instance.Spec.BlacklistRouterIDs = []int{1, 2, 3}
+			return k8sClient.Update(ctx, instance)
+		}, timeout, interval).Should(Succeed())
+		Eventually(routerIDs("blacklist"), timeout, interval).Should(Equal(map[string]int{key("svc1"): 4}))
+		Eventually(keepalivedConfig("blacklist"), timeout, interval).Should(ContainSubstring("virtual_router_id 4"))
+	})
+
+	It("moves a service between groups when its annotation changes", func() {
+		Expect(k8sClient.Create(ctx, newKeepalivedGroup("source"))).To(Succeed())
+		Expect(k8sClient.Create(ctx, newKeepalivedGroup("target"))).To(Succeed())
+		service := newService("moving", "source", "192.168.131.134")
+		Expect(k8sClient.Create(ctx, service)).To(Succeed())
+		Eventually(routerIDs("source"), timeout, interval).Should(HaveKey(key("moving")))
+		Eventually(keepalivedConfig("source"), timeout, interval).Should(ContainSubstring("192.168.131.134"))
+
+		By("annotating the service with the other group")
+		Eventually(func() error {
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(service), service)
+			if err != nil {
+				return err
+			}
+			service.Annotations[keepalivedGroupAnnotation] = key("target")
+			return k8sClient.Update(ctx, service)
+		}, timeout, interval).Should(Succeed())
+		Eventually(routerIDs("target"), timeout, interval).Should(Equal(map[string]int{key("moving"): 1}))
+		Eventually(keepalivedConfig("target"), timeout, interval).Should(ContainSubstring("192.168.131.134"))
+		Eventually(routerIDs("source"), timeout, interval).Should(BeEmpty())
+		Eventually(keepalivedConfig("source"), timeout, interval).ShouldNot(ContainSubstring("192.168.131.134"))
+	})
+
+	It("reports a missing passwordAuth secret until it is created", func() {
+		instance := newKeepalivedGroup("auth")
+		instance.Spec.PasswordAuth.SecretRef.Name = "vrrp-password"
+		Expect(k8sClient.Create(ctx, instance)).To(Succeed())
+		Expect(k8sClient.Create(ctx, newService("svc1", "auth", "192.168.131.135"))).To(Succeed())
+
+		Eventually(func() (*metav1.Condition, error) {
+			instance := &redhatcopv1alpha1.KeepalivedGroup{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "auth"}, instance)
+			return meta.FindStatusCondition(instance.Status.Conditions, apis.ReconcileError), err
+		}, timeout, interval).Should(And(
+			Not(BeNil()),
+			HaveField("Status", metav1.ConditionTrue),
+			HaveField("Message", ContainSubstring("could not find passwordAuth secret vrrp-password")),
+		))
+		Consistently(func() bool {
+			err := k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "auth"}, &corev1.ConfigMap{})
+			return apierrors.IsNotFound(err)
+		}, 2*time.Second, interval).Should(BeTrue())
+
+		By("creating the secret")
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "vrrp-password", Namespace: namespace},
+			Data:       map[string][]byte{redhatcopv1alpha1.DefaultSecretKey: []byte("s3cr3t")},
+		}
+		Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+		// secrets are not watched, the failed reconcile cycle is retried
+		Eventually(keepalivedConfig("auth"), timeout, interval).Should(And(
+			ContainSubstring("auth_type PASS"),
+			ContainSubstring("auth_pass s3cr3t"),
+		))
+	})
+})
@@ -0,0 +1,179 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	"github.com/scylladb/go-set/strset"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	drainReasonDrainNodes    = "DrainNodes"
+	drainReasonUnschedulable = "Unschedulable"
+	drainReasonTaint         = "Taint"
+)
+
+// maintenanceTaintKeys are the taints that always put a node under maintenance
+var maintenanceTaintKeys = []string{corev1.TaintNodeUnschedulable, corev1.TaintNodeOutOfService}
+
+// getDrainedNodes returns the nodes running keepalived pods that must hand over their VIPs, because they are listed in DrainNodes
+// or because they are under maintenance
+func (r *KeepalivedGroupReconciler) getDrainedNodes(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, pods []corev1.Pod) ([]redhatcopv1alpha1.DrainedNodeStatus, error) {
+	drained := map[string]redhatcopv1alpha1.DrainedNodeStatus{}
+	for _, node := range instance.Spec.DrainNodes {
+		drained[node] = redhatcopv1alpha1.DrainedNodeStatus{Node: node, Reason: drainReasonDrainNodes, Message: "the node is listed in drainNodes"}
+	}
+	if instance.Spec.NodeMaintenance == nil || !instance.Spec.NodeMaintenance.Disabled {
+		taintKeys := strset.New(maintenanceTaintKeys...)
+		if instance.Spec.NodeMaintenance != nil {
+			taintKeys.Add(instance.Spec.NodeMaintenance.TaintKeys...)
+		}
+		nodes, err := r.getKeepalivedNodes(ctx, pods)
+		if err != nil {
+			return nil, err
+		}
+		for name, node := range nodes {
+			if _, ok := drained[name]; ok {
+				continue
+			}
+			if reason, message, ok := isUnderMaintenance(node, taintKeys); ok {
+				drained[name] = redhatcopv1alpha1.DrainedNodeStatus{Node: name, Reason: reason, Message: message}
+			}
+		}
+	}
+	result := []redhatcopv1alpha1.DrainedNodeStatus{}
+	for _, status := range drained {
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Node < result[j].Node
+	})
+	return result, nil
+}
+
+// isUnderMaintenance returns why the node is under maintenance, if it is cordoned or has one of the taints
+func isUnderMaintenance(node *corev1.Node, taintKeys *strset.Set) (string, string, bool) {
+	if node.Spec.Unschedulable {
+		return drainReasonUnschedulable, "the node is cordoned", true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taintKeys.Has(taint.Key) {
+			return drainReasonTaint, fmt.Sprintf("the node has taint %s:%s", taint.Key, taint.Effect), true
+		}
+	}
+	return "", "", false
+}
+
+// updateDrainedNodesStatus reports the VIPs the drained nodes still hold, from the VRRP state of the instances
+func updateDrainedNodesStatus(instance *redhatcopv1alpha1.KeepalivedGroup) {
+	held := map[string][]string{}
+	for _, status := range instance.Status.VRRPInstances {
+		masters := status.SplitBrain
+		if len(masters) == 0 && status.Master != "" {
+			masters = []string{status.Master}
+		}
+		for _, node := range masters {
+			held[node] = append(held[node], status.VIPs...)
+		}
+	}
+	for i := range instance.Status.DrainedNodes {
+		status := &instance.Status.DrainedNodes[i]
+		status.VIPs = held[status.Node]
+		status.Drained = len(status.VIPs) == 0
+	}
+}
+
+// Handler to issue reconciles for the KeepalivedGroup resources that can run on a node or that run pods on it
+func (r *KeepalivedGroupReconciler) requestsForNodeChange(obj client.Object) []reconcile.Request {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		r.Log.Error(fmt.Errorf("expected a Node, got %T", obj), "could not process node change")
+		return nil
+	}
+	groups := strset.New()
+	keepalivedGroupList := &redhatcopv1alpha1.KeepalivedGroupList{}
+	err := r.GetClient().List(context.TODO(), keepalivedGroupList, &client.ListOptions{})
+	if err != nil {
+		r.Log.Error(err, "unable to list keepalived groups", "node", node.GetName())
+		return nil
+	}
+	for i := range keepalivedGroupList.Items {
+		if labels.SelectorFromSet(keepalivedGroupList.Items[i].Spec.NodeSelector).Matches(labels.Set(node.GetLabels())) {
+			groups.Add(apis.GetKeyShort(&keepalivedGroupList.Items[i]))
+		}
+	}
+	// the node may not match the node selector anymore
+	requirement, err := labels.NewRequirement(keepalivedGroupLabel, selection.Exists, nil)
+	if err != nil {
+		r.Log.Error(err, "unable to select keepalived pods")
+		return nil
+	}
+	podList := &corev1.PodList{}
+	err = r.GetClient().List(context.TODO(), podList, &client.ListOptions{LabelSelector: labels.NewSelector().Add(*requirement)})
+	if err != nil {
+		r.Log.Error(err, "unable to list keepalived pods", "node", node.GetName())
+		return nil
+	}
+	for i := range podList.Items {
+		if podList.Items[i].Spec.NodeName == node.GetName() {
+			groups.Add(podList.Items[i].GetNamespace() + "/" + podList.Items[i].GetLabels()[keepalivedGroupLabel])
+		}
+	}
+	requests := []reconcile.Request{}
+	for _, group := range groups.List() {
+		namespacedName, err := getNamespacedName(group)
+		if err != nil {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: namespacedName})
+	}
+	return requests
+}
+
+// NodeChange is a predicate that filters Node updates that can change the placement of the VIPs:
+// changes of labels, used by node priorities and zone spreading, and of the maintenance state
+type NodeChange struct {
+	predicate.Funcs
+}
+
+// Update filters out node updates that change neither the labels, nor the unschedulable flag, nor the taints
+func (NodeChange) Update(e event.UpdateEvent) bool {
+	oldNode, ok := e.ObjectOld.(*corev1.Node)
+	if !ok {
+		return false
+	}
+	newNode, ok := e.ObjectNew.(*corev1.Node)
+	if !ok {
+		return false
+	}
+	return !reflect.DeepEqual(oldNode.GetLabels(), newNode.GetLabels()) ||
+		oldNode.Spec.Unschedulable != newNode.Spec.Unschedulable ||
+		!reflect.DeepEqual(oldNode.Spec.Taints, newNode.Spec.Taints)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RenderOptions are the settings of the operator that change the rendered objects
+type RenderOptions struct {
+	// TemplateFileName is the custom template of the keepalived objects, the objects are generated when it is empty
+	TemplateFileName string
+	// SupportsPodMonitors renders the PodMonitor and its RBAC objects, as on clusters with the prometheus operator
+	SupportsPodMonitors bool
+}
+
+// RenderResult is the outcome of rendering a KeepalivedGroup offline
+type RenderResult struct {
+	// KeepalivedGroup is the rendered group, with the router ids and the placement of its services in its status
+	KeepalivedGroup *redhatcopv1alpha1.KeepalivedGroup
+	// Objects are the objects the operator would create or update
+	Objects []unstructured.Unstructured
+	// KeepalivedConfig is the keepalived configuration of the ConfigMap
+	KeepalivedConfig string
+	// Events are the events the operator would record, such as the annotations it ignores
+	Events []string
+}
+
+// RenderKeepalivedGroup renders the objects of a KeepalivedGroup without a cluster, the client stands for the content of the cluster:
+// the KeepalivedGroups, including the overlapping ones, the Services, the keepalived Pods, the Nodes, the Secrets and the KeepalivedAddressPools.
+// It runs the same code paths as the reconcile cycle, the router ids already recorded in the status of the KeepalivedGroup are kept.
+// The client is typically an in memory client holding manifests, the services of the group get their allocated load balancer IPs through it
+func RenderKeepalivedGroup(ctx context.Context, c client.Client, group types.NamespacedName, options RenderOptions) (*RenderResult, error) {
+	recorder := &eventCollector{}
+	r := &KeepalivedGroupReconciler{
+		ReconcilerBase:      util.NewReconcilerBase(c, c.Scheme(), nil, recorder, c),
+		Log:                 ctrl.Log.WithName("render").WithName("KeepalivedGroup"),
+		supportsPodMonitors: "false",
+	}
+	if options.SupportsPodMonitors {
+		r.supportsPodMonitors = "true"
+	}
+	if options.TemplateFileName != "" {
+		keepalivedTemplate, err := r.parseTemplate(options.TemplateFileName)
+		if err != nil {
+			return nil, err
+		}
+		r.keepalivedTemplate = keepalivedTemplate
+	}
+
+	instance := &redhatcopv1alpha1.KeepalivedGroup{}
+	err := c.Get(ctx, group, instance)
+	if err != nil {
+		return nil, err
+	}
+	instance.Default()
+	authPass, err := r.getAuthPass(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := r.getKeepalivedPods(instance)
+	if err != nil {
+		return nil, err
+	}
+	services, err := r.getReferencingServices(instance)
+	if err != nil {
+		return nil, err
+	}
+	services, err = r.allocateLoadBalancerIPs(ctx, instance, services)
+	if err != nil {
+		return nil, err
+	}
+	rendered, _, err := r.render(ctx, instance, services, pods, authPass)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RenderResult{
+		KeepalivedGroup: instance,
+		Objects:         *rendered,
+	}
+	if configMap := getConfigMap(*rendered); configMap != nil {
+		result.KeepalivedConfig, _, _ = unstructured.NestedString(configMap.Object, "data", keepalivedConfigKey)
+	}
+	result.Events = recorder.getEvents()
+	return result, nil
+}
+
+// eventCollector records the events of an offline rendering in memory, without bound
+type eventCollector struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+// Event formats the events like the fake recorder of client-go
+func (e *eventCollector) Event(object runtime.Object, eventtype, reason, message string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.events = append(e.events, fmt.Sprintf("%s %s %s", eventtype, reason, message))
+}
+
+func (e *eventCollector) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	e.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (e *eventCollector) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	e.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func (e *eventCollector) getEvents() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]string(nil), e.events...)
+}
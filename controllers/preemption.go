@@ -0,0 +1,118 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	keepalivedNoPreemptAnnotation    = "keepalived-operator.redhat-cop.io/nopreempt"
+	keepalivedPreemptDelayAnnotation = "keepalived-operator.redhat-cop.io/preempt-delay"
+	// drainedPriority is given to the keepalived pods of drained nodes, so that any other node takes over
+	drainedPriority = 1
+)
+
+// getPreemption returns the preemption settings of the service, the annotations of the service override the ones of the KeepalivedGroup
+func getPreemption(instance *redhatcopv1alpha1.KeepalivedGroup, service *corev1.Service) (redhatcopv1alpha1.Preemption, error) {
+	preemption := redhatcopv1alpha1.Preemption{}
+	if instance.Spec.Preemption != nil {
+		preemption = *instance.Spec.Preemption
+	}
+	if value, ok := service.GetAnnotations()[keepalivedNoPreemptAnnotation]; ok {
+		noPreempt, err := parseNoPreempt(value)
+		if err != nil {
+			return preemption, err
+		}
+		preemption.NoPreempt = noPreempt
+	}
+	if value, ok := service.GetAnnotations()[keepalivedPreemptDelayAnnotation]; ok {
+		delay, err := parsePreemptDelay(value)
+		if err != nil {
+			return preemption, err
+		}
+		preemption.PreemptDelay = delay
+	}
+	return preemption, nil
+}
+
+func parseNoPreempt(value string) (bool, error) {
+	if value != "true" && value != "false" {
+		return false, fmt.Errorf("annotation %s must be \"true\" or \"false\", found %q", keepalivedNoPreemptAnnotation, value)
+	}
+	return value == "true", nil
+}
+
+func parsePreemptDelay(value string) (int, error) {
+	delay, err := strconv.Atoi(value)
+	if err != nil || delay < 0 || delay > redhatcopv1alpha1.MaxPreemptDelay {
+		return 0, fmt.Errorf("annotation %s must be a number of seconds between 0 and %d, found %q", keepalivedPreemptDelayAnnotation, redhatcopv1alpha1.MaxPreemptDelay, value)
+	}
+	return delay, nil
+}
+
+// setPreemption sets the preemption settings of the vrrp instances.
+// Services with an invalid annotation get a warning event and the settings of the KeepalivedGroup
+func (r *KeepalivedGroupReconciler) setPreemption(instance *redhatcopv1alpha1.KeepalivedGroup, vrrpInstances []vrrpInstance) {
+	reported := map[string]bool{}
+	for i := range vrrpInstances {
+		vrrp := &vrrpInstances[i]
+		preemption, err := getPreemption(instance, vrrp.Service)
+		if err != nil {
+			if !reported[apis.GetKeyShort(vrrp.Service)] {
+				r.GetRecorder().Event(vrrp.Service, corev1.EventTypeWarning, "InvalidPreemption", fmt.Sprintf("ignoring preemption annotations: %s", err))
+				reported[apis.GetKeyShort(vrrp.Service)] = true
+			}
+			if instance.Spec.Preemption != nil {
+				preemption = *instance.Spec.Preemption
+			}
+		}
+		vrrp.NoPreempt = preemption.NoPreempt
+		vrrp.PreemptDelay = preemption.PreemptDelay
+	}
+}
+
+// drainVRRPInstances gives the lowest priority to the keepalived pods of the drained nodes in all the vrrp instances.
+// Preemption is enabled while nodes are drained, as the other nodes would otherwise let the drained node keep the VIPs
+func drainVRRPInstances(vrrpInstances []vrrpInstance, drainedPods []string) {
+	if len(drainedPods) == 0 {
+		return
+	}
+	drained := map[string]bool{}
+	for _, pod := range drainedPods {
+		drained[pod] = true
+	}
+	for i := range vrrpInstances {
+		vrrp := &vrrpInstances[i]
+		priorities := []podPriority{}
+		for _, priority := range vrrp.Priorities {
+			if !drained[priority.Pod] {
+				priorities = append(priorities, priority)
+			}
+		}
+		for _, pod := range drainedPods {
+			priorities = append(priorities, podPriority{Pod: pod, Priority: drainedPriority})
+		}
+		vrrp.Priorities = priorities
+		vrrp.NoPreempt = false
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const keepalivedNodePrioritiesAnnotation = "keepalived-operator.redhat-cop.io/node-priorities"
+
+// podPriority is rendered as a @<pod> priority <priority> line of a vrrp_instance section
+type podPriority struct {
+	Pod      string
+	Priority int
+}
+
+// parseNodePriorities parses the node-priorities annotation of a service, a JSON list of node priorities
+func parseNodePriorities(value string) ([]redhatcopv1alpha1.NodePriority, error) {
+	priorities := []redhatcopv1alpha1.NodePriority{}
+	if err := json.Unmarshal([]byte(value), &priorities); err != nil {
+		return nil, err
+	}
+	if errs := redhatcopv1alpha1.ValidateNodePriorities(priorities, field.NewPath("")); len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+	return priorities, nil
+}
+
+// getNodePriorities returns the node priorities of the service, falling back to the ones of the KeepalivedGroup
+func getNodePriorities(instance *redhatcopv1alpha1.KeepalivedGroup, service *corev1.Service) ([]redhatcopv1alpha1.NodePriority, error) {
+	value, ok := service.GetAnnotations()[keepalivedNodePrioritiesAnnotation]
+	if !ok {
+		return instance.Spec.NodePriorities, nil
+	}
+	return parseNodePriorities(value)
+}
+
+// getNodePriority returns the highest priority of the entries selecting the node, 0 if none does
+func getNodePriority(priorities []redhatcopv1alpha1.NodePriority, node *corev1.Node) int {
+	result := 0
+	for _, priority := range priorities {
+		selected := priority.NodeName == node.GetName()
+		if priority.NodeName == "" {
+			selected = labels.SelectorFromSet(priority.NodeSelector).Matches(labels.Set(node.GetLabels()))
+		}
+		if selected && priority.Priority > result {
+			result = priority.Priority
+		}
+	}
+	return result
+}
+
+// setNodePriorities sets the priorities of the keepalived pods for the vrrp instances of the services with node priorities.
+// Services with an invalid node-priorities annotation get a warning event and the priorities of the KeepalivedGroup
+func (r *KeepalivedGroupReconciler) setNodePriorities(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, vrrpInstances []vrrpInstance, pods []corev1.Pod) error {
+	var nodes map[string]*corev1.Node
+	reported := map[string]bool{}
+	for i := range vrrpInstances {
+		vrrp := &vrrpInstances[i]
+		priorities, err := getNodePriorities(instance, vrrp.Service)
+		if err != nil {
+			if !reported[apis.GetKeyShort(vrrp.Service)] {
+				r.GetRecorder().Event(vrrp.Service, corev1.EventTypeWarning, "InvalidNodePriorities", fmt.Sprintf("ignoring annotation %s: %s", keepalivedNodePrioritiesAnnotation, err))
+				reported[apis.GetKeyShort(vrrp.Service)] = true
+			}
+			priorities = instance.Spec.NodePriorities
+		}
+		if len(priorities) == 0 {
+			continue
+		}
+		if nodes == nil {
+			nodes, err = r.getKeepalivedNodes(ctx, pods)
+			if err != nil {
+				return err
+			}
+		}
+		for j := range pods {
+			node, ok := nodes[pods[j].Spec.NodeName]
+			if !ok {
+				continue
+			}
+			if priority := getNodePriority(priorities, node); priority > 0 {
+				vrrp.Priorities = append(vrrp.Priorities, podPriority{Pod: pods[j].GetName(), Priority: priority})
+			}
+		}
+		r.Log.V(1).Info("node priorities", "vrrp instance", vrrp.Name, "service", apis.GetKeyShort(vrrp.Service), "priorities", vrrp.Priorities)
+	}
+	return nil
+}
+
+// getKeepalivedNodes returns the nodes the keepalived pods run on, by name
+func (r *KeepalivedGroupReconciler) getKeepalivedNodes(ctx context.Context, pods []corev1.Pod) (map[string]*corev1.Node, error) {
+	nodes := map[string]*corev1.Node{}
+	nodeList := &corev1.NodeList{}
+	err := r.GetClient().List(ctx, nodeList)
+	if err != nil {
+		r.Log.Error(err, "unable to get list of nodes")
+		return nodes, err
+	}
+	scheduled := map[string]bool{}
+	for i := range pods {
+		scheduled[pods[i].Spec.NodeName] = true
+	}
+	for i := range nodeList.Items {
+		if scheduled[nodeList.Items[i].GetName()] {
+			nodes[nodeList.Items[i].GetName()] = &nodeList.Items[i]
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+var updateGoldens = flag.Bool("update", false, "update the golden files of the rendering tests")
+
+// TestRender renders the objects of the KeepalivedGroup of each testdata/render/<case>/input.yaml, which also contains
+// the services, nodes, keepalived pods and secrets of the case, and compares them with the golden files of the case.
+// The template case renders its objects with the keepalived template of config/templates instead of generating them.
+// Run go test ./controllers -run TestRender -update to update the golden files after an intended change
+func TestRender(t *testing.T) {
+	// the images of the golden files do not depend on the environment
+	t.Setenv(imageNameEnv, "quay.io/redhat-cop/keepalived-operator:test")
+	t.Setenv(configReloaderImageEnv, "")
+	t.Setenv(vrrpStateReporterImageEnv, "")
+	t.Setenv(prometheusExporterImageEnv, "")
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := redhatcopv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	options := map[string]RenderOptions{
+		"template": {TemplateFileName: "../config/templates/keepalived-template.yaml"},
+	}
+	cases, err := filepath.Glob(filepath.Join("testdata", "render", "*", "input.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatal("no rendering test cases found")
+	}
+	for _, input := range cases {
+		dir := filepath.Dir(input)
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			objs, group := readTestObjects(t, scheme, input)
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+			result, err := RenderKeepalivedGroup(context.TODO(), c, group, options[filepath.Base(dir)])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var daemonSet []byte
+			for _, obj := range result.Objects {
+				if obj.GetKind() == "DaemonSet" {
+					daemonSet, err = yaml.Marshal(obj.Object)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			compareGolden(t, filepath.Join(dir, "keepalived.conf"), []byte(result.KeepalivedConfig))
+			compareGolden(t, filepath.Join(dir, "daemonset.yaml"), daemonSet)
+		})
+	}
+}
+
+// readTestObjects decodes the objects of a multi-document yaml file and returns them with the name of its KeepalivedGroup
+func readTestObjects(t *testing.T, scheme *runtime.Scheme, fileName string) ([]client.Object, types.NamespacedName) {
+	t.Helper()
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decoder := serializer.NewCodecFactory(scheme).UniversalDeserializer()
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(file))
+	objs := []client.Object{}
+	group := types.NamespacedName{}
+	for {
+		document, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bytes.TrimSpace(document)) == 0 {
+			continue
+		}
+		obj, _, err := decoder.Decode(document, nil, nil)
+		if err != nil {
+			t.Fatalf("unable to decode %s: %v", fileName, err)
+		}
+		if instance, ok := obj.(*redhatcopv1alpha1.KeepalivedGroup); ok {
+			group = types.NamespacedName{Namespace: instance.GetNamespace(), Name: instance.GetName()}
+		}
+		objs = append(objs, obj.(client.Object))
+	}
+	if group.Name == "" {
+		t.Fatalf("%s does not contain a KeepalivedGroup", fileName)
+	}
+	return objs, group
+}
+
+// compareGolden compares the actual content with the golden file, or updates the golden file with -update
+func compareGolden(t *testing.T, fileName string, actual []byte) {
+	t.Helper()
+	if *updateGoldens {
+		if err := os.WriteFile(fileName, actual, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("unable to read golden file, run the test with -update to create it: %v", err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("%s does not match, run the test with -update if the change is intended:\n%s", fileName, actual)
+	}
+}
+
+// TestEventCollector checks that an offline rendering never blocks on the events it records, however many there are
+func TestEventCollector(t *testing.T) {
+	recorder := &eventCollector{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5000; i++ {
+			recorder.Eventf(nil, corev1.EventTypeWarning, "IgnoredAnnotation", "annotation %d is ignored", i)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("recording the events blocked")
+	}
+	events := recorder.getEvents()
+	if len(events) != 5000 || events[4999] != "Warning IgnoredAnnotation annotation 4999 is ignored" {
+		t.Errorf("unexpected events: %d events, last %q", len(events), events[len(events)-1])
+	}
+}
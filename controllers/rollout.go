@@ -0,0 +1,315 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/scylladb/go-set/strset"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// Progressing is True while a canary rollout of the keepalived configuration is in progress
+	progressingCondition = "Progressing"
+	// minRolloutRequeue bounds how often a rollout in progress is checked
+	minRolloutRequeue = time.Second
+)
+
+// rolloutConfig decides which keepalived pods load the configuration rendered from the template, and rewrites the rendered ConfigMap accordingly:
+// keepalived.conf keeps the stable configuration while the rendered one is rolled out to the pods listed in the keepalived-next.pods key.
+// The rendered configuration is the one manageConfigHistory left in keepalived.conf, rolloutConfig is the only writer of the keepalived-next keys.
+// Only the configuration is canaried, the changes of the DaemonSet are rolled out by its rolling update.
+// It returns when the rollout must be checked again, 0 when no rollout is in progress
+func (r *KeepalivedGroupReconciler) rolloutConfig(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, objs []unstructured.Unstructured, pods []corev1.Pod) (time.Duration, error) {
+	configMap := getConfigMap(objs)
+	if configMap == nil || instance.Spec.ConfigRollout == nil || instance.Spec.ConfigRollout.Strategy != redhatcopv1alpha1.CanaryConfigRollout {
+		instance.Status.ConfigRollout = nil
+		meta.RemoveStatusCondition(&instance.Status.Conditions, progressingCondition)
+		return 0, nil
+	}
+	rollout := instance.Spec.ConfigRollout
+	desired, _, _ := unstructured.NestedString(configMap.Object, "data", keepalivedConfigKey)
+	stable, err := r.getStableConfig(ctx, instance, configMap)
+	if err != nil {
+		return 0, err
+	}
+	if stable == "" {
+		// nothing runs yet, there is nothing to protect
+		stable = desired
+	}
+	status := instance.Status.ConfigRollout
+	if status == nil {
+		status = &redhatcopv1alpha1.ConfigRolloutStatus{}
+		instance.Status.ConfigRollout = status
+	}
+	status.StableConfigHash = getConfigHash(stable)
+	desiredHash := getConfigHash(desired)
+	candidates := getRolloutCandidates(pods)
+	now := metav1.Now()
+
+	if desiredHash == status.StableConfigHash || len(candidates) == 0 {
+		r.completeRollout(instance, configMap, desired)
+		return 0, nil
+	}
+	if desiredHash == status.FailedConfigHash {
+		setRolloutConfig(configMap, stable, "", nil)
+		meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+			Type:    progressingCondition,
+			Status:  metav1.ConditionFalse,
+			Reason:  "RolledBack",
+			Message: fmt.Sprintf("configuration %s was rolled back: %s", shortHash(desiredHash), status.FailureMessage),
+		})
+		return 0, nil
+	}
+	if status.TargetConfigHash != desiredHash {
+		status.TargetConfigHash = desiredHash
+		status.FailedConfigHash = ""
+		status.FailureMessage = ""
+		startRolloutStep(status, nextRolloutPods(nil, candidates, rollout.CanaryNodes), now)
+	} else {
+		// the pods deleted since the step started do not count
+		status.UpdatedPods = sortedList(strset.Intersection(strset.New(status.UpdatedPods...), strset.New(candidates...)))
+		if len(status.UpdatedPods) == 0 {
+			startRolloutStep(status, nextRolloutPods(nil, candidates, rollout.CanaryNodes), now)
+		}
+	}
+
+	converged, failure := getRolloutStepState(instance, status, pods)
+	deadline := status.StepStartTime.Add(time.Duration(rollout.ProgressDeadlineSeconds) * time.Second)
+	if failure == "" && !converged && now.After(deadline) {
+		failure = fmt.Sprintf("the nodes of the step did not load the configuration within %d seconds", rollout.ProgressDeadlineSeconds)
+	}
+	if failure != "" {
+		r.rollbackConfig(instance, configMap, stable, failure)
+		return 0, nil
+	}
+	if !converged {
+		status.StableSince = nil
+		r.continueRollout(instance, configMap, stable, desired, len(candidates))
+		return untilRolloutDeadline(deadline, now), nil
+	}
+	if status.StableSince == nil {
+		status.StableSince = &now
+	}
+	if wait := status.StableSince.Add(time.Duration(rollout.StabilizationSeconds) * time.Second).Sub(now.Time); wait > 0 {
+		r.continueRollout(instance, configMap, stable, desired, len(candidates))
+		return maxDuration(wait, minRolloutRequeue), nil
+	}
+	if len(status.UpdatedPods) >= len(candidates) {
+		r.completeRollout(instance, configMap, desired)
+		return 0, nil
+	}
+	step := rollout.StepNodes
+	if step == 0 {
+		step = len(candidates)
+	}
+	startRolloutStep(status, nextRolloutPods(status.UpdatedPods, candidates, step), now)
+	r.continueRollout(instance, configMap, stable, desired, len(candidates))
+	return untilRolloutDeadline(status.StepStartTime.Add(time.Duration(rollout.ProgressDeadlineSeconds)*time.Second), now), nil
+}
+
+// getStableConfig returns the configuration of the live ConfigMap, which the pods outside of the rollout load, empty if there is none yet.
+// The ConfigMap is read from the API server, a stale cache would restart the rollout of a configuration that was just completed
+func (r *KeepalivedGroupReconciler) getStableConfig(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, configMap *unstructured.Unstructured) (string, error) {
+	namespace := configMap.GetNamespace()
+	if namespace == "" {
+		namespace = instance.GetNamespace()
+	}
+	live := &corev1.ConfigMap{}
+	err := r.GetAPIReader().Get(ctx, types.NamespacedName{Namespace: namespace, Name: configMap.GetName()}, live)
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		r.Log.Error(err, "unable to get the keepalived configuration", "configmap", configMap.GetName())
+		return "", err
+	}
+	return live.Data[keepalivedConfigKey], nil
+}
+
+// getRolloutCandidates returns the keepalived pods a configuration is rolled out to, in the order they are picked
+func getRolloutCandidates(pods []corev1.Pod) []string {
+	candidates := []string{}
+	for i := range pods {
+		if pods[i].Spec.NodeName != "" && pods[i].GetDeletionTimestamp() == nil {
+			candidates = append(candidates, pods[i].GetName())
+		}
+	}
+	return candidates
+}
+
+// nextRolloutPods adds count candidates to the updated pods
+func nextRolloutPods(updated []string, candidates []string, count int) []string {
+	result := strset.New(updated...)
+	for _, pod := range candidates {
+		if count <= 0 {
+			break
+		}
+		if !result.Has(pod) {
+			result.Add(pod)
+			count--
+		}
+	}
+	return sortedList(result)
+}
+
+// sortedList keeps the rendered ConfigMap stable across reconciles
+func sortedList(set *strset.Set) []string {
+	list := set.List()
+	sort.Strings(list)
+	return list
+}
+
+func startRolloutStep(status *redhatcopv1alpha1.ConfigRolloutStatus, updatedPods []string, now metav1.Time) {
+	status.UpdatedPods = updatedPods
+	status.StepStartTime = &now
+	status.StableSince = nil
+}
+
+// getRolloutStepState returns whether the updated pods all loaded the configuration being rolled out, and why the configuration must be rolled back, if it must.
+// The VRRP state is the one reported by the last reconcile, the stabilization period lets it catch up
+func getRolloutStepState(instance *redhatcopv1alpha1.KeepalivedGroup, status *redhatcopv1alpha1.ConfigRolloutStatus, pods []corev1.Pod) (bool, string) {
+	updated := strset.New(status.UpdatedPods...)
+	nodes := strset.New()
+	converged := true
+	for i := range pods {
+		if !updated.Has(pods[i].GetName()) {
+			continue
+		}
+		nodes.Add(pods[i].Spec.NodeName)
+		if pods[i].GetAnnotations()[redhatcopv1alpha1.ConfigHashAnnotation] == status.TargetConfigHash {
+			continue
+		}
+		converged = false
+		if reason := pods[i].GetAnnotations()[redhatcopv1alpha1.ConfigErrorAnnotation]; reason != "" {
+			return false, fmt.Sprintf("node %s could not load the configuration: %s", pods[i].Spec.NodeName, reason)
+		}
+	}
+	if !converged {
+		return false, ""
+	}
+	for _, vrrp := range instance.Status.VRRPInstances {
+		for _, node := range vrrp.Fault {
+			if nodes.Has(node) {
+				return false, fmt.Sprintf("vrrp instance %s is in FAULT state on node %s", vrrp.Name, node)
+			}
+		}
+		for _, node := range vrrp.SplitBrain {
+			if nodes.Has(node) {
+				return false, fmt.Sprintf("vrrp instance %s is in split brain between nodes %s", vrrp.Name, strings.Join(vrrp.SplitBrain, ","))
+			}
+		}
+	}
+	return true, ""
+}
+
+// continueRollout makes the updated pods load the configuration being rolled out and the other pods keep the stable configuration
+func (r *KeepalivedGroupReconciler) continueRollout(instance *redhatcopv1alpha1.KeepalivedGroup, configMap *unstructured.Unstructured, stable string, desired string, candidates int) {
+	status := instance.Status.ConfigRollout
+	setRolloutConfig(configMap, stable, desired, status.UpdatedPods)
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:    progressingCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  "RollingOut",
+		Message: fmt.Sprintf("configuration %s is rolled out to %d of %d nodes", shortHash(status.TargetConfigHash), len(status.UpdatedPods), candidates),
+	})
+}
+
+// completeRollout makes all the pods load the rendered configuration, which becomes the stable configuration
+func (r *KeepalivedGroupReconciler) completeRollout(instance *redhatcopv1alpha1.KeepalivedGroup, configMap *unstructured.Unstructured, desired string) {
+	status := instance.Status.ConfigRollout
+	if status.TargetConfigHash == getConfigHash(desired) {
+		r.GetRecorder().Event(instance, corev1.EventTypeNormal, "ConfigRolledOut", fmt.Sprintf("configuration %s was rolled out to all the nodes", shortHash(status.TargetConfigHash)))
+	}
+	setRolloutConfig(configMap, desired, "", nil)
+	status.StableConfigHash = getConfigHash(desired)
+	status.TargetConfigHash = ""
+	status.UpdatedPods = nil
+	status.StepStartTime = nil
+	status.StableSince = nil
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:    progressingCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  "RolloutComplete",
+		Message: fmt.Sprintf("all the nodes run configuration %s", shortHash(status.StableConfigHash)),
+	})
+}
+
+// rollbackConfig makes all the pods load the stable configuration again, the configuration being rolled out is not rolled out again until it changes
+func (r *KeepalivedGroupReconciler) rollbackConfig(instance *redhatcopv1alpha1.KeepalivedGroup, configMap *unstructured.Unstructured, stable string, failure string) {
+	status := instance.Status.ConfigRollout
+	r.GetRecorder().Event(instance, corev1.EventTypeWarning, "ConfigRolledBack", fmt.Sprintf("configuration %s was rolled back: %s", shortHash(status.TargetConfigHash), failure))
+	setRolloutConfig(configMap, stable, "", nil)
+	status.FailedConfigHash = status.TargetConfigHash
+	status.FailureMessage = failure
+	status.TargetConfigHash = ""
+	status.UpdatedPods = nil
+	status.StepStartTime = nil
+	status.StableSince = nil
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:    progressingCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  "RolledBack",
+		Message: fmt.Sprintf("configuration %s was rolled back: %s", shortHash(status.FailedConfigHash), failure),
+	})
+}
+
+// setRolloutConfig sets the configurations of the rendered ConfigMap, next is loaded by the pods listed, if any. Only rolloutConfig calls it
+func setRolloutConfig(configMap *unstructured.Unstructured, stable string, next string, pods []string) {
+	data, _, _ := unstructured.NestedStringMap(configMap.Object, "data")
+	if data == nil {
+		data = map[string]string{}
+	}
+	data[keepalivedConfigKey] = stable
+	delete(data, redhatcopv1alpha1.NextConfigKey)
+	delete(data, redhatcopv1alpha1.NextConfigPodsKey)
+	if len(pods) > 0 {
+		data[redhatcopv1alpha1.NextConfigKey] = next
+		data[redhatcopv1alpha1.NextConfigPodsKey] = strings.Join(pods, "\n") + "\n"
+	}
+	_ = unstructured.SetNestedStringMap(configMap.Object, data, "data")
+}
+
+func untilRolloutDeadline(deadline time.Time, now metav1.Time) time.Duration {
+	return maxDuration(deadline.Sub(now.Time), minRolloutRequeue)
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// shortHash abbreviates a configuration hash in messages, like git abbreviates commits
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
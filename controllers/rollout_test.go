@@ -0,0 +1,373 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	stableTestConfig  = "vrrp_instance stable {}\n"
+	desiredTestConfig = "vrrp_instance desired {}\n"
+)
+
+// rolloutTest runs rolloutConfig on a canary KeepalivedGroup of three nodes, whose live ConfigMap holds stableTestConfig
+type rolloutTest struct {
+	t          *testing.T
+	reconciler *KeepalivedGroupReconciler
+	recorder   *record.FakeRecorder
+	instance   *redhatcopv1alpha1.KeepalivedGroup
+	pods       []corev1.Pod
+	configMap  *unstructured.Unstructured
+}
+
+func newRolloutTest(t *testing.T, rollout *redhatcopv1alpha1.ConfigRollout) *rolloutTest {
+	t.Helper()
+	live := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "keepalived-operator", Name: "group"},
+		Data:       map[string]string{keepalivedConfigKey: stableTestConfig},
+	}
+	reconciler, recorder := newTestReconciler(t, live)
+	test := &rolloutTest{
+		t:          t,
+		reconciler: reconciler,
+		recorder:   recorder,
+		instance: &redhatcopv1alpha1.KeepalivedGroup{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "keepalived-operator", Name: "group"},
+			Spec:       redhatcopv1alpha1.KeepalivedGroupSpec{ConfigRollout: rollout},
+		},
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		test.pods = append(test.pods, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "keepalived-operator",
+				Name:        "group-" + node,
+				Annotations: map[string]string{redhatcopv1alpha1.ConfigHashAnnotation: getConfigHash(stableTestConfig)},
+			},
+			Spec: corev1.PodSpec{NodeName: "node-" + node},
+		})
+	}
+	return test
+}
+
+func newCanaryRollout(stepNodes int, stabilizationSeconds int) *redhatcopv1alpha1.ConfigRollout {
+	return &redhatcopv1alpha1.ConfigRollout{
+		Strategy:                redhatcopv1alpha1.CanaryConfigRollout,
+		CanaryNodes:             1,
+		StepNodes:               stepNodes,
+		StabilizationSeconds:    stabilizationSeconds,
+		ProgressDeadlineSeconds: 600,
+	}
+}
+
+// reconcile renders the desired configuration and rolls it out, like a reconcile cycle does
+func (test *rolloutTest) reconcile(desired string) time.Duration {
+	test.t.Helper()
+	test.configMap = &unstructured.Unstructured{}
+	test.configMap.SetAPIVersion("v1")
+	test.configMap.SetKind("ConfigMap")
+	test.configMap.SetName("group")
+	_ = unstructured.SetNestedStringMap(test.configMap.Object, map[string]string{keepalivedConfigKey: desired}, "data")
+	requeue, err := test.reconciler.rolloutConfig(context.TODO(), test.instance, []unstructured.Unstructured{*test.configMap}, test.pods)
+	if err != nil {
+		test.t.Fatal(err)
+	}
+	test.configMap = getConfigMap([]unstructured.Unstructured{*test.configMap})
+	return requeue
+}
+
+// apply updates the live ConfigMap and makes the pods load the configuration they are given, as the config-reloader sidecars do.
+// The config-reloader sidecars clear the error of a pod once it loads a configuration
+func (test *rolloutTest) apply() {
+	test.t.Helper()
+	data, _, _ := unstructured.NestedStringMap(test.configMap.Object, "data")
+	live := &corev1.ConfigMap{}
+	if err := test.reconciler.GetClient().Get(context.TODO(), client.ObjectKey{Namespace: "keepalived-operator", Name: "group"}, live); err != nil {
+		test.t.Fatal(err)
+	}
+	live.Data = data
+	if err := test.reconciler.GetClient().Update(context.TODO(), live); err != nil {
+		test.t.Fatal(err)
+	}
+	next := strings.Fields(data[redhatcopv1alpha1.NextConfigPodsKey])
+	for i := range test.pods {
+		config := data[keepalivedConfigKey]
+		for _, pod := range next {
+			if pod == test.pods[i].Name {
+				config = data[redhatcopv1alpha1.NextConfigKey]
+			}
+		}
+		test.pods[i].Annotations[redhatcopv1alpha1.ConfigHashAnnotation] = getConfigHash(config)
+		delete(test.pods[i].Annotations, redhatcopv1alpha1.ConfigErrorAnnotation)
+	}
+}
+
+// expectConfigMap checks the configurations the rendered ConfigMap gives to the pods
+func (test *rolloutTest) expectConfigMap(stable string, next string, pods ...string) {
+	test.t.Helper()
+	data, _, _ := unstructured.NestedStringMap(test.configMap.Object, "data")
+	want := map[string]string{keepalivedConfigKey: stable}
+	if len(pods) > 0 {
+		want[redhatcopv1alpha1.NextConfigKey] = next
+		want[redhatcopv1alpha1.NextConfigPodsKey] = strings.Join(pods, "\n") + "\n"
+	}
+	if !reflect.DeepEqual(data, want) {
+		test.t.Errorf("got ConfigMap data %v, want %v", data, want)
+	}
+}
+
+func (test *rolloutTest) expectProgressing(status metav1.ConditionStatus, reason string) {
+	test.t.Helper()
+	condition := meta.FindStatusCondition(test.instance.Status.Conditions, progressingCondition)
+	if condition == nil || condition.Status != status || condition.Reason != reason {
+		test.t.Errorf("got Progressing condition %+v, want %s %s", condition, status, reason)
+	}
+}
+
+func (test *rolloutTest) expectEvent(reason string) {
+	test.t.Helper()
+	select {
+	case event := <-test.recorder.Events:
+		if !strings.Contains(event, reason) {
+			test.t.Errorf("got event %q, want %s", event, reason)
+		}
+	default:
+		test.t.Errorf("expected a %s event", reason)
+	}
+}
+
+func TestRolloutConfigDisabled(t *testing.T) {
+	test := newRolloutTest(t, &redhatcopv1alpha1.ConfigRollout{Strategy: redhatcopv1alpha1.AllAtOnceConfigRollout})
+	test.instance.Status.ConfigRollout = &redhatcopv1alpha1.ConfigRolloutStatus{TargetConfigHash: "stale"}
+	meta.SetStatusCondition(&test.instance.Status.Conditions, metav1.Condition{Type: progressingCondition, Status: metav1.ConditionTrue, Reason: "RollingOut"})
+	if requeue := test.reconcile(desiredTestConfig); requeue != 0 {
+		t.Errorf("expected no requeue, got %s", requeue)
+	}
+	test.expectConfigMap(desiredTestConfig, "")
+	if test.instance.Status.ConfigRollout != nil || meta.FindStatusCondition(test.instance.Status.Conditions, progressingCondition) != nil {
+		t.Errorf("expected the rollout status to be cleared, got %+v", test.instance.Status)
+	}
+}
+
+func TestRolloutConfigFirstConfig(t *testing.T) {
+	test := newRolloutTest(t, newCanaryRollout(0, 0))
+	if err := test.reconciler.GetClient().DeleteAllOf(context.TODO(), &corev1.ConfigMap{}, client.InNamespace("keepalived-operator")); err != nil {
+		t.Fatal(err)
+	}
+	// nothing runs yet, the first configuration is given to all the nodes
+	test.reconcile(desiredTestConfig)
+	test.expectConfigMap(desiredTestConfig, "")
+	test.expectProgressing(metav1.ConditionFalse, "RolloutComplete")
+}
+
+func TestRolloutConfigSteps(t *testing.T) {
+	test := newRolloutTest(t, newCanaryRollout(1, 0))
+
+	// the canary step
+	if requeue := test.reconcile(desiredTestConfig); requeue <= 0 {
+		t.Errorf("expected a requeue while the rollout is in progress, got %s", requeue)
+	}
+	test.expectConfigMap(stableTestConfig, desiredTestConfig, "group-a")
+	test.expectProgressing(metav1.ConditionTrue, "RollingOut")
+	status := test.instance.Status.ConfigRollout
+	if status.StableConfigHash != getConfigHash(stableTestConfig) || status.TargetConfigHash != getConfigHash(desiredTestConfig) {
+		t.Errorf("unexpected rollout status %+v", status)
+	}
+
+	// the canary did not load the configuration yet
+	test.reconcile(desiredTestConfig)
+	test.expectConfigMap(stableTestConfig, desiredTestConfig, "group-a")
+
+	// the canary loaded the configuration, the next step adds a node
+	test.apply()
+	test.reconcile(desiredTestConfig)
+	test.expectConfigMap(stableTestConfig, desiredTestConfig, "group-a", "group-b")
+	test.apply()
+	test.reconcile(desiredTestConfig)
+	test.expectConfigMap(stableTestConfig, desiredTestConfig, "group-a", "group-b", "group-c")
+
+	// all the nodes run the configuration, it becomes the stable configuration
+	test.apply()
+	if requeue := test.reconcile(desiredTestConfig); requeue != 0 {
+		t.Errorf("expected no requeue once the rollout is complete, got %s", requeue)
+	}
+	test.expectConfigMap(desiredTestConfig, "")
+	test.expectProgressing(metav1.ConditionFalse, "RolloutComplete")
+	test.expectEvent("ConfigRolledOut")
+	if status := test.instance.Status.ConfigRollout; status.StableConfigHash != getConfigHash(desiredTestConfig) || status.TargetConfigHash != "" || status.UpdatedPods != nil {
+		t.Errorf("unexpected rollout status %+v", status)
+	}
+
+	// the stable configuration read from the API server is not rolled out again
+	test.apply()
+	test.reconcile(desiredTestConfig)
+	test.expectConfigMap(desiredTestConfig, "")
+	test.expectProgressing(metav1.ConditionFalse, "RolloutComplete")
+}
+
+func TestRolloutConfigStabilization(t *testing.T) {
+	test := newRolloutTest(t, newCanaryRollout(0, 30))
+	test.reconcile(desiredTestConfig)
+	test.apply()
+	// the canary runs the configuration, it must keep running it for the stabilization period
+	requeue := test.reconcile(desiredTestConfig)
+	if requeue <= 0 || requeue > 30*time.Second {
+		t.Errorf("expected a requeue at the end of the stabilization period, got %s", requeue)
+	}
+	test.expectConfigMap(stableTestConfig, desiredTestConfig, "group-a")
+	if test.instance.Status.ConfigRollout.StableSince == nil {
+		t.Error("expected the stabilization period to be started")
+	}
+
+	// the stabilization period is over, the remaining nodes are all updated in the next step
+	past := metav1.NewTime(time.Now().Add(-time.Minute))
+	test.instance.Status.ConfigRollout.StableSince = &past
+	test.reconcile(desiredTestConfig)
+	test.expectConfigMap(stableTestConfig, desiredTestConfig, "group-a", "group-b", "group-c")
+	if test.instance.Status.ConfigRollout.StableSince != nil {
+		t.Error("expected the stabilization period to restart with the step")
+	}
+}
+
+func TestRolloutConfigRollback(t *testing.T) {
+	cases := []struct {
+		name    string
+		fail    func(test *rolloutTest)
+		failure string
+	}{
+		{
+			name: "the canary rejects the configuration",
+			fail: func(test *rolloutTest) {
+				test.pods[0].Annotations[redhatcopv1alpha1.ConfigErrorAnnotation] = "keepalived rejected the configuration"
+			},
+			failure: "node node-a could not load the configuration: keepalived rejected the configuration",
+		},
+		{
+			name: "a vrrp instance is in FAULT state on the canary",
+			fail: func(test *rolloutTest) {
+				test.apply()
+				test.instance.Status.VRRPInstances = []redhatcopv1alpha1.VRRPInstanceStatus{{Name: "ns/svc", Fault: []string{"node-a"}}}
+			},
+			failure: "vrrp instance ns/svc is in FAULT state on node node-a",
+		},
+		{
+			name: "a vrrp instance is in split brain on the canary",
+			fail: func(test *rolloutTest) {
+				test.apply()
+				test.instance.Status.VRRPInstances = []redhatcopv1alpha1.VRRPInstanceStatus{{Name: "ns/svc", SplitBrain: []string{"node-a", "node-b"}}}
+			},
+			failure: "vrrp instance ns/svc is in split brain between nodes node-a,node-b",
+		},
+		{
+			name: "the canary does not load the configuration in time",
+			fail: func(test *rolloutTest) {
+				past := metav1.NewTime(time.Now().Add(-time.Hour))
+				test.instance.Status.ConfigRollout.StepStartTime = &past
+			},
+			failure: "the nodes of the step did not load the configuration within 600 seconds",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			test := newRolloutTest(t, newCanaryRollout(0, 30))
+			test.reconcile(desiredTestConfig)
+			c.fail(test)
+			if requeue := test.reconcile(desiredTestConfig); requeue != 0 {
+				t.Errorf("expected no requeue after a rollback, got %s", requeue)
+			}
+			test.expectConfigMap(stableTestConfig, "")
+			test.expectProgressing(metav1.ConditionFalse, "RolledBack")
+			test.expectEvent("ConfigRolledBack")
+			status := test.instance.Status.ConfigRollout
+			if status.FailedConfigHash != getConfigHash(desiredTestConfig) || status.FailureMessage != c.failure || status.TargetConfigHash != "" || status.UpdatedPods != nil {
+				t.Errorf("unexpected rollout status %+v", status)
+			}
+
+			// the configuration that was rolled back is not rolled out again
+			test.apply()
+			test.reconcile(desiredTestConfig)
+			test.expectConfigMap(stableTestConfig, "")
+			test.expectProgressing(metav1.ConditionFalse, "RolledBack")
+
+			// a new configuration is rolled out
+			test.reconcile("vrrp_instance fixed {}\n")
+			test.expectConfigMap(stableTestConfig, "vrrp_instance fixed {}\n", "group-a")
+			if status := test.instance.Status.ConfigRollout; status.FailedConfigHash != "" || status.FailureMessage != "" {
+				t.Errorf("expected the failure to be cleared, got %+v", status)
+			}
+		})
+	}
+}
+
+func TestRolloutConfigChangedDuringRollout(t *testing.T) {
+	test := newRolloutTest(t, newCanaryRollout(1, 0))
+	test.reconcile(desiredTestConfig)
+	test.apply()
+	test.reconcile(desiredTestConfig)
+	test.expectConfigMap(stableTestConfig, desiredTestConfig, "group-a", "group-b")
+
+	// a configuration changed during a rollout restarts from the canary step
+	test.reconcile("vrrp_instance other {}\n")
+	test.expectConfigMap(stableTestConfig, "vrrp_instance other {}\n", "group-a")
+
+	// changing back to the stable configuration ends the rollout
+	test.reconcile(stableTestConfig)
+	test.expectConfigMap(stableTestConfig, "")
+	test.expectProgressing(metav1.ConditionFalse, "RolloutComplete")
+}
+
+func TestRolloutConfigDeletedPod(t *testing.T) {
+	test := newRolloutTest(t, newCanaryRollout(1, 0))
+	test.reconcile(desiredTestConfig)
+	test.expectConfigMap(stableTestConfig, desiredTestConfig, "group-a")
+
+	// the canary pod is replaced, the step restarts with the remaining pods
+	test.pods = test.pods[1:]
+	test.reconcile(desiredTestConfig)
+	test.expectConfigMap(stableTestConfig, desiredTestConfig, "group-b")
+}
+
+func TestNextRolloutPods(t *testing.T) {
+	candidates := []string{"group-c", "group-a", "group-b"}
+	cases := []struct {
+		updated []string
+		count   int
+		want    []string
+	}{
+		{count: 1, want: []string{"group-c"}},
+		{updated: []string{"group-c"}, count: 1, want: []string{"group-a", "group-c"}},
+		{updated: []string{"group-a"}, count: 5, want: []string{"group-a", "group-b", "group-c"}},
+		{updated: []string{"group-a"}, count: 0, want: []string{"group-a"}},
+	}
+	for _, c := range cases {
+		if got := nextRolloutPods(c.updated, candidates, c.count); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("nextRolloutPods(%v, %d): got %v, want %v", c.updated, c.count, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	"github.com/scylladb/go-set/iset"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	maxRouterID = 255
+	// RouterIDsNearExhaustion is set to true when one of the router id spaces of a KeepalivedGroup is almost full
+	routerIDsNearExhaustionCondition = "RouterIDsNearExhaustion"
+	// a router id space is considered near exhaustion when this percentage of its ids is used
+	routerIDsExhaustionThreshold = 90
+	// RouterIDConflict is set to true when router ids pinned by services cannot be honored
+	routerIDConflictCondition = "RouterIDConflict"
+	// Degraded is set to true when router ids are shared with an overlapping keepalived group
+	degradedCondition = "Degraded"
+)
+
+// routerIDSpace identifies a set of vrrp instances that must have distinct virtual router ids.
+// keepalived scopes virtual router ids per interface and address family.
+// An empty interface is discovered on each node from interfaceFromIP, it may be any interface.
+type routerIDSpace struct {
+	Interface string
+	IPv6      bool
+}
+
+func (s routerIDSpace) family() string {
+	if s.IPv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func getRouterIDSpace(instance *redhatcopv1alpha1.KeepalivedGroup, vrrp vrrpInstance) routerIDSpace {
+	space := routerIDSpace{Interface: instance.Spec.Interface, IPv6: vrrp.IPv6}
+	if instance.Spec.InterfaceFromIP != "" {
+		space.Interface = ""
+	}
+	if vrrp.Interface != "" {
+		space.Interface = vrrp.Interface
+	}
+	return space
+}
+
+func sortedRouterIDSpaces(spaces map[routerIDSpace][]vrrpInstance) []routerIDSpace {
+	result := []routerIDSpace{}
+	for space := range spaces {
+		result = append(result, space)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Interface == result[j].Interface {
+			return !result[i].IPv6 && result[j].IPv6
+		}
+		return result[i].Interface < result[j].Interface
+	})
+	return result
+}
+
+// routerIDConflict describes a router id pinned by a service that cannot be honored
+type routerIDConflict struct {
+	Service  *corev1.Service
+	Instance string
+	Message  string
+}
+
+// peerRouterIDs maps the router ids used by overlapping keepalived groups to the namespace/name of the group, per router id space
+type peerRouterIDs map[routerIDSpace]map[int]string
+
+// inSpace returns the router ids of the overlapping groups that can collide with the router id space.
+// Spaces of the same family collide when their interfaces are equal or when one of them is not known in advance
+func (p peerRouterIDs) inSpace(space routerIDSpace) map[int]string {
+	result := map[int]string{}
+	for peerSpace, ids := range p {
+		if peerSpace.IPv6 != space.IPv6 || (peerSpace.Interface != space.Interface && peerSpace.Interface != "" && space.Interface != "") {
+			continue
+		}
+		for id, group := range ids {
+			if other, ok := result[id]; !ok || group < other {
+				result[id] = group
+			}
+		}
+	}
+	return result
+}
+
+// routerIDCollision describes router ids used both by a keepalived group and by an overlapping group
+type routerIDCollision struct {
+	Space routerIDSpace
+	Group string
+	IDs   []int
+}
+
+// routerIDExhaustion describes the vrrp instances left without router id because their router id space is full
+type routerIDExhaustion struct {
+	Space     routerIDSpace
+	Instances []vrrpInstance
+}
+
+// nodeSelectorsOverlap returns true if a node can match both node selectors
+func nodeSelectorsOverlap(a map[string]string, b map[string]string) bool {
+	for key, value := range a {
+		if other, ok := b[key]; ok && other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// getPeerRouterIDs returns the router ids used by the other keepalived groups that can run on the same nodes as the instance
+func (r *KeepalivedGroupReconciler) getPeerRouterIDs(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup) (peerRouterIDs, error) {
+	peers := peerRouterIDs{}
+	// read the groups without cache to make sure router ids of recent reconcile cycles are visible
+	keepalivedGroupList := &redhatcopv1alpha1.KeepalivedGroupList{}
+	err := r.GetAPIReader().List(ctx, keepalivedGroupList, &client.ListOptions{})
+	if err != nil {
+		r.Log.Error(err, "unable to list keepalived groups")
+		return peers, err
+	}
+	for i := range keepalivedGroupList.Items {
+		keepalivedGroup := &keepalivedGroupList.Items[i]
+		if apis.GetKeyShort(keepalivedGroup) == apis.GetKeyShort(instance) || !nodeSelectorsOverlap(instance.Spec.NodeSelector, keepalivedGroup.Spec.NodeSelector) {
+			continue
+		}
+		for _, space := range keepalivedGroup.Status.RouterIDSpaces {
+			key := routerIDSpace{Interface: space.Interface, IPv6: space.Family == "IPv6"}
+			if peers[key] == nil {
+				peers[key] = map[int]string{}
+			}
+			for _, id := range space.RouterIDs {
+				// when several groups use the same id the one that takes precedence is recorded
+				if group, ok := peers[key][id]; !ok || apis.GetKeyShort(keepalivedGroup) < group {
+					peers[key][id] = apis.GetKeyShort(keepalivedGroup)
+				}
+			}
+		}
+	}
+	return peers, nil
+}
+
+// getRouterIDCollisions returns the router ids of the instance that are also used by overlapping groups
+func getRouterIDCollisions(instance *redhatcopv1alpha1.KeepalivedGroup, peers peerRouterIDs) []routerIDCollision {
+	collisions := []routerIDCollision{}
+	for _, status := range instance.Status.RouterIDSpaces {
+		space := routerIDSpace{Interface: status.Interface, IPv6: status.Family == "IPv6"}
+		peer := peers.inSpace(space)
+		byGroup := map[string][]int{}
+		for _, id := range status.RouterIDs {
+			if group, ok := peer[id]; ok {
+				byGroup[group] = append(byGroup[group], id)
+			}
+		}
+		groups := []string{}
+		for group := range byGroup {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			collisions = append(collisions, routerIDCollision{Space: space, Group: group, IDs: byGroup[group]})
+		}
+	}
+	return collisions
+}
+
+// getRouterIDRange returns the inclusive range of router ids the instance can allocate from
+func getRouterIDRange(instance *redhatcopv1alpha1.KeepalivedGroup) (int, int) {
+	min, max := 1, maxRouterID
+	if instance.Spec.RouterIDRange != nil {
+		if instance.Spec.RouterIDRange.Min != 0 {
+			min = instance.Spec.RouterIDRange.Min
+		}
+		if instance.Spec.RouterIDRange.Max != 0 {
+			max = instance.Spec.RouterIDRange.Max
+		}
+	}
+	return min, max
+}
+
+// getPinnedRouterID returns the router id pinned by the service of the vrrp instance with the routerid annotation.
+// Services with spreadvips pin one id per VIP, as a comma separated list following the order of the VIPs.
+func getPinnedRouterID(vrrp vrrpInstance) (int, bool, error) {
+	value, ok := vrrp.Service.GetAnnotations()[keepalivedRouterIDAnnotation]
+	if !ok {
+		return 0, false, nil
+	}
+	values := strings.Split(value, ",")
+	index := 0
+	if vrrp.SpreadIndex >= 0 {
+		if len(values) != len(getServiceIPs(vrrp.Service)) {
+			return 0, true, fmt.Errorf("annotation %s must list one router id per VIP, found %d ids for %d VIPs", keepalivedRouterIDAnnotation, len(values), len(getServiceIPs(vrrp.Service)))
+		}
+		index = vrrp.SpreadIndex
+	} else if len(values) != 1 {
+		return 0, true, fmt.Errorf("annotation %s must contain a single router id unless spreadvips is enabled", keepalivedRouterIDAnnotation)
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(values[index]))
+	if err != nil {
+		return 0, true, fmt.Errorf("annotation %s contains an invalid router id %q", keepalivedRouterIDAnnotation, values[index])
+	}
+	return id, true, nil
+}
+
+// assignRouterIDs assigns a virtual router id to each vrrp instance, keeping the ids already recorded in the status when they are still valid.
+// Ids are unique within a router id space, so a group can have up to 255 instances per interface and address family.
+// Ids pinned by services are honored when they are free, otherwise a conflict is returned and the ids of the other instances are left untouched.
+// Ids used by overlapping keepalived groups are never allocated, those of groups whose namespace/name sorts first are also taken away from this group.
+// Instances that do not fit in their router id space are left without id and returned, the other spaces are not affected.
+func (r *KeepalivedGroupReconciler) assignRouterIDs(instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service, peers peerRouterIDs) (bool, []routerIDConflict, []routerIDExhaustion) {
+	spaces := map[routerIDSpace][]vrrpInstance{}
+	for _, vrrp := range servicesToVRRPInstances(services) {
+		space := getRouterIDSpace(instance, vrrp)
+		spaces[space] = append(spaces[space], vrrp)
+	}
+	min, max := getRouterIDRange(instance)
+	blacklist := iset.New(instance.Spec.BlacklistRouterIDs...)
+	key := apis.GetKeyShort(instance)
+	routerIDs := map[string]int{}
+	routerIDSpaces := []redhatcopv1alpha1.RouterIDSpace{}
+	conflicts := []routerIDConflict{}
+	exhaustions := []routerIDExhaustion{}
+	for _, space := range sortedRouterIDSpaces(spaces) {
+		vrrps := spaces[space]
+		peer := peers.inSpace(space)
+		usable := func(id int) bool {
+			// ids of the overlapping groups that take precedence are treated as blacklisted
+			if group, ok := peer[id]; ok && group < key {
+				return false
+			}
+			return id >= min && id <= max && !blacklist.Has(id)
+		}
+		sort.Slice(vrrps, func(i, j int) bool {
+			return vrrps[i].Name < vrrps[j].Name
+		})
+		owners := map[int]string{}
+		assign := func(name string, id int) {
+			routerIDs[name] = id
+			owners[id] = name
+		}
+		pinned := []vrrpInstance{}
+		pins := map[string]int{}
+		toBeAdded := []vrrpInstance{}
+		for _, vrrp := range vrrps {
+			id, ok, err := getPinnedRouterID(vrrp)
+			if !ok {
+				// keep the current id unless it is no longer usable or it is taken by another instance that moved to this space
+				if current, found := instance.Status.RouterIDs[vrrp.Name]; found && usable(current) && owners[current] == "" {
+					assign(vrrp.Name, current)
+				} else {
+					toBeAdded = append(toBeAdded, vrrp)
+				}
+				continue
+			}
+			if err == nil && !usable(id) {
+				if group, ok := peer[id]; ok && group < key {
+					err = fmt.Errorf("pinned router id %d is used by keepalived group %s on interface %s for %s", id, group, space.Interface, space.family())
+				} else {
+					err = fmt.Errorf("pinned router id %d is blacklisted or outside of the range %d-%d of keepalived group %s", id, min, max, key)
+				}
+			}
+			if err != nil {
+				conflicts = append(conflicts, routerIDConflict{Service: vrrp.Service, Instance: vrrp.Name, Message: err.Error()})
+				id = 0
+			}
+			pins[vrrp.Name] = id
+			pinned = append(pinned, vrrp)
+		}
+		// instances already holding their pinned id go first, so that a new pin never takes an id away
+		sort.SliceStable(pinned, func(i, j int) bool {
+			return instance.Status.RouterIDs[pinned[i].Name] == pins[pinned[i].Name] && instance.Status.RouterIDs[pinned[j].Name] != pins[pinned[j].Name]
+		})
+		for _, vrrp := range pinned {
+			id := pins[vrrp.Name]
+			if id != 0 {
+				owner := owners[id]
+				if owner == "" {
+					assign(vrrp.Name, id)
+					continue
+				}
+				conflicts = append(conflicts, routerIDConflict{
+					Service:  vrrp.Service,
+					Instance: vrrp.Name,
+					Message:  fmt.Sprintf("pinned router id %d is already used by %s on interface %s for %s", id, owner, space.Interface, space.family()),
+				})
+			}
+			// a rejected pin keeps the instance on its current id, if any, instead of reshuffling
+			if current, found := instance.Status.RouterIDs[vrrp.Name]; found && usable(current) && owners[current] == "" {
+				assign(vrrp.Name, current)
+			}
+		}
+		pending := []vrrpInstance{}
+		for _, vrrp := range toBeAdded {
+			ids := blacklist.Copy()
+			for id := range owners {
+				ids.Add(id)
+			}
+			for id := range peer {
+				ids.Add(id)
+			}
+			id, err := findNextAvailableID(ids.List(), min, max)
+			if err != nil {
+				r.Log.Error(err, "unable to assign a router id to", "instance", vrrp.Name, "interface", space.Interface, "family", space.family())
+				pending = append(pending, vrrp)
+				continue
+			}
+			assign(vrrp.Name, id)
+		}
+		if len(pending) > 0 {
+			exhaustions = append(exhaustions, routerIDExhaustion{Space: space, Instances: pending})
+		}
+		available := 0
+		for id := min; id <= max; id++ {
+			if _, ok := peer[id]; !ok && !blacklist.Has(id) && owners[id] == "" {
+				available++
+			}
+		}
+		used := []int{}
+		for id := range owners {
+			used = append(used, id)
+		}
+		sort.Ints(used)
+		routerIDSpaces = append(routerIDSpaces, redhatcopv1alpha1.RouterIDSpace{
+			Interface: space.Interface,
+			Family:    space.family(),
+			Used:      len(owners),
+			Available: available,
+			RouterIDs: used,
+		})
+	}
+	changed := !reflect.DeepEqual(routerIDs, instance.Status.RouterIDs)
+	instance.Status.RouterIDs = routerIDs
+	instance.Status.RouterIDSpaces = routerIDSpaces
+	return changed, conflicts, exhaustions
+}
+
+func findNextAvailableID(ids []int, min int, max int) (int, error) {
+	usedSet := iset.New(ids...)
+	for i := min; i <= max; i++ {
+		if !usedSet.Has(i) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no router id available in the range %d-%d", min, max)
+}
+
+// reportRouterIDConflicts records the rejected router id pins in the RouterIDConflict condition and as events on the services
+func (r *KeepalivedGroupReconciler) reportRouterIDConflicts(instance *redhatcopv1alpha1.KeepalivedGroup, conflicts []routerIDConflict) {
+	condition := metav1.Condition{
+		Type:               routerIDConflictCondition,
+		ObservedGeneration: instance.GetGeneration(),
+		Status:             metav1.ConditionFalse,
+		Reason:             "NoConflict",
+		Message:            "all pinned router ids are honored",
+	}
+	if len(conflicts) > 0 {
+		messages := []string{}
+		for _, conflict := range conflicts {
+			messages = append(messages, conflict.Instance+": "+conflict.Message)
+			r.GetRecorder().Event(conflict.Service, corev1.EventTypeWarning, "RouterIDConflict", conflict.Message)
+		}
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "PinnedRouterIDRejected"
+		condition.Message = strings.Join(messages, "; ")
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+}
+
+// reportRouterIDCollisions records the router ids shared with overlapping groups in the Degraded condition and as events on the instance
+func (r *KeepalivedGroupReconciler) reportRouterIDCollisions(instance *redhatcopv1alpha1.KeepalivedGroup, collisions []routerIDCollision) {
+	condition := metav1.Condition{
+		Type:               degradedCondition,
+		ObservedGeneration: instance.GetGeneration(),
+		Status:             metav1.ConditionFalse,
+		Reason:             "NoRouterIDCollision",
+		Message:            "no router id is shared with an overlapping keepalived group",
+	}
+	if len(collisions) > 0 {
+		messages := []string{}
+		for _, collision := range collisions {
+			ids := []string{}
+			for _, id := range collision.IDs {
+				ids = append(ids, strconv.Itoa(id))
+			}
+			messages = append(messages, fmt.Sprintf("router ids %s on interface %s for %s are also used by keepalived group %s", strings.Join(ids, ","), collision.Space.Interface, collision.Space.family(), collision.Group))
+		}
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "RouterIDCollision"
+		condition.Message = strings.Join(messages, "; ")
+		r.GetRecorder().Event(instance, corev1.EventTypeWarning, "RouterIDCollision", condition.Message)
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+}
+
+// Handler to issue reconciles for the KeepalivedGroups that overlap with a changed KeepalivedGroup
+func (r *KeepalivedGroupReconciler) requestsForOverlappingKeepalivedGroups(obj client.Object) []reconcile.Request {
+	changed, ok := obj.(*redhatcopv1alpha1.KeepalivedGroup)
+	if !ok {
+		r.Log.Error(fmt.Errorf("expected a KeepalivedGroup, got %T", obj), "could not process keepalived group change")
+		return nil
+	}
+	keepalivedGroupList := &redhatcopv1alpha1.KeepalivedGroupList{}
+	err := r.GetClient().List(context.TODO(), keepalivedGroupList, &client.ListOptions{})
+	if err != nil {
+		r.Log.Error(err, "unable to list keepalived groups", "keepalivedgroup", apis.GetKeyShort(changed))
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, keepalivedGroup := range keepalivedGroupList.Items {
+		if apis.GetKeyShort(&keepalivedGroup) != apis.GetKeyShort(changed) && nodeSelectorsOverlap(keepalivedGroup.Spec.NodeSelector, changed.Spec.NodeSelector) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: keepalivedGroup.GetNamespace(), Name: keepalivedGroup.GetName()}})
+		}
+	}
+	return requests
+}
+
+// RouterIDSpacesChange is a predicate that filters KeepalivedGroup changes that can affect the router ids of overlapping groups
+type RouterIDSpacesChange struct {
+	predicate.Funcs
+}
+
+// Update filters out updates that change neither the node selector nor the router ids of a KeepalivedGroup
+func (RouterIDSpacesChange) Update(e event.UpdateEvent) bool {
+	oldGroup, ok := e.ObjectOld.(*redhatcopv1alpha1.KeepalivedGroup)
+	if !ok {
+		return false
+	}
+	newGroup, ok := e.ObjectNew.(*redhatcopv1alpha1.KeepalivedGroup)
+	if !ok {
+		return false
+	}
+	return !reflect.DeepEqual(oldGroup.Spec.NodeSelector, newGroup.Spec.NodeSelector) || !reflect.DeepEqual(oldGroup.Status.RouterIDSpaces, newGroup.Status.RouterIDSpaces)
+}
+
+// reportRouterIDExhaustion reports whether any router id space of the instance is close to being exhausted.
+// The instances left without router id are recorded in the condition and as events on their services
+func (r *KeepalivedGroupReconciler) reportRouterIDExhaustion(instance *redhatcopv1alpha1.KeepalivedGroup, exhaustions []routerIDExhaustion) {
+	nearExhaustion := []string{}
+	for _, space := range instance.Status.RouterIDSpaces {
+		if space.Used*100 >= (space.Used+space.Available)*routerIDsExhaustionThreshold {
+			nearExhaustion = append(nearExhaustion, fmt.Sprintf("%s on interface %s (%d used, %d available)", space.Family, space.Interface, space.Used, space.Available))
+		}
+	}
+	condition := metav1.Condition{
+		Type:               routerIDsNearExhaustionCondition,
+		ObservedGeneration: instance.GetGeneration(),
+		Status:             metav1.ConditionFalse,
+		Reason:             "RouterIDsAvailable",
+		Message:            "all router id spaces have enough available ids",
+	}
+	advice := ". Move services to another interface with the " + keepalivedInterfaceAnnotation + " annotation or to another keepalived group"
+	switch {
+	case len(exhaustions) > 0:
+		messages := []string{}
+		for _, exhaustion := range exhaustions {
+			pending := []string{}
+			for _, vrrp := range exhaustion.Instances {
+				pending = append(pending, vrrp.Name)
+				r.GetRecorder().Event(vrrp.Service, corev1.EventTypeWarning, "RouterIDsExhausted", fmt.Sprintf("no router id available for %s on interface %s for %s in keepalived group %s", vrrp.Name, exhaustion.Space.Interface, exhaustion.Space.family(), apis.GetKeyShort(instance)))
+			}
+			messages = append(messages, fmt.Sprintf("%s on interface %s is full, instances pending: %s", exhaustion.Space.family(), exhaustion.Space.Interface, strings.Join(pending, ", ")))
+		}
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "RouterIDSpaceExhausted"
+		condition.Message = "router id spaces exhausted: " + strings.Join(messages, "; ") + advice
+	case len(nearExhaustion) > 0:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "RouterIDSpaceAlmostFull"
+		condition.Message = "router id spaces almost full: " + strings.Join(nearExhaustion, ", ") + advice
+	}
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+}
@@ -0,0 +1,391 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newRouterIDService returns a load balancer service of namespace ns exposing the passed VIPs
+func newRouterIDService(name string, annotations map[string]string, ips ...string) corev1.Service {
+	service := newTestService("ns", name, corev1.ServiceTypeLoadBalancer, ips...)
+	service.Annotations = annotations
+	return *service
+}
+
+func TestAssignRouterIDs(t *testing.T) {
+	eth0v4 := routerIDSpace{Interface: "eth0"}
+	cases := []struct {
+		name            string
+		interfaceFromIP string
+		routerIDRange   *redhatcopv1alpha1.RouterIDRange
+		blacklist       []int
+		current         map[string]int
+		services        []corev1.Service
+		peers           peerRouterIDs
+		want            map[string]int
+		wantConflicts   []string
+		wantPending     []string
+	}{
+		{
+			name: "allocates the lowest free ids",
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", nil, "10.0.0.2"),
+			},
+			want: map[string]int{"ns/a": 1, "ns/b": 2},
+		},
+		{
+			name:    "keeps the current ids",
+			current: map[string]int{"ns/b": 7},
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", nil, "10.0.0.2"),
+			},
+			want: map[string]int{"ns/a": 1, "ns/b": 7},
+		},
+		{
+			name:          "skips the blacklisted ids of the range",
+			routerIDRange: &redhatcopv1alpha1.RouterIDRange{Min: 10, Max: 13},
+			blacklist:     []int{10, 12},
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", nil, "10.0.0.2"),
+			},
+			want: map[string]int{"ns/a": 11, "ns/b": 13},
+		},
+		{
+			name:          "moves the ids that left the range or got blacklisted",
+			routerIDRange: &redhatcopv1alpha1.RouterIDRange{Min: 10, Max: 20},
+			blacklist:     []int{15},
+			current:       map[string]int{"ns/a": 5, "ns/b": 15},
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", nil, "10.0.0.2"),
+			},
+			want: map[string]int{"ns/a": 10, "ns/b": 11},
+		},
+		{
+			name:          "leaves the instances pending when the range is exhausted",
+			routerIDRange: &redhatcopv1alpha1.RouterIDRange{Min: 1, Max: 3},
+			blacklist:     []int{2},
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", nil, "10.0.0.2"),
+				newRouterIDService("c", nil, "10.0.0.3"),
+			},
+			want:        map[string]int{"ns/a": 1, "ns/b": 3},
+			wantPending: []string{"ns/c"},
+		},
+		{
+			name:          "keeps assigning the ids of the other spaces when a space is full",
+			routerIDRange: &redhatcopv1alpha1.RouterIDRange{Min: 1, Max: 2},
+			current:       map[string]int{"ns/a": 1, "ns/b": 2},
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", nil, "10.0.0.2"),
+				newRouterIDService("c", nil, "10.0.0.3", "fd00::3"),
+				newRouterIDService("d", map[string]string{keepalivedInterfaceAnnotation: "eth1"}, "10.0.0.4"),
+			},
+			want:        map[string]int{"ns/a": 1, "ns/b": 2, "ns/c" + ipv6InstanceSuffix: 1, "ns/d": 1},
+			wantPending: []string{"ns/c"},
+		},
+		{
+			name:          "honors pins at the edges of the range",
+			routerIDRange: &redhatcopv1alpha1.RouterIDRange{Min: 10, Max: 20},
+			services: []corev1.Service{
+				newRouterIDService("a", map[string]string{keepalivedRouterIDAnnotation: "10"}, "10.0.0.1"),
+				newRouterIDService("b", map[string]string{keepalivedRouterIDAnnotation: "20"}, "10.0.0.2"),
+				newRouterIDService("c", nil, "10.0.0.3"),
+			},
+			want: map[string]int{"ns/a": 10, "ns/b": 20, "ns/c": 11},
+		},
+		{
+			name:          "rejects pins just outside of the range",
+			routerIDRange: &redhatcopv1alpha1.RouterIDRange{Min: 10, Max: 20},
+			current:       map[string]int{"ns/b": 12},
+			services: []corev1.Service{
+				newRouterIDService("a", map[string]string{keepalivedRouterIDAnnotation: "9"}, "10.0.0.1"),
+				newRouterIDService("b", map[string]string{keepalivedRouterIDAnnotation: "21"}, "10.0.0.2"),
+			},
+			want:          map[string]int{"ns/b": 12},
+			wantConflicts: []string{"ns/a", "ns/b"},
+		},
+		{
+			name:      "rejects blacklisted pins",
+			blacklist: []int{5},
+			services: []corev1.Service{
+				newRouterIDService("a", map[string]string{keepalivedRouterIDAnnotation: "5"}, "10.0.0.1"),
+			},
+			want:          map[string]int{},
+			wantConflicts: []string{"ns/a"},
+		},
+		{
+			name: "rejects invalid pins",
+			services: []corev1.Service{
+				newRouterIDService("a", map[string]string{keepalivedRouterIDAnnotation: "one"}, "10.0.0.1"),
+			},
+			want:          map[string]int{},
+			wantConflicts: []string{"ns/a"},
+		},
+		{
+			name: "gives a pinned id to the first instance when both are new",
+			services: []corev1.Service{
+				newRouterIDService("a", map[string]string{keepalivedRouterIDAnnotation: "3"}, "10.0.0.1"),
+				newRouterIDService("b", map[string]string{keepalivedRouterIDAnnotation: "3"}, "10.0.0.2"),
+			},
+			want:          map[string]int{"ns/a": 3},
+			wantConflicts: []string{"ns/b"},
+		},
+		{
+			name:    "never takes a pinned id away from its holder",
+			current: map[string]int{"ns/a": 4, "ns/b": 3},
+			services: []corev1.Service{
+				newRouterIDService("a", map[string]string{keepalivedRouterIDAnnotation: "3"}, "10.0.0.1"),
+				newRouterIDService("b", map[string]string{keepalivedRouterIDAnnotation: "3"}, "10.0.0.2"),
+			},
+			want:          map[string]int{"ns/a": 4, "ns/b": 3},
+			wantConflicts: []string{"ns/a"},
+		},
+		{
+			name:    "never takes the id of an unpinned instance",
+			current: map[string]int{"ns/a": 3},
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", map[string]string{keepalivedRouterIDAnnotation: "3"}, "10.0.0.2"),
+			},
+			want:          map[string]int{"ns/a": 3},
+			wantConflicts: []string{"ns/b"},
+		},
+		{
+			name: "pins one id per VIP with spreadvips",
+			services: []corev1.Service{
+				newRouterIDService("a", map[string]string{keepalivedSpreadVIPsAnnotation: "true", keepalivedRouterIDAnnotation: "5,6"}, "10.0.0.1", "10.0.0.2"),
+			},
+			want: map[string]int{"ns/a/10.0.0.1": 5, "ns/a/10.0.0.2": 6},
+		},
+		{
+			name: "rejects a pin list that does not match the VIPs",
+			services: []corev1.Service{
+				newRouterIDService("a", map[string]string{keepalivedSpreadVIPsAnnotation: "true", keepalivedRouterIDAnnotation: "5"}, "10.0.0.1", "10.0.0.2"),
+			},
+			want:          map[string]int{},
+			wantConflicts: []string{"ns/a/10.0.0.1", "ns/a/10.0.0.2"},
+		},
+		{
+			name: "allocates separate spaces per family and interface",
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1", "fd00::1"),
+				newRouterIDService("b", map[string]string{keepalivedInterfaceAnnotation: "eth1"}, "10.0.0.2"),
+			},
+			want: map[string]int{"ns/a": 1, "ns/a" + ipv6InstanceSuffix: 1, "ns/b": 1},
+		},
+		{
+			name:    "takes away the ids of peers that sort first",
+			current: map[string]int{"ns/a": 1},
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", map[string]string{keepalivedRouterIDAnnotation: "2"}, "10.0.0.2"),
+			},
+			peers:         peerRouterIDs{eth0v4: {1: "ns/a-group", 2: "ns/a-group"}},
+			want:          map[string]int{"ns/a": 3},
+			wantConflicts: []string{"ns/b"},
+		},
+		{
+			name:    "only avoids the ids of peers that sort last",
+			current: map[string]int{"ns/a": 1},
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", nil, "10.0.0.2"),
+				newRouterIDService("c", map[string]string{keepalivedRouterIDAnnotation: "3"}, "10.0.0.3"),
+			},
+			peers: peerRouterIDs{eth0v4: {1: "ns/z-group", 2: "ns/z-group", 3: "ns/z-group"}},
+			want:  map[string]int{"ns/a": 1, "ns/b": 4, "ns/c": 3},
+		},
+		{
+			name: "ignores the peers of other spaces",
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+			},
+			peers: peerRouterIDs{routerIDSpace{Interface: "eth1"}: {1: "ns/a-group"}, routerIDSpace{Interface: "eth0", IPv6: true}: {1: "ns/a-group"}},
+			want:  map[string]int{"ns/a": 1},
+		},
+		{
+			name: "avoids the ids of peers whose interface is discovered",
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1", "fd00::1"),
+			},
+			peers: peerRouterIDs{routerIDSpace{}: {1: "ns/a-group"}},
+			want:  map[string]int{"ns/a": 2, "ns/a" + ipv6InstanceSuffix: 1},
+		},
+		{
+			name:            "avoids the ids of peers on any interface when the interface is discovered",
+			interfaceFromIP: "192.168.0.1",
+			services: []corev1.Service{
+				newRouterIDService("a", nil, "10.0.0.1"),
+				newRouterIDService("b", map[string]string{keepalivedInterfaceAnnotation: "eth2"}, "10.0.0.2"),
+			},
+			peers: peerRouterIDs{routerIDSpace{Interface: "eth1"}: {1: "ns/a-group"}, routerIDSpace{Interface: "eth3"}: {2: "ns/a-group"}},
+			want:  map[string]int{"ns/a": 3, "ns/b": 1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, _ := newTestReconciler(t)
+			instance := &redhatcopv1alpha1.KeepalivedGroup{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "m-group"},
+				Spec: redhatcopv1alpha1.KeepalivedGroupSpec{
+					Interface:          "eth0",
+					InterfaceFromIP:    c.interfaceFromIP,
+					RouterIDRange:      c.routerIDRange,
+					BlacklistRouterIDs: c.blacklist,
+				},
+				Status: redhatcopv1alpha1.KeepalivedGroupStatus{RouterIDs: c.current},
+			}
+			_, conflicts, exhaustions := r.assignRouterIDs(instance, c.services, c.peers)
+			if !reflect.DeepEqual(instance.Status.RouterIDs, c.want) {
+				t.Errorf("router ids: got %v, want %v", instance.Status.RouterIDs, c.want)
+			}
+			conflicting := []string{}
+			for _, conflict := range conflicts {
+				conflicting = append(conflicting, conflict.Instance)
+			}
+			sort.Strings(conflicting)
+			if len(c.wantConflicts) == 0 {
+				c.wantConflicts = []string{}
+			}
+			if !reflect.DeepEqual(conflicting, c.wantConflicts) {
+				t.Errorf("conflicts: got %v, want %v", conflicting, c.wantConflicts)
+			}
+			pending := []string{}
+			for _, exhaustion := range exhaustions {
+				for _, vrrp := range exhaustion.Instances {
+					pending = append(pending, vrrp.Name)
+				}
+			}
+			if len(c.wantPending) == 0 {
+				c.wantPending = []string{}
+			}
+			if !reflect.DeepEqual(pending, c.wantPending) {
+				t.Errorf("pending: got %v, want %v", pending, c.wantPending)
+			}
+		})
+	}
+}
+
+func TestAssignRouterIDsSpaces(t *testing.T) {
+	r, _ := newTestReconciler(t)
+	instance := &redhatcopv1alpha1.KeepalivedGroup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "m-group"},
+		Spec: redhatcopv1alpha1.KeepalivedGroupSpec{
+			Interface:          "eth0",
+			RouterIDRange:      &redhatcopv1alpha1.RouterIDRange{Min: 1, Max: 10},
+			BlacklistRouterIDs: []int{2},
+		},
+	}
+	services := []corev1.Service{
+		newRouterIDService("a", nil, "10.0.0.1", "fd00::1"),
+		newRouterIDService("b", nil, "10.0.0.2"),
+	}
+	peers := peerRouterIDs{routerIDSpace{Interface: "eth0"}: {4: "ns/z-group"}}
+	changed, _, _ := r.assignRouterIDs(instance, services, peers)
+	if !changed {
+		t.Error("expected the router ids to change")
+	}
+	want := []redhatcopv1alpha1.RouterIDSpace{
+		{Interface: "eth0", Family: "IPv4", Used: 2, Available: 6, RouterIDs: []int{1, 3}},
+		{Interface: "eth0", Family: "IPv6", Used: 1, Available: 8, RouterIDs: []int{1}},
+	}
+	if !reflect.DeepEqual(instance.Status.RouterIDSpaces, want) {
+		t.Errorf("got %+v, want %+v", instance.Status.RouterIDSpaces, want)
+	}
+	changed, _, _ = r.assignRouterIDs(instance, services, peers)
+	if changed {
+		t.Error("expected the router ids to be stable")
+	}
+}
+
+func TestReportRouterIDExhaustion(t *testing.T) {
+	r, recorder := newTestReconciler(t)
+	instance := &redhatcopv1alpha1.KeepalivedGroup{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "m-group"},
+		Spec: redhatcopv1alpha1.KeepalivedGroupSpec{
+			Interface:     "eth0",
+			RouterIDRange: &redhatcopv1alpha1.RouterIDRange{Min: 1, Max: 1},
+		},
+	}
+	services := []corev1.Service{
+		newRouterIDService("a", nil, "10.0.0.1"),
+		newRouterIDService("b", nil, "10.0.0.2"),
+	}
+	_, _, exhaustions := r.assignRouterIDs(instance, services, nil)
+	r.reportRouterIDExhaustion(instance, exhaustions)
+	condition := meta.FindStatusCondition(instance.Status.Conditions, routerIDsNearExhaustionCondition)
+	if condition == nil || condition.Status != metav1.ConditionTrue || condition.Reason != "RouterIDSpaceExhausted" || !strings.Contains(condition.Message, "IPv4 on interface eth0 is full, instances pending: ns/b") {
+		t.Errorf("expected the condition to report the pending instance, got %+v", condition)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected one warning event, found %d", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "RouterIDsExhausted") {
+		t.Errorf("unexpected event %q", event)
+	}
+	if vrrps := getVRRPInstances(instance, services); len(vrrps) != 1 || vrrps[0].Name != "ns/a" {
+		t.Errorf("expected only the instance with a router id to be configured, got %+v", vrrps)
+	}
+
+	// once the instance fits again the condition is cleared
+	instance.Spec.RouterIDRange.Max = 100
+	_, _, exhaustions = r.assignRouterIDs(instance, services, nil)
+	r.reportRouterIDExhaustion(instance, exhaustions)
+	if condition := meta.FindStatusCondition(instance.Status.Conditions, routerIDsNearExhaustionCondition); condition.Status != metav1.ConditionFalse {
+		t.Errorf("expected the condition to be cleared, got %+v", condition)
+	}
+}
+
+func TestGetRouterIDCollisions(t *testing.T) {
+	instance := &redhatcopv1alpha1.KeepalivedGroup{
+		Status: redhatcopv1alpha1.KeepalivedGroupStatus{
+			RouterIDSpaces: []redhatcopv1alpha1.RouterIDSpace{
+				{Interface: "eth0", Family: "IPv4", RouterIDs: []int{1, 2, 3}},
+				{Interface: "eth0", Family: "IPv6", RouterIDs: []int{1}},
+			},
+		},
+	}
+	peers := peerRouterIDs{
+		routerIDSpace{Interface: "eth0"}:             {1: "ns/b", 3: "ns/a", 4: "ns/a"},
+		routerIDSpace{Interface: "eth1", IPv6: true}: {1: "ns/a"},
+		routerIDSpace{Interface: "", IPv6: true}:     {2: "ns/c"},
+		routerIDSpace{Interface: ""}:                 {2: "ns/c"},
+	}
+	want := []routerIDCollision{
+		{Space: routerIDSpace{Interface: "eth0"}, Group: "ns/a", IDs: []int{3}},
+		{Space: routerIDSpace{Interface: "eth0"}, Group: "ns/b", IDs: []int{1}},
+		{Space: routerIDSpace{Interface: "eth0"}, Group: "ns/c", IDs: []int{2}},
+	}
+	if got := getRouterIDCollisions(instance, peers); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/keepalived-operator/pkg/keepalived"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	"github.com/scylladb/go-set/strset"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const serviceWebhookPath = "/validate-v1-service"
+
+var servicelog = logf.Log.WithName("service-webhook")
+
+// the webhook intercepts all the services of the cluster, failurePolicy=ignore keeps services manageable when the operator is down
+//+kubebuilder:webhook:path=/validate-v1-service,mutating=false,failurePolicy=ignore,sideEffects=None,groups="",resources=services,verbs=create;update,versions=v1,name=vservice.keepalived-operator.redhat-cop.io,admissionReviewVersions=v1
+
+// ServiceValidator rejects Services whose keepalived annotations are invalid
+type ServiceValidator struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the Service validating webhook
+func (v *ServiceValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	if v.Client == nil {
+		v.Client = mgr.GetClient()
+	}
+	mgr.GetWebhookServer().Register(serviceWebhookPath, &webhook.Admission{Handler: v})
+	return nil
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (v *ServiceValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+// Handle implements admission.Handler
+func (v *ServiceValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	service := &corev1.Service{}
+	err := v.decoder.Decode(req, service)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if _, ok := service.GetAnnotations()[keepalivedGroupAnnotation]; !ok {
+		return admission.Allowed("")
+	}
+	// the namespace is not always set on the object of create requests
+	if service.Namespace == "" {
+		service.Namespace = req.Namespace
+	}
+	// the services created before the webhook, or before their keepalived group was deleted, must stay updatable
+	var oldService *corev1.Service
+	if req.Operation == admissionv1.Update && len(req.OldObject.Raw) > 0 {
+		oldService = &corev1.Service{}
+		if err := v.decoder.DecodeRaw(req.OldObject, oldService); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+	servicelog.V(1).Info("validate", "service", apis.GetKeyShort(service))
+	problems, err := v.validate(ctx, service, oldService)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(problems) > 0 {
+		return admission.Denied(strings.Join(problems, "; "))
+	}
+	return admission.Allowed("")
+}
+
+// validate returns the problems of the keepalived annotations of the service, oldService is the service being updated, nil on creation.
+// The keepalived group and the IPs of an updated service are only checked when they change
+func (v *ServiceValidator) validate(ctx context.Context, service *corev1.Service, oldService *corev1.Service) ([]string, error) {
+	problems := []string{}
+	annotations := service.GetAnnotations()
+	if value, ok := annotations[keepalivedGroupVerbatimConfigAnnotation]; ok && value != "" {
+		verbatimConfig := map[string]string{}
+		if err := json.Unmarshal([]byte(value), &verbatimConfig); err != nil {
+			problems = append(problems, fmt.Sprintf("annotation %s must be a JSON object with string values: %s", keepalivedGroupVerbatimConfigAnnotation, err))
+		}
+		for _, option := range getOptions(verbatimConfig) {
+			if err := keepalived.ValidateInstanceOption(option.Keyword, option.Value); err != nil {
+				problems = append(problems, fmt.Sprintf("annotation %s has an invalid entry: %s", keepalivedGroupVerbatimConfigAnnotation, err))
+			}
+		}
+	}
+	if value, ok := annotations[keepalivedInterfaceAnnotation]; ok && value != "" {
+		if err := keepalived.ValidateWord(value); err != nil {
+			problems = append(problems, fmt.Sprintf("annotation %s must be an interface name: %s", keepalivedInterfaceAnnotation, err))
+		}
+	}
+	if value, ok := annotations[keepalivedSpreadVIPsAnnotation]; ok && value != "true" && value != "false" {
+		problems = append(problems, fmt.Sprintf("annotation %s must be \"true\" or \"false\", found %q", keepalivedSpreadVIPsAnnotation, value))
+	}
+	if value, ok := annotations[keepalivedNoPreemptAnnotation]; ok {
+		if _, err := parseNoPreempt(value); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if value, ok := annotations[keepalivedPreemptDelayAnnotation]; ok {
+		if _, err := parsePreemptDelay(value); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if value, ok := annotations[keepalivedNodePrioritiesAnnotation]; ok {
+		if _, err := parseNodePriorities(value); err != nil {
+			problems = append(problems, fmt.Sprintf("annotation %s must be a JSON list of node priorities: %s", keepalivedNodePrioritiesAnnotation, err))
+		}
+	}
+	if value, ok := annotations[keepalivedVRRPOptionsAnnotation]; ok {
+		if _, err := parseVRRPOptions(value); err != nil {
+			problems = append(problems, fmt.Sprintf("annotation %s must be a JSON object of vrrp options: %s", keepalivedVRRPOptionsAnnotation, err))
+		}
+	}
+	value := annotations[keepalivedGroupAnnotation]
+	namespacedName, err := getNamespacedName(value)
+	if err == nil && (len(validation.IsDNS1123Label(namespacedName.Namespace)) > 0 || len(validation.IsDNS1123Subdomain(namespacedName.Name)) > 0) {
+		err = fmt.Errorf("%q is not a valid <namespace>/<name> reference", value)
+	}
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("annotation %s must reference a keepalived group as <namespace>/<name>: %s", keepalivedGroupAnnotation, err))
+		return problems, nil
+	}
+	if oldService != nil && !keepalivedReferenceChanged(oldService, service) {
+		return problems, nil
+	}
+	keepalivedGroup := &redhatcopv1alpha1.KeepalivedGroup{}
+	err = v.Client.Get(ctx, namespacedName, keepalivedGroup)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			problems = append(problems, fmt.Sprintf("annotation %s references keepalived group %s which does not exist", keepalivedGroupAnnotation, value))
+			return problems, nil
+		}
+		return problems, err
+	}
+	claimed, err := v.getClaimedIPs(ctx, service, keepalivedGroup)
+	if err != nil {
+		return problems, err
+	}
+	ips := getServiceIPs(service)
+	if service.Spec.LoadBalancerIP != "" {
+		ips = strset.New(append(ips, service.Spec.LoadBalancerIP)...).List()
+	}
+	for _, ip := range ips {
+		if owner, ok := claimed[ip]; ok {
+			problems = append(problems, fmt.Sprintf("IP %s is already used by service %s in keepalived group %s", ip, owner, value))
+		}
+	}
+	return problems, nil
+}
+
+// getClaimedIPs returns the IPs of the other services of the keepalived group and the service that owns them
+func (v *ServiceValidator) getClaimedIPs(ctx context.Context, service *corev1.Service, keepalivedGroup *redhatcopv1alpha1.KeepalivedGroup) (map[string]string, error) {
+	claimed := map[string]string{}
+	serviceList := &corev1.ServiceList{}
+	err := v.Client.List(ctx, serviceList, &client.ListOptions{})
+	if err != nil {
+		servicelog.Error(err, "unable to list services")
+		return claimed, err
+	}
+	for i := range serviceList.Items {
+		other := &serviceList.Items[i]
+		if apis.GetKeyShort(other) == apis.GetKeyShort(service) || (other.Spec.Type != corev1.ServiceTypeLoadBalancer && len(other.Spec.ExternalIPs) == 0) {
+			continue
+		}
+		namespacedName, err := getNamespacedName(other.GetAnnotations()[keepalivedGroupAnnotation])
+		if err != nil || namespacedName.Namespace != keepalivedGroup.GetNamespace() || namespacedName.Name != keepalivedGroup.GetName() {
+			continue
+		}
+		ips := getServiceIPs(other)
+		if other.Spec.LoadBalancerIP != "" {
+			ips = append(ips, other.Spec.LoadBalancerIP)
+		}
+		for _, ip := range ips {
+			claimed[ip] = apis.GetKeyShort(other)
+		}
+	}
+	return claimed, nil
+}
+
+// keepalivedReferenceChanged returns true if the update changes the keepalived group or the IPs requested by the service
+func keepalivedReferenceChanged(oldService *corev1.Service, service *corev1.Service) bool {
+	return oldService.GetAnnotations()[keepalivedGroupAnnotation] != service.GetAnnotations()[keepalivedGroupAnnotation] ||
+		oldService.Spec.LoadBalancerIP != service.Spec.LoadBalancerIP ||
+		!strset.New(oldService.Spec.ExternalIPs...).IsEqual(strset.New(service.Spec.ExternalIPs...))
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestServiceValidatorVerbatimConfig(t *testing.T) {
+	cases := []struct {
+		name           string
+		verbatimConfig string
+		problem        string
+	}{
+		{name: "accepts protocol options", verbatimConfig: `{"track_src_ip": "", "garp_master_refresh": "60"}`},
+		{name: "rejects notify_master", verbatimConfig: `{"notify_master": "\"/usr/local/bin/notify master\""}`, problem: "notify_master is not an allowed vrrp_instance option"},
+		{name: "rejects notify", verbatimConfig: `{"notify": "/bin/sh"}`, problem: "notify is not an allowed vrrp_instance option"},
+		{name: "rejects notify_fifo", verbatimConfig: `{"notify_fifo": "/tmp/fifo"}`, problem: "notify_fifo is not an allowed vrrp_instance option"},
+		{name: "rejects track_script", verbatimConfig: `{"track_script": "chk"}`, problem: "track_script is not an allowed vrrp_instance option"},
+		{name: "rejects include", verbatimConfig: `{"include": "/etc/keepalived/other.conf"}`, problem: "include is not an allowed vrrp_instance option"},
+		{name: "rejects values that close the block", verbatimConfig: `{"track_src_ip": "}"}`, problem: "must not contain braces or line breaks"},
+		{name: "rejects invalid JSON", verbatimConfig: `track_src_ip`, problem: "must be a JSON object with string values"},
+	}
+	group := &redhatcopv1alpha1.KeepalivedGroup{ObjectMeta: metav1.ObjectMeta{Namespace: "keepalived-operator", Name: "group"}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, _ := newTestReconciler(t, group)
+			validator := &ServiceValidator{Client: r.GetClient()}
+			service := newTestService("ns", "svc", corev1.ServiceTypeClusterIP)
+			service.Annotations = map[string]string{
+				keepalivedGroupAnnotation:               "keepalived-operator/group",
+				keepalivedGroupVerbatimConfigAnnotation: c.verbatimConfig,
+			}
+			problems, err := validator.validate(context.TODO(), service, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.problem == "" {
+				if len(problems) > 0 {
+					t.Errorf("expected no problem, got %v", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.Contains(problems[0], c.problem) {
+				t.Errorf("expected a single problem containing %q, got %v", c.problem, problems)
+			}
+		})
+	}
+}
+
+// newGroupService returns a service of the keepalived group with the external IPs
+func newGroupService(name string, group string, externalIPs ...string) *corev1.Service {
+	service := newTestService("ns", name, corev1.ServiceTypeClusterIP)
+	service.Annotations = map[string]string{keepalivedGroupAnnotation: group}
+	service.Spec.ExternalIPs = externalIPs
+	return service
+}
+
+func TestServiceValidatorValidate(t *testing.T) {
+	withAnnotation := func(service *corev1.Service, key, value string) *corev1.Service {
+		service.Annotations[key] = value
+		return service
+	}
+	withLoadBalancerIP := func(service *corev1.Service, ip string) *corev1.Service {
+		service.Spec.Type = corev1.ServiceTypeLoadBalancer
+		service.Spec.LoadBalancerIP = ip
+		return service
+	}
+	cases := []struct {
+		name    string
+		service *corev1.Service
+		problem string
+	}{
+		{name: "accepts a valid service", service: newGroupService("svc", "keepalived-operator/group", "10.0.0.2")},
+		{name: "rejects a reference without namespace", service: newGroupService("svc", "group"), problem: "must reference a keepalived group as <namespace>/<name>"},
+		{name: "rejects a reference with too many elements", service: newGroupService("svc", "keepalived-operator/group/other"), problem: "must reference a keepalived group as <namespace>/<name>"},
+		{name: "rejects an invalid namespace", service: newGroupService("svc", "Keepalived_Operator/group"), problem: "is not a valid <namespace>/<name> reference"},
+		{name: "rejects a missing keepalived group", service: newGroupService("svc", "keepalived-operator/missing"), problem: "references keepalived group keepalived-operator/missing which does not exist"},
+		{name: "accepts spreadvips false", service: withAnnotation(newGroupService("svc", "keepalived-operator/group"), keepalivedSpreadVIPsAnnotation, "false")},
+		{name: "rejects a spreadvips value other than true or false", service: withAnnotation(newGroupService("svc", "keepalived-operator/group"), keepalivedSpreadVIPsAnnotation, "yes"), problem: `must be "true" or "false", found "yes"`},
+		{name: "rejects an external IP of another service of the group", service: newGroupService("svc", "keepalived-operator/group", "10.0.0.1"), problem: "IP 10.0.0.1 is already used by service ns/existing in keepalived group keepalived-operator/group"},
+		{name: "rejects a load balancer IP of another service of the group", service: withLoadBalancerIP(newGroupService("svc", "keepalived-operator/group"), "10.0.0.1"), problem: "IP 10.0.0.1 is already used by service ns/existing"},
+		{name: "accepts an IP of a service of another group", service: newGroupService("svc", "keepalived-operator/group", "10.0.0.3")},
+	}
+	objs := []client.Object{
+		&redhatcopv1alpha1.KeepalivedGroup{ObjectMeta: metav1.ObjectMeta{Namespace: "keepalived-operator", Name: "group"}},
+		&redhatcopv1alpha1.KeepalivedGroup{ObjectMeta: metav1.ObjectMeta{Namespace: "keepalived-operator", Name: "other"}},
+		newGroupService("existing", "keepalived-operator/group", "10.0.0.1"),
+		newGroupService("other", "keepalived-operator/other", "10.0.0.3"),
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, _ := newTestReconciler(t, objs...)
+			validator := &ServiceValidator{Client: r.GetClient()}
+			problems, err := validator.validate(context.TODO(), c.service, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.problem == "" {
+				if len(problems) > 0 {
+					t.Errorf("expected no problem, got %v", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.Contains(problems[0], c.problem) {
+				t.Errorf("expected a single problem containing %q, got %v", c.problem, problems)
+			}
+		})
+	}
+}
+
+func TestServiceValidatorHandle(t *testing.T) {
+	withAnnotation := func(service *corev1.Service, key, value string) *corev1.Service {
+		service.Annotations[key] = value
+		return service
+	}
+	cases := []struct {
+		name       string
+		operation  admissionv1.Operation
+		oldService *corev1.Service
+		service    *corev1.Service
+		allowed    bool
+	}{
+		{
+			name:      "allows a service without keepalived group",
+			operation: admissionv1.Create,
+			service:   newTestService("ns", "svc", corev1.ServiceTypeClusterIP),
+			allowed:   true,
+		},
+		{
+			name:      "denies the creation of a service of a missing group",
+			operation: admissionv1.Create,
+			service:   newGroupService("svc", "keepalived-operator/missing"),
+		},
+		{
+			name:       "allows updating a service whose group was deleted",
+			operation:  admissionv1.Update,
+			oldService: newGroupService("svc", "keepalived-operator/missing", "10.0.0.5"),
+			service:    withAnnotation(newGroupService("svc", "keepalived-operator/missing", "10.0.0.5"), keepalivedNodePrioritiesAnnotation, `[{"nodeName":"node-a","priority":254}]`),
+			allowed:    true,
+		},
+		{
+			name:       "allows updating a service that already shared an IP",
+			operation:  admissionv1.Update,
+			oldService: newGroupService("svc", "keepalived-operator/group", "10.0.0.1"),
+			service:    withAnnotation(newGroupService("svc", "keepalived-operator/group", "10.0.0.1"), keepalivedSpreadVIPsAnnotation, "true"),
+			allowed:    true,
+		},
+		{
+			name:       "denies moving a service to a missing group",
+			operation:  admissionv1.Update,
+			oldService: newGroupService("svc", "keepalived-operator/group"),
+			service:    newGroupService("svc", "keepalived-operator/missing"),
+		},
+		{
+			name:       "denies adding an IP of another service of the group",
+			operation:  admissionv1.Update,
+			oldService: newGroupService("svc", "keepalived-operator/group", "10.0.0.2"),
+			service:    newGroupService("svc", "keepalived-operator/group", "10.0.0.2", "10.0.0.1"),
+		},
+		{
+			name:       "denies an invalid annotation on update",
+			operation:  admissionv1.Update,
+			oldService: newGroupService("svc", "keepalived-operator/missing"),
+			service:    withAnnotation(newGroupService("svc", "keepalived-operator/missing"), keepalivedSpreadVIPsAnnotation, "yes"),
+		},
+	}
+	r, _ := newTestReconciler(t,
+		&redhatcopv1alpha1.KeepalivedGroup{ObjectMeta: metav1.ObjectMeta{Namespace: "keepalived-operator", Name: "group"}},
+		newGroupService("existing", "keepalived-operator/group", "10.0.0.1"),
+	)
+	decoder, err := admission.NewDecoder(r.GetClient().Scheme())
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := &ServiceValidator{Client: r.GetClient()}
+	if err := validator.InjectDecoder(decoder); err != nil {
+		t.Fatal(err)
+	}
+	encode := func(service *corev1.Service) runtime.RawExtension {
+		if service == nil {
+			return runtime.RawExtension{}
+		}
+		raw, err := json.Marshal(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runtime.RawExtension{Raw: raw}
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response := validator.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: c.operation,
+				Namespace: "ns",
+				Object:    encode(c.service),
+				OldObject: encode(c.oldService),
+			}})
+			if response.Allowed != c.allowed {
+				t.Errorf("got allowed %t, want %t: %v", response.Allowed, c.allowed, response.Result)
+			}
+		})
+	}
+}
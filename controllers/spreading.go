@@ -0,0 +1,176 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"hash/fnv"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	"github.com/scylladb/go-set/strset"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ownerPriority is given to the keepalived pod of the node a spread VIP is assigned to, the other pods keep the default priority of 100
+const ownerPriority = 200
+
+// spreadCandidate is a node running a keepalived pod that can own spread VIPs
+type spreadCandidate struct {
+	Node string
+	Zone string
+	Pod  string
+}
+
+// placeVRRPInstances decides which nodes are preferred to hold the VIPs of each vrrp instance,
+// either from the node priorities of the service or by spreading the VIPs of services with spreadvips enabled, and moves the VIPs away from the drained nodes
+func (r *KeepalivedGroupReconciler) placeVRRPInstances(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, vrrpInstances []vrrpInstance, pods []corev1.Pod) error {
+	r.setPreemption(instance, vrrpInstances)
+	r.setVRRPOptions(instance, vrrpInstances)
+	err := r.setNodePriorities(ctx, instance, vrrpInstances, pods)
+	if err != nil {
+		return err
+	}
+	drained, err := r.getDrainedNodes(ctx, instance, pods)
+	if err != nil {
+		return err
+	}
+	instance.Status.DrainedNodes = drained
+	drainedNodes := strset.New()
+	for _, status := range drained {
+		drainedNodes.Add(status.Node)
+	}
+	err = r.spreadServicesVRRPInstances(ctx, instance, vrrpInstances, pods, drainedNodes)
+	if err != nil {
+		return err
+	}
+	drainedPods := []string{}
+	for i := range pods {
+		if drainedNodes.Has(pods[i].Spec.NodeName) {
+			drainedPods = append(drainedPods, pods[i].GetName())
+		}
+	}
+	drainVRRPInstances(vrrpInstances, drainedPods)
+	return nil
+}
+
+// spreadServicesVRRPInstances spreads the VIPs of the services with spreadvips enabled and no node priorities across the nodes that are not drained
+func (r *KeepalivedGroupReconciler) spreadServicesVRRPInstances(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, vrrpInstances []vrrpInstance, pods []corev1.Pod, drainedNodes *strset.Set) error {
+	spread := map[string][]*vrrpInstance{}
+	services := []string{}
+	for i := range vrrpInstances {
+		vrrp := &vrrpInstances[i]
+		if vrrp.SpreadIndex < 0 || len(vrrp.Priorities) > 0 {
+			continue
+		}
+		key := apis.GetKeyShort(vrrp.Service)
+		if _, ok := spread[key]; !ok {
+			services = append(services, key)
+		}
+		spread[key] = append(spread[key], vrrp)
+	}
+	if len(services) == 0 {
+		return nil
+	}
+	nodes, err := r.getKeepalivedNodes(ctx, pods)
+	if err != nil {
+		return err
+	}
+	candidates := []spreadCandidate{}
+	for i := range pods {
+		node, ok := nodes[pods[i].Spec.NodeName]
+		if !ok || pods[i].GetDeletionTimestamp() != nil || drainedNodes.Has(node.GetName()) {
+			continue
+		}
+		candidates = append(candidates, spreadCandidate{Node: node.GetName(), Zone: node.GetLabels()[corev1.LabelTopologyZone], Pod: pods[i].GetName()})
+	}
+	previous := map[string]string{}
+	for _, status := range instance.Status.VRRPInstances {
+		previous[status.Name] = status.Owner
+	}
+	for _, service := range services {
+		spreadVRRPInstances(spread[service], candidates, previous)
+	}
+	return nil
+}
+
+// spreadVRRPInstances assigns an owner to each vrrp instance of a service, so that the VIPs of the service are spread across zones and nodes.
+// Instances keep their previous owner while it is a candidate and does not own more than its share of the instances,
+// the other instances are assigned with rendezvous hashing so that a change of the candidates only moves the instances it has to
+func spreadVRRPInstances(vrrps []*vrrpInstance, candidates []spreadCandidate, previous map[string]string) {
+	if len(candidates) == 0 {
+		return
+	}
+	// when there are more instances than nodes, nodes own several instances of the service
+	share := (len(vrrps) + len(candidates) - 1) / len(candidates)
+	nodeLoad := map[string]int{}
+	zoneLoad := map[string]int{}
+	byNode := map[string]spreadCandidate{}
+	for _, candidate := range candidates {
+		byNode[candidate.Node] = candidate
+	}
+	assign := func(vrrp *vrrpInstance, candidate spreadCandidate) {
+		vrrp.Owner = candidate.Node
+		vrrp.OwnerZone = candidate.Zone
+		vrrp.OwnerPod = candidate.Pod
+		vrrp.Priorities = []podPriority{{Pod: candidate.Pod, Priority: ownerPriority}}
+		nodeLoad[candidate.Node]++
+		zoneLoad[candidate.Zone]++
+	}
+	unassigned := []*vrrpInstance{}
+	for _, vrrp := range vrrps {
+		candidate, ok := byNode[previous[vrrp.Name]]
+		if ok && nodeLoad[candidate.Node] < share {
+			assign(vrrp, candidate)
+			continue
+		}
+		unassigned = append(unassigned, vrrp)
+	}
+	for _, vrrp := range unassigned {
+		best := candidates[0]
+		for _, candidate := range candidates[1:] {
+			if spreadLess(vrrp.Name, candidate, best, nodeLoad, zoneLoad) {
+				best = candidate
+			}
+		}
+		assign(vrrp, best)
+	}
+}
+
+// spreadLess returns true if candidate a is a better owner than b for the instance: the least loaded node first,
+// then the least loaded zone, then the highest rendezvous hash
+func spreadLess(name string, a spreadCandidate, b spreadCandidate, nodeLoad map[string]int, zoneLoad map[string]int) bool {
+	if nodeLoad[a.Node] != nodeLoad[b.Node] {
+		return nodeLoad[a.Node] < nodeLoad[b.Node]
+	}
+	if zoneLoad[a.Zone] != zoneLoad[b.Zone] {
+		return zoneLoad[a.Zone] < zoneLoad[b.Zone]
+	}
+	scoreA, scoreB := rendezvousHash(name, a.Node), rendezvousHash(name, b.Node)
+	if scoreA != scoreB {
+		return scoreA > scoreB
+	}
+	return a.Node < b.Node
+}
+
+func rendezvousHash(name string, node string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	hash.Write([]byte{0})
+	hash.Write([]byte(node))
+	return hash.Sum64()
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func newSpreadVRRPInstances(count int) []*vrrpInstance {
+	vrrps := []*vrrpInstance{}
+	for i := 0; i < count; i++ {
+		vrrps = append(vrrps, &vrrpInstance{Name: fmt.Sprintf("ns/svc/10.0.0.%d", i+1), SpreadIndex: i})
+	}
+	return vrrps
+}
+
+func newSpreadCandidates(zones ...string) []spreadCandidate {
+	candidates := []spreadCandidate{}
+	for i, zone := range zones {
+		candidates = append(candidates, spreadCandidate{Node: fmt.Sprintf("node-%d", i+1), Zone: zone, Pod: fmt.Sprintf("pod-%d", i+1)})
+	}
+	return candidates
+}
+
+func getOwners(vrrps []*vrrpInstance) map[string]string {
+	owners := map[string]string{}
+	for _, vrrp := range vrrps {
+		if vrrp.Owner != "" {
+			owners[vrrp.Name] = vrrp.Owner
+		}
+	}
+	return owners
+}
+
+func countBy(vrrps []*vrrpInstance, key func(*vrrpInstance) string) map[string]int {
+	counts := map[string]int{}
+	for _, vrrp := range vrrps {
+		counts[key(vrrp)]++
+	}
+	return counts
+}
+
+func TestSpreadVRRPInstances(t *testing.T) {
+	cases := []struct {
+		name       string
+		instances  int
+		candidates []spreadCandidate
+		previous   map[string]string
+		// want lists the owners that are decided by the previous owners, the others only have to be balanced
+		want         map[string]string
+		wantNodeLoad map[string]int
+		wantZoneLoad map[string]int
+	}{
+		{
+			name:       "leaves the instances unassigned without candidates",
+			instances:  2,
+			candidates: newSpreadCandidates(),
+			want:       map[string]string{},
+		},
+		{
+			name:         "gives one instance to each node",
+			instances:    3,
+			candidates:   newSpreadCandidates("a", "b", "c"),
+			wantNodeLoad: map[string]int{"node-1": 1, "node-2": 1, "node-3": 1},
+		},
+		{
+			name:         "spreads across zones before nodes",
+			instances:    2,
+			candidates:   newSpreadCandidates("a", "a", "b"),
+			wantZoneLoad: map[string]int{"a": 1, "b": 1},
+		},
+		{
+			name:         "gives several instances to a node when there are more instances than nodes",
+			instances:    4,
+			candidates:   newSpreadCandidates("a", "b"),
+			wantNodeLoad: map[string]int{"node-1": 2, "node-2": 2},
+		},
+		{
+			name:       "keeps the previous owners",
+			instances:  3,
+			candidates: newSpreadCandidates("a", "b", "c"),
+			previous:   map[string]string{"ns/svc/10.0.0.1": "node-3", "ns/svc/10.0.0.2": "node-1", "ns/svc/10.0.0.3": "node-2"},
+			want:       map[string]string{"ns/svc/10.0.0.1": "node-3", "ns/svc/10.0.0.2": "node-1", "ns/svc/10.0.0.3": "node-2"},
+		},
+		{
+			name:         "moves the instances of an overloaded previous owner",
+			instances:    2,
+			candidates:   newSpreadCandidates("a", "b"),
+			previous:     map[string]string{"ns/svc/10.0.0.1": "node-1", "ns/svc/10.0.0.2": "node-1"},
+			want:         map[string]string{"ns/svc/10.0.0.1": "node-1", "ns/svc/10.0.0.2": "node-2"},
+			wantNodeLoad: map[string]int{"node-1": 1, "node-2": 1},
+		},
+		{
+			name:         "moves the instances of a previous owner that is no longer a candidate",
+			instances:    2,
+			candidates:   newSpreadCandidates("a", "b"),
+			previous:     map[string]string{"ns/svc/10.0.0.1": "node-1", "ns/svc/10.0.0.2": "node-9"},
+			want:         map[string]string{"ns/svc/10.0.0.1": "node-1", "ns/svc/10.0.0.2": "node-2"},
+			wantNodeLoad: map[string]int{"node-1": 1, "node-2": 1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vrrps := newSpreadVRRPInstances(c.instances)
+			spreadVRRPInstances(vrrps, c.candidates, c.previous)
+			owners := getOwners(vrrps)
+			if c.want != nil {
+				for name, owner := range c.want {
+					if owners[name] != owner {
+						t.Errorf("%s: got owner %q, want %q", name, owners[name], owner)
+					}
+				}
+				if len(c.want) == 0 && len(owners) > 0 {
+					t.Errorf("expected no owner, got %v", owners)
+				}
+			}
+			if c.wantNodeLoad != nil {
+				if got := countBy(vrrps, func(vrrp *vrrpInstance) string { return vrrp.Owner }); !reflect.DeepEqual(got, c.wantNodeLoad) {
+					t.Errorf("node load: got %v, want %v", got, c.wantNodeLoad)
+				}
+			}
+			if c.wantZoneLoad != nil {
+				if got := countBy(vrrps, func(vrrp *vrrpInstance) string { return vrrp.OwnerZone }); !reflect.DeepEqual(got, c.wantZoneLoad) {
+					t.Errorf("zone load: got %v, want %v", got, c.wantZoneLoad)
+				}
+			}
+			for _, vrrp := range vrrps {
+				if vrrp.Owner == "" {
+					continue
+				}
+				want := []podPriority{{Pod: vrrp.OwnerPod, Priority: ownerPriority}}
+				if !reflect.DeepEqual(vrrp.Priorities, want) {
+					t.Errorf("%s: got priorities %v, want %v", vrrp.Name, vrrp.Priorities, want)
+				}
+			}
+		})
+	}
+}
+
+// TestSpreadVRRPInstancesNodeLoss checks that losing a node only moves the instances it owned, and that only as many instances as needed move back when it returns
+func TestSpreadVRRPInstancesNodeLoss(t *testing.T) {
+	candidates := newSpreadCandidates("a", "b", "c")
+	vrrps := newSpreadVRRPInstances(3)
+	spreadVRRPInstances(vrrps, candidates, nil)
+	initial := getOwners(vrrps)
+
+	lost := "node-2"
+	vrrps = newSpreadVRRPInstances(3)
+	spreadVRRPInstances(vrrps, []spreadCandidate{candidates[0], candidates[2]}, initial)
+	afterLoss := getOwners(vrrps)
+	for name, owner := range initial {
+		if owner == lost {
+			if afterLoss[name] == lost || afterLoss[name] == "" {
+				t.Errorf("%s: expected to move away from %s, got %q", name, lost, afterLoss[name])
+			}
+			continue
+		}
+		if afterLoss[name] != owner {
+			t.Errorf("%s: expected to stay on %s, moved to %s", name, owner, afterLoss[name])
+		}
+	}
+
+	vrrps = newSpreadVRRPInstances(3)
+	spreadVRRPInstances(vrrps, candidates, afterLoss)
+	afterReturn := getOwners(vrrps)
+	moved := 0
+	for name, owner := range afterLoss {
+		if afterReturn[name] != owner {
+			moved++
+			if afterReturn[name] != lost {
+				t.Errorf("%s: expected to move back to %s, got %s", name, lost, afterReturn[name])
+			}
+		}
+	}
+	if moved != 1 {
+		t.Errorf("expected a single instance to move back, %d moved: %v -> %v", moved, afterLoss, afterReturn)
+	}
+
+	// the assignment is deterministic, a new reconcile cycle with the same inputs keeps the owners
+	vrrps = newSpreadVRRPInstances(3)
+	spreadVRRPInstances(vrrps, candidates, nil)
+	if again := getOwners(vrrps); !reflect.DeepEqual(again, initial) {
+		t.Errorf("expected the same owners from scratch, got %v, want %v", again, initial)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const keepalivedVRRPOptionsAnnotation = "keepalived-operator.redhat-cop.io/vrrp-options"
+
+// parseVRRPOptions parses and validates the vrrp-options annotation of a service, unknown options are rejected so that typos are not silently ignored
+func parseVRRPOptions(value string) (*redhatcopv1alpha1.VRRPOptions, error) {
+	options := &redhatcopv1alpha1.VRRPOptions{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(options); err != nil {
+		return nil, err
+	}
+	if errs := redhatcopv1alpha1.ValidateVRRPOptions(options, field.NewPath("")); len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+	return options, nil
+}
+
+// getVRRPOptions returns the vrrp options of the service, the options set in the annotation of the service override the ones of the KeepalivedGroup
+func getVRRPOptions(instance *redhatcopv1alpha1.KeepalivedGroup, service *corev1.Service) (redhatcopv1alpha1.VRRPOptions, error) {
+	options := redhatcopv1alpha1.VRRPOptions{}
+	if instance.Spec.VRRPOptions != nil {
+		options = *instance.Spec.VRRPOptions.DeepCopy()
+	}
+	value, ok := service.GetAnnotations()[keepalivedVRRPOptionsAnnotation]
+	if !ok {
+		return options, nil
+	}
+	override, err := parseVRRPOptions(value)
+	if err != nil {
+		return options, err
+	}
+	return mergeVRRPOptions(options, *override), nil
+}
+
+// mergeVRRPOptions returns the options with the fields set in override replaced, an empty list in override clears the list of the options
+func mergeVRRPOptions(options, override redhatcopv1alpha1.VRRPOptions) redhatcopv1alpha1.VRRPOptions {
+	if override.AdvertIntervalSeconds != nil {
+		options.AdvertIntervalSeconds = override.AdvertIntervalSeconds
+	}
+	if override.GarpMasterDelaySeconds != nil {
+		options.GarpMasterDelaySeconds = override.GarpMasterDelaySeconds
+	}
+	if override.GarpMasterRepeat != nil {
+		options.GarpMasterRepeat = override.GarpMasterRepeat
+	}
+	if override.GarpMasterRefreshSeconds != nil {
+		options.GarpMasterRefreshSeconds = override.GarpMasterRefreshSeconds
+	}
+	if override.GarpMasterRefreshRepeat != nil {
+		options.GarpMasterRefreshRepeat = override.GarpMasterRefreshRepeat
+	}
+	if override.DontTrackPrimary != nil {
+		options.DontTrackPrimary = override.DontTrackPrimary
+	}
+	if override.SMTPAlert != nil {
+		options.SMTPAlert = override.SMTPAlert
+	}
+	if override.TrackInterfaces != nil {
+		options.TrackInterfaces = override.TrackInterfaces
+	}
+	if override.VirtualRoutes != nil {
+		options.VirtualRoutes = override.VirtualRoutes
+	}
+	return options
+}
+
+// setVRRPOptions sets the vrrp options of the vrrp instances, keeping only the virtual routes of the address family of each instance.
+// Services with an invalid annotation get a warning event and the options of the KeepalivedGroup
+func (r *KeepalivedGroupReconciler) setVRRPOptions(instance *redhatcopv1alpha1.KeepalivedGroup, vrrpInstances []vrrpInstance) {
+	reported := map[string]bool{}
+	for i := range vrrpInstances {
+		vrrp := &vrrpInstances[i]
+		options, err := getVRRPOptions(instance, vrrp.Service)
+		if err != nil && !reported[apis.GetKeyShort(vrrp.Service)] {
+			r.GetRecorder().Event(vrrp.Service, corev1.EventTypeWarning, "InvalidVRRPOptions", fmt.Sprintf("ignoring annotation %s: %s", keepalivedVRRPOptionsAnnotation, err))
+			reported[apis.GetKeyShort(vrrp.Service)] = true
+		}
+		routes := []redhatcopv1alpha1.VirtualRoute{}
+		for _, route := range options.VirtualRoutes {
+			if prefix, err := netip.ParsePrefix(route.To); err == nil && prefix.Addr().Is6() == vrrp.IPv6 {
+				routes = append(routes, route)
+			}
+		}
+		options.VirtualRoutes = routes
+		vrrp.Options = options
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	redhatcopv1alpha1 "github.com/redhat-cop/keepalived-operator/api/v1alpha1"
+	"github.com/redhat-cop/operator-utils/pkg/util/apis"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	vrrpStateMaster = "MASTER"
+	vrrpStateBackup = "BACKUP"
+	vrrpStateFault  = "FAULT"
+	// VIPAssigned is set on the services to report whether all their VIPs are held by a node
+	vipAssignedCondition = "KeepalivedVIPAssigned"
+)
+
+// getPodVRRPStates returns the VRRP state of each instance notified by the keepalived pod
+func getPodVRRPStates(pod *corev1.Pod) map[string]string {
+	states := map[string]string{}
+	value, ok := pod.GetAnnotations()[redhatcopv1alpha1.VRRPStateAnnotation]
+	if !ok {
+		return states
+	}
+	if err := json.Unmarshal([]byte(value), &states); err != nil {
+		return map[string]string{}
+	}
+	return states
+}
+
+// getVRRPInstanceStatuses combines the states notified by the keepalived pods into the status of each vrrp instance
+func getVRRPInstanceStatuses(instance *redhatcopv1alpha1.KeepalivedGroup, vrrpInstances []vrrpInstance, pods []corev1.Pod) []redhatcopv1alpha1.VRRPInstanceStatus {
+	podStates := map[string]map[string]string{}
+	nodes := []string{}
+	for i := range pods {
+		if pods[i].Spec.NodeName == "" {
+			continue
+		}
+		podStates[pods[i].Spec.NodeName] = getPodVRRPStates(&pods[i])
+		nodes = append(nodes, pods[i].Spec.NodeName)
+	}
+	sort.Strings(nodes)
+	statuses := []redhatcopv1alpha1.VRRPInstanceStatus{}
+	for _, vrrp := range vrrpInstances {
+		status := redhatcopv1alpha1.VRRPInstanceStatus{
+			Name:      vrrp.Name,
+			Service:   apis.GetKeyShort(vrrp.Service),
+			RouterID:  instance.Status.RouterIDs[vrrp.Name],
+			VIPs:      vrrp.IPs,
+			Owner:     vrrp.Owner,
+			OwnerZone: vrrp.OwnerZone,
+		}
+		masters := []string{}
+		for _, node := range nodes {
+			switch podStates[node][vrrp.Name] {
+			case vrrpStateMaster:
+				masters = append(masters, node)
+			case vrrpStateBackup:
+				status.Backup = append(status.Backup, node)
+			case vrrpStateFault:
+				status.Fault = append(status.Fault, node)
+			}
+		}
+		if len(masters) > 0 {
+			status.Master = masters[0]
+		}
+		if len(masters) > 1 {
+			status.SplitBrain = masters
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// updateVRRPInstanceStatuses records the VRRP state of the instances in the status of the KeepalivedGroup and of the services,
+// and issues events on the services when the node holding their VIPs changes
+func (r *KeepalivedGroupReconciler) updateVRRPInstanceStatuses(ctx context.Context, instance *redhatcopv1alpha1.KeepalivedGroup, services []corev1.Service, vrrpInstances []vrrpInstance, pods []corev1.Pod) error {
+	previous := map[string]redhatcopv1alpha1.VRRPInstanceStatus{}
+	for _, status := range instance.Status.VRRPInstances {
+		previous[status.Name] = status
+	}
+	statuses := getVRRPInstanceStatuses(instance, vrrpInstances, pods)
+	byService := map[string][]redhatcopv1alpha1.VRRPInstanceStatus{}
+	for _, status := range statuses {
+		byService[status.Service] = append(byService[status.Service], status)
+		old, known := previous[status.Name]
+		if !known || old.Master == status.Master {
+			continue
+		}
+		service := getServiceByKey(services, status.Service)
+		if service == nil {
+			continue
+		}
+		if status.Master == "" {
+			r.GetRecorder().Event(service, corev1.EventTypeWarning, "VRRPNoMaster", fmt.Sprintf("no node holds the VIPs %s of vrrp instance %s (router id %d), last held by node %s", strings.Join(status.VIPs, ","), status.Name, status.RouterID, old.Master))
+		} else {
+			r.GetRecorder().Event(service, corev1.EventTypeNormal, "VRRPMasterChanged", fmt.Sprintf("node %s now holds the VIPs %s of vrrp instance %s (router id %d)", status.Master, strings.Join(status.VIPs, ","), status.Name, status.RouterID))
+		}
+	}
+	instance.Status.VRRPInstances = statuses
+	for i := range services {
+		service := &services[i]
+		condition := getVIPAssignedCondition(byService[apis.GetKeyShort(service)])
+		current := meta.FindStatusCondition(service.Status.Conditions, vipAssignedCondition)
+		if current != nil && current.Status == condition.Status && current.Reason == condition.Reason && current.Message == condition.Message {
+			continue
+		}
+		meta.SetStatusCondition(&service.Status.Conditions, condition)
+		err := r.GetClient().Status().Update(ctx, service)
+		if err != nil {
+			r.Log.Error(err, "unable to update status of", "service", apis.GetKeyShort(service))
+			return err
+		}
+	}
+	return nil
+}
+
+// getVIPAssignedCondition summarizes the VRRP state of the instances of a service
+func getVIPAssignedCondition(statuses []redhatcopv1alpha1.VRRPInstanceStatus) metav1.Condition {
+	held := []string{}
+	unheld := []string{}
+	splitBrain := []string{}
+	for _, status := range statuses {
+		vips := strings.Join(status.VIPs, ",")
+		switch {
+		case len(status.SplitBrain) > 0:
+			splitBrain = append(splitBrain, fmt.Sprintf("%s (router id %d) claimed by nodes %s", vips, status.RouterID, strings.Join(status.SplitBrain, ",")))
+		case status.Master == "":
+			unheld = append(unheld, fmt.Sprintf("%s (router id %d)", vips, status.RouterID))
+		default:
+			held = append(held, fmt.Sprintf("%s (router id %d) held by node %s", vips, status.RouterID, status.Master))
+		}
+	}
+	condition := metav1.Condition{
+		Type:    vipAssignedCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  "MasterElected",
+		Message: "VIPs " + strings.Join(held, ", "),
+	}
+	switch {
+	case len(statuses) == 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "NoVRRPInstance"
+		condition.Message = "the service has no VIP or no router id could be assigned to it"
+	case len(splitBrain) > 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "SplitBrain"
+		condition.Message = "VIPs " + strings.Join(splitBrain, ", ")
+	case len(unheld) > 0:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "NoMaster"
+		condition.Message = "no node holds the VIPs " + strings.Join(unheld, ", ")
+	}
+	return condition
+}
+
+func getServiceByKey(services []corev1.Service, key string) *corev1.Service {
+	for i := range services {
+		if apis.GetKeyShort(&services[i]) == key {
+			return &services[i]
+		}
+	}
+	return nil
+}
+
+// vrrpStatesChanged returns true if the VRRP states notified by a keepalived pod changed
+func vrrpStatesChanged(oldPod *corev1.Pod, newPod *corev1.Pod) bool {
+	return !reflect.DeepEqual(getPodVRRPStates(oldPod), getPodVRRPStates(newPod))
+}
@@ -88,6 +88,16 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "KeepalivedGroup")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&redhatcopv1alpha1.KeepalivedGroupWebhook{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "KeepalivedGroup")
+			os.Exit(1)
+		}
+		if err = (&controllers.ServiceValidator{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Service")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("health", healthz.Ping); err != nil {
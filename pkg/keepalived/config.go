@@ -0,0 +1,138 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package keepalived models the keepalived configuration and serializes it deterministically.
+// All the values are checked before being written, so that they cannot add keywords or blocks to the configuration
+package keepalived
+
+// Config is a keepalived configuration
+type Config struct {
+	GlobalDefs     GlobalDefs
+	VRRPScripts    []VRRPScript
+	VRRPInstances  []VRRPInstance
+	VirtualServers []VirtualServer
+}
+
+// GlobalDefs is the global_defs section
+type GlobalDefs struct {
+	RouterID                   string
+	NotifyFifo                 string
+	VRRPVersion                int
+	VRRPStrict                 bool
+	VRRPSkipCheckAdvertAddress bool
+	EnableScriptSecurity       bool
+	ScriptUser                 string
+	// SMTPServer enables the smtp_* and notification_email* keywords when set
+	SMTPServer            string
+	SMTPPort              int
+	SMTPConnectTimeout    int
+	NotificationEmailFrom string
+	NotificationEmails    []string
+	// Options are written after the typed keywords, in order
+	Options []Option
+}
+
+// Option is a keyword and its value, which can be made of several words
+type Option struct {
+	Keyword string
+	Value   string
+}
+
+// VRRPScript is a vrrp_script section, tracked by the vrrp instances
+type VRRPScript struct {
+	Name string
+	// Script is the command line of the script, it is written quoted
+	Script   string
+	Interval int
+	Timeout  int
+	Rise     int
+	Fall     int
+}
+
+// VRRPInstance is a vrrp_instance section
+type VRRPInstance struct {
+	Name string
+	// Priorities apply to the keepalived processes started with the matching --config-id only
+	Priorities []ConditionalPriority
+	// MasterConfigID is the --config-id of the keepalived process that starts in the MASTER state, if any
+	MasterConfigID string
+	// Interface can be left empty when the config-reloader discovers it, the keyword is then written without value
+	Interface       string
+	VirtualRouterID int
+	NoPreempt       bool
+	PreemptDelay    int
+	// the optional settings are only written when set
+	AdvertInt               *int
+	GarpMasterDelay         *int
+	GarpMasterRepeat        *int
+	GarpMasterRefresh       *int
+	GarpMasterRefreshRepeat *int
+	DontTrackPrimary        bool
+	SMTPAlert               bool
+	TrackInterfaces         []TrackInterface
+	VirtualRoutes           []VirtualRoute
+	VirtualIPAddresses      []string
+	// Unicast writes the unicast_peer block, even when there are no peers yet
+	Unicast      bool
+	UnicastPeers []string
+	// AuthPass enables PASS authentication when set
+	AuthPass     string
+	TrackScripts []string
+	// Options are written at the end of the section, in order
+	Options []Option
+}
+
+// ConditionalPriority is the priority of the keepalived process started with --config-id=ConfigID
+type ConditionalPriority struct {
+	ConfigID string
+	Priority int
+}
+
+// TrackInterface is an interface of the track_interface block
+type TrackInterface struct {
+	Name   string
+	Weight *int
+}
+
+// VirtualRoute is a route of the virtual_routes block
+type VirtualRoute struct {
+	Src    string
+	To     string
+	Via    string
+	Dev    string
+	Metric *int
+	Table  *int64
+}
+
+// VirtualServer is a virtual_server section, load balancing a VIP and port with IPVS
+type VirtualServer struct {
+	IP        string
+	Port      int
+	Protocol  string
+	DelayLoop int
+	LBAlgo    string
+	LBKind    string
+	// Options are written after the typed keywords, in order
+	Options     []Option
+	RealServers []RealServer
+}
+
+// RealServer is a real_server block of a virtual server
+type RealServer struct {
+	IP     string
+	Port   int
+	Weight *int
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keepalived
+
+import (
+	"strings"
+)
+
+// Section is a top level block of a keepalived configuration, such as a vrrp_instance
+type Section struct {
+	// Keyword opens the section, for example vrrp_instance
+	Keyword string
+	// Args are the words between the keyword and the opening brace, for example the name of the vrrp instance
+	Args []string
+	// Text is the section as written in the configuration, from its first line to its closing brace
+	Text string
+}
+
+// Sections splits a keepalived configuration into its top level blocks.
+// It works on any configuration, including the ones rendered from a custom template or containing verbatim configuration,
+// the lines outside of the blocks are ignored
+func Sections(config string) []Section {
+	sections := []Section{}
+	var current *Section
+	var text strings.Builder
+	depth := 0
+	for _, line := range strings.SplitAfter(config, "\n") {
+		words := strings.Fields(stripComment(line))
+		if current == nil && strings.Contains(strings.Join(words, " "), "{") {
+			args := []string{}
+			for _, word := range words[1:] {
+				if strings.HasPrefix(word, "{") {
+					break
+				}
+				args = append(args, strings.TrimSuffix(word, "{"))
+			}
+			current = &Section{Keyword: strings.TrimSuffix(words[0], "{"), Args: args}
+			text.Reset()
+		}
+		if current == nil {
+			continue
+		}
+		text.WriteString(line)
+		for _, word := range words {
+			depth += strings.Count(word, "{") - strings.Count(word, "}")
+		}
+		if depth <= 0 {
+			current.Text = text.String()
+			sections = append(sections, *current)
+			current = nil
+			depth = 0
+		}
+	}
+	if current != nil {
+		current.Text = text.String()
+		sections = append(sections, *current)
+	}
+	return sections
+}
+
+// Name returns the first argument of the section, which is the name of the vrrp instances and vrrp scripts
+func (s Section) Name() string {
+	if len(s.Args) == 0 {
+		return ""
+	}
+	return s.Args[0]
+}
+
+// Values returns the words following the keyword in the lines of the section starting with the keyword,
+// and the words of the blocks opened by the keyword, such as the scripts of a track_script block
+func (s Section) Values(keyword string) []string {
+	values := []string{}
+	lines := strings.Split(s.Text, "\n")
+	// the first line opens the section
+	for i := 1; i < len(lines); i++ {
+		words := strings.Fields(stripComment(lines[i]))
+		if len(words) == 0 || words[0] != keyword {
+			continue
+		}
+		if words[len(words)-1] != "{" {
+			values = append(values, words[1:]...)
+			continue
+		}
+		for i++; i < len(lines); i++ {
+			words := strings.Fields(stripComment(lines[i]))
+			if len(words) > 0 && words[0] == "}" {
+				break
+			}
+			if len(words) > 0 {
+				values = append(values, words[0])
+			}
+		}
+	}
+	return values
+}
+
+// stripComment removes the comment of a line, keepalived comments start with # or ! outside of quoted strings
+func stripComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case (c == '#' || c == '!') && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keepalived
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSections(t *testing.T) {
+	weight := -20
+	config := Config{
+		GlobalDefs:  GlobalDefs{RouterID: "group"},
+		VRRPScripts: []VRRPScript{{Name: "ns/svc", Script: "/usr/bin/true # not a comment", Timeout: 10}},
+		VRRPInstances: []VRRPInstance{{
+			Name:               "ns/svc",
+			Interface:          "eth0",
+			VirtualRouterID:    7,
+			TrackInterfaces:    []TrackInterface{{Name: "bond0", Weight: &weight}},
+			VirtualIPAddresses: []string{"192.168.1.10", "192.168.1.11"},
+			TrackScripts:       []string{"ns/svc"},
+		}},
+		VirtualServers: []VirtualServer{{IP: "192.168.1.10", Port: 80, Protocol: "TCP", RealServers: []RealServer{{IP: "10.0.0.1", Port: 8080}}}},
+	}
+	content, err := Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// verbatim configuration is not written by Marshal, it must be read as well
+	content = append(content, []byte("\n# verbatim\nvrrp_sync_group ns/group { ! comment\n    group {\n        ns/svc\n    }\n}\n")...)
+
+	sections := Sections(string(content))
+	keywords := []string{}
+	for _, section := range sections {
+		keywords = append(keywords, section.Keyword+" "+section.Name())
+	}
+	expected := []string{"global_defs ", "vrrp_script ns/svc", "vrrp_instance ns/svc", "virtual_server 192.168.1.10", "vrrp_sync_group ns/group"}
+	if !reflect.DeepEqual(keywords, expected) {
+		t.Fatalf("expected sections %v, found %v", expected, keywords)
+	}
+	if expected := []string{"192.168.1.10", "80"}; !reflect.DeepEqual(sections[3].Args, expected) {
+		t.Errorf("expected virtual_server arguments %v, found %v", expected, sections[3].Args)
+	}
+	if expected := "vrrp_script ns/svc {\n    script \"/usr/bin/true # not a comment\"\n    timeout 10\n}\n"; sections[1].Text != expected {
+		t.Errorf("expected vrrp_script text:\n%s\nfound:\n%s", expected, sections[1].Text)
+	}
+	if values := sections[2].Values("virtual_router_id"); !reflect.DeepEqual(values, []string{"7"}) {
+		t.Errorf("expected virtual_router_id 7, found %v", values)
+	}
+	if values := sections[2].Values("track_script"); !reflect.DeepEqual(values, []string{"ns/svc"}) {
+		t.Errorf("expected track_script ns/svc, found %v", values)
+	}
+	if values := sections[2].Values("virtual_ipaddress"); !reflect.DeepEqual(values, []string{"192.168.1.10", "192.168.1.11"}) {
+		t.Errorf("expected the virtual ip addresses, found %v", values)
+	}
+}
@@ -0,0 +1,384 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keepalived
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const indent = "    "
+
+// keywords are made of letters, digits and underscores
+var keywordRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Marshal returns the keepalived configuration, it fails if a value could change the structure of the configuration
+func Marshal(config Config) ([]byte, error) {
+	w := &writer{}
+	w.globalDefs(config.GlobalDefs)
+	for _, script := range config.VRRPScripts {
+		w.raw("")
+		w.vrrpScript(script)
+	}
+	for _, instance := range config.VRRPInstances {
+		w.raw("")
+		w.vrrpInstance(instance)
+	}
+	for _, server := range config.VirtualServers {
+		w.raw("")
+		w.virtualServer(server)
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// ValidateWord checks a value written as a single word: it must not be empty nor contain
+// white spaces, quotes, braces, comment characters or control characters
+func ValidateWord(word string) error {
+	if word == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	for _, r := range word {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(`"'{}#!\`, r) {
+			return fmt.Errorf("%q must be a single word without quotes, braces, comments or control characters", word)
+		}
+	}
+	return nil
+}
+
+// ValidateOption checks a keyword and its value: the keyword must be made of letters, digits and underscores,
+// the value can be made of several words but must not contain braces or line breaks, which could open or close a block
+func ValidateOption(keyword, value string) error {
+	if !keywordRegexp.MatchString(keyword) {
+		return fmt.Errorf("%q must be a single keyword made of letters, digits and underscores", keyword)
+	}
+	if strings.ContainsAny(value, "{}\n\r") {
+		return fmt.Errorf("the value of %s must not contain braces or line breaks", keyword)
+	}
+	return nil
+}
+
+// instanceOptionKeywords are the vrrp_instance keywords that can be set as options. They only tune the VRRP protocol:
+// keywords that run commands or read files, like notify_master, track_script or include, are left out because
+// the options of a vrrp_instance come from annotations set by the owners of the services
+var instanceOptionKeywords = map[string]bool{
+	"accept":                     true,
+	"advert_int":                 true,
+	"check_unicast_src":          true,
+	"dont_track_primary":         true,
+	"garp_interval":              true,
+	"garp_lower_prio_delay":      true,
+	"garp_lower_prio_repeat":     true,
+	"garp_master_delay":          true,
+	"garp_master_refresh":        true,
+	"garp_master_refresh_repeat": true,
+	"garp_master_repeat":         true,
+	"gna_interval":               true,
+	"higher_prio_send_advert":    true,
+	"kernel_rx_buf_size":         true,
+	"lower_prio_no_advert":       true,
+	"mcast_src_ip":               true,
+	"native_ipv6":                true,
+	"no_accept":                  true,
+	"nopreempt":                  true,
+	"preempt_delay":              true,
+	"skip_check_adv_addr":        true,
+	"smtp_alert":                 true,
+	"strict_mode":                true,
+	"track_src_ip":               true,
+	"unicast_fault_no_peer":      true,
+	"unicast_src_ip":             true,
+	"unicast_ttl":                true,
+	"use_vmac":                   true,
+	"version":                    true,
+	"vmac_xmit_base":             true,
+}
+
+// ValidateInstanceOption checks an option of a vrrp_instance as ValidateOption does,
+// and that its keyword is one of the vrrp_instance keywords that neither run commands nor read files
+func ValidateInstanceOption(keyword, value string) error {
+	if err := ValidateOption(keyword, value); err != nil {
+		return err
+	}
+	if !instanceOptionKeywords[keyword] {
+		return fmt.Errorf("%s is not an allowed vrrp_instance option, keywords that run scripts or read files like notify_master, track_script or include cannot be set", keyword)
+	}
+	return nil
+}
+
+// validateQuoted checks a value written between double quotes
+func validateQuoted(value string) error {
+	for _, r := range value {
+		if unicode.IsControl(r) || r == '"' || r == '\\' {
+			return fmt.Errorf("%q must not contain double quotes, backslashes or control characters", value)
+		}
+	}
+	return nil
+}
+
+// writer writes the sections of the configuration, it keeps the first error and ignores the following writes
+type writer struct {
+	buf   bytes.Buffer
+	depth int
+	err   error
+}
+
+// line writes the words of a line, separated by spaces
+func (w *writer) line(words ...string) {
+	w.raw(w.join(words))
+}
+
+// join checks the words and joins them with spaces
+func (w *writer) join(words []string) string {
+	for _, word := range words {
+		if err := ValidateWord(word); err != nil {
+			w.fail(err)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// raw writes a line that was already checked
+func (w *writer) raw(line string) {
+	if w.err != nil {
+		return
+	}
+	w.buf.WriteString(strings.Repeat(indent, w.depth))
+	w.buf.WriteString(line)
+	w.buf.WriteByte('\n')
+}
+
+// block writes the words opening a block, the body and the closing brace
+func (w *writer) block(body func(), words ...string) {
+	w.raw(w.join(words) + " {")
+	w.depth++
+	body()
+	w.depth--
+	w.raw("}")
+}
+
+// list writes a block of single words
+func (w *writer) list(keyword string, words []string) {
+	w.block(func() {
+		for _, word := range words {
+			w.line(word)
+		}
+	}, keyword)
+}
+
+func (w *writer) option(option Option) {
+	if err := ValidateOption(option.Keyword, option.Value); err != nil {
+		w.fail(err)
+		return
+	}
+	w.raw(strings.TrimSpace(option.Keyword + " " + strings.TrimSpace(option.Value)))
+}
+
+func (w *writer) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *writer) globalDefs(defs GlobalDefs) {
+	w.block(func() {
+		w.line("router_id", defs.RouterID)
+		if defs.NotifyFifo != "" {
+			w.line("notify_fifo", defs.NotifyFifo)
+		}
+		if defs.VRRPVersion != 0 {
+			w.line("vrrp_version", strconv.Itoa(defs.VRRPVersion))
+		}
+		if defs.VRRPStrict {
+			w.line("vrrp_strict")
+		}
+		if defs.VRRPSkipCheckAdvertAddress {
+			w.line("vrrp_skip_check_adv_addr")
+		}
+		if defs.EnableScriptSecurity {
+			w.line("enable_script_security")
+		}
+		if defs.ScriptUser != "" {
+			w.line("script_user", defs.ScriptUser)
+		}
+		if defs.SMTPServer != "" {
+			if defs.SMTPPort != 0 {
+				w.line("smtp_server", defs.SMTPServer, strconv.Itoa(defs.SMTPPort))
+			} else {
+				w.line("smtp_server", defs.SMTPServer)
+			}
+			if defs.SMTPConnectTimeout != 0 {
+				w.line("smtp_connect_timeout", strconv.Itoa(defs.SMTPConnectTimeout))
+			}
+			if defs.NotificationEmailFrom != "" {
+				w.line("notification_email_from", defs.NotificationEmailFrom)
+			}
+			if len(defs.NotificationEmails) > 0 {
+				w.list("notification_email", defs.NotificationEmails)
+			}
+		}
+		for _, option := range defs.Options {
+			w.option(option)
+		}
+	}, "global_defs")
+}
+
+func (w *writer) vrrpScript(script VRRPScript) {
+	w.block(func() {
+		if err := validateQuoted(script.Script); err != nil {
+			w.fail(err)
+		}
+		w.raw(`script "` + script.Script + `"`)
+		w.optionalInt("interval", script.Interval)
+		w.optionalInt("timeout", script.Timeout)
+		w.optionalInt("rise", script.Rise)
+		w.optionalInt("fall", script.Fall)
+	}, "vrrp_script", script.Name)
+}
+
+func (w *writer) vrrpInstance(instance VRRPInstance) {
+	w.block(func() {
+		for _, priority := range instance.Priorities {
+			w.line("@"+priority.ConfigID, "priority", strconv.Itoa(priority.Priority))
+		}
+		if instance.MasterConfigID != "" {
+			w.line("@"+instance.MasterConfigID, "state", "MASTER")
+		}
+		if instance.Interface != "" {
+			w.line("interface", instance.Interface)
+		} else {
+			// the config-reloader replaces the empty interface with the one it discovers
+			w.raw("interface ")
+		}
+		w.line("virtual_router_id", strconv.Itoa(instance.VirtualRouterID))
+		if instance.NoPreempt {
+			w.line("nopreempt")
+		}
+		w.optionalInt("preempt_delay", instance.PreemptDelay)
+		w.optionalIntPtr("advert_int", instance.AdvertInt)
+		w.optionalIntPtr("garp_master_delay", instance.GarpMasterDelay)
+		w.optionalIntPtr("garp_master_repeat", instance.GarpMasterRepeat)
+		w.optionalIntPtr("garp_master_refresh", instance.GarpMasterRefresh)
+		w.optionalIntPtr("garp_master_refresh_repeat", instance.GarpMasterRefreshRepeat)
+		if instance.DontTrackPrimary {
+			w.line("dont_track_primary")
+		}
+		if instance.SMTPAlert {
+			w.line("smtp_alert")
+		}
+		if len(instance.TrackInterfaces) > 0 {
+			w.block(func() {
+				for _, track := range instance.TrackInterfaces {
+					if track.Weight != nil {
+						w.line(track.Name, "weight", strconv.Itoa(*track.Weight))
+					} else {
+						w.line(track.Name)
+					}
+				}
+			}, "track_interface")
+		}
+		if len(instance.VirtualRoutes) > 0 {
+			w.block(func() {
+				for _, route := range instance.VirtualRoutes {
+					w.line(route.words()...)
+				}
+			}, "virtual_routes")
+		}
+		w.list("virtual_ipaddress", instance.VirtualIPAddresses)
+		if instance.Unicast {
+			w.list("unicast_peer", instance.UnicastPeers)
+		}
+		if instance.AuthPass != "" {
+			w.block(func() {
+				w.line("auth_type", "PASS")
+				w.line("auth_pass", instance.AuthPass)
+			}, "authentication")
+		}
+		if len(instance.TrackScripts) > 0 {
+			w.list("track_script", instance.TrackScripts)
+		}
+		for _, option := range instance.Options {
+			if err := ValidateInstanceOption(option.Keyword, option.Value); err != nil {
+				w.fail(err)
+				continue
+			}
+			w.option(option)
+		}
+	}, "vrrp_instance", instance.Name)
+}
+
+func (r VirtualRoute) words() []string {
+	words := []string{}
+	if r.Src != "" {
+		words = append(words, "src", r.Src)
+	}
+	words = append(words, "to", r.To)
+	if r.Via != "" {
+		words = append(words, "via", r.Via)
+	}
+	if r.Dev != "" {
+		words = append(words, "dev", r.Dev)
+	}
+	if r.Metric != nil {
+		words = append(words, "metric", strconv.Itoa(*r.Metric))
+	}
+	if r.Table != nil {
+		words = append(words, "table", strconv.FormatInt(*r.Table, 10))
+	}
+	return words
+}
+
+func (w *writer) virtualServer(server VirtualServer) {
+	w.block(func() {
+		w.optionalInt("delay_loop", server.DelayLoop)
+		if server.LBAlgo != "" {
+			w.line("lb_algo", server.LBAlgo)
+		}
+		if server.LBKind != "" {
+			w.line("lb_kind", server.LBKind)
+		}
+		if server.Protocol != "" {
+			w.line("protocol", server.Protocol)
+		}
+		for _, option := range server.Options {
+			w.option(option)
+		}
+		for _, realServer := range server.RealServers {
+			w.block(func() {
+				w.optionalIntPtr("weight", realServer.Weight)
+			}, "real_server", realServer.IP, strconv.Itoa(realServer.Port))
+		}
+	}, "virtual_server", server.IP, strconv.Itoa(server.Port))
+}
+
+func (w *writer) optionalInt(keyword string, value int) {
+	if value != 0 {
+		w.line(keyword, strconv.Itoa(value))
+	}
+}
+
+func (w *writer) optionalIntPtr(keyword string, value *int) {
+	if value != nil {
+		w.line(keyword, strconv.Itoa(*value))
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2020.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keepalived
+
+import (
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	weight := -20
+	config := Config{
+		GlobalDefs: GlobalDefs{
+			RouterID:   "group",
+			NotifyFifo: "/var/run/notify.fifo",
+			Options:    []Option{{Keyword: "vrrp_iptables", Value: "chain"}, {Keyword: "script_security", Value: ""}},
+		},
+		VRRPScripts: []VRRPScript{{Name: "ns/svc", Script: "/usr/bin/true --flag", Timeout: 10}},
+		VRRPInstances: []VRRPInstance{{
+			Name:               "ns/svc",
+			Priorities:         []ConditionalPriority{{ConfigID: "pod-a", Priority: 200}},
+			MasterConfigID:     "pod-a",
+			Interface:          "eth0",
+			VirtualRouterID:    7,
+			TrackInterfaces:    []TrackInterface{{Name: "bond0", Weight: &weight}},
+			VirtualIPAddresses: []string{"192.168.1.10"},
+			Unicast:            true,
+			TrackScripts:       []string{"ns/svc"},
+		}},
+		VirtualServers: []VirtualServer{{IP: "192.168.1.10", Port: 80, Protocol: "TCP", RealServers: []RealServer{{IP: "10.0.0.1", Port: 8080}}}},
+	}
+	expected := `global_defs {
+    router_id group
+    notify_fifo /var/run/notify.fifo
+    vrrp_iptables chain
+    script_security
+}
+
+vrrp_script ns/svc {
+    script "/usr/bin/true --flag"
+    timeout 10
+}
+
+vrrp_instance ns/svc {
+    @pod-a priority 200
+    @pod-a state MASTER
+    interface eth0
+    virtual_router_id 7
+    track_interface {
+        bond0 weight -20
+    }
+    virtual_ipaddress {
+        192.168.1.10
+    }
+    unicast_peer {
+    }
+    track_script {
+        ns/svc
+    }
+}
+
+virtual_server 192.168.1.10 80 {
+    protocol TCP
+    real_server 10.0.0.1 8080 {
+    }
+}
+`
+	actual, err := Marshal(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(actual) != expected {
+		t.Errorf("unexpected configuration:\n%s\nexpected:\n%s", actual, expected)
+	}
+}
+
+func TestMarshalRejectsInjection(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"line break in a word", Config{GlobalDefs: GlobalDefs{RouterID: "group\n}"}}},
+		{"space in a word", Config{VRRPInstances: []VRRPInstance{{Name: "a", Interface: "eth0 }"}}}},
+		{"brace in an option", Config{GlobalDefs: GlobalDefs{RouterID: "group", Options: []Option{{Keyword: "a", Value: "b }"}}}}},
+		{"line break in an option", Config{GlobalDefs: GlobalDefs{RouterID: "group", Options: []Option{{Keyword: "a", Value: "b\nvrrp_strict"}}}}},
+		{"invalid keyword", Config{GlobalDefs: GlobalDefs{RouterID: "group", Options: []Option{{Keyword: "a b", Value: ""}}}}},
+		{"quote in a script", Config{GlobalDefs: GlobalDefs{RouterID: "group"}, VRRPScripts: []VRRPScript{{Name: "s", Script: `true"`}}}},
+		{"script in a vrrp_instance option", Config{GlobalDefs: GlobalDefs{RouterID: "group"}, VRRPInstances: []VRRPInstance{{Name: "a", Options: []Option{{Keyword: "notify_master", Value: "/bin/sh"}}}}}},
+		{"empty virtual address", Config{GlobalDefs: GlobalDefs{RouterID: "group"}, VRRPInstances: []VRRPInstance{{Name: "a", VirtualIPAddresses: []string{""}}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Marshal(test.config); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestValidateInstanceOption(t *testing.T) {
+	tests := []struct {
+		keyword string
+		value   string
+		valid   bool
+	}{
+		{"track_src_ip", "", true},
+		{"garp_master_refresh", "60", true},
+		{"unicast_src_ip", "10.0.0.1", true},
+		{"use_vmac", "vrrp1", true},
+		{"notify_master", "\"/usr/local/bin/notify master\"", false},
+		{"notify_backup", "/bin/true", false},
+		{"notify_fault", "/bin/true", false},
+		{"notify_stop", "/bin/true", false},
+		{"notify", "/bin/true", false},
+		{"notify_fifo", "/tmp/fifo", false},
+		{"notify_fifo_script", "/bin/true", false},
+		{"track_script", "chk", false},
+		{"track_file", "file", false},
+		{"include", "/etc/passwd", false},
+		{"script_user", "root", false},
+		{"unknown_keyword", "", false},
+		{"advert_int", "1 }", false},
+		{"advert int", "1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.keyword, func(t *testing.T) {
+			err := ValidateInstanceOption(test.keyword, test.value)
+			if test.valid && err != nil {
+				t.Errorf("expected %s %q to be valid: %v", test.keyword, test.value, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected %s %q to be rejected", test.keyword, test.value)
+			}
+		})
+	}
+}